@@ -363,6 +363,35 @@ Java_com_burntpeanut_core_CoreBridge_nativeCreateNode(JNIEnv* env, jclass /*claz
     return static_cast<jlong>(node);
 }
 
+extern "C" JNIEXPORT jlong JNICALL
+Java_com_burntpeanut_core_CoreBridge_nativeCreateNodeWithPassphrase(JNIEnv* env, jclass /*clazz*/, jstring jpath, jbyteArray jpassphrase) {
+    if (!jpath || !jpassphrase) {
+        return 0;
+    }
+    if (!g_hooks_cls && !init_hook_ids(env)) {
+        return 0;
+    }
+    const jsize passphrase_len = env->GetArrayLength(jpassphrase);
+    if (passphrase_len <= 0) {
+        return 0;
+    }
+    const char* path = env->GetStringUTFChars(jpath, nullptr);
+    if (!path) {
+        return 0;
+    }
+    jbyte* passphrase = env->GetByteArrayElements(jpassphrase, nullptr);
+    if (!passphrase) {
+        env->ReleaseStringUTFChars(jpath, path);
+        return 0;
+    }
+    MLCallbacks cb = make_callbacks();
+    MLNode node = ml_node_create_with_passphrase(path, reinterpret_cast<const uint8_t*>(passphrase),
+                                                 static_cast<int32_t>(passphrase_len), cb);
+    env->ReleaseByteArrayElements(jpassphrase, passphrase, JNI_ABORT);
+    env->ReleaseStringUTFChars(jpath, path);
+    return static_cast<jlong>(node);
+}
+
 extern "C" JNIEXPORT void JNICALL
 Java_com_burntpeanut_core_CoreBridge_nativeDestroyNode(JNIEnv* /*env*/, jclass /*clazz*/, jlong handle) {
     if (handle != 0) {
@@ -370,6 +399,20 @@ Java_com_burntpeanut_core_CoreBridge_nativeDestroyNode(JNIEnv* /*env*/, jclass /
     }
 }
 
+extern "C" JNIEXPORT jint JNICALL
+Java_com_burntpeanut_core_CoreBridge_nativeSetEncounterCluster(JNIEnv* env, jclass /*clazz*/, jlong handle, jstring jcluster) {
+    if (handle == 0 || !jcluster) {
+        return ML_ERR_INVALID_ARG;
+    }
+    const char* cluster = env->GetStringUTFChars(jcluster, nullptr);
+    if (!cluster) {
+        return ML_ERR_INVALID_ARG;
+    }
+    const int32_t rc = ml_set_encounter_cluster(static_cast<MLNode>(handle), cluster);
+    env->ReleaseStringUTFChars(jcluster, cluster);
+    return rc;
+}
+
 extern "C" JNIEXPORT void JNICALL
 Java_com_burntpeanut_core_CoreBridge_nativeOnPeerDiscovered(JNIEnv* /*env*/, jclass /*clazz*/, jlong handle, jlong peerId) {
     if (handle != 0) {
@@ -391,6 +434,13 @@ Java_com_burntpeanut_core_CoreBridge_nativeOnPeerDisconnected(JNIEnv* /*env*/, j
     }
 }
 
+extern "C" JNIEXPORT void JNICALL
+Java_com_burntpeanut_core_CoreBridge_nativeOnPeerMtuChanged(JNIEnv* /*env*/, jclass /*clazz*/, jlong handle, jlong peerId, jint mtu) {
+    if (handle != 0) {
+        ml_on_peer_mtu_changed(static_cast<MLNode>(handle), static_cast<uintptr_t>(peerId), static_cast<int32_t>(mtu));
+    }
+}
+
 extern "C" JNIEXPORT void JNICALL
 Java_com_burntpeanut_core_CoreBridge_nativeOnDataReceived(JNIEnv* env, jclass /*clazz*/, jlong handle, jlong peerId, jbyteArray data) {
     if (handle == 0 || !data) return;
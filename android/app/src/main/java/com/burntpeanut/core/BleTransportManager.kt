@@ -29,13 +29,10 @@ import android.os.PowerManager
 import android.location.LocationManager
 import androidx.core.content.ContextCompat
 import android.util.Log
-import java.nio.ByteBuffer
-import java.nio.ByteOrder
 import java.util.UUID
 import java.util.concurrent.ConcurrentLinkedQueue
 import java.util.concurrent.CopyOnWriteArraySet
 import java.util.concurrent.LinkedBlockingDeque
-import java.util.concurrent.atomic.AtomicInteger
 import android.os.Handler
 import android.os.Looper
 import android.os.ParcelUuid
@@ -56,10 +53,8 @@ object BleTransportManager {
     /** Delay after each central [BluetoothGatt.writeCharacteristic] success before starting the next; avoids flooding the peripheral ATT queue. */
     private const val WRITE_PACE_MS = 15L
     private val peers = CopyOnWriteArraySet<Long>()
-    private const val FRAME_MAGIC: Short = 0x4250 // "BP"
-    private const val FRAME_HEADER_SIZE = 8
-    private const val MAX_CHUNK = 180
-    private const val MAX_FRAME_PAYLOAD = MAX_CHUNK - FRAME_HEADER_SIZE
+    /** Largest write reported to the core, whatever the ATT MTU; the core fragments envelopes to fit. */
+    private const val MAX_WRITE = 180
     private const val MANUFACTURER_ID = 0x1337
     private val MANUFACTURER_TAG = byteArrayOf(0x42, 0x50, 0x4E) // "BPN"
 
@@ -78,8 +73,6 @@ object BleTransportManager {
     private var outboundDevice: BluetoothDevice? = null
     private var pendingConnectAddress: String? = null
     private var inboundDevice: BluetoothDevice? = null
-    private val seq = AtomicInteger(1)
-    private val inbound = mutableMapOf<Long, FrameAssembly>()
     private val inboundLock = Any()
     private val peerAddresses = mutableMapOf<Long, String>()
     private val seenScanAddresses = mutableSetOf<String>()
@@ -155,11 +148,6 @@ object BleTransportManager {
     @Volatile
     private var pendingOutboundServiceDiscover = false
 
-    private data class FrameAssembly(
-        val total: Int,
-        val parts: MutableMap<Int, ByteArray> = mutableMapOf(),
-    )
-
     fun start(context: Context) {
         if (started) {
             Log.i(TAG, "start transport (already started)")
@@ -308,60 +296,11 @@ object BleTransportManager {
         }
     }
 
-    private fun onBleFrame(peerId: Long, frame: ByteArray) {
-        if (frame.size < FRAME_HEADER_SIZE) return
-        val buf = ByteBuffer.wrap(frame).order(ByteOrder.BIG_ENDIAN)
-        val magic = buf.short
-        if (magic != FRAME_MAGIC) return
-        val messageId = buf.short.toInt() and 0xFFFF
-        val total = buf.short.toInt() and 0xFFFF
-        val index = buf.short.toInt() and 0xFFFF
-        if (total <= 0 || index < 0 || index >= total) return
-        val payload = frame.copyOfRange(FRAME_HEADER_SIZE, frame.size)
-        val key = (peerId shl 16) xor messageId.toLong()
-        val complete: ByteArray? = synchronized(inboundLock) {
-            val entry = inbound.getOrPut(key) { FrameAssembly(total = total) }
-            entry.parts[index] = payload
-            if (entry.parts.size == entry.total) {
-                val ordered = ByteArray(entry.parts.values.sumOf { it.size })
-                var offset = 0
-                for (i in 0 until entry.total) {
-                    val part = entry.parts[i] ?: return@synchronized null
-                    System.arraycopy(part, 0, ordered, offset, part.size)
-                    offset += part.size
-                }
-                inbound.remove(key)
-                ordered
-            } else {
-                null
-            }
-        }
-        if (complete != null) {
-            deliverInbound(peerId, complete)
-        }
-    }
-
-    /** Max application payload per frame so full PDU fits in ATT (mtu - 3). */
-    private fun effectiveMaxFramePayload(): Int {
-        val maxPdu = (lastAttMtu - 3).coerceAtLeast(FRAME_HEADER_SIZE + 1)
-        val cap = maxPdu - FRAME_HEADER_SIZE
-        return minOf(MAX_FRAME_PAYLOAD, maxOf(1, cap))
-    }
-
-    private fun makeFrames(data: ByteArray): List<ByteArray> {
-        if (data.isEmpty()) return emptyList()
-        val parts = chunk(data, effectiveMaxFramePayload())
-        val messageId = seq.getAndIncrement() and 0xFFFF
-        val total = parts.size
-        return parts.mapIndexed { idx, payload ->
-            val out = ByteArray(FRAME_HEADER_SIZE + payload.size)
-            val hdr = ByteBuffer.wrap(out).order(ByteOrder.BIG_ENDIAN)
-            hdr.putShort(FRAME_MAGIC)
-            hdr.putShort(messageId.toShort())
-            hdr.putShort(total.toShort())
-            hdr.putShort(idx.toShort())
-            System.arraycopy(payload, 0, out, FRAME_HEADER_SIZE, payload.size)
-            out
+    /** Reports the usable write size for [peerId] so the core sizes its fragments to fit. */
+    private fun reportMtu(peerId: Long, attMtu: Int) {
+        val handle = CoreBridge.currentNodeHandle
+        if (handle != 0L) {
+            CoreBridge.nativeOnPeerMtuChanged(handle, peerId, minOf(MAX_WRITE, attMtu - 3))
         }
     }
 
@@ -369,15 +308,13 @@ object BleTransportManager {
         val gatt = outboundGatt
         val ch = outboundChar
         if (gatt != null && ch != null && outboundDevice != null) {
-            val frames = makeFrames(data)
-            for (frame in frames) outboundWriteQueue.offerLast(frame)
+            outboundWriteQueue.offerLast(data)
             kickOutboundWrite()
             return true
         }
         if (gatt != null && outboundDevice != null && ch == null) {
             Log.w(TAG, "send queued but service not ready yet peer=$peerId bytes=${data.size} q=${outboundWriteQueue.size}")
-            val frames = makeFrames(data)
-            for (frame in frames) outboundWriteQueue.offerLast(frame)
+            outboundWriteQueue.offerLast(data)
             return true
         }
 
@@ -386,8 +323,7 @@ object BleTransportManager {
         val device = inboundDevice
         if (server != null && device != null) {
             server.getService(SERVICE_UUID)?.getCharacteristic(CHAR_UUID) ?: return false
-            val frames = makeFrames(data)
-            for (frame in frames) notifyFrameQueue.add(frame)
+            notifyFrameQueue.add(data)
             scheduleNotifyDrain()
             return true
         }
@@ -766,7 +702,7 @@ object BleTransportManager {
 
         override fun onCharacteristicChanged(gatt: BluetoothGatt, characteristic: BluetoothGattCharacteristic, value: ByteArray) {
             val peerId = peerIdFromAddress(gatt.device.address ?: "")
-            onBleFrame(peerId, value)
+            deliverInbound(peerId, value)
         }
 
         override fun onCharacteristicWrite(gatt: BluetoothGatt, characteristic: BluetoothGattCharacteristic, status: Int) {
@@ -794,6 +730,7 @@ object BleTransportManager {
             Log.i(TAG, "mtu changed mtu=$mtu status=$status")
             if (status == BluetoothGatt.GATT_SUCCESS) {
                 lastAttMtu = mtu
+                reportMtu(peerIdFromAddress(gatt.device.address ?: ""), mtu)
                 if (outboundCccdReady) kickOutboundWrite()
             }
             if (outboundGatt === gatt && pendingOutboundServiceDiscover) {
@@ -810,7 +747,7 @@ object BleTransportManager {
                 return
             }
             val peerId = peerIdFromAddress(gatt.device.address ?: "")
-            onBleFrame(peerId, characteristic.value ?: ByteArray(0))
+            deliverInbound(peerId, characteristic.value ?: ByteArray(0))
         }
     }
 
@@ -835,6 +772,11 @@ object BleTransportManager {
             }
         }
 
+        override fun onMtuChanged(device: BluetoothDevice, mtu: Int) {
+            Log.i(TAG, "server mtu changed mtu=$mtu")
+            reportMtu(peerIdFromAddress(device.address ?: ""), mtu)
+        }
+
         override fun onCharacteristicWriteRequest(
             device: BluetoothDevice,
             requestId: Int,
@@ -845,7 +787,7 @@ object BleTransportManager {
             value: ByteArray,
         ) {
             val peerId = peerIdFromAddress(device.address ?: "")
-            onBleFrame(peerId, value)
+            deliverInbound(peerId, value)
             if (responseNeeded) {
                 gattServer?.sendResponse(device, requestId, BluetoothGatt.GATT_SUCCESS, offset, null)
             }
@@ -931,16 +873,4 @@ object BleTransportManager {
         val id = address.hashCode().toLong()
         return if (id >= 0) id else -id
     }
-
-    private fun chunk(data: ByteArray, size: Int): List<ByteArray> {
-        if (data.size <= size) return listOf(data)
-        val out = ArrayList<ByteArray>((data.size + size - 1) / size)
-        var i = 0
-        while (i < data.size) {
-            val end = minOf(i + size, data.size)
-            out.add(data.copyOfRange(i, end))
-            i = end
-        }
-        return out
-    }
 }
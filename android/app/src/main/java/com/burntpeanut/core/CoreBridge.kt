@@ -29,13 +29,25 @@ object CoreBridge {
         appExternalFilesDir = externalFilesDir?.absolutePath?.takeIf { it.isNotEmpty() } ?: ""
     }
 
+    /** The identity key is sealed under [NodePassphrase]; the core refuses to start without one. */
     fun createNode(dbPath: String): Long {
-        val handle = nativeCreateNode(dbPath)
+        val passphrase = runCatching { NodePassphrase.loadOrCreate(File(appFilesDir)) }
+            .onFailure { Log.e(TAG, "node passphrase unavailable", it) }
+            .getOrNull() ?: return 0L
+        val handle = nativeCreateNodeWithPassphrase(dbPath, passphrase)
+        passphrase.fill(0)
         currentNodeHandle = handle
         Log.i(TAG, "createNode handle=$handle")
         return handle
     }
 
+    /** Labels the checkpoints this node witnesses; without a cluster it does not witness. */
+    fun setEncounterCluster(handle: Long, cluster: String): Int {
+        val rc = nativeSetEncounterCluster(handle, cluster)
+        Log.i(TAG, "setEncounterCluster cluster=$cluster rc=$rc")
+        return rc
+    }
+
     fun destroyNode(handle: Long) {
         nativeDestroyNode(handle)
         if (currentNodeHandle == handle) currentNodeHandle = 0L
@@ -45,9 +57,15 @@ object CoreBridge {
     @JvmStatic
     external fun nativeCreateNode(dbPath: String): Long
 
+    @JvmStatic
+    external fun nativeCreateNodeWithPassphrase(dbPath: String, passphrase: ByteArray): Long
+
     @JvmStatic
     external fun nativeDestroyNode(handle: Long)
 
+    @JvmStatic
+    external fun nativeSetEncounterCluster(handle: Long, cluster: String): Int
+
     @JvmStatic
     external fun nativeOnPeerDiscovered(handle: Long, peerId: Long)
 
@@ -57,9 +75,14 @@ object CoreBridge {
     @JvmStatic
     external fun nativeOnPeerDisconnected(handle: Long, peerId: Long)
 
+    /** [data] is one raw GATT write or notification; the core reassembles envelopes from them. */
     @JvmStatic
     external fun nativeOnDataReceived(handle: Long, peerId: Long, data: ByteArray)
 
+    /** [mtu] is the largest write the link carries to [peerId] (ATT MTU - 3). */
+    @JvmStatic
+    external fun nativeOnPeerMtuChanged(handle: Long, peerId: Long, mtu: Int)
+
     @JvmStatic
     external fun nativeRequestFile(handle: Long, fileHash: ByteArray): ByteArray?
 
@@ -0,0 +1,70 @@
+package com.burntpeanut.core
+
+import android.Manifest
+import android.content.Context
+import android.content.pm.PackageManager
+import android.location.Location
+import android.location.LocationManager
+import androidx.core.content.ContextCompat
+
+/**
+ * Names the area encounters happen in, for the witnesses this node signs. Strict peers count
+ * distinct clusters among a checkpoint's witnesses, so the label is a coarse geohash (about
+ * 5 km across) rather than anything that identifies the device.
+ */
+object EncounterCluster {
+    private const val PRECISION = 5
+    private const val BASE32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+    /** Returns the cluster for the last known location, or null when none is available. */
+    fun fromLastKnownLocation(context: Context): String? {
+        if (ContextCompat.checkSelfPermission(context, Manifest.permission.ACCESS_FINE_LOCATION) != PackageManager.PERMISSION_GRANTED) {
+            return null
+        }
+        val lm = context.getSystemService(LocationManager::class.java) ?: return null
+        val location = lm.getProviders(true)
+            .mapNotNull { provider -> runCatching { lm.getLastKnownLocation(provider) }.getOrNull() }
+            .maxByOrNull(Location::getTime)
+            ?: return null
+        return geohash(location.latitude, location.longitude)
+    }
+
+    private fun geohash(latitude: Double, longitude: Double): String {
+        var latLo = -90.0
+        var latHi = 90.0
+        var lonLo = -180.0
+        var lonHi = 180.0
+        val out = StringBuilder(PRECISION)
+        var even = true
+        var bits = 0
+        var ch = 0
+        while (out.length < PRECISION) {
+            if (even) {
+                val mid = (lonLo + lonHi) / 2
+                if (longitude >= mid) {
+                    ch = ch shl 1 or 1
+                    lonLo = mid
+                } else {
+                    ch = ch shl 1
+                    lonHi = mid
+                }
+            } else {
+                val mid = (latLo + latHi) / 2
+                if (latitude >= mid) {
+                    ch = ch shl 1 or 1
+                    latLo = mid
+                } else {
+                    ch = ch shl 1
+                    latHi = mid
+                }
+            }
+            even = !even
+            if (++bits == 5) {
+                out.append(BASE32[ch])
+                bits = 0
+                ch = 0
+            }
+        }
+        return out.toString()
+    }
+}
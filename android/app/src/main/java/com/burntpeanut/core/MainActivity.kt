@@ -104,6 +104,7 @@ class MainActivity : AppCompatActivity() {
         5 -> "ML_ERR_EXISTS"
         6 -> "ML_ERR_OVERFLOW"
         7 -> "ML_ERR_INTERNAL"
+        8 -> "ML_ERR_VERSION"
         else -> "UNKNOWN"
     }
 
@@ -202,6 +203,7 @@ class MainActivity : AppCompatActivity() {
                 pushEvent(logView, statusView, "nativeCreateNode failed (handle 0)")
             } else {
                 BleTransportManager.rehydrateCorePeerLifecycle(nodeHandle)
+                EncounterCluster.fromLastKnownLocation(this)?.let { CoreBridge.setEncounterCluster(nodeHandle, it) }
                 pushEvent(logView, statusView, "Node created (handle=$nodeHandle)")
             }
         }
@@ -0,0 +1,68 @@
+package com.burntpeanut.core
+
+import android.security.keystore.KeyGenParameterSpec
+import android.security.keystore.KeyProperties
+import java.io.File
+import java.security.KeyStore
+import java.security.SecureRandom
+import javax.crypto.Cipher
+import javax.crypto.KeyGenerator
+import javax.crypto.SecretKey
+import javax.crypto.spec.GCMParameterSpec
+
+/**
+ * The passphrase the core seals its identity key under. It is a random secret generated on
+ * first use and kept in the app's files, wrapped by an AndroidKeyStore AES key, so the sealed
+ * identity key is useless without this device's keystore.
+ */
+object NodePassphrase {
+    private const val ANDROID_KEYSTORE = "AndroidKeyStore"
+    private const val WRAPPING_ALIAS = "burnt_peanut_node_passphrase"
+    private const val FILE_NAME = "node_passphrase.bin"
+    private const val SECRET_SIZE = 32
+    private const val GCM_IV_SIZE = 12
+    private const val GCM_TAG_BITS = 128
+
+    @Synchronized
+    fun loadOrCreate(filesDir: File): ByteArray {
+        val file = File(filesDir, FILE_NAME)
+        if (file.exists()) {
+            val blob = file.readBytes()
+            val cipher = Cipher.getInstance("AES/GCM/NoPadding")
+            cipher.init(
+                Cipher.DECRYPT_MODE,
+                wrappingKey(),
+                GCMParameterSpec(GCM_TAG_BITS, blob, 0, GCM_IV_SIZE),
+            )
+            return cipher.doFinal(blob, GCM_IV_SIZE, blob.size - GCM_IV_SIZE)
+        }
+
+        val secret = ByteArray(SECRET_SIZE).also { SecureRandom().nextBytes(it) }
+        val cipher = Cipher.getInstance("AES/GCM/NoPadding")
+        cipher.init(Cipher.ENCRYPT_MODE, wrappingKey())
+        val tmp = File(filesDir, "$FILE_NAME.tmp")
+        tmp.writeBytes(cipher.iv + cipher.doFinal(secret))
+        if (!tmp.renameTo(file)) {
+            throw IllegalStateException("could not store node passphrase")
+        }
+        return secret
+    }
+
+    private fun wrappingKey(): SecretKey {
+        val keyStore = KeyStore.getInstance(ANDROID_KEYSTORE).apply { load(null) }
+        (keyStore.getEntry(WRAPPING_ALIAS, null) as? KeyStore.SecretKeyEntry)?.let { return it.secretKey }
+
+        val generator = KeyGenerator.getInstance(KeyProperties.KEY_ALGORITHM_AES, ANDROID_KEYSTORE)
+        generator.init(
+            KeyGenParameterSpec.Builder(
+                WRAPPING_ALIAS,
+                KeyProperties.PURPOSE_ENCRYPT or KeyProperties.PURPOSE_DECRYPT,
+            )
+                .setBlockModes(KeyProperties.BLOCK_MODE_GCM)
+                .setEncryptionPaddings(KeyProperties.ENCRYPTION_PADDING_NONE)
+                .setKeySize(256)
+                .build(),
+        )
+        return generator.generateKey()
+    }
+}
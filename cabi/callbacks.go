@@ -18,6 +18,8 @@ import "unsafe"
 // Flow: Go method → C shim → native function pointer
 type NativeCallbacks struct {
 	raw C.MLCallbacks
+	// links fragments what Send carries to fit each peer's MTU.
+	links linkFraming
 }
 
 func wrapCallbacks(callbacks C.MLCallbacks) *NativeCallbacks {
@@ -44,6 +46,20 @@ func (nc *NativeCallbacks) Send(peerID uintptr, data []byte) int32 {
 	return int32(result)
 }
 
+// SendFrame sends an encoded envelope to peerID as one Send per fragment.
+func (nc *NativeCallbacks) SendFrame(peerID uintptr, frame []byte) int32 {
+	fragments, err := nc.links.split(peerID, frame)
+	if err != nil {
+		return errorToCode(err)
+	}
+	for _, fragment := range fragments {
+		if rc := nc.Send(peerID, fragment); rc != ML_OK {
+			return rc
+		}
+	}
+	return ML_OK
+}
+
 func (nc *NativeCallbacks) StartAdvertising(payload []byte) int32 {
 	cData := C.CBytes(payload)
 	defer C.free(cData)
@@ -95,6 +111,9 @@ func (nc *NativeCallbacks) SignWithSecureKey(data []byte) ([]byte, int32) {
 }
 
 func (nc *NativeCallbacks) GetPublicKey() ([]byte, int32) {
+	if nc.raw.get_public_key == nil {
+		return nil, ML_ERR_INTERNAL
+	}
 	// Ed25519 public key is 32 bytes
 	pubOut := make([]byte, 32)
 
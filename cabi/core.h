@@ -18,6 +18,7 @@ extern "C" {
 #define ML_ERR_EXISTS       5
 #define ML_ERR_OVERFLOW     6
 #define ML_ERR_INTERNAL     7
+#define ML_ERR_VERSION      8
 
 /* ─── Opaque Handle ─── */
 
@@ -111,6 +112,8 @@ typedef struct {
 
 /* Node Lifecycle */
 MLNode  ml_node_create(const char* db_path, MLCallbacks callbacks);
+MLNode  ml_node_create_with_passphrase(const char* db_path, const uint8_t* passphrase,
+                                       int32_t passphrase_len, MLCallbacks callbacks);
 void    ml_node_destroy(MLNode node);
 
 /* User Actions */
@@ -119,17 +122,27 @@ MLResult ml_request_file_with_chunk_count(MLNode node, const uint8_t* file_hash,
 MLResult ml_get_balance(MLNode node);
 MLResult ml_get_chain_summary(MLNode node);
 int32_t  ml_set_service_policy(MLNode node, int32_t policy);
+/* cluster names where encounters happen (e.g. a coarse geohash); needed to witness checkpoints. */
+int32_t  ml_set_encounter_cluster(MLNode node, const char* cluster);
 MLResult ml_get_peers(MLNode node);
 MLResult ml_get_file_index(MLNode node);
 int32_t  ml_share_file(MLNode node, const uint8_t* file_data, int32_t len,
                         const char* file_name);
+int32_t  ml_set_file_visibility(MLNode node, const uint8_t* file_hash,
+                                 int32_t file_hash_len, int32_t visibility);
+int32_t  ml_add_capability(MLNode node, const uint8_t* capability, int32_t len);
+int32_t  ml_set_network_params(MLNode node, const uint8_t* params, int32_t len);
+MLResult ml_get_network_params(MLNode node);
 
 /* Transport Events */
 void ml_on_peer_discovered(MLNode node, uintptr_t peer_id);
 void ml_on_peer_connected(MLNode node, uintptr_t peer_id);
 void ml_on_peer_disconnected(MLNode node, uintptr_t peer_id);
+/* data is one raw link write (e.g. a GATT notification); the core reassembles envelopes. */
 void ml_on_data_received(MLNode node, uintptr_t peer_id,
                           const uint8_t* data, int32_t len);
+/* mtu is the largest write the link carries to peer_id (ATT MTU - 3 on BLE). */
+void ml_on_peer_mtu_changed(MLNode node, uintptr_t peer_id, int32_t mtu);
 
 /* Memory */
 void ml_free(void* ptr);
@@ -6,6 +6,8 @@ import (
 	"database/sql"
 	"errors"
 	"strings"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 )
 
 // Error codes matching the C header
@@ -18,6 +20,7 @@ const (
 	ML_ERR_EXISTS      int32 = 5
 	ML_ERR_OVERFLOW    int32 = 6
 	ML_ERR_INTERNAL    int32 = 7
+	ML_ERR_VERSION     int32 = 8
 )
 
 // we need to map known Go errors to integer codes that C understands
@@ -30,6 +33,10 @@ func errorToCode(err error) int32 {
 		return ML_ERR_NOT_FOUND
 	}
 
+	if errors.Is(err, wire.ErrIncompatibleVersion) {
+		return ML_ERR_VERSION
+	}
+
 	msg := err.Error()
 
 	if strings.Contains(msg, "is required") || strings.Contains(msg, "invalid") {
@@ -69,6 +76,7 @@ var errMessages = map[int32]string{
 	ML_ERR_EXISTS:      "already exists",
 	ML_ERR_OVERFLOW:    "overflow",
 	ML_ERR_INTERNAL:    "internal error",
+	ML_ERR_VERSION:     "incompatible protocol version",
 }
 
 func codeToError(code int32) error {
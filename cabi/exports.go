@@ -22,15 +22,20 @@ we need to use //export comment so that CGo makes them visible to C.
 */
 import "C"
 import (
+	"bytes"
 	"crypto/rand"
+	"database/sql"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"time"
 	"unsafe"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/discovery"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/gossip"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/identity"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
@@ -52,36 +57,87 @@ func ml_free(ptr unsafe.Pointer) {
 
 //export ml_node_create
 func ml_node_create(dbPath *C.char, callbacks C.MLCallbacks) C.uintptr_t {
-    // convert C string to Go string
-	dbPathStr := C.GoString(dbPath)
+	// Without a passphrase the node only starts on a device with a secure element; a software
+	// key sealed under an empty passphrase would be plaintext at rest.
+	return C.uintptr_t(createNode(C.GoString(dbPath), wrapCallbacks(callbacks), nil))
+}
 
-	db, err := storage.OpenDatabase(dbPathStr)
-	if err != nil {
+//export ml_node_create_with_passphrase
+func ml_node_create_with_passphrase(dbPath *C.char, passphrase *C.uint8_t, passphraseLen C.int32_t, callbacks C.MLCallbacks) C.uintptr_t {
+	if passphraseLen < 0 || (passphrase == nil && passphraseLen > 0) {
 		return 0
 	}
+	var secret []byte
+	if passphraseLen > 0 {
+		secret = C.GoBytes(unsafe.Pointer(passphrase), passphraseLen)
+	}
+	return C.uintptr_t(createNode(C.GoString(dbPath), wrapCallbacks(callbacks), secret))
+}
 
-	dev, err := identity.LoadIdentity(db)
+func createNode(dbPath string, callbacks *NativeCallbacks, passphrase []byte) uintptr {
+	db, err := storage.OpenDatabase(dbPath)
 	if err != nil {
-		dev, err = identity.NewIdentity(db)
-		if err != nil {
+		return 0
+	}
+
+	// A secure element keeps the key on the device; otherwise the key is sealed in the database.
+	var keys identity.KeyStore
+	if callbacks.HasSecureElement() {
+		keys = identity.NewSecureElementKeyStore(cabiSecureElement{callbacks: callbacks})
+	} else {
+		if len(passphrase) == 0 {
 			db.Close()
 			return 0
 		}
+		keys = identity.NewPassphraseKeyStore(db, passphrase, identity.DefaultArgon2Params())
+	}
+
+	dev, err := loadDeviceIdentity(db, keys)
+	if err != nil {
+		db.Close()
+		return 0
 	}
 
 	// Create a node context holding all state
 	node := &NodeContext{
 		Store:          db,
 		Identity:       dev,
-		Callbacks:      wrapCallbacks(callbacks),
+		Callbacks:      callbacks,
 		Transfer:       transfer.NewSessionManager(4),
 		SessionKeys:    make(map[uintptr][]byte),
 		SharedSecrets:  make(map[uintptr][]byte),
 		PeerTransports: make(map[uintptr]*cabiPeerTransport),
+		PeerHellos:     make(map[uintptr]*pb.HandshakeMsg),
+		VerifiedPeers:  make(map[uintptr][]byte),
 	}
+	node.Forks = gossip.NewForkMonitor(db, dev.Pubkey, cabiSigner{node: node}, node.Callbacks.NotifyForkDetected)
 
-	handle := RegisterHandle(node)
-	return C.uintptr_t(handle)
+	return RegisterHandle(node)
+}
+
+// loadDeviceIdentity opens the stored identity, creating one on first start. Installs that
+// sealed their key under the old empty passphrase have it re-sealed under the new one, and an
+// identity whose key was never kept is replaced by a fresh one. A wrong passphrase is an error:
+// recovering from it would throw away a key the user can still unlock.
+func loadDeviceIdentity(db *storage.Store, keys identity.KeyStore) (*identity.DeviceIdentity, error) {
+	dev, err := identity.LoadIdentity(db, keys)
+	if errors.Is(err, sql.ErrNoRows) {
+		return identity.NewIdentity(db, keys)
+	}
+	if sealed, ok := keys.(*identity.PassphraseKeyStore); ok && errors.Is(err, identity.ErrWrongPassphrase) {
+		stored, getErr := db.GetIdentity()
+		if getErr != nil {
+			return nil, getErr
+		}
+		if sealed.Reseal(stored.Pubkey, nil) != nil {
+			return nil, err
+		}
+		return identity.LoadIdentity(db, keys)
+	}
+	if errors.Is(err, identity.ErrNoKey) {
+		return identity.RecoverIdentity(db, keys)
+	}
+	return dev, err
 }
 
 //export ml_node_destroy
@@ -118,6 +174,24 @@ func ml_set_service_policy(handle C.uintptr_t, policy C.int32_t) C.int32_t {
 
 
 
+//export ml_set_encounter_cluster
+func ml_set_encounter_cluster(handle C.uintptr_t, cluster *C.char) C.int32_t {
+	node, err := getNode(handle)
+	if err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	if cluster == nil {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+
+	// Strict peers count distinct clusters among a checkpoint's witnesses, so the label should
+	// name the area the node is in (e.g. a coarse geohash), not the node.
+	node.mu.Lock()
+	node.EncounterCluster = C.GoString(cluster)
+	node.mu.Unlock()
+	return C.int32_t(ML_OK)
+}
+
 //export ml_get_peers
 func ml_get_peers(handle C.uintptr_t) C.MLResult {
 	node, err := getNode(handle)
@@ -196,11 +270,6 @@ func ml_share_file(handle C.uintptr_t, fileData *C.uint8_t, length C.int32_t, fi
 
 	const chunkSize = 64 * 1024
 	fileHash := crypto.Hash(data)
-	originSig, sigErr := cabiSigner{node: node}.Sign(fileHash[:])
-	if sigErr != nil {
-		fmt.Printf("[cabi][share] origin signature failed err=%v\n", sigErr)
-		return C.int32_t(ML_ERR_CRYPTO)
-	}
 	chunkHashes := make([][]byte, 0, (len(data)+chunkSize-1)/chunkSize)
 	for i := 0; i < len(data); i += chunkSize {
 		end := i + chunkSize
@@ -223,15 +292,21 @@ func ml_share_file(handle C.uintptr_t, fileData *C.uint8_t, length C.int32_t, fi
 	}
 
 	meta := &pb.FileMeta{
-		FileHash:    fileHash[:],
-		FileName:    name,
-		FileSize:    uint64(len(data)),
-		ChunkSize:   chunkSize,
-		ChunkHashes: chunkHashes,
-		OriginPubkey: node.Identity.Pubkey,
-		OriginSig:    originSig,
-		CreatedAt:    time.Now().Unix(),
+		FileHash:       fileHash[:],
+		FileName:       name,
+		FileSize:       uint64(len(data)),
+		ChunkSize:      chunkSize,
+		ChunkHashes:    chunkHashes,
+		OriginPubkey:   node.Identity.Pubkey,
+		CreatedAt:      time.Now().Unix(),
+		SigningVersion: wire.LocalProtocol().SigningVersion(),
+	}
+	originSig, sigErr := cabiSigner{node: node}.Sign(dag.FileMetaSignableBytes(meta))
+	if sigErr != nil {
+		fmt.Printf("[cabi][share] origin signature failed err=%v\n", sigErr)
+		return C.int32_t(ML_ERR_CRYPTO)
 	}
+	meta.OriginSig = originSig
 	if err := node.Store.InsertFileMeta(meta); err != nil {
 		fmt.Printf("[cabi][share] InsertFileMeta failed hash=%x err=%v\n", fileHash[:], err)
 		return C.int32_t(errorToCode(err))
@@ -241,6 +316,96 @@ func ml_share_file(handle C.uintptr_t, fileData *C.uint8_t, length C.int32_t, fi
 	return C.int32_t(ML_OK)
 }
 
+//export ml_set_file_visibility
+func ml_set_file_visibility(handle C.uintptr_t, fileHash *C.uint8_t, fileHashLen C.int32_t, visibility C.int32_t) C.int32_t {
+	node, err := getNode(handle)
+	if err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	if fileHash == nil || fileHashLen <= 0 {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	// Visibility value maps to protobuf Visibility enum:
+	//   0 = VISIBILITY_PUBLIC, 1 = VISIBILITY_PRIVATE
+	if _, ok := pb.Visibility_name[int32(visibility)]; !ok {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	hash := C.GoBytes(unsafe.Pointer(fileHash), fileHashLen)
+	if err := node.Store.SetFileVisibility(hash, pb.Visibility(visibility)); err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	return C.int32_t(ML_OK)
+}
+
+// ml_add_capability stores a serialized FileCapability granted to this device. Requests for the
+// file carry it from then on, and the file metadata it carries makes the file requestable.
+//
+//export ml_add_capability
+func ml_add_capability(handle C.uintptr_t, data *C.uint8_t, length C.int32_t) C.int32_t {
+	node, err := getNode(handle)
+	if err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	if data == nil || length <= 0 {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	var capability pb.FileCapability
+	if err := proto.Unmarshal(C.GoBytes(unsafe.Pointer(data), length), &capability); err != nil {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	if err := discovery.ValidateCapabilityChain(&capability, node.Identity.Pubkey, nil, node.Store.RevokersOf, time.Now().Unix()); err != nil {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	if err := node.Store.SaveCapability(&capability); err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	return C.int32_t(ML_OK)
+}
+
+// ml_set_network_params installs serialized, signed pb.NetworkParams. Joining another network
+// is the app's decision; within one network the version can only go up.
+//
+//export ml_set_network_params
+func ml_set_network_params(handle C.uintptr_t, data *C.uint8_t, length C.int32_t) C.int32_t {
+	node, err := getNode(handle)
+	if err != nil {
+		return C.int32_t(errorToCode(err))
+	}
+	if data == nil || length <= 0 {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	var params pb.NetworkParams
+	if err := proto.Unmarshal(C.GoBytes(unsafe.Pointer(data), length), &params); err != nil {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	if err := credit.ValidateNetworkParams(&params); err != nil {
+		return C.int32_t(ML_ERR_INVALID_ARG)
+	}
+	if err := node.Store.SaveNetworkParams(&params); err != nil {
+		if errors.Is(err, storage.ErrStaleNetworkParams) {
+			return C.int32_t(ML_ERR_INVALID_ARG)
+		}
+		return C.int32_t(errorToCode(err))
+	}
+	return C.int32_t(ML_OK)
+}
+
+// ml_get_network_params returns the serialized pb.NetworkParams this node computes balances with.
+//
+//export ml_get_network_params
+func ml_get_network_params(handle C.uintptr_t) C.MLResult {
+	node, err := getNode(handle)
+	if err != nil {
+		return makeResult(nil, err)
+	}
+	params, err := credit.LocalNetworkParams(node.Store)
+	if err != nil {
+		return makeResult(nil, err)
+	}
+	data, err := proto.Marshal(params)
+	return makeResult(data, err)
+}
+
 
 func makeResult(data []byte, err error) C.MLResult {
 	var result C.MLResult
@@ -290,36 +455,27 @@ func ml_get_balance(handle C.uintptr_t) C.MLResult {
 		return makeResult(nil, err)
 	}
 
-	records, err := node.Store.GetRecordsByDevice(identity.Pubkey, 0, 2000)
+	params, err := credit.LocalParams(node.Store)
 	if err != nil {
-		records = nil
+		return makeResult(nil, err)
 	}
-
-	params := credit.DefaultParams()
 	now := time.Now().Unix()
-	dripAllowance := credit.ComputeDripAllowance(time.Unix(identity.CreatedAt, 0), time.Unix(now, 0), params)
-	diversityWeighted := credit.DiversityWeightedCredit(records, identity.Pubkey, params.WindowSize)
-	effective := credit.ComputeEffectiveBalance(records, identity.Pubkey, identity.CreatedAt, now, params)
 
-	var cumulativeReceived int64
-	for _, r := range records {
-		if bytesEqual(r.GetReceiverPubkey(), identity.Pubkey) {
-			cumulativeReceived += int64(r.GetBytesTotal())
-		}
-	}
-	decayPenalty := diversityWeighted - credit.ApplyPerPeerCaps(records, identity.Pubkey, params)
-	if decayPenalty < 0 {
-		decayPenalty = 0
+	// After a key rotation the history of the earlier keys is still this device's.
+	breakdown, _, err := transfer.TrustedBreakdown(node.Store, identity.Pubkey, nil, nil, identity.CreatedAt, params)
+	if err != nil {
+		return makeResult(nil, err)
 	}
 
 	balance := &pb.Balance{
-		DevicePubkey:             identity.Pubkey,
-		DripAllowance:            dripAllowance,
-		DiversityWeightedCredit:  diversityWeighted,
-		CumulativeReceived:       cumulativeReceived,
-		DecayPenalty:             decayPenalty,
-		EffectiveBalance:         effective,
-		ComputedAt:               now,
+		DevicePubkey:            identity.Pubkey,
+		DripAllowance:           breakdown.DripAllowance,
+		DiversityWeightedCredit: breakdown.DiversityCredit,
+		CumulativeReceived:      breakdown.CumulativeReceived,
+		DecayPenalty:            breakdown.DecayPenalty,
+		EffectiveBalance:        breakdown.Effective,
+		ComputedAt:              now,
+		CapReduction:            breakdown.CapReduction,
 	}
 	data, err := proto.Marshal(balance)
 	if err != nil {
@@ -357,6 +513,37 @@ func ml_get_chain_summary(handle C.uintptr_t) C.MLResult {
 }
 
 
+// pickRequestPeer returns the peer a new request goes to: the active peer, else any connected
+// one, else the most recently seen. The peer must have completed handshake authentication.
+func pickRequestPeer(node *NodeContext) (uintptr, error) {
+	node.mu.Lock()
+	peerID := node.ActivePeer
+	if peerID != 0 {
+		if _, ok := node.PeerTransports[peerID]; !ok {
+			peerID = 0
+			node.ActivePeer = 0
+		}
+	}
+	if peerID == 0 {
+		if id := pickFallbackPeerIDLocked(node); id != 0 {
+			node.ActivePeer = id
+			peerID = id
+		}
+	}
+	node.mu.Unlock()
+	if peerID == 0 {
+		peers, err := node.Store.GetAllPeers(1)
+		if err != nil || len(peers) == 0 {
+			return 0, fmt.Errorf("no active peer available")
+		}
+		peerID = uint64ToPeerID(peers[0].GetLastSeen())
+	}
+	if verifiedPeerIdentity(node, peerID) == nil {
+		return 0, fmt.Errorf("peer %d has not completed handshake authentication", peerID)
+	}
+	return peerID, nil
+}
+
 //export ml_request_file
 func ml_request_file(handle C.uintptr_t, fileHash *C.uint8_t, fileHashLen C.int32_t) C.MLResult {
 	node, err := getNode(handle)
@@ -387,12 +574,23 @@ func ml_request_file(handle C.uintptr_t, fileHash *C.uint8_t, fileHashLen C.int3
 		fmt.Printf("[cabi][request] nonce generation failed err=%v\n", err)
 		return makeResult(nil, err)
 	}
+	// The request is signed in the encoding negotiated with the peer that will serve it.
+	peerID, err := pickRequestPeer(node)
+	if err != nil {
+		fmt.Printf("[cabi][request] no peer to request from err=%v\n", err)
+		return makeResult(nil, err)
+	}
 	req := &pb.TransferRequest{
 		RequesterPubkey: node.Identity.Pubkey,
 		FileHash:        hash,
 		ChunkIndices:    chunks,
 		Nonce:           nonce,
 		Timestamp:       time.Now().Unix(),
+		SigningVersion:  ensurePeerTransport(node, peerID).protocol().SigningVersion(),
+	}
+	// A capability held for the file is what lets the seeder serve it if it is private.
+	if capability, err := node.Store.FindCapability(hash, req.Timestamp); err == nil {
+		req.Capability = capability
 	}
 	sig, err := cabiSigner{node: node}.Sign(dag.TransferRequestSignableBytes(req))
 	if err != nil {
@@ -405,29 +603,6 @@ func ml_request_file(handle C.uintptr_t, fileHash *C.uint8_t, fileHashLen C.int3
 		return makeResult(nil, err)
 	}
 
-	node.mu.Lock()
-	peerID := node.ActivePeer
-	if peerID != 0 {
-		if _, ok := node.PeerTransports[peerID]; !ok {
-			peerID = 0
-			node.ActivePeer = 0
-		}
-	}
-	if peerID == 0 {
-		if id := pickFallbackPeerIDLocked(node); id != 0 {
-			node.ActivePeer = id
-			peerID = id
-		}
-	}
-	node.mu.Unlock()
-	if peerID == 0 {
-		peers, pErr := node.Store.GetAllPeers(1)
-		if pErr != nil || len(peers) == 0 {
-			fmt.Printf("[cabi][request] no active peer and no fallback peers err=%v\n", pErr)
-			return makeResult(nil, fmt.Errorf("no active peer available"))
-		}
-		peerID = uint64ToPeerID(peers[0].GetLastSeen())
-	}
 	if err := startSession(node, peerID, req, transfer.DirectionOutbound); err != nil {
 		fmt.Printf("[cabi][request] startSession failed peerID=%d err=%v\n", peerID, err)
 		return makeResult(nil, err)
@@ -456,6 +631,12 @@ func ml_request_file_with_chunk_count(handle C.uintptr_t, fileHash *C.uint8_t, f
 	hash := C.GoBytes(unsafe.Pointer(fileHash), fileHashLen)
 	fmt.Printf("[cabi][request2] begin hash=%x len=%d chunkCount=%d\n", hash, len(hash), int32(chunkCount))
 
+	// Received chunks are verified against FileMeta, so it must be known (e.g. from gossip) first.
+	if _, err := node.Store.GetFileMeta(hash); err != nil {
+		fmt.Printf("[cabi][request2] GetFileMeta failed hash=%x err=%v\n", hash, err)
+		return makeResult(nil, err)
+	}
+
 	chunks := make([]uint32, int32(chunkCount))
 	for i := range chunks {
 		chunks[i] = uint32(i)
@@ -465,12 +646,23 @@ func ml_request_file_with_chunk_count(handle C.uintptr_t, fileHash *C.uint8_t, f
 		fmt.Printf("[cabi][request2] nonce generation failed err=%v\n", err)
 		return makeResult(nil, err)
 	}
+	// The request is signed in the encoding negotiated with the peer that will serve it.
+	peerID, err := pickRequestPeer(node)
+	if err != nil {
+		fmt.Printf("[cabi][request2] no peer to request from err=%v\n", err)
+		return makeResult(nil, err)
+	}
 	req := &pb.TransferRequest{
 		RequesterPubkey: node.Identity.Pubkey,
 		FileHash:        hash,
 		ChunkIndices:    chunks,
 		Nonce:           nonce,
 		Timestamp:       time.Now().Unix(),
+		SigningVersion:  ensurePeerTransport(node, peerID).protocol().SigningVersion(),
+	}
+	// A capability held for the file is what lets the seeder serve it if it is private.
+	if capability, err := node.Store.FindCapability(hash, req.Timestamp); err == nil {
+		req.Capability = capability
 	}
 	sig, err := cabiSigner{node: node}.Sign(dag.TransferRequestSignableBytes(req))
 	if err != nil {
@@ -483,29 +675,6 @@ func ml_request_file_with_chunk_count(handle C.uintptr_t, fileHash *C.uint8_t, f
 		return makeResult(nil, err)
 	}
 
-	node.mu.Lock()
-	peerID := node.ActivePeer
-	if peerID != 0 {
-		if _, ok := node.PeerTransports[peerID]; !ok {
-			peerID = 0
-			node.ActivePeer = 0
-		}
-	}
-	if peerID == 0 {
-		if id := pickFallbackPeerIDLocked(node); id != 0 {
-			node.ActivePeer = id
-			peerID = id
-		}
-	}
-	node.mu.Unlock()
-	if peerID == 0 {
-		peers, pErr := node.Store.GetAllPeers(1)
-		if pErr != nil || len(peers) == 0 {
-			fmt.Printf("[cabi][request2] no active peer and no fallback peers err=%v\n", pErr)
-			return makeResult(nil, fmt.Errorf("no active peer available"))
-		}
-		peerID = uint64ToPeerID(peers[0].GetLastSeen())
-	}
 	if err := startSession(node, peerID, req, transfer.DirectionOutbound); err != nil {
 		fmt.Printf("[cabi][request2] startSession failed peerID=%d err=%v\n", peerID, err)
 		return makeResult(nil, err)
@@ -577,17 +746,17 @@ func ml_on_peer_connected(handle C.uintptr_t, peerID C.uintptr_t) {
 
 
 	// store the session private key for the peer so we can use it to derive the shared secret later.
+	node.mu.Lock()
 	node.SessionKeys[pid] = sessionPriv
+	node.mu.Unlock()
 
+	// The hello carries our latest checkpoint and the records since it for the peer's policy.
+	// Our ephemeral key doubles as the session label until both hellos are in.
+	hello := transfer.BuildHandshake(node.Identity, pb.ServicePolicy(node.Policy), fmt.Sprintf("%x", sessionPub), sessionPub, node.Store)
 	env := &pb.Envelope{
-		Payload: &pb.Envelope_Handshake{
-			Handshake: &pb.HandshakeMsg{
-				EphemeralPubkey: sessionPub,
-				IdentityPubkey:  node.Identity.Pubkey,
-				Policy:          pb.ServicePolicy(node.Policy),
-			},
-		},
+		Payload: &pb.Envelope_Handshake{Handshake: hello},
 	}
+	wire.LocalProtocol().Stamp(env)
 
 	data, err := wire.EncodeEnvelope(env)
 	if err != nil {
@@ -595,7 +764,7 @@ func ml_on_peer_connected(handle C.uintptr_t, peerID C.uintptr_t) {
 	}
 
 	// Initial handshake advertises identity, policy, and ephemeral session key.
-	node.Callbacks.Send(pid, data)
+	node.Callbacks.SendFrame(pid, data)
 }
 
 //export ml_on_peer_disconnected
@@ -604,10 +773,13 @@ func ml_on_peer_disconnected(handle C.uintptr_t, peerID C.uintptr_t) {
 	if err != nil {
 		return
 	}
-	delete(node.SessionKeys, uintptr(peerID))
-	delete(node.SharedSecrets, uintptr(peerID))
 	dropped := uintptr(peerID)
+	node.Callbacks.links.forget(dropped)
 	node.mu.Lock()
+	delete(node.SessionKeys, dropped)
+	delete(node.SharedSecrets, dropped)
+	delete(node.PeerHellos, dropped)
+	delete(node.VerifiedPeers, dropped)
 	oldT := node.PeerTransports[dropped]
 	delete(node.PeerTransports, dropped)
 	if node.ActivePeer == dropped {
@@ -626,6 +798,9 @@ func ml_on_peer_disconnected(handle C.uintptr_t, peerID C.uintptr_t) {
 		node.ActivePeer = survID
 	}
 	node.mu.Unlock()
+	if oldT != nil {
+		oldT.closeStream()
+	}
 
 	if oldT != nil && survT != nil && oldT != survT {
 		oldT.linkDelegate(survT)
@@ -657,6 +832,18 @@ func ml_on_peer_disconnected(handle C.uintptr_t, peerID C.uintptr_t) {
 	})
 }
 
+//export ml_on_peer_mtu_changed
+func ml_on_peer_mtu_changed(handle C.uintptr_t, peerID C.uintptr_t, mtu C.int32_t) {
+	node, err := getNode(handle)
+	if err != nil {
+		return
+	}
+	if int(mtu) < wire.MinFragmentMTU {
+		return
+	}
+	node.Callbacks.links.setMTU(uintptr(peerID), int(mtu))
+}
+
 //export ml_on_data_received
 func ml_on_data_received(handle C.uintptr_t, peerID C.uintptr_t, data *C.uint8_t, dataLen C.int32_t) {
 	node, err := getNode(handle)
@@ -667,16 +854,62 @@ func ml_on_data_received(handle C.uintptr_t, peerID C.uintptr_t, data *C.uint8_t
 	if data == nil || dataLen <= 0 {
 		return
 	}
-	goData := C.GoBytes(unsafe.Pointer(data), dataLen)
+	// Native code hands over raw link writes; an envelope is only processed once all of its
+	// fragments are in, or once its stream frame is on a link that moved onto stream frames.
+	fragment := C.GoBytes(unsafe.Pointer(data), dataLen)
+	if in, _ := ensurePeerTransport(node, uintptr(peerID)).linkStream(); in != nil {
+		in.push(fragment)
+		return
+	}
+	goData, err := node.Callbacks.links.push(uintptr(peerID), fragment)
+	if err != nil {
+		fmt.Printf("[cabi] ml_on_data_received fragment dropped peer=%d bytes=%d err=%v\n", uintptr(peerID), len(fragment), err)
+		return
+	}
+	if goData == nil {
+		return
+	}
 
 	env, err := wire.DecodeEnvelope(goData)
 	if err != nil {
 		fmt.Printf("[cabi] ml_on_data_received decode failed peer=%d bytes=%d err=%v\n", uintptr(peerID), len(goData), err)
 		return
 	}
+	receiveEnvelope(node, uintptr(peerID), env)
+}
+
+// receiveEnvelope handles one envelope decoded off peerID's link, however it was framed.
+func receiveEnvelope(node *NodeContext, peerID uintptr, env *pb.Envelope) {
+	env, err := openIncoming(node, peerID, env)
+	if err != nil {
+		fmt.Printf("[cabi] ml_on_data_received dropped unauthenticated envelope peer=%d err=%v\n", peerID, err)
+		return
+	}
+	protocol := ensurePeerTransport(node, peerID).protocol()
+	env, err = wire.DecompressEnvelope(env, protocol)
+	if err != nil {
+		fmt.Printf("[cabi] ml_on_data_received dropped compressed envelope peer=%d err=%v\n", peerID, err)
+		return
+	}
+	if err := protocol.Accepts(env); err != nil {
+		fmt.Printf("[cabi] ml_on_data_received dropped envelope peer=%d err=%v\n", peerID, err)
+		node.Callbacks.NotifyTransferFailed(peerID, errorToCode(err))
+		return
+	}
+
+	// Nothing but the handshake itself is processed until the peer has proven its identity key.
+	peerIdentity := verifiedPeerIdentity(node, peerID)
+	if peerIdentity == nil && env.GetHandshake() == nil && env.GetHandshakeAuth() == nil {
+		fmt.Printf("[cabi] ml_on_data_received dropped %T from unverified peer=%d\n", env.GetPayload(), peerID)
+		return
+	}
 
 	switch payload := env.Payload.(type) {
 	case *pb.Envelope_Gossip:
+		if err := gossip.CheckRelay(node.Store, peerIdentity); err != nil {
+			fmt.Printf("[cabi] gossip dropped peer=%d err=%v\n", peerID, err)
+			return
+		}
 		for _, peer := range payload.Gossip.GetPeerSummaries() {
 			_ = node.Store.UpsertPeer(peer)
 		}
@@ -687,40 +920,81 @@ func ml_on_data_received(handle C.uintptr_t, peerID C.uintptr_t, data *C.uint8_t
 			_ = node.Store.InsertFileMeta(f)
 		}
 		if payload.Gossip.GetLatestCheckpoint() != nil {
-			_ = node.Store.InsertCheckpoint(payload.Gossip.GetLatestCheckpoint())
-		}
-		for _, fe := range payload.Gossip.GetForkEvidence() {
-			_ = node.Store.InsertForkEvidence(fe)
+			_ = gossip.PropagateCheckpoint(node.Store, payload.Gossip.GetLatestCheckpoint())
 		}
-		node.Callbacks.NotifyGossipReceived(uintptr(peerID))
+		_ = gossip.PropagateForkEvidence(node.Store, payload.Gossip.GetForkEvidence(), peerIdentity)
+		_ = gossip.PropagateRevocations(node.Store, payload.Gossip.GetRevocations())
+		_ = gossip.PropagateSuccessions(node.Store, payload.Gossip.GetSuccessions())
+		node.Forks.CheckGossip(payload.Gossip)
+		node.Callbacks.NotifyGossipReceived(peerID)
 	case *pb.Envelope_ForkEvidence:
 		if payload.ForkEvidence != nil {
-			_ = node.Store.InsertForkEvidence(payload.ForkEvidence)
+			if err := gossip.AcceptForkEvidence(node.Store, payload.ForkEvidence, peerIdentity); err != nil {
+				fmt.Printf("[cabi] fork evidence dropped peer=%d err=%v\n", peerID, err)
+				return
+			}
 			node.Callbacks.NotifyForkDetected(payload.ForkEvidence.GetDevicePubkey())
 		}
 	case *pb.Envelope_ShareRecord:
-		if payload.ShareRecord != nil {
-			_ = node.Store.InsertRecord(payload.ShareRecord)
-		}
-		ensurePeerTransport(node, uintptr(peerID)).enqueue(env)
+		// The session that owns this record stores it through cabiChainAppender; checking here
+		// also covers records that arrive without one.
+		node.Forks.CheckRecords([]*pb.ShareRecord{payload.ShareRecord})
+		ensurePeerTransport(node, peerID).enqueue(env)
 	case *pb.Envelope_TransferRequest:
 		if payload.TransferRequest != nil {
+			if !bytes.Equal(payload.TransferRequest.GetRequesterPubkey(), peerIdentity) {
+				fmt.Printf("[cabi] transfer request from peer=%d does not match authenticated identity\n", peerID)
+				return
+			}
+			_ = node.Store.ExpireOldRequests(transfer.DefaultTransferRequestTTLSeconds)
+			if err := transfer.AdmitTransferRequest(payload.TransferRequest, node.Store, time.Now().Unix()); err != nil {
+				fmt.Printf("[cabi] transfer request refused peer=%d err=%v\n", peerID, err)
+				return
+			}
+			if err := transfer.AuthorizeFileAccess(node.Store, payload.TransferRequest, node.Identity.Pubkey, time.Now().Unix()); err != nil {
+				fmt.Printf("[cabi] transfer request unauthorized peer=%d err=%v\n", peerID, err)
+				return
+			}
 			_ = node.Store.InsertRequest(payload.TransferRequest)
-			if err := startSession(node, uintptr(peerID), payload.TransferRequest, transfer.DirectionInbound); err != nil {
-				fmt.Printf("[cabi] startSession inbound failed peer=%d hash=%x err=%v\n", uintptr(peerID), payload.TransferRequest.GetFileHash(), err)
+			if err := startSession(node, peerID, payload.TransferRequest, transfer.DirectionInbound); err != nil {
+				fmt.Printf("[cabi] startSession inbound failed peer=%d hash=%x err=%v\n", peerID, payload.TransferRequest.GetFileHash(), err)
 			}
 		}
 	case *pb.Envelope_ChunkBatch:
-		// Chunk persistence is delegated to native chunk storage callbacks.
-		batch := payload.ChunkBatch
-		if batch != nil {
-			for _, chunk := range batch.GetChunks() {
-				_ = node.Callbacks.WriteChunk(batch.GetFileHash(), chunk.GetChunkIndex(), chunk.GetData())
-			}
+		// Chunk persistence is delegated to native chunk storage callbacks, but only for chunks
+		// that match the stored FileMeta.
+		if err := storeVerifiedBatch(node, peerID, peerIdentity, payload.ChunkBatch); err != nil {
+			fmt.Printf("[cabi] chunk batch dropped peer=%d err=%v\n", peerID, err)
+			return
 		}
-		ensurePeerTransport(node, uintptr(peerID)).enqueue(env)
+		ensurePeerTransport(node, peerID).enqueue(env)
 	case *pb.Envelope_Handshake:
-		ensurePeerTransport(node, uintptr(peerID)).enqueue(env)
+		if err := acceptPeerHello(node, peerID, payload.Handshake); err != nil {
+			fmt.Printf("[cabi] handshake rejected peer=%d err=%v\n", peerID, err)
+			if errors.Is(err, wire.ErrIncompatibleVersion) {
+				node.Callbacks.NotifyTransferFailed(peerID, ML_ERR_VERSION)
+			}
+			node.Callbacks.NotifyPeerVerified(peerID, false)
+			return
+		}
+		ensurePeerTransport(node, peerID).enqueue(env)
+	case *pb.Envelope_ChunkAck:
+		ensurePeerTransport(node, peerID).enqueue(env)
+	case *pb.Envelope_WitnessRequest:
+		if err := witnessPeerCheckpoint(node, peerID, peerIdentity, payload.WitnessRequest); err != nil {
+			fmt.Printf("[cabi] witness request refused peer=%d err=%v\n", peerID, err)
+		}
+	case *pb.Envelope_WitnessResponse:
+		if _, err := gossip.AddWitness(node.Store, node.Identity.Pubkey, payload.WitnessResponse); err != nil {
+			fmt.Printf("[cabi] witness response dropped peer=%d err=%v\n", peerID, err)
+		}
+	case *pb.Envelope_HandshakeAuth:
+		if err := verifyPeerAuth(node, peerID, payload.HandshakeAuth); err != nil {
+			fmt.Printf("[cabi] handshake auth failed peer=%d err=%v\n", peerID, err)
+			node.Callbacks.NotifyPeerVerified(peerID, false)
+			return
+		}
+		node.Callbacks.NotifyPeerVerified(peerID, true)
 	}
 }
 
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"sync"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/gossip"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
@@ -25,6 +27,14 @@ type cabiPeerTransport struct {
 	delegateMu     sync.Mutex
 	delegatePeer   *cabiPeerTransport // when set, Send/Recv forward to surviving link after BLE path change
 	incomingClosed bool
+	cipherMu       sync.Mutex
+	cipher         *crypto.SessionCipher // set once the peer has authenticated the hello it is keyed from
+	protoMu        sync.Mutex
+	proto          *wire.Protocol // set once the peer's hello has been negotiated on this link
+	buffered       transfer.ChunkGauge // chunks queued in preRecv and incoming
+	streamMu       sync.Mutex
+	streamIn       *linkStream               // set once the link has moved onto stream frames
+	stream         *transfer.StreamTransport // frames envelopes on streamIn after the hello
 }
 
 func newCabiPeerTransport(peerID uintptr, callbacks *NativeCallbacks) *cabiPeerTransport {
@@ -48,6 +58,7 @@ func (t *cabiPeerTransport) linkDelegate(surv *cabiPeerTransport) {
 	}
 	t.preMu.Lock()
 	for _, env := range t.preRecv {
+		t.buffered.Taken(env)
 		surv.enqueueLocked(env)
 	}
 	t.preRecv = nil
@@ -61,6 +72,7 @@ func (t *cabiPeerTransport) linkDelegate(surv *cabiPeerTransport) {
 				t.delegateMu.Unlock()
 				return
 			}
+			t.buffered.Taken(env)
 			surv.enqueueLocked(env)
 		default:
 			t.delegatePeer = surv
@@ -104,19 +116,100 @@ func (t *cabiPeerTransport) Send(env *pb.Envelope) error {
 	if err != nil {
 		return err
 	}
+	return cur.sendOnLink(env)
+}
+
+// sendOnLink sends on this exact link without following delegates. Handshake auth must go out
+// on the link whose ephemeral keys it signs.
+func (t *cabiPeerTransport) sendOnLink(env *pb.Envelope) error {
 	if env == nil {
 		return fmt.Errorf("nil envelope")
 	}
+	protocol := t.protocol()
+	protocol.Stamp(env)
+	env, err := wire.CompressEnvelope(env, protocol)
+	if err != nil {
+		return err
+	}
+	if c := t.sessionCipher(); c != nil && env.GetHandshake() == nil {
+		if env, err = wire.SealEnvelope(env, c); err != nil {
+			return err
+		}
+	}
+	if _, st := t.linkStream(); st != nil {
+		return st.Send(env)
+	}
 	data, err := wire.EncodeEnvelope(env)
 	if err != nil {
 		return err
 	}
-	if rc := cur.callbacks.Send(cur.peerID, data); rc != ML_OK {
+	if rc := t.callbacks.SendFrame(t.peerID, data); rc != ML_OK {
 		return codeToError(rc)
 	}
 	return nil
 }
 
+func (t *cabiPeerTransport) sessionCipher() *crypto.SessionCipher {
+	t.cipherMu.Lock()
+	defer t.cipherMu.Unlock()
+	return t.cipher
+}
+
+// setSessionCipher installs the link cipher once. A later handshake on the same link must not
+// re-key it, otherwise a replayed handshake would reset the replay counters.
+func (t *cabiPeerTransport) setSessionCipher(c *crypto.SessionCipher) bool {
+	t.cipherMu.Lock()
+	defer t.cipherMu.Unlock()
+	if t.cipher != nil {
+		return false
+	}
+	t.cipher = c
+	return true
+}
+
+// protocol is the version and features negotiated on this link, or ours until the peer's
+// hello is in.
+func (t *cabiPeerTransport) protocol() wire.Protocol {
+	t.protoMu.Lock()
+	defer t.protoMu.Unlock()
+	if t.proto == nil {
+		return wire.LocalProtocol()
+	}
+	return *t.proto
+}
+
+func (t *cabiPeerTransport) setProtocol(p wire.Protocol) {
+	t.protoMu.Lock()
+	defer t.protoMu.Unlock()
+	t.proto = &p
+}
+
+// linkStream is the stream this exact link has moved onto, or nils while it still carries
+// fragments.
+func (t *cabiPeerTransport) linkStream() (*linkStream, *transfer.StreamTransport) {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	return t.streamIn, t.stream
+}
+
+// setStream moves the link onto st once; a link never goes back to fragments.
+func (t *cabiPeerTransport) setStream(in *linkStream, st *transfer.StreamTransport) bool {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	if t.stream != nil {
+		return false
+	}
+	t.streamIn, t.stream = in, st
+	return true
+}
+
+// closeStream ends the link's stream, if it has one, when the link goes away.
+func (t *cabiPeerTransport) closeStream() {
+	if _, st := t.linkStream(); st != nil {
+		_ = st.Close()
+	}
+}
+
 func (t *cabiPeerTransport) takePreRecv() (*pb.Envelope, bool) {
 	t.preMu.Lock()
 	defer t.preMu.Unlock()
@@ -125,6 +218,7 @@ func (t *cabiPeerTransport) takePreRecv() (*pb.Envelope, bool) {
 	}
 	env := t.preRecv[0]
 	t.preRecv = t.preRecv[1:]
+	t.buffered.Taken(env)
 	return env, true
 }
 
@@ -150,6 +244,7 @@ func (t *cabiPeerTransport) Recv() (*pb.Envelope, error) {
 		if !ok {
 			return nil, fmt.Errorf("transport closed")
 		}
+		cur.buffered.Taken(env)
 		return env, nil
 	}
 }
@@ -177,6 +272,7 @@ func (t *cabiPeerTransport) TryRecv() (*pb.Envelope, bool) {
 			if !ok {
 				return nil, false
 			}
+			cur.buffered.Taken(env)
 			return env, true
 		default:
 			return nil, false
@@ -194,9 +290,19 @@ func (t *cabiPeerTransport) PutBack(env *pb.Envelope) {
 	}
 	cur.preMu.Lock()
 	defer cur.preMu.Unlock()
+	cur.buffered.Queued(env)
 	cur.preRecv = append([]*pb.Envelope{env}, cur.preRecv...)
 }
 
+// BufferedChunks is how many chunks are queued on the active link and not read yet.
+func (t *cabiPeerTransport) BufferedChunks() int {
+	cur, err := t.delegateRoot()
+	if err != nil {
+		return 0
+	}
+	return cur.buffered.BufferedChunks()
+}
+
 func (t *cabiPeerTransport) PeerID() string {
 	return fmt.Sprintf("%d", t.peerID)
 }
@@ -213,16 +319,20 @@ func (t *cabiPeerTransport) enqueueLocked(env *pb.Envelope) {
 	if env == nil {
 		return
 	}
+	// counted before it can be read, so the count never dips below what is queued.
+	t.buffered.Queued(env)
 	select {
 	case t.incoming <- env:
 	default:
 		select {
-		case <-t.incoming:
+		case dropped := <-t.incoming:
+			t.buffered.Taken(dropped)
 		default:
 		}
 		select {
 		case t.incoming <- env:
 		default:
+			t.buffered.Taken(env)
 		}
 	}
 }
@@ -240,10 +350,12 @@ func (t *cabiPeerTransport) enqueue(env *pb.Envelope) {
 
 type cabiChainAppender struct {
 	store *storage.Store
+	forks *gossip.ForkMonitor
 }
 
 func (a cabiChainAppender) AppendRecord(record *pb.ShareRecord) error {
-	return a.store.InsertRecord(record)
+	a.forks.CheckRecords([]*pb.ShareRecord{record})
+	return a.store.AppendRecord(record)
 }
 
 type cabiBalanceChecker struct {
@@ -251,14 +363,16 @@ type cabiBalanceChecker struct {
 }
 
 func (b cabiBalanceChecker) EffectiveBalance(records []*pb.ShareRecord, peerPubKey []byte, peerCreatedAt int64) int64 {
-	params := credit.DefaultParams()
-	now := time.Now().Unix()
-	if len(records) == 0 {
-		if fetched, err := b.store.GetRecordsByDevice(peerPubKey, 0, 1000); err == nil {
-			records = fetched
-		}
+	params, err := credit.LocalParams(b.store)
+	if err != nil {
+		return 0
 	}
-	return credit.ComputeEffectiveBalance(records, peerPubKey, peerCreatedAt, now, params)
+	// The same balance the service policy holds the peer to.
+	breakdown, _, err := transfer.TrustedBreakdown(b.store, peerPubKey, nil, records, peerCreatedAt, params)
+	if err != nil {
+		return 0
+	}
+	return breakdown.Effective
 }
 
 type cabiSigner struct {
@@ -266,14 +380,30 @@ type cabiSigner struct {
 }
 
 func (s cabiSigner) Sign(message []byte) ([]byte, error) {
-	// For mobile MVP we always attempt callback signing first.
-	// This works with either real secure element or temporary software-backed callbacks.
-	if s.node.Callbacks != nil {
-		if sig, code := s.node.Callbacks.SignWithSecureKey(message); code == ML_OK {
-			return sig, nil
-		}
+	// The identity's key store decides where the key lives: the secure element or a sealed
+	// software key.
+	return s.node.Identity.Sign(message)
+}
+
+// cabiSecureElement exposes the native secure-element callbacks as an identity.SecureElement.
+type cabiSecureElement struct {
+	callbacks *NativeCallbacks
+}
+
+func (e cabiSecureElement) PublicKey() ([]byte, error) {
+	pubkey, code := e.callbacks.GetPublicKey()
+	if code != ML_OK {
+		return nil, codeToError(code)
+	}
+	return pubkey, nil
+}
+
+func (e cabiSecureElement) Sign(message []byte) ([]byte, error) {
+	sig, code := e.callbacks.SignWithSecureKey(message)
+	if code != ML_OK {
+		return nil, codeToError(code)
 	}
-	return crypto.Sign(s.node.Identity.PrivateKey, message)
+	return sig, nil
 }
 
 type cabiFileStorage struct {
@@ -299,6 +429,66 @@ func (s cabiFileStorage) HasChunk(fileHash []byte, chunkIndex uint32) (bool, err
 	return s.node.Callbacks.HasChunk(fileHash, chunkIndex), nil
 }
 
+// DeleteFile lets a session discard a file that failed the whole-file hash check.
+func (s cabiFileStorage) DeleteFile(fileHash []byte) error {
+	if code := s.node.Callbacks.DeleteFile(fileHash); code != ML_OK {
+		return codeToError(code)
+	}
+	return nil
+}
+
+// storeVerifiedBatch writes the chunks of batch that match the file metadata. Rejected chunks are
+// counted against the peer here only when no session is running for the file; a running session
+// sees the same batch, counts them itself and asks the sender to re-send them.
+func storeVerifiedBatch(node *NodeContext, peerID uintptr, peerIdentity []byte, batch *pb.ChunkBatch) error {
+	if batch == nil {
+		return nil
+	}
+	meta, err := node.Store.GetFileMeta(batch.GetFileHash())
+	if err != nil {
+		return fmt.Errorf("no file metadata to verify chunks against: %w", err)
+	}
+	verified, rejected, err := transfer.SplitVerifiedChunks(batch, meta)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range verified {
+		_ = node.Callbacks.WriteChunk(batch.GetFileHash(), chunk.GetChunkIndex(), chunk.GetData())
+	}
+	if len(rejected) > 0 {
+		if _, ok := node.Transfer.Get(fmt.Sprintf("%d:%x", peerID, batch.GetFileHash())); !ok {
+			now := time.Now().Unix()
+			for range rejected {
+				_ = node.Store.RecordPeerFault(peerIdentity, storage.PeerFaultBadChunk, now)
+			}
+		}
+	}
+	return nil
+}
+
+// witnessPeerCheckpoint co-signs a checkpoint for the authenticated peer it belongs to.
+func witnessPeerCheckpoint(node *NodeContext, peerID uintptr, peerIdentity []byte, req *pb.WitnessRequest) error {
+	cp := req.GetCheckpoint()
+	if !bytes.Equal(cp.GetDevicePubkey(), peerIdentity) {
+		return fmt.Errorf("checkpoint does not belong to the authenticated peer")
+	}
+	node.mu.Lock()
+	cluster := node.EncounterCluster
+	node.mu.Unlock()
+	// An unlabelled witness says nothing about where the encounter happened, and strict peers
+	// would not count it towards cluster diversity.
+	if cluster == "" {
+		return fmt.Errorf("witnessing requires an encounter cluster")
+	}
+	resp, err := gossip.WitnessCheckpoint(node.Store, cp, node.Identity.Pubkey, cluster, cabiSigner{node: node}, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return ensurePeerTransport(node, peerID).Send(&pb.Envelope{
+		Payload: &pb.Envelope_WitnessResponse{WitnessResponse: resp},
+	})
+}
+
 func ensurePeerTransport(node *NodeContext, peerID uintptr) *cabiPeerTransport {
 	node.mu.Lock()
 	defer node.mu.Unlock()
@@ -313,7 +503,13 @@ func ensurePeerTransport(node *NodeContext, peerID uintptr) *cabiPeerTransport {
 	return t
 }
 
+// startSession runs a transfer with a peer whose link verifyPeerAuth has verified; that is where
+// the peer was held to our policy.
 func startSession(node *NodeContext, peerID uintptr, req *pb.TransferRequest, direction transfer.SessionDirection) error {
+	peerIdentity := verifiedPeerIdentity(node, peerID)
+	if peerIdentity == nil {
+		return fmt.Errorf("peer %d is not verified", peerID)
+	}
 	t := ensurePeerTransport(node, peerID)
 	sessionID := fmt.Sprintf("%d:%x", peerID, req.GetFileHash())
 	peerKey := fmt.Sprintf("%d", peerID)
@@ -324,14 +520,17 @@ func startSession(node *NodeContext, peerID uintptr, req *pb.TransferRequest, di
 			direction,
 			req.GetFileHash(),
 			t,
-			cabiChainAppender{store: node.Store},
+			cabiChainAppender{store: node.Store, forks: node.Forks},
 			cabiBalanceChecker{store: node.Store},
 			cabiSigner{node: node},
 		)
 		s.ID = sessionID
 		s.SetPolicyStore(node.Store)
+		s.SetForkDetector(node.Forks)
 		s.SetFileStorage(cabiFileStorage{node: node})
 		s.SetLocalPubKey(node.Identity.Pubkey)
+		s.SetPeerIdentity(peerIdentity)
+		s.SetProtocol(t.protocol())
 		// Must set before RunSession: handleTransferring skips chunk work when pendingRequest is nil
 		// (race caused sender to jump to CoSigning without ChunkBatch — matches "no chunks" on receiver).
 		s.SetPendingRequest(req)
@@ -349,3 +548,151 @@ func startSession(node *NodeContext, peerID uintptr, req *pb.TransferRequest, di
 	s.SetPendingRequest(req)
 	return nil
 }
+
+// deriveSessionCipher keys the link from the hello the peer authenticated. Keying from a hello
+// before its HandshakeAuth verifies would let whoever injected the first hello read the link.
+// Our ephemeral private key was stored by ml_on_peer_connected when our own handshake went out.
+func deriveSessionCipher(node *NodeContext, peerID uintptr, hs *pb.HandshakeMsg) error {
+	if hs == nil || len(hs.GetEphemeralPubkey()) == 0 {
+		return nil
+	}
+	t := ensurePeerTransport(node, peerID)
+	if t.sessionCipher() != nil {
+		return nil
+	}
+
+	node.mu.Lock()
+	priv := node.SessionKeys[peerID]
+	node.mu.Unlock()
+	if len(priv) == 0 {
+		return fmt.Errorf("no session key for peer %d", peerID)
+	}
+
+	shared, err := crypto.DeriveSharedSecret(priv, hs.GetEphemeralPubkey())
+	if err != nil {
+		return err
+	}
+	localPub, err := crypto.SessionPublicKey(priv)
+	if err != nil {
+		return err
+	}
+	c, err := crypto.NewSessionCipher(shared, localPub, hs.GetEphemeralPubkey())
+	if err != nil {
+		return err
+	}
+	if !t.setSessionCipher(c) {
+		return nil
+	}
+
+	node.mu.Lock()
+	node.SharedSecrets[peerID] = shared
+	node.mu.Unlock()
+	return nil
+}
+
+// openIncoming unwraps sealed envelopes received on a keyed link. Plaintext is only accepted
+// for the handshake, or while the link has not been keyed yet.
+func openIncoming(node *NodeContext, peerID uintptr, env *pb.Envelope) (*pb.Envelope, error) {
+	c := ensurePeerTransport(node, peerID).sessionCipher()
+	if c == nil {
+		if env.GetSealed() != nil {
+			return nil, fmt.Errorf("sealed envelope before session keys were exchanged")
+		}
+		return env, nil
+	}
+	return wire.OpenEnvelope(env, c)
+}
+
+// acceptPeerHello records the peer's hello and answers with our HandshakeAuth on the same link.
+// A hello arriving after the link is already verified is ignored so it cannot swap identities.
+func acceptPeerHello(node *NodeContext, peerID uintptr, hello *pb.HandshakeMsg) error {
+	_, peerPolicy, err := transfer.ProcessHandshake(hello)
+	if err != nil {
+		return err
+	}
+	protocol, err := transfer.NegotiateProtocol(hello)
+	if err != nil {
+		return err
+	}
+
+	node.mu.Lock()
+	if _, verified := node.VerifiedPeers[peerID]; verified {
+		node.mu.Unlock()
+		return nil
+	}
+	priv := node.SessionKeys[peerID]
+	node.PeerHellos[peerID] = hello
+	node.mu.Unlock()
+	if len(priv) == 0 {
+		return fmt.Errorf("no session key for peer %d", peerID)
+	}
+
+	localEph, err := crypto.SessionPublicKey(priv)
+	if err != nil {
+		return err
+	}
+	negotiated := transfer.NegotiatePolicy(pb.ServicePolicy(node.Policy), peerPolicy)
+	auth, err := transfer.BuildHandshakeAuth(cabiSigner{node: node}, node.Identity.Pubkey, localEph, hello, negotiated, protocol)
+	if err != nil {
+		return err
+	}
+	t := ensurePeerTransport(node, peerID)
+	t.setProtocol(protocol)
+	if err := startLinkStream(node, peerID, protocol); err != nil {
+		return err
+	}
+	return t.sendOnLink(&pb.Envelope{
+		Payload: &pb.Envelope_HandshakeAuth{HandshakeAuth: auth},
+	})
+}
+
+// verifyPeerAuth checks the peer's HandshakeAuth against the hello it sent on this link, holds
+// the peer to the negotiated policy, keys the link from that hello and marks it verified.
+func verifyPeerAuth(node *NodeContext, peerID uintptr, auth *pb.HandshakeAuth) error {
+	node.mu.Lock()
+	hello := node.PeerHellos[peerID]
+	priv := node.SessionKeys[peerID]
+	node.mu.Unlock()
+	if hello == nil {
+		return fmt.Errorf("handshake auth before hello")
+	}
+	if len(priv) == 0 {
+		return fmt.Errorf("no session key for peer %d", peerID)
+	}
+
+	localEph, err := crypto.SessionPublicKey(priv)
+	if err != nil {
+		return err
+	}
+	negotiated := transfer.NegotiatePolicy(pb.ServicePolicy(node.Policy), hello.GetPolicy())
+	protocol, err := transfer.NegotiateProtocol(hello)
+	if err != nil {
+		return err
+	}
+	if err := transfer.VerifyHandshakeAuth(auth, hello, localEph, negotiated, protocol); err != nil {
+		return err
+	}
+	// Sessions on this link skip their own verifying state, so the policy is applied here.
+	if err := transfer.VerifyPeer(node.Store, hello, negotiated, node.Forks, transfer.MetaLookup(node.Store)); err != nil {
+		return err
+	}
+	// A later hello may have replaced the protocol negotiated from this one; only the
+	// authenticated hello counts.
+	ensurePeerTransport(node, peerID).setProtocol(protocol)
+	if err := deriveSessionCipher(node, peerID, hello); err != nil {
+		return err
+	}
+
+	node.mu.Lock()
+	node.VerifiedPeers[peerID] = append([]byte(nil), hello.GetIdentityPubkey()...)
+	delete(node.PeerHellos, peerID)
+	node.mu.Unlock()
+	return nil
+}
+
+// verifiedPeerIdentity returns the authenticated identity on this link, or nil.
+func verifiedPeerIdentity(node *NodeContext, peerID uintptr) []byte {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.VerifiedPeers[peerID]
+}
@@ -3,13 +3,17 @@
 package main
 
 import (
+	"bytes"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/identity"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
@@ -20,7 +24,7 @@ func testNodeContext(t *testing.T) *NodeContext {
 		t.Fatalf("open db: %v", err)
 	}
 	t.Cleanup(func() { _ = db.Close() })
-	dev, err := identity.NewIdentity(db)
+	dev, err := identity.NewIdentity(db, identity.NewMemoryKeyStore())
 	if err != nil {
 		t.Fatalf("new identity: %v", err)
 	}
@@ -31,6 +35,8 @@ func testNodeContext(t *testing.T) *NodeContext {
 		SessionKeys:    make(map[uintptr][]byte),
 		SharedSecrets:  make(map[uintptr][]byte),
 		PeerTransports: make(map[uintptr]*cabiPeerTransport),
+		PeerHellos:     make(map[uintptr]*pb.HandshakeMsg),
+		VerifiedPeers:  make(map[uintptr][]byte),
 	}
 }
 
@@ -77,6 +83,7 @@ func TestStartSessionAddsTransferSession(t *testing.T) {
 		Nonce:           []byte("nonce"),
 		Timestamp:       time.Now().Unix(),
 	}
+	node.VerifiedPeers[42] = []byte("peer-identity")
 	if err := startSession(node, 42, req, transfer.DirectionOutbound); err != nil {
 		t.Fatalf("start session: %v", err)
 	}
@@ -84,3 +91,319 @@ func TestStartSessionAddsTransferSession(t *testing.T) {
 		t.Fatalf("expected exactly one active session, got %d", node.Transfer.ActiveCount())
 	}
 }
+
+// legacyPeerAuth is the auth a version 1 peer sends: it signs no full transcript.
+func legacyPeerAuth(signer transfer.Signer, peerPub, peerEph, localEph []byte, policy pb.ServicePolicy) (*pb.HandshakeAuth, error) {
+	auth, err := transfer.BuildHandshakeAuth(signer, peerPub, peerEph, &pb.HandshakeMsg{EphemeralPubkey: localEph}, policy, wire.Protocol{Version: wire.LegacyProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+	auth.TranscriptSignature = nil
+	return auth, nil
+}
+
+func TestVerifyPeerAuthRequiresProofOfIdentity(t *testing.T) {
+	node := testNodeContext(t)
+	_, localPriv, err := crypto.GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("generate session key: %v", err)
+	}
+	localEph, _ := crypto.SessionPublicKey(localPriv)
+	node.SessionKeys[9] = localPriv
+
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	_, otherPriv, _ := crypto.GenerateKeyPair()
+	peerEph, _, _ := crypto.GenerateSessionKeyPair()
+	node.PeerHellos[9] = &pb.HandshakeMsg{
+		SessionId:       []byte("peer"),
+		EphemeralPubkey: peerEph,
+		IdentityPubkey:  peerPub,
+		Policy:          pb.ServicePolicy_POLICY_NONE,
+	}
+
+	forged, err := legacyPeerAuth(testSigner{priv: otherPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_NONE)
+	if err != nil {
+		t.Fatalf("build forged auth: %v", err)
+	}
+	if err := verifyPeerAuth(node, 9, forged); err == nil {
+		t.Fatalf("expected forged auth to be rejected")
+	}
+	if verifiedPeerIdentity(node, 9) != nil {
+		t.Fatalf("expected peer to stay unverified")
+	}
+
+	auth, err := legacyPeerAuth(testSigner{priv: peerPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_NONE)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := verifyPeerAuth(node, 9, auth); err != nil {
+		t.Fatalf("verify auth: %v", err)
+	}
+	if !bytes.Equal(verifiedPeerIdentity(node, 9), peerPub) {
+		t.Fatalf("expected peer identity to be recorded")
+	}
+}
+
+func TestInjectedHelloCannotKeyTheLink(t *testing.T) {
+	node := testNodeContext(t)
+	node.Callbacks = &NativeCallbacks{}
+	_, localPriv, err := crypto.GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("generate session key: %v", err)
+	}
+	localEph, _ := crypto.SessionPublicKey(localPriv)
+	node.SessionKeys[9] = localPriv
+
+	// An attacker's hello reaches the link before the genuine one. Sending our auth fails
+	// without native callbacks, which does not matter here.
+	attackerPub, _, _ := crypto.GenerateKeyPair()
+	attackerEph, _, _ := crypto.GenerateSessionKeyPair()
+	_ = acceptPeerHello(node, 9, &pb.HandshakeMsg{
+		SessionId:       []byte("attacker"),
+		EphemeralPubkey: attackerEph,
+		IdentityPubkey:  attackerPub,
+		Policy:          pb.ServicePolicy_POLICY_NONE,
+	})
+	if ensurePeerTransport(node, 9).sessionCipher() != nil {
+		t.Fatalf("link keyed from an unauthenticated hello")
+	}
+
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	peerEph, peerEphPriv, _ := crypto.GenerateSessionKeyPair()
+	_ = acceptPeerHello(node, 9, &pb.HandshakeMsg{
+		SessionId:       []byte("peer"),
+		EphemeralPubkey: peerEph,
+		IdentityPubkey:  peerPub,
+		Policy:          pb.ServicePolicy_POLICY_NONE,
+	})
+	auth, err := legacyPeerAuth(testSigner{priv: peerPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_NONE)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := verifyPeerAuth(node, 9, auth); err != nil {
+		t.Fatalf("verify auth: %v", err)
+	}
+
+	shared, err := crypto.DeriveSharedSecret(peerEphPriv, localEph)
+	if err != nil {
+		t.Fatalf("derive shared secret: %v", err)
+	}
+	peerCipher, err := crypto.NewSessionCipher(shared, peerEph, localEph)
+	if err != nil {
+		t.Fatalf("peer cipher: %v", err)
+	}
+	sealed, err := wire.SealEnvelope(&pb.Envelope{
+		Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{}},
+	}, peerCipher)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if _, err := openIncoming(node, 9, sealed); err != nil {
+		t.Fatalf("link not keyed from the authenticated hello: %v", err)
+	}
+}
+
+func TestLinkStreamSkipsCorruptedWrites(t *testing.T) {
+	node := testNodeContext(t)
+	node.Callbacks = &NativeCallbacks{}
+	peerPub, _, _ := crypto.GenerateKeyPair()
+	node.VerifiedPeers[9] = peerPub
+	if err := startLinkStream(node, 9, wire.LocalProtocol()); err != nil {
+		t.Fatalf("start stream: %v", err)
+	}
+	tr := ensurePeerTransport(node, 9)
+	in, _ := tr.linkStream()
+	if in == nil {
+		t.Fatalf("expected the link to move onto stream frames")
+	}
+	defer tr.closeStream()
+
+	ack := func(index uint32) []byte {
+		env := &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{ChunkIndices: []uint32{index}}}}
+		wire.LocalProtocol().Stamp(env)
+		frame, err := wire.EncodeStreamFrame(env)
+		if err != nil {
+			t.Fatalf("encode frame: %v", err)
+		}
+		return frame
+	}
+	corrupted := ack(1)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	in.push(corrupted)
+	in.push(ack(2))
+
+	env, err := tr.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if got := env.GetChunkAck().GetChunkIndices(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("expected the ack after the corrupted write, got %v", got)
+	}
+}
+
+func TestStartSessionRejectsPeerFailingPolicy(t *testing.T) {
+	node := testNodeContext(t)
+	node.Policy = int32(pb.ServicePolicy_POLICY_LIGHT)
+	_, localPriv, _ := crypto.GenerateSessionKeyPair()
+	localEph, _ := crypto.SessionPublicKey(localPriv)
+	node.SessionKeys[9] = localPriv
+
+	// The peer proves its identity, but its checkpoint has no witness, which LIGHT requires.
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	peerEph, _, _ := crypto.GenerateSessionKeyPair()
+	cp := &pb.Checkpoint{
+		DevicePubkey:   peerPub,
+		Timestamp:      time.Now().Unix() - 3600,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	cp.DeviceSig, _ = crypto.Sign(peerPriv, dag.CheckpointSignableBytes(cp))
+	node.PeerHellos[9] = &pb.HandshakeMsg{
+		SessionId:        []byte("peer"),
+		EphemeralPubkey:  peerEph,
+		IdentityPubkey:   peerPub,
+		Policy:           pb.ServicePolicy_POLICY_NONE,
+		LatestCheckpoint: cp,
+	}
+	auth, err := legacyPeerAuth(testSigner{priv: peerPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_LIGHT)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := verifyPeerAuth(node, 9, auth); err == nil {
+		t.Fatalf("expected a peer failing the policy to be refused")
+	}
+
+	req := &pb.TransferRequest{
+		RequesterPubkey: peerPub,
+		FileHash:        []byte("file-hash"),
+		Nonce:           []byte("nonce"),
+		Timestamp:       time.Now().Unix(),
+	}
+	if err := startSession(node, 9, req, transfer.DirectionInbound); err == nil {
+		t.Fatalf("expected no session for a peer failing the policy")
+	}
+	if node.Transfer.ActiveCount() != 0 {
+		t.Fatalf("expected no active session, got %d", node.Transfer.ActiveCount())
+	}
+}
+
+func TestVerifyPeerAuthEvaluatesChainProof(t *testing.T) {
+	node := testNodeContext(t)
+	_, localPriv, _ := crypto.GenerateSessionKeyPair()
+	localEph, _ := crypto.SessionPublicKey(localPriv)
+	node.SessionKeys[9] = localPriv
+	node.SessionKeys[10] = localPriv
+
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	peerEph, _, _ := crypto.GenerateSessionKeyPair()
+	auth, err := legacyPeerAuth(testSigner{priv: peerPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_NONE)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+
+	// A segment the peer never signed fails chain validation whatever the policy.
+	node.PeerHellos[9] = &pb.HandshakeMsg{
+		SessionId:       []byte("peer"),
+		EphemeralPubkey: peerEph,
+		IdentityPubkey:  peerPub,
+		Policy:          pb.ServicePolicy_POLICY_NONE,
+		RecordsSinceCheckpoint: []*pb.ShareRecord{{
+			SenderPubkey:      peerPub,
+			ReceiverPubkey:    []byte("receiver"),
+			SenderRecordIndex: 1,
+			BytesTotal:        10,
+			Timestamp:         time.Now().Unix(),
+		}},
+	}
+	if err := verifyPeerAuth(node, 9, auth); err == nil {
+		t.Fatalf("expected a hello with an invalid chain segment to be refused")
+	}
+
+	// Leaving the proof out does not pass the peer off as a new device when we hold its
+	// checkpoint, which has no witness.
+	node.Policy = int32(pb.ServicePolicy_POLICY_LIGHT)
+	cp := &pb.Checkpoint{DevicePubkey: peerPub, ChainHead: []byte("head"), RecordIndex: 1, Timestamp: time.Now().Unix()}
+	cp.DeviceSig, _ = crypto.Sign(peerPriv, dag.CheckpointSignableBytes(cp))
+	if err := node.Store.InsertCheckpoint(cp); err != nil {
+		t.Fatalf("insert checkpoint: %v", err)
+	}
+	node.PeerHellos[10] = &pb.HandshakeMsg{
+		SessionId:       []byte("peer"),
+		EphemeralPubkey: peerEph,
+		IdentityPubkey:  peerPub,
+		Policy:          pb.ServicePolicy_POLICY_NONE,
+	}
+	auth, err = legacyPeerAuth(testSigner{priv: peerPriv}, peerPub, peerEph, localEph, pb.ServicePolicy_POLICY_LIGHT)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := verifyPeerAuth(node, 10, auth); err == nil {
+		t.Fatalf("expected a hello without its chain proof to be held to the stored checkpoint")
+	}
+}
+
+type testSigner struct {
+	priv []byte
+}
+
+func (s testSigner) Sign(message []byte) ([]byte, error) {
+	return crypto.Sign(s.priv, message)
+}
+
+func TestLoadDeviceIdentityMigratesOldInstalls(t *testing.T) {
+	params := identity.Argon2Params{Time: 1, Memory: 1024, Threads: 1}
+	passphrase := []byte("device secret")
+
+	// An install from before sealed keys has an identity row and nothing to sign with.
+	legacy, err := storage.OpenDatabase(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer legacy.Close()
+	lostPub, _, _ := crypto.GenerateKeyPair()
+	if err := legacy.InitIdentity(lostPub, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	dev, err := loadDeviceIdentity(legacy, identity.NewPassphraseKeyStore(legacy, passphrase, params))
+	if err != nil {
+		t.Fatalf("recover identity: %v", err)
+	}
+	if bytes.Equal(dev.Pubkey, lostPub) {
+		t.Fatalf("recovered identity kept the lost key")
+	}
+	if _, err := loadDeviceIdentity(legacy, identity.NewPassphraseKeyStore(legacy, passphrase, params)); err != nil {
+		t.Fatalf("reload recovered identity: %v", err)
+	}
+
+	// A key sealed under the empty passphrase moves to the real one.
+	sealed, err := storage.OpenDatabase(filepath.Join(t.TempDir(), "sealed.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer sealed.Close()
+	original, err := identity.NewIdentity(sealed, identity.NewPassphraseKeyStore(sealed, nil, params))
+	if err != nil {
+		t.Fatalf("new identity: %v", err)
+	}
+	dev, err = loadDeviceIdentity(sealed, identity.NewPassphraseKeyStore(sealed, passphrase, params))
+	if err != nil {
+		t.Fatalf("reseal identity: %v", err)
+	}
+	if !bytes.Equal(dev.Pubkey, original.Pubkey) {
+		t.Fatalf("resealing replaced the identity key")
+	}
+	if _, err := identity.LoadIdentity(sealed, identity.NewPassphraseKeyStore(sealed, nil, params)); err == nil {
+		t.Fatalf("key still opens under the empty passphrase")
+	}
+
+	// A wrong passphrase must not be mistaken for a lost key.
+	if _, err := loadDeviceIdentity(sealed, identity.NewPassphraseKeyStore(sealed, []byte("wrong"), params)); err == nil {
+		t.Fatalf("wrong passphrase loaded the identity")
+	}
+	stored, err := sealed.GetIdentity()
+	if err != nil {
+		t.Fatalf("get identity: %v", err)
+	}
+	if !bytes.Equal(stored.Pubkey, original.Pubkey) {
+		t.Fatalf("wrong passphrase replaced the identity")
+	}
+}
@@ -0,0 +1,66 @@
+//go:build cgo
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+)
+
+// linkFraming splits outgoing frames into link-sized fragments and reassembles incoming ones,
+// so native code only moves raw GATT writes and notifications.
+type linkFraming struct {
+	mu  sync.Mutex
+	mtu map[uintptr]int
+	in  *wire.Reassembler
+	out wire.Fragmenter
+}
+
+// setMTU records the largest write native code can make to peerID.
+func (l *linkFraming) setMTU(peerID uintptr, mtu int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mtu == nil {
+		l.mtu = make(map[uintptr]int)
+	}
+	l.mtu[peerID] = mtu
+}
+
+// mtuFor is the largest write native code can make to peerID.
+func (l *linkFraming) mtuFor(peerID uintptr) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if mtu, ok := l.mtu[peerID]; ok {
+		return mtu
+	}
+	return wire.DefaultFragmentMTU
+}
+
+func (l *linkFraming) split(peerID uintptr, frame []byte) ([][]byte, error) {
+	return l.out.Split(frame, l.mtuFor(peerID))
+}
+
+// push adds a fragment from peerID and returns the frame it completes, if any.
+func (l *linkFraming) push(peerID uintptr, fragment []byte) ([]byte, error) {
+	return l.reassembler().Push(fmt.Sprintf("%d", peerID), fragment, time.Now())
+}
+
+// forget drops everything known about peerID's link.
+func (l *linkFraming) forget(peerID uintptr) {
+	l.mu.Lock()
+	delete(l.mtu, peerID)
+	l.mu.Unlock()
+	l.reassembler().Forget(fmt.Sprintf("%d", peerID))
+}
+
+func (l *linkFraming) reassembler() *wire.Reassembler {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.in == nil {
+		l.in = wire.NewReassembler(wire.DefaultReassemblyLimits())
+	}
+	return l.in
+}
@@ -0,0 +1,111 @@
+//go:build cgo
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+)
+
+// linkStream carries a peer link as one byte stream once both hellos advertise
+// wire.FeatureStreamFraming. Writes leave as raw link writes of at most the link's MTU, and
+// whatever native code hands over is read back in order, so a transfer.StreamTransport on top
+// can skip a corrupted or lost write instead of losing the link.
+type linkStream struct {
+	peerID    uintptr
+	callbacks *NativeCallbacks
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func newLinkStream(peerID uintptr, callbacks *NativeCallbacks) *linkStream {
+	l := &linkStream{peerID: peerID, callbacks: callbacks}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// push adds bytes native code received on the link. It never blocks the native caller.
+func (l *linkStream) push(data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.buf = append(l.buf, data...)
+	l.cond.Broadcast()
+}
+
+func (l *linkStream) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.buf) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if len(l.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+func (l *linkStream) Write(p []byte) (int, error) {
+	mtu := l.callbacks.links.mtuFor(l.peerID)
+	for sent := 0; sent < len(p); {
+		n := min(mtu, len(p)-sent)
+		if rc := l.callbacks.Send(l.peerID, p[sent:sent+n]); rc != ML_OK {
+			return sent, codeToError(rc)
+		}
+		sent += n
+	}
+	return len(p), nil
+}
+
+func (l *linkStream) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+	return nil
+}
+
+// startLinkStream moves the link onto stream frames when the protocol negotiated from the
+// peer's hello has FeatureStreamFraming. The peer sent its hello before anything else, and we
+// answer it with our auth, so from here on both directions are stream frames. Envelopes read
+// off the stream take the same path as those reassembled from fragments.
+func startLinkStream(node *NodeContext, peerID uintptr, protocol wire.Protocol) error {
+	if !protocol.Features.Has(wire.FeatureStreamFraming) {
+		return nil
+	}
+	t := ensurePeerTransport(node, peerID)
+	in := newLinkStream(peerID, node.Callbacks)
+	st, err := transfer.NewStreamTransport(fmt.Sprintf("%d", peerID), in)
+	if err != nil {
+		return err
+	}
+	if !t.setStream(in, st) {
+		return st.Close()
+	}
+	go func() {
+		var dropped uint64
+		for {
+			env, err := st.Recv()
+			if err != nil {
+				return
+			}
+			if d := st.Dropped(); d > dropped {
+				fmt.Printf("[cabi] link stream skipped %d corrupted bytes peer=%d\n", d-dropped, peerID)
+				dropped = d
+			}
+			receiveEnvelope(node, peerID, env)
+		}
+	}()
+	return nil
+}
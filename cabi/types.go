@@ -5,9 +5,11 @@ package main
 import (
 	"sync"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/gossip"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/identity"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
 type handleRegistry struct {
@@ -22,6 +24,8 @@ type NodeContext struct {
 	Identity   *identity.DeviceIdentity
 	Callbacks  *NativeCallbacks
 	Policy     int32
+	// EncounterCluster labels the checkpoints this node witnesses with where the encounter happened.
+	EncounterCluster string
 	Transfer   *transfer.SessionManager
 	ActivePeer uintptr
 
@@ -31,5 +35,11 @@ type NodeContext struct {
 	SharedSecrets map[uintptr][]byte
 	// peerID -> transport adapter bound to callback send/recv.
 	PeerTransports map[uintptr]*cabiPeerTransport
+	// peerID -> peer's handshake hello; only trusted once its HandshakeAuth verifies.
+	PeerHellos map[uintptr]*pb.HandshakeMsg
+	// peerID -> identity pubkey the peer proved it holds.
+	VerifiedPeers map[uintptr][]byte
+	// Forks checks incoming records before they are stored and fires NotifyForkDetected.
+	Forks *gossip.ForkMonitor
 	mu             sync.Mutex
 }
\ No newline at end of file
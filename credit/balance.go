@@ -7,26 +7,94 @@ import (
 	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
-func ComputeEffectiveBalance(records []*gen.ShareRecord, devicePubKey []byte, deviceCreatedAt int64, now int64, params CreditParams) int64 {
-	dripAllowance := ComputeDripAllowance(time.Unix(deviceCreatedAt, 0), time.Unix(now, 0), params)
-	diversityWeightedCredits := DiversityWeightedCredit(records, devicePubKey, params.WindowSize)
-	var cumulativeReceived int64
+// BalanceBreakdown is every component of a device's balance. It is the one place the balance
+// formula lives; policy, node and cabi all read their numbers from it.
+//
+//	Effective = min(MaxBalance, DripAllowance + DiversityCredit - TrustDiscount - CapReduction - DecayPenalty - CumulativeReceived)
+type BalanceBreakdown struct {
+	// DripAllowance is the free credit earned by the device's age, at most MaxBalance.
+	DripAllowance int64
+	// DiversityCredit is the sent bytes in the recent window, weighted down per repeated counterparty.
+	DiversityCredit int64
+	// TrustDiscount is the diversity credit earned from counterparties the local trust graph does
+	// not vouch for. It is zero until WithTrust applies a graph.
+	TrustDiscount int64
+	// RawSent is every byte the device has sent.
+	RawSent int64
+	// CapReduction is the sent bytes above the per-peer cap within each epoch.
+	CapReduction int64
+	// DecayPenalty is how much of the sent bytes has decayed with age.
+	DecayPenalty int64
+	// CumulativeReceived is every byte the device has received.
+	CumulativeReceived int64
+	// Effective is the balance the device can spend. It may be negative.
+	Effective int64
+}
+
+// CappedCredit is the sent bytes that count after per-peer caps.
+func (b BalanceBreakdown) CappedCredit() int64 {
+	return b.RawSent - b.CapReduction
+}
+
+// TrustedCredit is the diversity credit left after the trust discount.
+func (b BalanceBreakdown) TrustedCredit() int64 {
+	return b.DiversityCredit - b.TrustDiscount
+}
+
+// WithTrust discounts b's diversity credit by g's trust in each counterparty. window holds the
+// records b's diversity credit was computed from.
+func (b BalanceBreakdown) WithTrust(window []*gen.ShareRecord, devicePubKey []byte, g *TrustGraph, params CreditParams) BalanceBreakdown {
+	b.TrustDiscount = b.DiversityCredit - TrustWeightedCredit(window, devicePubKey, params.WindowSize, g)
+	b.Effective = b.effective(params)
+	return b
+}
+
+// ComputeBalanceBreakdown computes the breakdown over records, the device's history oldest first.
+func ComputeBalanceBreakdown(records []*gen.ShareRecord, devicePubKey []byte, deviceCreatedAt int64, now int64, params CreditParams) BalanceBreakdown {
+	var cumulativeReceived, rawSent, decayedSent int64
+	halfLife := time.Duration(params.HalfLifeSeconds) * time.Second
 	for _, r := range records {
 		if bytes.Equal(r.ReceiverPubkey, devicePubKey) {
 			cumulativeReceived += int64(r.BytesTotal)
 		}
-	}
-	var rawCredit int64
-	var decayedCredit int64
-	for _, r := range records {
 		if bytes.Equal(r.SenderPubkey, devicePubKey) {
 			raw := int64(r.BytesTotal)
-			rawCredit += raw
-			decayed := DecayedValue(raw, time.Unix(r.Timestamp, 0), time.Unix(now, 0), time.Duration(params.HalfLifeSeconds)*time.Second)
-			decayedCredit += decayed
+			rawSent += raw
+			decayedSent += DecayedValue(raw, time.Unix(r.Timestamp, 0), time.Unix(now, 0), halfLife)
 		}
 	}
-	decayPenalty := rawCredit - decayedCredit
-	effectiveBalance := dripAllowance + diversityWeightedCredits - cumulativeReceived - decayPenalty
-	return effectiveBalance
+	return assembleBreakdown(
+		ComputeDripAllowance(time.Unix(deviceCreatedAt, 0), time.Unix(now, 0), params),
+		DiversityWeightedCredit(records, devicePubKey, params.WindowSize),
+		rawSent,
+		rawSent-ApplyPerPeerCaps(records, devicePubKey, params),
+		rawSent-decayedSent,
+		cumulativeReceived,
+		params,
+	)
+}
+
+func ComputeEffectiveBalance(records []*gen.ShareRecord, devicePubKey []byte, deviceCreatedAt int64, now int64, params CreditParams) int64 {
+	return ComputeBalanceBreakdown(records, devicePubKey, deviceCreatedAt, now, params).Effective
+}
+
+func assembleBreakdown(drip, diversity, rawSent, capReduction, decayPenalty, received int64, params CreditParams) BalanceBreakdown {
+	b := BalanceBreakdown{
+		DripAllowance:      drip,
+		DiversityCredit:    diversity,
+		RawSent:            rawSent,
+		CapReduction:       capReduction,
+		DecayPenalty:       decayPenalty,
+		CumulativeReceived: received,
+	}
+	b.Effective = b.effective(params)
+	return b
+}
+
+func (b BalanceBreakdown) effective(params CreditParams) int64 {
+	effective := b.DripAllowance + b.TrustedCredit() - b.CapReduction - b.DecayPenalty - b.CumulativeReceived
+	if effective > params.MaxBalance {
+		effective = params.MaxBalance
+	}
+	return effective
 }
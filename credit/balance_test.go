@@ -0,0 +1,141 @@
+package credit
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+var balanceDevice = []byte("dev")
+
+// randomHistory builds a history for balanceDevice from seed, oldest first, all before now.
+func randomHistory(seed int64, now int64) []*pb.ShareRecord {
+	rng := rand.New(rand.NewSource(seed))
+	n := rng.Intn(120)
+	records := make([]*pb.ShareRecord, 0, n)
+	for i := 0; i < n; i++ {
+		peer := []byte(fmt.Sprintf("peer-%d", rng.Intn(6)))
+		r := &pb.ShareRecord{
+			Id:             []byte(fmt.Sprintf("r-%d", i)),
+			SenderPubkey:   balanceDevice,
+			ReceiverPubkey: peer,
+			BytesTotal:     uint64(rng.Int63n(300 * MB)),
+			Timestamp:      now - rng.Int63n(365*86400),
+		}
+		if rng.Intn(3) == 0 {
+			r.SenderPubkey, r.ReceiverPubkey = peer, balanceDevice
+		}
+		records = append(records, r)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp < records[j].Timestamp })
+	return records
+}
+
+func TestBalanceBreakdownInvariants(t *testing.T) {
+	params := DefaultParams()
+	now := int64(1_800_000_000)
+	property := func(seed int64, age uint32) bool {
+		records := randomHistory(seed, now)
+		b := ComputeBalanceBreakdown(records, balanceDevice, now-int64(age), now, params)
+
+		formula := b.DripAllowance + b.DiversityCredit - b.CapReduction - b.DecayPenalty - b.CumulativeReceived
+		if formula > params.MaxBalance {
+			formula = params.MaxBalance
+		}
+		switch {
+		case b.Effective != formula:
+			t.Logf("effective %d does not follow the formula (%d)", b.Effective, formula)
+		case b.Effective > params.MaxBalance:
+			t.Logf("effective %d above MaxBalance", b.Effective)
+		case b.DripAllowance < 0 || b.DripAllowance > params.MaxBalance:
+			t.Logf("drip %d out of range", b.DripAllowance)
+		case b.CapReduction < 0 || b.CapReduction > b.RawSent:
+			t.Logf("cap reduction %d out of [0, %d]", b.CapReduction, b.RawSent)
+		case b.DecayPenalty < 0 || b.DecayPenalty > b.RawSent:
+			t.Logf("decay penalty %d out of [0, %d]", b.DecayPenalty, b.RawSent)
+		case b.DiversityCredit < 0 || b.DiversityCredit > b.RawSent:
+			t.Logf("diversity credit %d out of [0, %d]", b.DiversityCredit, b.RawSent)
+		case b.CappedCredit() != ApplyPerPeerCaps(records, balanceDevice, params):
+			t.Logf("capped credit %d disagrees with ApplyPerPeerCaps", b.CappedCredit())
+		default:
+			return true
+		}
+		return false
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBalanceBreakdownMonotonic(t *testing.T) {
+	params := DefaultParams()
+	// A window covering the whole history, so adding a record never pushes another out of it.
+	params.WindowSize = 1000
+	now := int64(1_800_000_000)
+	property := func(seed int64, received uint32, later uint32) bool {
+		records := randomHistory(seed, now)
+		createdAt := now - 30*86400
+		before := ComputeBalanceBreakdown(records, balanceDevice, createdAt, now, params)
+
+		more := append(append([]*pb.ShareRecord(nil), records...), &pb.ShareRecord{
+			Id:             []byte("extra"),
+			SenderPubkey:   []byte("peer-x"),
+			ReceiverPubkey: balanceDevice,
+			BytesTotal:     uint64(received),
+			Timestamp:      now,
+		})
+		if after := ComputeBalanceBreakdown(more, balanceDevice, createdAt, now, params); after.Effective > before.Effective {
+			t.Logf("receiving %d bytes raised the balance from %d to %d", received, before.Effective, after.Effective)
+			return false
+		}
+		if aged := ComputeBalanceBreakdown(records, balanceDevice, createdAt, now+int64(later), params); aged.DecayPenalty < before.DecayPenalty {
+			t.Logf("decay penalty fell from %d to %d as time passed", before.DecayPenalty, aged.DecayPenalty)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLedgerBreakdownMatchesFullComputation(t *testing.T) {
+	params := DefaultParams()
+	now := int64(1_800_000_000)
+	property := func(seed int64) bool {
+		records := randomHistory(seed, now)
+		// The ledger must not depend on the order records arrive in.
+		shuffled := append([]*pb.ShareRecord(nil), records...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		ledger := ReplayLedger(balanceDevice, shuffled, params)
+		if err := CrossCheckLedger(ledger, records, now); err != nil {
+			t.Log(err)
+			return false
+		}
+
+		window := records
+		if len(window) > int(params.WindowSize) {
+			window = window[len(window)-int(params.WindowSize):]
+		}
+		full := ComputeBalanceBreakdown(records, balanceDevice, now-86400, now, params)
+		got := ledger.Breakdown(window, now-86400, now, params)
+		diff := got.Effective - full.Effective
+		if diff < 0 {
+			diff = -diff
+		}
+		if got.DripAllowance != full.DripAllowance || got.DiversityCredit != full.DiversityCredit ||
+			got.CapReduction != full.CapReduction || got.CumulativeReceived != full.CumulativeReceived ||
+			diff > ledger.SentRecords+1 {
+			t.Logf("ledger breakdown %+v, full %+v", got, full)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -20,35 +20,63 @@ func ComputeCheckpoint(
 	params CreditParams,
 	witnesses []*pb.CheckpointWitness,
 ) (*pb.Checkpoint, CheckpointMetrics, error) {
-	var chainHead []byte
-	var recordIndex uint64
-	var cumulativeSent uint64
-	var cumulativeReceived uint64
-
+	var head *pb.ShareRecord
 	for _, r := range records {
 		if r == nil {
 			continue
 		}
-		if bytes.Equal(r.GetSenderPubkey(), devicePubKey) {
-			chainHead = r.GetId()
-			recordIndex = r.GetSenderRecordIndex()
-			cumulativeSent = r.GetSenderTotals().GetCumulativeSent()
-			cumulativeReceived = r.GetSenderTotals().GetCumulativeReceived()
-		} else if bytes.Equal(r.GetReceiverPubkey(), devicePubKey) {
-			chainHead = r.GetId()
-			recordIndex = r.GetReceiverRecordIndex()
-			cumulativeSent = r.GetReceiverTotals().GetCumulativeSent()
-			cumulativeReceived = r.GetReceiverTotals().GetCumulativeReceived()
+		if bytes.Equal(r.GetSenderPubkey(), devicePubKey) || bytes.Equal(r.GetReceiverPubkey(), devicePubKey) {
+			head = r
 		}
 	}
 
 	effective := ComputeEffectiveBalance(records, devicePubKey, now, now, params)
-	metrics := checkpointMetrics(witnesses, records, devicePubKey)
-	confidence := pb.ConfidenceLevel_CONFIDENCE_LOW
-	if metrics.WitnessCount >= 5 && metrics.ClusterCount >= 3 && metrics.FreshCount >= 2 {
-		confidence = pb.ConfidenceLevel_CONFIDENCE_HIGH
+	cp, metrics := newCheckpoint(head, devicePubKey, effective, now, witnesses, records)
+	return cp, metrics, nil
+}
+
+// LedgerCheckpoint is ComputeCheckpoint for a device whose history is folded into ledger. head is
+// the device's latest record and window its most recent records, oldest first.
+func LedgerCheckpoint(
+	ledger *Ledger,
+	window []*pb.ShareRecord,
+	head *pb.ShareRecord,
+	now int64,
+	params CreditParams,
+	witnesses []*pb.CheckpointWitness,
+) (*pb.Checkpoint, CheckpointMetrics, error) {
+	effective := ledger.EffectiveBalance(window, now, now, params)
+	cp, metrics := newCheckpoint(head, ledger.DevicePubkey, effective, now, witnesses, window)
+	return cp, metrics, nil
+}
+
+func newCheckpoint(
+	head *pb.ShareRecord,
+	devicePubKey []byte,
+	effective int64,
+	now int64,
+	witnesses []*pb.CheckpointWitness,
+	recentRecords []*pb.ShareRecord,
+) (*pb.Checkpoint, CheckpointMetrics) {
+	var chainHead []byte
+	var recordIndex uint64
+	var cumulativeSent uint64
+	var cumulativeReceived uint64
+
+	if bytes.Equal(head.GetSenderPubkey(), devicePubKey) {
+		chainHead = head.GetId()
+		recordIndex = head.GetSenderRecordIndex()
+		cumulativeSent = head.GetSenderTotals().GetCumulativeSent()
+		cumulativeReceived = head.GetSenderTotals().GetCumulativeReceived()
+	} else if bytes.Equal(head.GetReceiverPubkey(), devicePubKey) {
+		chainHead = head.GetId()
+		recordIndex = head.GetReceiverRecordIndex()
+		cumulativeSent = head.GetReceiverTotals().GetCumulativeSent()
+		cumulativeReceived = head.GetReceiverTotals().GetCumulativeReceived()
 	}
 
+	confidence, metrics := CheckpointConfidence(witnesses, recentRecords, devicePubKey)
+
 	cp := &pb.Checkpoint{
 		DevicePubkey: devicePubKey,
 		ChainHead:    chainHead,
@@ -62,7 +90,17 @@ func ComputeCheckpoint(
 		Witnesses:  witnesses,
 		Confidence: confidence,
 	}
-	return cp, metrics, nil
+	return cp, metrics
+}
+
+// CheckpointConfidence derives a checkpoint's confidence from its witnesses. Callers holding a
+// received checkpoint pass only the witnesses that verified (dag.VerifiedWitnesses).
+func CheckpointConfidence(witnesses []*pb.CheckpointWitness, recentRecords []*pb.ShareRecord, devicePubKey []byte) (pb.ConfidenceLevel, CheckpointMetrics) {
+	metrics := checkpointMetrics(witnesses, recentRecords, devicePubKey)
+	if metrics.WitnessCount >= 5 && metrics.ClusterCount >= 3 && metrics.FreshCount >= 2 {
+		return pb.ConfidenceLevel_CONFIDENCE_HIGH, metrics
+	}
+	return pb.ConfidenceLevel_CONFIDENCE_LOW, metrics
 }
 
 func checkpointMetrics(witnesses []*pb.CheckpointWitness, recentRecords []*pb.ShareRecord, devicePubKey []byte) CheckpointMetrics {
@@ -0,0 +1,217 @@
+package credit
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// Ledger holds the parts of a device's balance that fold one record at a time, so a balance
+// never needs the device's whole history. Records can be applied in any order.
+//
+// Decay is kept as a single sum scaled to DecayRef, the latest sent timestamp seen: every sent
+// record contributes bytes × 0.5^((DecayRef − t) / half-life), and moving to any later time is
+// one more multiplication.
+//
+// Per-peer caps need the bucket a sent record lands in, which the ledger does not keep; whoever
+// holds the history reports it through AddToBucket.
+type Ledger struct {
+	DevicePubkey       []byte
+	HalfLifeSeconds    int64
+	PerPeerCap         int64
+	EpochSeconds       int64
+	Records            int64
+	SentRecords        int64
+	CumulativeReceived int64
+	RawSent            int64
+	DecayedSent        float64
+	DecayRef           int64
+	CapReduction       int64
+}
+
+func NewLedger(devicePubKey []byte, params CreditParams) *Ledger {
+	return &Ledger{
+		DevicePubkey:    devicePubKey,
+		HalfLifeSeconds: params.HalfLifeSeconds,
+		PerPeerCap:      params.PerPeerCap,
+		EpochSeconds:    params.EpochSeconds,
+	}
+}
+
+// Matches reports whether the ledger was built with params' decay and cap settings.
+func (l *Ledger) Matches(params CreditParams) bool {
+	return l.HalfLifeSeconds == params.HalfLifeSeconds &&
+		l.PerPeerCap == params.PerPeerCap &&
+		l.EpochSeconds == params.EpochSeconds
+}
+
+// AddToBucket charges bytes sent to one peer within one epoch against the per-peer cap. before
+// is what that peer had already been sent in the epoch.
+func (l *Ledger) AddToBucket(before, bytes int64) {
+	l.CapReduction += l.capExcess(before+bytes) - l.capExcess(before)
+}
+
+// ReplayLedger builds a ledger from records, tracking the per-peer cap buckets itself.
+func ReplayLedger(devicePubKey []byte, records []*gen.ShareRecord, params CreditParams) *Ledger {
+	l := NewLedger(devicePubKey, params)
+	buckets := make(map[PeerEpoch]int64)
+	for _, r := range records {
+		l.Apply(r)
+		if bytes.Equal(r.GetSenderPubkey(), devicePubKey) {
+			key := l.Bucket(r)
+			l.AddToBucket(buckets[key], int64(r.GetBytesTotal()))
+			buckets[key] += int64(r.GetBytesTotal())
+		}
+	}
+	return l
+}
+
+// Bucket is the per-peer cap bucket a record the device sent falls in.
+func (l *Ledger) Bucket(r *gen.ShareRecord) PeerEpoch {
+	return PeerEpoch{peer: string(r.GetReceiverPubkey()), epoch: r.GetTimestamp() / l.EpochSeconds}
+}
+
+// Apply folds r into the ledger, except for its per-peer cap. Records the device is not a party
+// to are ignored.
+func (l *Ledger) Apply(r *gen.ShareRecord) {
+	sent := bytes.Equal(r.GetSenderPubkey(), l.DevicePubkey)
+	received := bytes.Equal(r.GetReceiverPubkey(), l.DevicePubkey)
+	if !sent && !received {
+		return
+	}
+	l.Records++
+	if received {
+		l.CumulativeReceived += int64(r.GetBytesTotal())
+	}
+	if !sent {
+		return
+	}
+	raw := int64(r.GetBytesTotal())
+	l.SentRecords++
+	l.RawSent += raw
+	t := r.GetTimestamp()
+	if l.SentRecords == 1 || t > l.DecayRef {
+		l.DecayedSent *= l.decayBetween(l.DecayRef, t)
+		l.DecayRef = t
+	}
+	l.DecayedSent += float64(raw) * l.decayBetween(t, l.DecayRef)
+}
+
+// Remove takes r back out of the ledger, except for its per-peer cap. r must have been applied.
+func (l *Ledger) Remove(r *gen.ShareRecord) {
+	sent := bytes.Equal(r.GetSenderPubkey(), l.DevicePubkey)
+	received := bytes.Equal(r.GetReceiverPubkey(), l.DevicePubkey)
+	if !sent && !received {
+		return
+	}
+	l.Records--
+	if received {
+		l.CumulativeReceived -= int64(r.GetBytesTotal())
+	}
+	if !sent {
+		return
+	}
+	raw := int64(r.GetBytesTotal())
+	l.SentRecords--
+	l.RawSent -= raw
+	l.DecayedSent -= float64(raw) * l.decayBetween(r.GetTimestamp(), l.DecayRef)
+	if l.SentRecords == 0 || l.DecayedSent < 0 {
+		l.DecayedSent = 0
+	}
+}
+
+// Merge adds other's totals to the ledger, as if every record of other had been applied to it.
+// Both must share decay settings. Cap reductions are added per ledger; a peer served by both
+// devices within one epoch is capped for each of them separately.
+func (l *Ledger) Merge(other *Ledger) {
+	l.Records += other.Records
+	l.CumulativeReceived += other.CumulativeReceived
+	l.CapReduction += other.CapReduction
+	if other.SentRecords == 0 {
+		return
+	}
+	if l.SentRecords == 0 || other.DecayRef > l.DecayRef {
+		l.DecayedSent *= l.decayBetween(l.DecayRef, other.DecayRef)
+		l.DecayRef = other.DecayRef
+	}
+	l.DecayedSent += other.DecayedSent * l.decayBetween(other.DecayRef, l.DecayRef)
+	l.SentRecords += other.SentRecords
+	l.RawSent += other.RawSent
+}
+
+// DecayedSentAt is the decayed value of everything sent, as seen at now.
+func (l *Ledger) DecayedSentAt(now int64) int64 {
+	return int64(l.DecayedSent * l.decayBetween(l.DecayRef, now))
+}
+
+// Breakdown matches ComputeBalanceBreakdown over the device's full history. window is the
+// device's most recent params.WindowSize records, oldest first, for the diversity term.
+func (l *Ledger) Breakdown(window []*gen.ShareRecord, deviceCreatedAt int64, now int64, params CreditParams) BalanceBreakdown {
+	return assembleBreakdown(
+		ComputeDripAllowance(time.Unix(deviceCreatedAt, 0), time.Unix(now, 0), params),
+		DiversityWeightedCredit(window, l.DevicePubkey, params.WindowSize),
+		l.RawSent,
+		l.CapReduction,
+		l.RawSent-l.DecayedSentAt(now),
+		l.CumulativeReceived,
+		params,
+	)
+}
+
+func (l *Ledger) EffectiveBalance(window []*gen.ShareRecord, deviceCreatedAt int64, now int64, params CreditParams) int64 {
+	return l.Breakdown(window, deviceCreatedAt, now, params).Effective
+}
+
+// CrossCheckLedger replays records, the device's whole history, and compares the result with
+// the ledger as seen at now. Counts, byte totals and the cap reduction must match exactly. The full computation
+// truncates each record's decayed value, so the decayed total may differ by less than a byte per
+// sent record, and only while no sent record is newer than now.
+func CrossCheckLedger(l *Ledger, records []*gen.ShareRecord, now int64) error {
+	params := CreditParams{HalfLifeSeconds: l.HalfLifeSeconds, PerPeerCap: l.PerPeerCap, EpochSeconds: l.EpochSeconds}
+	full := ReplayLedger(l.DevicePubkey, records, params)
+	var decayed int64
+	halfLife := time.Duration(l.HalfLifeSeconds) * time.Second
+	for _, r := range records {
+		if bytes.Equal(r.GetSenderPubkey(), l.DevicePubkey) {
+			decayed += DecayedValue(int64(r.GetBytesTotal()), time.Unix(r.GetTimestamp(), 0), time.Unix(now, 0), halfLife)
+		}
+	}
+	if full.Records != l.Records || full.SentRecords != l.SentRecords {
+		return fmt.Errorf("ledger holds %d records (%d sent), history has %d (%d sent)",
+			l.Records, l.SentRecords, full.Records, full.SentRecords)
+	}
+	if full.CumulativeReceived != l.CumulativeReceived || full.RawSent != l.RawSent {
+		return fmt.Errorf("ledger totals sent %d / received %d, history has %d / %d",
+			l.RawSent, l.CumulativeReceived, full.RawSent, full.CumulativeReceived)
+	}
+	if capped := full.RawSent - ApplyPerPeerCaps(records, l.DevicePubkey, params); capped != l.CapReduction {
+		return fmt.Errorf("ledger cap reduction %d, history has %d", l.CapReduction, capped)
+	}
+	diff := l.DecayedSentAt(now) - decayed
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > l.SentRecords+1 {
+		return fmt.Errorf("ledger decayed credit %d, history has %d", l.DecayedSentAt(now), decayed)
+	}
+	return nil
+}
+
+func (l *Ledger) capExcess(total int64) int64 {
+	if total > l.PerPeerCap {
+		return total - l.PerPeerCap
+	}
+	return 0
+}
+
+// decayBetween is the decay factor from one time to a later one. Like DecayFactor it never
+// grows a value: going back in time is a factor of one.
+func (l *Ledger) decayBetween(from, to int64) float64 {
+	if to <= from || l.HalfLifeSeconds <= 0 {
+		return 1.0
+	}
+	return math.Pow(0.5, float64(to-from)/float64(l.HalfLifeSeconds))
+}
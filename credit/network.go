@@ -0,0 +1,213 @@
+package credit
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultNetworkID names the network every node belongs to until it installs other parameters.
+const DefaultNetworkID = "default"
+
+// networkParamsDomain prefixed the legacy encoding; the canonical one is the next version.
+const (
+	networkParamsDomain          = "burnt-peanut/network-params/v1"
+	canonicalNetworkParamsDomain = "burnt-peanut/network-params/v2"
+)
+
+// ErrIncompatibleParams is returned for a peer whose network parameters cannot be reconciled
+// with ours: another network, another issuer, or different economics at a version we will not adopt.
+var ErrIncompatibleParams = errors.New("incompatible network parameters")
+
+// NetworkParamsSource is implemented by storage.Store in production.
+type NetworkParamsSource interface {
+	GetNetworkParams() (*pb.NetworkParams, error)
+}
+
+// DefaultNetworkParams is version 0 of the default network, wrapping DefaultParams. It is the
+// only unsigned parameter set.
+func DefaultNetworkParams() *pb.NetworkParams {
+	return &pb.NetworkParams{
+		NetworkId: DefaultNetworkID,
+		Version:   0,
+		Credit:    DefaultParams().Proto(),
+	}
+}
+
+func (c CreditParams) Proto() *pb.CreditParams {
+	return &pb.CreditParams{
+		DripRate:        c.DripRate,
+		MaxBalance:      c.MaxBalance,
+		WindowSize:      c.WindowSize,
+		HalfLifeSeconds: c.HalfLifeSeconds,
+		PerPeerCap:      c.PerPeerCap,
+		EpochSeconds:    c.EpochSeconds,
+	}
+}
+
+func ParamsFromProto(p *pb.CreditParams) CreditParams {
+	return CreditParams{
+		DripRate:        p.GetDripRate(),
+		MaxBalance:      p.GetMaxBalance(),
+		WindowSize:      p.GetWindowSize(),
+		HalfLifeSeconds: p.GetHalfLifeSeconds(),
+		PerPeerCap:      p.GetPerPeerCap(),
+		EpochSeconds:    p.GetEpochSeconds(),
+	}
+}
+
+func NetworkParamsSignableBytes(p *pb.NetworkParams) []byte {
+	if p.GetSigningVersion() == wire.LegacySigning {
+		return legacyNetworkParamsSignableBytes(p)
+	}
+	c := p.GetCredit()
+	credit := new(wire.Canonical).
+		Int64(1, c.GetDripRate()).
+		Int64(2, c.GetMaxBalance()).
+		Int64(3, int64(c.GetWindowSize())).
+		Int64(4, c.GetHalfLifeSeconds()).
+		Int64(5, c.GetPerPeerCap()).
+		Int64(6, c.GetEpochSeconds())
+	return wire.NewCanonical(canonicalNetworkParamsDomain).
+		String(1, p.GetNetworkId()).
+		Uint32(2, p.GetVersion()).
+		Message(3, credit).
+		Bytes(4, p.GetIssuerPubkey()).
+		Int64(5, p.GetIssuedAt()).
+		Encode()
+}
+
+func legacyNetworkParamsSignableBytes(p *pb.NetworkParams) []byte {
+	c := p.GetCredit()
+	buf := []byte(networkParamsDomain)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.GetNetworkId())))
+	buf = append(buf, p.GetNetworkId()...)
+	buf = binary.BigEndian.AppendUint32(buf, p.GetVersion())
+	for _, v := range []int64{
+		c.GetDripRate(), c.GetMaxBalance(), int64(c.GetWindowSize()),
+		c.GetHalfLifeSeconds(), c.GetPerPeerCap(), c.GetEpochSeconds(),
+	} {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v))
+	}
+	buf = append(buf, p.GetIssuerPubkey()...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(p.GetIssuedAt()))
+	return buf
+}
+
+// SignNetworkParams issues version of networkID's parameters, signed by the issuer.
+func SignNetworkParams(networkID string, version uint32, params CreditParams, issuerPubkey []byte, issuedAt int64, sign func([]byte) ([]byte, error)) (*pb.NetworkParams, error) {
+	if version == 0 {
+		return nil, fmt.Errorf("version 0 is reserved for the built-in parameters")
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	p := &pb.NetworkParams{
+		NetworkId:      networkID,
+		Version:        version,
+		Credit:         params.Proto(),
+		IssuerPubkey:   issuerPubkey,
+		IssuedAt:       issuedAt,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	sig, err := sign(NetworkParamsSignableBytes(p))
+	if err != nil {
+		return nil, err
+	}
+	p.Signature = sig
+	return p, nil
+}
+
+// ValidateNetworkParams checks p is either the built-in default or a valid signed version.
+func ValidateNetworkParams(p *pb.NetworkParams) error {
+	if p == nil {
+		return fmt.Errorf("network params are nil")
+	}
+	if p.GetNetworkId() == "" {
+		return fmt.Errorf("network id is required")
+	}
+	if p.GetCredit() == nil {
+		return fmt.Errorf("credit params are required")
+	}
+	if err := ParamsFromProto(p.GetCredit()).Validate(); err != nil {
+		return err
+	}
+	if p.GetVersion() == 0 {
+		if !proto.Equal(p, DefaultNetworkParams()) {
+			return fmt.Errorf("version 0 must be the built-in default parameters")
+		}
+		return nil
+	}
+	if err := wire.CheckSigningVersion(p.GetSigningVersion()); err != nil {
+		return err
+	}
+	ok, err := crypto.Verify(p.GetIssuerPubkey(), NetworkParamsSignableBytes(p), p.GetSignature())
+	if err != nil {
+		return fmt.Errorf("network params sig verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid network params signature")
+	}
+	return nil
+}
+
+// CheckCompatibility reports whether a peer running remote can be served by a node running
+// local. A peer that sends no parameters runs the built-in default. Peers agree when they run
+// the same network with the same economics. A newer version from the same issuer is
+// compatible too, and adopt tells the caller to switch to it; an older one is not, and the
+// peer will adopt ours when it sees them.
+func CheckCompatibility(local, remote *pb.NetworkParams) (adopt bool, err error) {
+	if local == nil {
+		local = DefaultNetworkParams()
+	}
+	if remote == nil {
+		remote = DefaultNetworkParams()
+	}
+	if err := ValidateNetworkParams(remote); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrIncompatibleParams, err)
+	}
+	if remote.GetNetworkId() != local.GetNetworkId() {
+		return false, fmt.Errorf("%w: peer runs network %q, we run %q", ErrIncompatibleParams, remote.GetNetworkId(), local.GetNetworkId())
+	}
+	sameIssuer := bytes.Equal(remote.GetIssuerPubkey(), local.GetIssuerPubkey())
+	newer := remote.GetVersion() > local.GetVersion()
+	if newer && sameIssuer && local.GetVersion() > 0 {
+		return true, nil
+	}
+	if proto.Equal(remote.GetCredit(), local.GetCredit()) {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: peer runs version %d of %q, we run version %d",
+		ErrIncompatibleParams, remote.GetVersion(), remote.GetNetworkId(), local.GetVersion())
+}
+
+// LocalNetworkParams returns the parameters src has installed, or the built-in default.
+func LocalNetworkParams(src NetworkParamsSource) (*pb.NetworkParams, error) {
+	if src == nil {
+		return DefaultNetworkParams(), nil
+	}
+	p, err := src.GetNetworkParams()
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultNetworkParams(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LocalParams returns the credit parameters src's network runs with.
+func LocalParams(src NetworkParamsSource) (CreditParams, error) {
+	p, err := LocalNetworkParams(src)
+	if err != nil {
+		return CreditParams{}, err
+	}
+	return ParamsFromProto(p.GetCredit()), nil
+}
@@ -0,0 +1,58 @@
+package credit
+
+import (
+	"bytes"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+FollowSuccession attributes records of every key in lineage to lineage[0], the device's current
+key, so credit earned before a key rotation carries forward. Records between two keys of the same
+lineage move no credit and are dropped.
+
+The rewritten records are copies that no longer verify; use them for credit only.
+*/
+func FollowSuccession(records []*gen.ShareRecord, lineage [][]byte) []*gen.ShareRecord {
+	if len(lineage) <= 1 {
+		return records
+	}
+	current := lineage[0]
+	inLineage := func(key []byte) bool {
+		for _, k := range lineage {
+			if bytes.Equal(k, key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := make([]*gen.ShareRecord, 0, len(records))
+	for _, r := range records {
+		sender, receiver := inLineage(r.GetSenderPubkey()), inLineage(r.GetReceiverPubkey())
+		switch {
+		case sender && receiver:
+			continue
+		case sender && !bytes.Equal(r.GetSenderPubkey(), current):
+			c := proto.Clone(r).(*gen.ShareRecord)
+			c.SenderPubkey = current
+			r = c
+		case receiver && !bytes.Equal(r.GetReceiverPubkey(), current):
+			c := proto.Clone(r).(*gen.ShareRecord)
+			c.ReceiverPubkey = current
+			r = c
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// ComputeLineageBalance is ComputeEffectiveBalance for a device that may have rotated its key:
+// lineage is its current key followed by the keys it succeeded.
+func ComputeLineageBalance(records []*gen.ShareRecord, lineage [][]byte, deviceCreatedAt int64, now int64, params CreditParams) int64 {
+	if len(lineage) == 0 {
+		return 0
+	}
+	return ComputeEffectiveBalance(FollowSuccession(records, lineage), lineage[0], deviceCreatedAt, now, params)
+}
@@ -0,0 +1,212 @@
+package credit
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+const (
+	// MaxTrustDistance is the furthest a device can be from us, in hops, and still earn trust.
+	// Devices we have met directly are one hop away.
+	MaxTrustDistance = 3
+	// ClusteringPenalty is the share of its trust a device loses when all of its counterparties
+	// also deal with each other, as a ring of colluding keys does.
+	ClusteringPenalty = 0.5
+)
+
+// TrustGraphSource is implemented by storage.Store in production.
+type TrustGraphSource interface {
+	GetRecentRecords(limit int) ([]*pb.ShareRecord, error)
+	GetRecentCheckpoints(limit int) ([]*pb.Checkpoint, error)
+}
+
+/*
+TrustGraph is the local view of who has dealt with whom. Devices are linked when they are the
+two parties of a share record, or when one witnessed the other's checkpoint.
+
+A device's trust score is in [0, 1]. It halves with every hop beyond the devices we met
+directly and is zero past MaxTrustDistance, so keys that only ever deal with each other earn
+nothing however much they share. It is then reduced by the device's clustering coefficient
+(how many of its counterparties also deal with each other), leaving out ourselves.
+*/
+type TrustGraph struct {
+	local     string
+	adjacent  map[string]map[string]struct{}
+	distances map[string]int
+}
+
+func NewTrustGraph(localPubkey []byte) *TrustGraph {
+	return &TrustGraph{
+		local:    string(localPubkey),
+		adjacent: make(map[string]map[string]struct{}),
+	}
+}
+
+// LoadTrustGraph builds the graph around localPubkey from src's limit most recent records and
+// checkpoints.
+func LoadTrustGraph(src TrustGraphSource, localPubkey []byte, limit int) (*TrustGraph, error) {
+	g := NewTrustGraph(localPubkey)
+	records, err := src.GetRecentRecords(limit)
+	if err != nil {
+		return nil, err
+	}
+	g.AddRecords(records)
+	checkpoints, err := src.GetRecentCheckpoints(limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range checkpoints {
+		g.AddCheckpoint(cp)
+	}
+	return g, nil
+}
+
+// Clone returns a copy of g that can be extended without changing g.
+func (g *TrustGraph) Clone() *TrustGraph {
+	c := NewTrustGraph([]byte(g.local))
+	for from, to := range g.adjacent {
+		edges := make(map[string]struct{}, len(to))
+		for n := range to {
+			edges[n] = struct{}{}
+		}
+		c.adjacent[from] = edges
+	}
+	return c
+}
+
+// IsLocal reports whether g is built around pubkey.
+func (g *TrustGraph) IsLocal(pubkey []byte) bool {
+	return g.local == string(pubkey)
+}
+
+func (g *TrustGraph) AddRecords(records []*pb.ShareRecord) {
+	for _, r := range records {
+		g.link(r.GetSenderPubkey(), r.GetReceiverPubkey())
+	}
+}
+
+// AddCheckpoint links cp's device to each witness whose signature verifies.
+func (g *TrustGraph) AddCheckpoint(cp *pb.Checkpoint) {
+	if cp == nil {
+		return
+	}
+	for _, w := range dag.VerifiedWitnesses(cp) {
+		g.link(cp.GetDevicePubkey(), w.GetWitnessPubkey())
+	}
+}
+
+// Distance is the number of hops from us to pubkey, or -1 when it cannot be reached.
+func (g *TrustGraph) Distance(pubkey []byte) int {
+	if g.distances == nil {
+		g.distances = g.walk()
+	}
+	d, ok := g.distances[string(pubkey)]
+	if !ok {
+		return -1
+	}
+	return d
+}
+
+// Clustering is the share of pairs of pubkey's counterparties, other than us, that are linked.
+func (g *TrustGraph) Clustering(pubkey []byte) float64 {
+	var neighbours []string
+	for n := range g.adjacent[string(pubkey)] {
+		if n != g.local {
+			neighbours = append(neighbours, n)
+		}
+	}
+	if len(neighbours) < 2 {
+		return 0
+	}
+	links := 0
+	for i, a := range neighbours {
+		for _, b := range neighbours[i+1:] {
+			if _, ok := g.adjacent[a][b]; ok {
+				links++
+			}
+		}
+	}
+	pairs := len(neighbours) * (len(neighbours) - 1) / 2
+	return float64(links) / float64(pairs)
+}
+
+// Score is pubkey's trust score. A nil graph trusts everyone fully.
+func (g *TrustGraph) Score(pubkey []byte) float64 {
+	if g == nil || string(pubkey) == g.local {
+		return 1.0
+	}
+	d := g.Distance(pubkey)
+	if d < 0 || d > MaxTrustDistance {
+		return 0
+	}
+	return math.Pow(0.5, float64(d-1)) * (1 - ClusteringPenalty*g.Clustering(pubkey))
+}
+
+// TrustWeightedCredit is DiversityWeightedCredit with each record's credit further scaled by
+// the trust score of its receiver.
+func TrustWeightedCredit(records []*pb.ShareRecord, devicePubKey []byte, windowSize int32, g *TrustGraph) int64 {
+	if int32(len(records)) > windowSize {
+		records = records[len(records)-int(windowSize):]
+	}
+
+	counts := make(map[string]int)
+	for _, r := range records {
+		if bytes.Equal(r.SenderPubkey, devicePubKey) {
+			counts[string(r.ReceiverPubkey)]++
+		}
+	}
+	scores := make(map[string]float64)
+	var total int64
+	for _, r := range records {
+		if !bytes.Equal(r.SenderPubkey, devicePubKey) {
+			continue
+		}
+		peer := string(r.ReceiverPubkey)
+		score, ok := scores[peer]
+		if !ok {
+			score = g.Score(r.ReceiverPubkey)
+			scores[peer] = score
+		}
+		total += int64(float64(int64(r.BytesTotal)/int64(counts[peer])) * score)
+	}
+	return total
+}
+
+func (g *TrustGraph) link(a, b []byte) {
+	if len(a) == 0 || len(b) == 0 || bytes.Equal(a, b) {
+		return
+	}
+	g.addEdge(string(a), string(b))
+	g.addEdge(string(b), string(a))
+	g.distances = nil
+}
+
+func (g *TrustGraph) addEdge(from, to string) {
+	if g.adjacent[from] == nil {
+		g.adjacent[from] = make(map[string]struct{})
+	}
+	g.adjacent[from][to] = struct{}{}
+}
+
+// walk finds every device's distance from us, breadth first, up to MaxTrustDistance.
+func (g *TrustGraph) walk() map[string]int {
+	distances := map[string]int{g.local: 0}
+	frontier := []string{g.local}
+	for d := 1; d <= MaxTrustDistance && len(frontier) > 0; d++ {
+		var next []string
+		for _, node := range frontier {
+			for n := range g.adjacent[node] {
+				if _, seen := distances[n]; seen {
+					continue
+				}
+				distances[n] = d
+				next = append(next, n)
+			}
+		}
+		frontier = next
+	}
+	return distances
+}
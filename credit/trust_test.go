@@ -0,0 +1,80 @@
+package credit
+
+import (
+	"testing"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func share(sender, receiver string, bytesTotal uint64) *pb.ShareRecord {
+	return &pb.ShareRecord{SenderPubkey: []byte(sender), ReceiverPubkey: []byte(receiver), BytesTotal: bytesTotal}
+}
+
+func TestTrustGraphScoresByDistanceAndClustering(t *testing.T) {
+	g := NewTrustGraph([]byte("me"))
+	g.AddRecords([]*pb.ShareRecord{
+		share("me", "alice", 1),
+		share("alice", "bob", 1),
+		share("bob", "carol", 1),
+		share("carol", "dave", 1),
+		// a ring of fresh keys that only deal with each other
+		share("s1", "s2", 1),
+		share("s2", "s3", 1),
+		share("s3", "s1", 1),
+	})
+
+	cases := []struct {
+		key   string
+		dist  int
+		score float64
+	}{
+		{"alice", 1, 1.0},
+		{"bob", 2, 0.5},
+		{"carol", 3, 0.25},
+		{"dave", -1, 0},
+		{"s1", -1, 0},
+	}
+	for _, c := range cases {
+		if d := g.Distance([]byte(c.key)); d != c.dist {
+			t.Fatalf("%s: expected distance %d, got %d", c.key, c.dist, d)
+		}
+		if s := g.Score([]byte(c.key)); s != c.score {
+			t.Fatalf("%s: expected score %v, got %v", c.key, c.score, s)
+		}
+	}
+	if c := g.Clustering([]byte("s1")); c != 1 {
+		t.Fatalf("expected a closed ring to be fully clustered, got %v", c)
+	}
+
+	// Once we meet one of the ring it is reachable, but its clustering still costs it.
+	g.AddRecords([]*pb.ShareRecord{share("s1", "me", 1)})
+	if s := g.Score([]byte("s1")); s != 1-ClusteringPenalty {
+		t.Fatalf("expected a clustered direct peer to score %v, got %v", 1-ClusteringPenalty, s)
+	}
+	if s := g.Score([]byte("alice")); s != 1.0 {
+		t.Fatalf("expected our own links not to count as clustering, got %v", s)
+	}
+}
+
+func TestWithTrustDiscountsUntrustedCounterparties(t *testing.T) {
+	params := DefaultParams()
+	g := NewTrustGraph([]byte("me"))
+	g.AddRecords([]*pb.ShareRecord{share("me", "alice", 1)})
+
+	records := []*pb.ShareRecord{
+		share("dev", "alice", 4*MB),
+		share("dev", "sybil", 4*MB),
+	}
+	plain := ComputeBalanceBreakdown(records, []byte("dev"), 0, 0, params)
+	trusted := plain.WithTrust(records, []byte("dev"), g, params)
+
+	if trusted.TrustDiscount != 4*MB {
+		t.Fatalf("expected the unreachable receiver's credit to be discounted, got %d", trusted.TrustDiscount)
+	}
+	if trusted.Effective != plain.Effective-4*MB {
+		t.Fatalf("expected effective %d, got %d", plain.Effective-4*MB, trusted.Effective)
+	}
+	if untouched := plain.WithTrust(records, []byte("dev"), nil, params); untouched != plain {
+		t.Fatalf("expected no graph to leave the breakdown unchanged")
+	}
+}
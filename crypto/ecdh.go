@@ -37,4 +37,13 @@ func DeriveSharedSecret(myPrivateKey []byte, peerPublicKey []byte) ([]byte, erro
 		return nil, err
 	}
 	return sharedSecret, nil
-}
\ No newline at end of file
+}
+
+// SessionPublicKey recovers the X25519 public key for a session private key.
+func SessionPublicKey(myPrivateKey []byte) ([]byte, error) {
+	privateKey, err := ecdh.X25519().NewPrivateKey(myPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.PublicKey().Bytes(), nil
+}
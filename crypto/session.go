@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+SessionCipher is the authenticated-encryption layer that sits on top of the X25519 handshake.
+
+both sides feed the same shared secret and the two ephemeral public keys into HKDF and get two
+AES-256-GCM keys, one per direction. the side with the lexicographically smaller ephemeral key
+sends with the first key and receives with the second; the other side does the opposite, so
+nobody has to agree on who "initiated" the connection.
+
+every sealed message carries a 64-bit counter. the counter is the GCM nonce for that direction
+and is also authenticated as associated data. the receiver only accepts counters strictly
+greater than the last one it accepted, which rejects replays and reordered frames.
+*/
+
+const (
+	sessionKeyInfo = "burnt-peanut/session/v1"
+	sessionKeySize = 32
+)
+
+var ErrReplayedMessage = errors.New("session message counter replayed or out of order")
+
+type SessionCipher struct {
+	mu          sync.Mutex
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	sendCounter uint64
+	recvCounter uint64
+}
+
+func NewSessionCipher(sharedSecret []byte, localEphemeral []byte, peerEphemeral []byte) (*SessionCipher, error) {
+	if len(sharedSecret) == 0 {
+		return nil, fmt.Errorf("shared secret is required")
+	}
+	if len(localEphemeral) == 0 || len(peerEphemeral) == 0 {
+		return nil, fmt.Errorf("both ephemeral public keys are required")
+	}
+
+	order := bytes.Compare(localEphemeral, peerEphemeral)
+	if order == 0 {
+		return nil, fmt.Errorf("local and peer ephemeral keys are identical")
+	}
+	low, high := localEphemeral, peerEphemeral
+	if order > 0 {
+		low, high = peerEphemeral, localEphemeral
+	}
+
+	salt := make([]byte, 0, len(low)+len(high))
+	salt = append(salt, low...)
+	salt = append(salt, high...)
+
+	keys, err := hkdf.Key(sha256.New, sharedSecret, salt, sessionKeyInfo, 2*sessionKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive session keys: %w", err)
+	}
+	lowToHigh, err := newGCM(keys[:sessionKeySize])
+	if err != nil {
+		return nil, err
+	}
+	highToLow, err := newGCM(keys[sessionKeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	if order < 0 {
+		return &SessionCipher{send: lowToHigh, recv: highToLow}, nil
+	}
+	return &SessionCipher{send: highToLow, recv: lowToHigh}, nil
+}
+
+// Seal encrypts plaintext under the next send counter.
+func (c *SessionCipher) Seal(plaintext []byte) (counter uint64, ciphertext []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sendCounter == ^uint64(0) {
+		return 0, nil, fmt.Errorf("session send counter exhausted")
+	}
+	c.sendCounter++
+	counter = c.sendCounter
+
+	nonce := sessionNonce(counter)
+	ciphertext = c.send.Seal(nil, nonce, plaintext, nonce)
+	return counter, ciphertext, nil
+}
+
+// Open authenticates and decrypts ciphertext. The counter is only committed once the
+// ciphertext authenticates, so a forged frame cannot burn counters for the real sender.
+func (c *SessionCipher) Open(counter uint64, ciphertext []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if counter <= c.recvCounter {
+		return nil, ErrReplayedMessage
+	}
+
+	nonce := sessionNonce(counter)
+	plaintext, err := c.recv.Open(nil, nonce, ciphertext, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("session message authentication failed")
+	}
+	c.recvCounter = counter
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 12-byte GCM nonce: 4 zero bytes followed by the big-endian counter.
+func sessionNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newSessionPair(t *testing.T) (*SessionCipher, *SessionCipher) {
+	t.Helper()
+	alicePub, alicePriv, err := GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	bobPub, bobPriv, err := GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	aliceShared, err := DeriveSharedSecret(alicePriv, bobPub)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	bobShared, err := DeriveSharedSecret(bobPriv, alicePub)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	alice, err := NewSessionCipher(aliceShared, alicePub, bobPub)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	bob, err := NewSessionCipher(bobShared, bobPub, alicePub)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	return alice, bob
+}
+
+func TestSessionCipherRoundTripBothDirections(t *testing.T) {
+	alice, bob := newSessionPair(t)
+
+	counter, ct, err := alice.Seal([]byte("hello bob"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pt, err := bob.Open(counter, ct)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(pt, []byte("hello bob")) {
+		t.Fatalf("expected plaintext to round-trip, got %q", pt)
+	}
+
+	counter, ct, err = bob.Seal([]byte("hello alice"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	pt, err = alice.Open(counter, ct)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !bytes.Equal(pt, []byte("hello alice")) {
+		t.Fatalf("expected plaintext to round-trip, got %q", pt)
+	}
+}
+
+func TestSessionCipherDirectionsUseDifferentKeys(t *testing.T) {
+	alice, _ := newSessionPair(t)
+
+	// alice must not be able to open her own outgoing traffic: a reflected frame is rejected.
+	counter, ct, err := alice.Seal([]byte("reflect me"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := alice.Open(counter, ct); err == nil {
+		t.Fatalf("expected reflected message to be rejected")
+	}
+}
+
+func TestSessionCipherRejectsTampering(t *testing.T) {
+	alice, bob := newSessionPair(t)
+
+	counter, ct, err := alice.Seal([]byte("chunk data"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	ct[0] ^= 0xff
+	if _, err := bob.Open(counter, ct); err == nil {
+		t.Fatalf("expected tampered ciphertext to be rejected")
+	}
+
+	// a forged frame must not burn the counter for the real sender.
+	ct[0] ^= 0xff
+	if _, err := bob.Open(counter, ct); err != nil {
+		t.Fatalf("expected original ciphertext to open, got %v", err)
+	}
+}
+
+func TestSessionCipherRejectsReplay(t *testing.T) {
+	alice, bob := newSessionPair(t)
+
+	c1, ct1, _ := alice.Seal([]byte("first"))
+	c2, ct2, _ := alice.Seal([]byte("second"))
+
+	if _, err := bob.Open(c2, ct2); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := bob.Open(c2, ct2); !errors.Is(err, ErrReplayedMessage) {
+		t.Fatalf("expected replay to be rejected, got %v", err)
+	}
+	if _, err := bob.Open(c1, ct1); !errors.Is(err, ErrReplayedMessage) {
+		t.Fatalf("expected out-of-order message to be rejected, got %v", err)
+	}
+}
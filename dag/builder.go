@@ -0,0 +1,139 @@
+package dag
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// ShareRecordParams is everything the sender needs to build the record for one transfer.
+// A nil head means the party has no records yet.
+type ShareRecordParams struct {
+	SenderPubkey   []byte
+	ReceiverPubkey []byte
+	SenderHead     *gen.ChainHead
+	ReceiverHead   *gen.ChainHead
+	Request        *gen.TransferRequest
+	Chunks         []*gen.ChunkData // the chunks actually delivered for Request
+	Visibility     gen.Visibility
+	Timestamp      int64
+	SigningVersion uint32 // the encoding both parties will sign, see wire.Protocol.SigningVersion
+}
+
+// BuildShareRecord links a new, unsigned record onto both parties' chains. Indices advance by one
+// from each head, the sender's cumulative sent and the receiver's cumulative received grow by
+// bytes_total, and request_hash commits to the signed request being settled.
+func BuildShareRecord(p ShareRecordParams) (*gen.ShareRecord, error) {
+	if len(p.SenderPubkey) == 0 || len(p.ReceiverPubkey) == 0 {
+		return nil, fmt.Errorf("sender and receiver pubkeys are required")
+	}
+	if bytes.Equal(p.SenderPubkey, p.ReceiverPubkey) {
+		return nil, fmt.Errorf("sender and receiver must differ")
+	}
+	if p.Request == nil {
+		return nil, fmt.Errorf("transfer request is required")
+	}
+	if len(p.Chunks) == 0 {
+		return nil, fmt.Errorf("no delivered chunks to record")
+	}
+
+	requestHash, err := RequestHash(p.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &gen.ShareRecord{
+		SenderPubkey:        p.SenderPubkey,
+		ReceiverPubkey:      p.ReceiverPubkey,
+		PrevSender:          p.SenderHead.GetRecordId(),
+		PrevReceiver:        p.ReceiverHead.GetRecordId(),
+		SenderRecordIndex:   p.SenderHead.GetIndex() + 1,
+		ReceiverRecordIndex: p.ReceiverHead.GetIndex() + 1,
+		RequestHash:         requestHash,
+		FileHash:            p.Request.GetFileHash(),
+		Timestamp:           p.Timestamp,
+		Visibility:          p.Visibility,
+		SigningVersion:      p.SigningVersion,
+	}
+	for _, ch := range p.Chunks {
+		h := crypto.Hash(ch.GetData())
+		record.ChunkHashes = append(record.ChunkHashes, h[:])
+		record.BytesTotal += uint64(len(ch.GetData()))
+	}
+
+	senderTotals := p.SenderHead.GetTotals()
+	receiverTotals := p.ReceiverHead.GetTotals()
+	record.SenderTotals = &gen.CumulativeTotals{
+		CumulativeSent:     senderTotals.GetCumulativeSent() + record.BytesTotal,
+		CumulativeReceived: senderTotals.GetCumulativeReceived(),
+	}
+	record.ReceiverTotals = &gen.CumulativeTotals{
+		CumulativeSent:     receiverTotals.GetCumulativeSent(),
+		CumulativeReceived: receiverTotals.GetCumulativeReceived() + record.BytesTotal,
+	}
+	return record, nil
+}
+
+// RequestHash is the hash a ShareRecord carries to commit to the request it settles. It covers
+// the request's signable bytes and its signature in the canonical encoding, so every
+// implementation derives the same hash however its protobuf library orders fields.
+func RequestHash(req *gen.TransferRequest) ([]byte, error) {
+	if req == nil {
+		return nil, fmt.Errorf("transfer request is nil")
+	}
+	h := crypto.Hash(wire.NewCanonical(requestHashDomain).
+		Bytes(1, TransferRequestSignableBytes(req)).
+		Bytes(2, req.GetSignature()).
+		Uint32(3, req.GetSigningVersion()).
+		Encode())
+	return h[:], nil
+}
+
+// HeadAfter returns the device's chain head once record is appended, or nil if the device is
+// not a party to it.
+func HeadAfter(r *gen.ShareRecord, devicePubkey []byte) *gen.ChainHead {
+	switch {
+	case bytes.Equal(r.GetSenderPubkey(), devicePubkey):
+		return &gen.ChainHead{RecordId: r.GetId(), Index: r.GetSenderRecordIndex(), Totals: r.GetSenderTotals()}
+	case bytes.Equal(r.GetReceiverPubkey(), devicePubkey):
+		return &gen.ChainHead{RecordId: r.GetId(), Index: r.GetReceiverRecordIndex(), Totals: r.GetReceiverTotals()}
+	default:
+		return nil
+	}
+}
+
+// CheckLinksTo reports whether record extends head for the device, i.e. it points at the head,
+// takes the next index and carries forward the head's totals.
+func CheckLinksTo(r *gen.ShareRecord, devicePubkey []byte, head *gen.ChainHead) error {
+	prev, index := deviceChainFields(r, devicePubkey)
+	if !bytes.Equal(prev, head.GetRecordId()) {
+		return fmt.Errorf("record does not link to chain head")
+	}
+	if index != head.GetIndex()+1 {
+		return fmt.Errorf("record index %d does not follow chain head %d", index, head.GetIndex())
+	}
+	return checkTotalsFollow(r, devicePubkey, head.GetTotals())
+}
+
+// checkTotalsFollow checks the device's totals on r grow from prev by exactly bytes_total, in the
+// column that matches the device's role.
+func checkTotalsFollow(r *gen.ShareRecord, devicePubkey []byte, prev *gen.CumulativeTotals) error {
+	sent, received := prev.GetCumulativeSent(), prev.GetCumulativeReceived()
+	got := r.GetReceiverTotals()
+	role := "receiver"
+	if bytes.Equal(r.GetSenderPubkey(), devicePubkey) {
+		sent += r.GetBytesTotal()
+		got = r.GetSenderTotals()
+		role = "sender"
+	} else {
+		received += r.GetBytesTotal()
+	}
+	if got.GetCumulativeSent() != sent || got.GetCumulativeReceived() != received {
+		return fmt.Errorf("%s totals sent=%d received=%d, expected sent=%d received=%d",
+			role, got.GetCumulativeSent(), got.GetCumulativeReceived(), sent, received)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package dag
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// ForkEvidenceSignableBytes is what the reporter signs. The records are covered by their ids,
+// which ValidateShareRecord recomputes from their content.
+func ForkEvidenceSignableBytes(e *gen.ForkEvidence) []byte {
+	if e.GetSigningVersion() == wire.LegacySigning {
+		return legacyForkEvidenceSignableBytes(e)
+	}
+	return wire.NewCanonical(forkEvidenceDomain).
+		Bytes(1, e.GetDevicePubkey()).
+		Bytes(2, e.GetRecordA().GetId()).
+		Bytes(3, e.GetRecordB().GetId()).
+		Bytes(4, e.GetReporterPubkey()).
+		Int64(6, e.GetDetectedAt()).
+		Bytes(7, e.GetSuccession().GetSignature()).
+		Bytes(9, e.GetConflictingSuccession().GetSignature()).
+		Encode()
+}
+
+func legacyForkEvidenceSignableBytes(e *gen.ForkEvidence) []byte {
+	var buf []byte
+	buf = append(buf, e.DevicePubkey...)
+	buf = append(buf, e.GetRecordA().GetId()...)
+	buf = append(buf, e.GetRecordB().GetId()...)
+	buf = append(buf, e.ReporterPubkey...)
+	buf = appendUint64(buf, uint64(e.DetectedAt))
+	// Evidence from a retired key also covers the succession that retired it.
+	if e.Succession != nil {
+		buf = append(buf, e.Succession.Signature...)
+	}
+	if e.ConflictingSuccession != nil {
+		buf = append(buf, e.ConflictingSuccession.Signature...)
+	}
+	return buf
+}
+
+/*
+ValidateForkEvidence checks that evidence actually proves a fork by the accused device:
+  - both records are dual-signed with valid ids and the device is a party to each
+  - both claim the same index in the device's chain but have different ids
+  - the reporter signed the evidence
+
+Evidence carrying a succession instead needs one dual-signed record that the device's retired
+key signed past the final head of that succession. Evidence carrying two successions needs both
+to be signed by the device's key and to differ.
+*/
+func ValidateForkEvidence(e *gen.ForkEvidence) error {
+	if e == nil {
+		return fmt.Errorf("fork evidence is nil")
+	}
+	if len(e.DevicePubkey) == 0 {
+		return fmt.Errorf("fork evidence has no device pubkey")
+	}
+	if e.ConflictingSuccession != nil {
+		if err := validateConflictingSuccessions(e); err != nil {
+			return err
+		}
+		return verifyReporterSig(e)
+	}
+	if e.Succession != nil {
+		if err := validateSuccessionFork(e); err != nil {
+			return err
+		}
+		return verifyReporterSig(e)
+	}
+	a, b := e.GetRecordA(), e.GetRecordB()
+	if a == nil || b == nil {
+		return fmt.Errorf("fork evidence needs two records")
+	}
+	for i, r := range []*gen.ShareRecord{a, b} {
+		name := [...]string{"record_a", "record_b"}[i]
+		if !bytes.Equal(r.SenderPubkey, e.DevicePubkey) && !bytes.Equal(r.ReceiverPubkey, e.DevicePubkey) {
+			return fmt.Errorf("%s does not involve the accused device", name)
+		}
+		if err := ValidateShareRecord(r); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if bytes.Equal(a.Id, b.Id) {
+		return fmt.Errorf("fork evidence records are the same record")
+	}
+	_, indexA := deviceChainFields(a, e.DevicePubkey)
+	_, indexB := deviceChainFields(b, e.DevicePubkey)
+	if indexA != indexB {
+		return fmt.Errorf("records are at different chain indices %d and %d", indexA, indexB)
+	}
+	if indexA == 0 {
+		return fmt.Errorf("records at index 0 carry no chain position")
+	}
+	return verifyReporterSig(e)
+}
+
+func validateSuccessionFork(e *gen.ForkEvidence) error {
+	if !bytes.Equal(e.Succession.GetOldPubkey(), e.DevicePubkey) {
+		return fmt.Errorf("succession does not retire the accused device")
+	}
+	if err := ValidateSuccessionRecord(e.Succession); err != nil {
+		return err
+	}
+	if e.GetRecordA() == nil {
+		return fmt.Errorf("succession fork evidence needs a record")
+	}
+	if err := ValidateShareRecord(e.GetRecordA()); err != nil {
+		return fmt.Errorf("record_a: %w", err)
+	}
+	if !PastFinalHead(e.GetRecordA(), e.Succession) {
+		return fmt.Errorf("record is not past the retired key's final head")
+	}
+	return nil
+}
+
+func validateConflictingSuccessions(e *gen.ForkEvidence) error {
+	for i, s := range []*gen.SuccessionRecord{e.Succession, e.ConflictingSuccession} {
+		name := [...]string{"succession", "conflicting_succession"}[i]
+		if !bytes.Equal(s.GetOldPubkey(), e.DevicePubkey) {
+			return fmt.Errorf("%s does not retire the accused device", name)
+		}
+		if err := ValidateSuccessionRecord(s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if bytes.Equal(e.Succession.GetSignature(), e.ConflictingSuccession.GetSignature()) {
+		return fmt.Errorf("fork evidence successions are the same succession")
+	}
+	return nil
+}
+
+func verifyReporterSig(e *gen.ForkEvidence) error {
+	if err := wire.CheckSigningVersion(e.GetSigningVersion()); err != nil {
+		return err
+	}
+	ok, err := crypto.Verify(e.ReporterPubkey, ForkEvidenceSignableBytes(e), e.ReporterSig)
+	if err != nil {
+		return fmt.Errorf("reporter sig verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid reporter signature")
+	}
+	return nil
+}
+
+// RecordsAtIndex returns the known records that claim index in devicePubkey's chain.
+type RecordsAtIndex func(devicePubkey []byte, index uint64) ([]*gen.ShareRecord, error)
+
+// DetectForks compares record against every known record at the same index of the sender's
+// chain and of the receiver's chain. It returns unsigned evidence, at most one per device.
+func DetectForks(record *gen.ShareRecord, lookup RecordsAtIndex) ([]*gen.ForkEvidence, error) {
+	if record == nil {
+		return nil, fmt.Errorf("record is nil")
+	}
+	var forks []*gen.ForkEvidence
+	for _, device := range [][]byte{record.SenderPubkey, record.ReceiverPubkey} {
+		_, index := deviceChainFields(record, device)
+		if index == 0 {
+			// Records at index 0 carry no chain position, so they cannot collide.
+			continue
+		}
+		known, err := lookup(device, index)
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range known {
+			if fork := DetectFork(existing, record, device); fork != nil {
+				forks = append(forks, fork)
+				break
+			}
+		}
+	}
+	return forks, nil
+}
@@ -6,10 +6,26 @@ import (
 	"fmt"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
+// Domain tags of the canonical encodings signed or hashed in this package.
+const (
+	shareRecordDomain       = "burnt-peanut/share-record/v1"
+	transferRequestDomain   = "burnt-peanut/transfer-request/v1"
+	fileMetaDomain          = "burnt-peanut/file-meta/v1"
+	checkpointDomain        = "burnt-peanut/checkpoint/v1"
+	checkpointWitnessDomain = "burnt-peanut/checkpoint-witness/v1"
+	successionDomain        = "burnt-peanut/succession/v1"
+	forkEvidenceDomain      = "burnt-peanut/fork-evidence/v1"
+	requestHashDomain       = "burnt-peanut/request-hash/v1"
+)
+
 func ValidateFileMeta(r *gen.FileMeta) error {
+	if err := wire.CheckSigningVersion(r.GetSigningVersion()); err != nil {
+		return err
+	}
 	message := FileMetaSignableBytes(r)
 	ok, err := crypto.Verify(r.OriginPubkey, message, r.OriginSig)
 	if err != nil {
@@ -22,6 +38,9 @@ func ValidateFileMeta(r *gen.FileMeta) error {
 }
 
 func ValidateTransferRequest(r *gen.TransferRequest) error {
+	if err := wire.CheckSigningVersion(r.GetSigningVersion()); err != nil {
+		return err
+	}
 	message := TransferRequestSignableBytes(r)
 	ok, err := crypto.Verify(r.RequesterPubkey, message, r.Signature)
 	if err != nil {
@@ -34,6 +53,9 @@ func ValidateTransferRequest(r *gen.TransferRequest) error {
 }
 
 func ValidateShareRecord(r *gen.ShareRecord) error {
+	if err := wire.CheckSigningVersion(r.GetSigningVersion()); err != nil {
+		return err
+	}
 	message := SignableBytes(r)
 	ok, err := crypto.Verify(r.SenderPubkey, message, r.SenderSig)
 	if err != nil {
@@ -58,7 +80,116 @@ func ValidateShareRecord(r *gen.ShareRecord) error {
 
 }
 
+// FileMetaSignableBytes is what the origin signs: every field but origin_sig, encoded as
+// r's signing version says.
 func FileMetaSignableBytes(r *gen.FileMeta) []byte {
+	if r.GetSigningVersion() == wire.LegacySigning {
+		return legacyFileMetaSignableBytes(r)
+	}
+	return wire.NewCanonical(fileMetaDomain).
+		Bytes(1, r.GetFileHash()).
+		String(2, r.GetFileName()).
+		Uint64(3, r.GetFileSize()).
+		Uint64(4, r.GetChunkSize()).
+		BytesList(5, r.GetChunkHashes()).
+		Bytes(6, r.GetOriginPubkey()).
+		Int64(8, r.GetCreatedAt()).
+		Encode()
+}
+
+// TransferRequestSignableBytes is what the requester signs: every field but the signature.
+// The capability's signature covers its whole delegation chain, so binding it is enough.
+func TransferRequestSignableBytes(r *gen.TransferRequest) []byte {
+	if r.GetSigningVersion() == wire.LegacySigning {
+		return legacyTransferRequestSignableBytes(r)
+	}
+	return wire.NewCanonical(transferRequestDomain).
+		Bytes(1, r.GetRequesterPubkey()).
+		Bytes(2, r.GetFileHash()).
+		Uint32List(3, r.GetChunkIndices()).
+		Bytes(4, r.GetNonce()).
+		Int64(5, r.GetTimestamp()).
+		Message(7, canonicalChainHead(r.GetRequesterHead())).
+		Bytes(8, r.GetCapability().GetSignature()).
+		Encode()
+}
+
+// SignableBytes is what both parties of a record sign, and what its id hashes: every field but
+// the id and the two signatures.
+func SignableBytes(r *gen.ShareRecord) []byte {
+	if r.GetSigningVersion() == wire.LegacySigning {
+		return legacySignableBytes(r)
+	}
+	return wire.NewCanonical(shareRecordDomain).
+		Bytes(2, r.GetSenderPubkey()).
+		Bytes(3, r.GetReceiverPubkey()).
+		Bytes(4, r.GetPrevSender()).
+		Bytes(5, r.GetPrevReceiver()).
+		Uint64(6, r.GetSenderRecordIndex()).
+		Uint64(7, r.GetReceiverRecordIndex()).
+		Message(8, canonicalTotals(r.GetSenderTotals())).
+		Message(9, canonicalTotals(r.GetReceiverTotals())).
+		Bytes(10, r.GetRequestHash()).
+		BytesList(11, r.GetChunkHashes()).
+		Uint64(12, r.GetBytesTotal()).
+		Int64(13, r.GetTimestamp()).
+		Bytes(16, r.GetFileHash()).
+		Uint32(17, uint32(r.GetVisibility())).
+		Encode()
+}
+
+func AttachSenderSig(r *gen.ShareRecord, sig []byte) {
+	r.SenderSig = sig
+}
+
+func AttachReceiverSig(r *gen.ShareRecord, sig []byte) {
+	r.ReceiverSig = sig
+	data := SignableBytes(r)
+	hash := crypto.Hash(data)
+	r.Id = hash[:]
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	return append(buf, b...)
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return append(buf, b...)
+}
+
+func appendTotals(buf []byte, t *gen.CumulativeTotals) []byte {
+	buf = appendUint64(buf, t.GetCumulativeSent())
+	buf = appendUint64(buf, t.GetCumulativeReceived())
+	return buf
+}
+
+func canonicalTotals(t *gen.CumulativeTotals) *wire.Canonical {
+	if t == nil {
+		return nil
+	}
+	return new(wire.Canonical).
+		Uint64(1, t.GetCumulativeSent()).
+		Uint64(2, t.GetCumulativeReceived())
+}
+
+func canonicalChainHead(h *gen.ChainHead) *wire.Canonical {
+	if h == nil {
+		return nil
+	}
+	return new(wire.Canonical).
+		Bytes(1, h.GetRecordId()).
+		Uint64(2, h.GetIndex()).
+		Message(3, canonicalTotals(h.GetTotals()))
+}
+
+// Legacy encodings, kept so structures signed before the canonical encoding still verify. They
+// concatenate fields without lengths and must not be used for new signatures.
+
+func legacyFileMetaSignableBytes(r *gen.FileMeta) []byte {
 	var buf []byte
 	buf = append(buf, r.FileHash...)
 	buf = append(buf, []byte(r.FileName)...)
@@ -73,7 +204,7 @@ func FileMetaSignableBytes(r *gen.FileMeta) []byte {
 	return buf
 }
 
-func TransferRequestSignableBytes(r *gen.TransferRequest) []byte {
+func legacyTransferRequestSignableBytes(r *gen.TransferRequest) []byte {
 	var buf []byte
 	buf = append(buf, r.RequesterPubkey...)
 	buf = append(buf, r.FileHash...)
@@ -83,9 +214,20 @@ func TransferRequestSignableBytes(r *gen.TransferRequest) []byte {
 	}
 	buf = append(buf, r.Nonce...)
 	buf = appendUint64(buf, uint64(r.Timestamp))
+	// Appended only when present so requests signed before the field existed still verify.
+	if h := r.RequesterHead; h != nil {
+		buf = append(buf, h.RecordId...)
+		buf = appendUint64(buf, h.Index)
+		buf = appendTotals(buf, h.GetTotals())
+	}
+	// The capability's signature covers the whole delegation chain, so binding it is enough.
+	if c := r.Capability; c != nil {
+		buf = append(buf, c.Signature...)
+	}
 	return buf
 }
-func SignableBytes(r *gen.ShareRecord) []byte {
+
+func legacySignableBytes(r *gen.ShareRecord) []byte {
 	var buf []byte
 	buf = append(buf, r.SenderPubkey...)
 	buf = append(buf, r.ReceiverPubkey...)
@@ -116,32 +258,3 @@ func SignableBytes(r *gen.ShareRecord) []byte {
 	buf = appendUint64(buf, uint64(r.Timestamp))
 	return buf
 }
-
-func AttachSenderSig(r *gen.ShareRecord, sig []byte) {
-	r.SenderSig = sig
-}
-
-func AttachReceiverSig(r *gen.ShareRecord, sig []byte) {
-	r.ReceiverSig = sig
-	data := SignableBytes(r)
-	hash := crypto.Hash(data)
-	r.Id = hash[:]
-}
-
-func appendUint64(buf []byte, value uint64) []byte {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, value)
-	return append(buf, b...)
-}
-
-func appendUint32(buf []byte, value uint32) []byte {
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, value)
-	return append(buf, b...)
-}
-
-func appendTotals(buf []byte, t *gen.CumulativeTotals) []byte {
-	buf = appendUint64(buf, t.CumulativeSent)
-	buf = appendUint64(buf, t.CumulativeReceived)
-	return buf
-}
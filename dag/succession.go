@@ -0,0 +1,99 @@
+package dag
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// SuccessionSignableBytes covers everything in a succession record except the signature.
+func SuccessionSignableBytes(s *gen.SuccessionRecord) []byte {
+	if s.GetSigningVersion() == wire.LegacySigning {
+		return legacySuccessionSignableBytes(s)
+	}
+	return wire.NewCanonical(successionDomain).
+		Bytes(1, s.GetOldPubkey()).
+		Bytes(2, s.GetNewPubkey()).
+		Int64(3, s.GetTimestamp()).
+		Message(4, canonicalChainHead(s.GetFinalHead())).
+		Encode()
+}
+
+func legacySuccessionSignableBytes(s *gen.SuccessionRecord) []byte {
+	var buf []byte
+	buf = append(buf, s.OldPubkey...)
+	buf = append(buf, s.NewPubkey...)
+	buf = appendUint64(buf, uint64(s.Timestamp))
+	buf = append(buf, s.GetFinalHead().GetRecordId()...)
+	buf = appendUint64(buf, s.GetFinalHead().GetIndex())
+	buf = appendTotals(buf, s.GetFinalHead().GetTotals())
+	return buf
+}
+
+func ValidateSuccessionRecord(s *gen.SuccessionRecord) error {
+	if s == nil {
+		return fmt.Errorf("succession record is nil")
+	}
+	if len(s.OldPubkey) == 0 || len(s.NewPubkey) == 0 {
+		return fmt.Errorf("succession record needs both keys")
+	}
+	if bytes.Equal(s.OldPubkey, s.NewPubkey) {
+		return fmt.Errorf("succession record does not change the key")
+	}
+	if err := wire.CheckSigningVersion(s.GetSigningVersion()); err != nil {
+		return err
+	}
+	ok, err := crypto.Verify(s.OldPubkey, SuccessionSignableBytes(s), s.Signature)
+	if err != nil {
+		return fmt.Errorf("succession sig verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid succession signature")
+	}
+	return nil
+}
+
+// PastFinalHead reports whether record extends the retired key's chain beyond the head it
+// handed over: a later index, or the final index with a different record.
+func PastFinalHead(record *gen.ShareRecord, s *gen.SuccessionRecord) bool {
+	old := s.GetOldPubkey()
+	if !bytes.Equal(record.GetSenderPubkey(), old) && !bytes.Equal(record.GetReceiverPubkey(), old) {
+		return false
+	}
+	_, index := deviceChainFields(record, old)
+	final := s.GetFinalHead()
+	if index > final.GetIndex() {
+		return true
+	}
+	return index == final.GetIndex() && index > 0 && !bytes.Equal(record.GetId(), final.GetRecordId())
+}
+
+// DetectSuccessionFork returns unsigned evidence when record was signed by a key after it was
+// retired by s, or nil.
+func DetectSuccessionFork(record *gen.ShareRecord, s *gen.SuccessionRecord) *gen.ForkEvidence {
+	if record == nil || s == nil || !PastFinalHead(record, s) {
+		return nil
+	}
+	return &gen.ForkEvidence{
+		DevicePubkey: s.GetOldPubkey(),
+		RecordA:      record,
+		Succession:   s,
+	}
+}
+
+// DetectConflictingSuccession returns unsigned evidence when a and b are two different
+// successions signed by the same key, or nil. A key is retired once; handing itself over twice
+// would give the device two histories.
+func DetectConflictingSuccession(a, b *gen.SuccessionRecord) *gen.ForkEvidence {
+	if a == nil || b == nil || !bytes.Equal(a.GetOldPubkey(), b.GetOldPubkey()) || bytes.Equal(a.GetSignature(), b.GetSignature()) {
+		return nil
+	}
+	return &gen.ForkEvidence{
+		DevicePubkey:          a.GetOldPubkey(),
+		Succession:            a,
+		ConflictingSuccession: b,
+	}
+}
@@ -0,0 +1,137 @@
+package dag
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// ViolationKind names the rule a record broke in ValidateChain.
+type ViolationKind string
+
+const (
+	ViolationNotParty  ViolationKind = "not_party"
+	ViolationSignature ViolationKind = "signature"
+	ViolationLink      ViolationKind = "link"
+	ViolationIndex     ViolationKind = "index"
+	ViolationTotals    ViolationKind = "totals"
+	ViolationTimestamp ViolationKind = "timestamp"
+	ViolationChunkHash ViolationKind = "chunk_hash"
+)
+
+// ChainViolation describes the first record that failed validation.
+type ChainViolation struct {
+	Position int // position of the record in the slice passed to ValidateChain
+	RecordID []byte
+	Index    uint64 // the device's index claimed by the record
+	Kind     ViolationKind
+	Detail   string
+}
+
+func (v *ChainViolation) Error() string {
+	return fmt.Sprintf("chain violation at position %d (index %d): %s: %s", v.Position, v.Index, v.Kind, v.Detail)
+}
+
+// ChainReport is the outcome of ValidateChain. Head is the device's head after the last record
+// that passed, so a caller can still trust the valid prefix of a chain.
+type ChainReport struct {
+	Checked   int
+	Head      *gen.ChainHead
+	Violation *ChainViolation
+}
+
+func (r *ChainReport) Valid() bool {
+	return r.Violation == nil
+}
+
+// FileMetaLookup returns the metadata for a file, or ok=false when it is not known locally.
+type FileMetaLookup func(fileHash []byte) (meta *gen.FileMeta, ok bool)
+
+/*
+ValidateChain walks a device's records from a trusted checkpoint and stops at the first violation.
+
+records must be the device's records in chain order, starting right after the checkpoint.
+a nil checkpoint means the walk starts at the genesis of the chain (no records, zero totals).
+
+for every record it checks:
+  - the device is the sender or receiver, and both signatures and the id are valid
+  - it links to the previous record and takes the next index
+  - the device's cumulative sent/received grow by exactly bytes_total in the device's role
+  - its timestamp is not earlier than the previous record (or the checkpoint)
+  - every chunk hash belongs to the file's FileMeta, when lookup knows the file
+
+files lookup does not know are not treated as violations; a device can share files we never saw.
+*/
+func ValidateChain(devicePubkey []byte, checkpoint *gen.Checkpoint, records []*gen.ShareRecord, lookup FileMetaLookup) *ChainReport {
+	report := &ChainReport{Head: &gen.ChainHead{}}
+	lastTimestamp := int64(0)
+	if checkpoint != nil {
+		report.Head = &gen.ChainHead{
+			RecordId: checkpoint.GetChainHead(),
+			Index:    checkpoint.GetRecordIndex(),
+			Totals:   checkpoint.GetTotals(),
+		}
+		lastTimestamp = checkpoint.GetTimestamp()
+	}
+
+	for pos, r := range records {
+		if v := checkRecord(r, devicePubkey, report.Head, lastTimestamp, lookup); v != nil {
+			v.Position = pos
+			v.RecordID = r.GetId()
+			if r != nil {
+				_, v.Index = deviceChainFields(r, devicePubkey)
+			}
+			report.Violation = v
+			return report
+		}
+		report.Head = HeadAfter(r, devicePubkey)
+		lastTimestamp = r.GetTimestamp()
+		report.Checked++
+	}
+	return report
+}
+
+func checkRecord(r *gen.ShareRecord, devicePubkey []byte, head *gen.ChainHead, lastTimestamp int64, lookup FileMetaLookup) *ChainViolation {
+	if r == nil {
+		return &ChainViolation{Kind: ViolationNotParty, Detail: "record is nil"}
+	}
+	if !bytes.Equal(r.GetSenderPubkey(), devicePubkey) && !bytes.Equal(r.GetReceiverPubkey(), devicePubkey) {
+		return &ChainViolation{Kind: ViolationNotParty, Detail: "device is neither sender nor receiver"}
+	}
+	if err := ValidateShareRecord(r); err != nil {
+		return &ChainViolation{Kind: ViolationSignature, Detail: err.Error()}
+	}
+
+	prev, index := deviceChainFields(r, devicePubkey)
+	if !bytes.Equal(prev, head.GetRecordId()) {
+		return &ChainViolation{Kind: ViolationLink, Detail: fmt.Sprintf("prev %x does not match head %x", prev, head.GetRecordId())}
+	}
+	if index != head.GetIndex()+1 {
+		return &ChainViolation{Kind: ViolationIndex, Detail: fmt.Sprintf("expected index %d", head.GetIndex()+1)}
+	}
+	if err := checkTotalsFollow(r, devicePubkey, head.GetTotals()); err != nil {
+		return &ChainViolation{Kind: ViolationTotals, Detail: err.Error()}
+	}
+	if r.GetTimestamp() < lastTimestamp {
+		return &ChainViolation{Kind: ViolationTimestamp, Detail: fmt.Sprintf("timestamp %d before previous %d", r.GetTimestamp(), lastTimestamp)}
+	}
+
+	if lookup == nil {
+		return nil
+	}
+	meta, ok := lookup(r.GetFileHash())
+	if !ok {
+		return nil
+	}
+	known := make(map[string]struct{}, len(meta.GetChunkHashes()))
+	for _, h := range meta.GetChunkHashes() {
+		known[string(h)] = struct{}{}
+	}
+	for i, h := range r.GetChunkHashes() {
+		if _, ok := known[string(h)]; !ok {
+			return &ChainViolation{Kind: ViolationChunkHash, Detail: fmt.Sprintf("chunk hash %d is not part of file %x", i, r.GetFileHash())}
+		}
+	}
+	return nil
+}
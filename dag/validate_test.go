@@ -0,0 +1,328 @@
+package dag
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+type testParty struct {
+	pub  []byte
+	priv []byte
+	head *gen.ChainHead
+}
+
+func newTestParty(t *testing.T) *testParty {
+	t.Helper()
+	pub, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
+	return &testParty{pub: pub, priv: priv}
+}
+
+// share builds a co-signed record for data flowing from sender to receiver and advances both heads.
+// mutate, when set, runs before signing.
+func share(t *testing.T, sender, receiver *testParty, data []byte, ts int64, mutate func(*gen.ShareRecord)) *gen.ShareRecord {
+	t.Helper()
+	r, err := BuildShareRecord(ShareRecordParams{
+		SenderPubkey:   sender.pub,
+		ReceiverPubkey: receiver.pub,
+		SenderHead:     sender.head,
+		ReceiverHead:   receiver.head,
+		Request:        &gen.TransferRequest{RequesterPubkey: receiver.pub, FileHash: []byte("file"), Timestamp: ts},
+		Chunks:         []*gen.ChunkData{{Data: data}},
+		Timestamp:      ts,
+	})
+	if err != nil {
+		t.Fatalf("build record: %v", err)
+	}
+	if mutate != nil {
+		mutate(r)
+	}
+	senderSig, _ := crypto.Sign(sender.priv, SignableBytes(r))
+	AttachSenderSig(r, senderSig)
+	receiverSig, _ := crypto.Sign(receiver.priv, SignableBytes(r))
+	AttachReceiverSig(r, receiverSig)
+	sender.head = HeadAfter(r, sender.pub)
+	receiver.head = HeadAfter(r, receiver.pub)
+	return r
+}
+
+func TestValidateChainAcceptsConsistentChain(t *testing.T) {
+	device, b, c := newTestParty(t), newTestParty(t), newTestParty(t)
+	records := []*gen.ShareRecord{
+		share(t, device, b, []byte("aaaa"), 10, nil),
+		share(t, c, device, []byte("bb"), 20, nil),
+		share(t, device, c, []byte("c"), 20, nil),
+	}
+
+	report := ValidateChain(device.pub, nil, records, nil)
+	if !report.Valid() {
+		t.Fatalf("expected valid chain, got %v", report.Violation)
+	}
+	if report.Checked != 3 || report.Head.GetIndex() != 3 {
+		t.Fatalf("expected 3 records checked up to index 3, got %d / %d", report.Checked, report.Head.GetIndex())
+	}
+	if report.Head.GetTotals().GetCumulativeSent() != 5 || report.Head.GetTotals().GetCumulativeReceived() != 2 {
+		t.Fatalf("unexpected final totals %v", report.Head.GetTotals())
+	}
+}
+
+func TestValidateChainStartsFromCheckpoint(t *testing.T) {
+	device, b := newTestParty(t), newTestParty(t)
+	device.head = &gen.ChainHead{RecordId: []byte("checkpointed"), Index: 7, Totals: &gen.CumulativeTotals{CumulativeSent: 100}}
+	records := []*gen.ShareRecord{share(t, device, b, []byte("x"), 50, nil)}
+	cp := &gen.Checkpoint{ChainHead: []byte("checkpointed"), RecordIndex: 7, Totals: &gen.CumulativeTotals{CumulativeSent: 100}, Timestamp: 40}
+
+	if report := ValidateChain(device.pub, cp, records, nil); !report.Valid() {
+		t.Fatalf("expected chain to continue from checkpoint, got %v", report.Violation)
+	}
+
+	cp.Timestamp = 60
+	report := ValidateChain(device.pub, cp, records, nil)
+	if report.Valid() || report.Violation.Kind != ViolationTimestamp {
+		t.Fatalf("expected timestamp violation, got %v", report.Violation)
+	}
+}
+
+func TestValidateChainReportsFirstViolation(t *testing.T) {
+	device, b := newTestParty(t), newTestParty(t)
+	good := share(t, device, b, []byte("aaaa"), 10, nil)
+	inflated := share(t, device, b, []byte("bb"), 20, func(r *gen.ShareRecord) {
+		r.SenderTotals.CumulativeSent += 1000
+	})
+	backdated := share(t, device, b, []byte("c"), 5, nil)
+
+	report := ValidateChain(device.pub, nil, []*gen.ShareRecord{good, inflated, backdated}, nil)
+	if report.Valid() {
+		t.Fatalf("expected a violation")
+	}
+	v := report.Violation
+	if v.Kind != ViolationTotals || v.Position != 1 || v.Index != 2 || report.Checked != 1 {
+		t.Fatalf("expected totals violation at position 1, got %+v (checked %d)", v, report.Checked)
+	}
+	if report.Head.GetIndex() != 1 {
+		t.Fatalf("expected head to stop at the last valid record, got index %d", report.Head.GetIndex())
+	}
+
+	report = ValidateChain(device.pub, nil, []*gen.ShareRecord{good, good}, nil)
+	if report.Valid() || report.Violation.Kind != ViolationLink {
+		t.Fatalf("expected link violation for a repeated record, got %v", report.Violation)
+	}
+}
+
+func TestValidateChainChecksChunkHashesAgainstFileMeta(t *testing.T) {
+	device, b := newTestParty(t), newTestParty(t)
+	records := []*gen.ShareRecord{share(t, device, b, []byte("data"), 10, nil)}
+	meta := &gen.FileMeta{FileHash: []byte("file")}
+	lookup := func(fileHash []byte) (*gen.FileMeta, bool) {
+		return meta, string(fileHash) == "file"
+	}
+
+	report := ValidateChain(device.pub, nil, records, lookup)
+	if report.Valid() || report.Violation.Kind != ViolationChunkHash {
+		t.Fatalf("expected chunk hash violation, got %v", report.Violation)
+	}
+
+	h := crypto.Hash([]byte("data"))
+	meta.ChunkHashes = [][]byte{h[:]}
+	if report := ValidateChain(device.pub, nil, records, lookup); !report.Valid() {
+		t.Fatalf("expected chunk hashes to match file meta, got %v", report.Violation)
+	}
+}
+
+func TestValidateForkEvidence(t *testing.T) {
+	device, b, reporter := newTestParty(t), newTestParty(t), newTestParty(t)
+	first := share(t, device, b, []byte("one"), 10, nil)
+	device.head, b.head = nil, nil
+	second := share(t, device, b, []byte("two"), 10, nil)
+
+	fork := DetectFork(first, second, device.pub)
+	if fork == nil {
+		t.Fatalf("expected records at the same index to be detected as a fork")
+	}
+	fork.ReporterPubkey = reporter.pub
+	fork.DetectedAt = 20
+	fork.ReporterSig, _ = crypto.Sign(reporter.priv, ForkEvidenceSignableBytes(fork))
+	if err := ValidateForkEvidence(fork); err != nil {
+		t.Fatalf("expected valid fork evidence, got %v", err)
+	}
+
+	fork.DevicePubkey = b.pub
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected evidence re-targeted at another device to fail")
+	}
+	fork.DevicePubkey = device.pub
+
+	fork.RecordB = first
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected the same record twice to fail")
+	}
+	fork.RecordB = second
+
+	second.BytesTotal++
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected a tampered record to fail")
+	}
+}
+
+func TestIndexZeroRecordsAreNotForks(t *testing.T) {
+	device, b, reporter := newTestParty(t), newTestParty(t), newTestParty(t)
+	unindexed := func(r *gen.ShareRecord) { r.SenderRecordIndex, r.ReceiverRecordIndex = 0, 0 }
+	first := share(t, device, b, []byte("one"), 10, unindexed)
+	second := share(t, device, b, []byte("two"), 10, unindexed)
+
+	lookup := func([]byte, uint64) ([]*gen.ShareRecord, error) { return []*gen.ShareRecord{first}, nil }
+	forks, err := DetectForks(second, lookup)
+	if err != nil {
+		t.Fatalf("detect forks: %v", err)
+	}
+	if len(forks) != 0 {
+		t.Fatalf("expected no forks for index-0 records, got %d", len(forks))
+	}
+
+	fork := &gen.ForkEvidence{DevicePubkey: device.pub, RecordA: first, RecordB: second, ReporterPubkey: reporter.pub, DetectedAt: 20}
+	fork.ReporterSig, _ = crypto.Sign(reporter.priv, ForkEvidenceSignableBytes(fork))
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected index-0 evidence to be rejected")
+	}
+}
+
+func TestSuccessionForkEvidence(t *testing.T) {
+	device, successor, b, reporter := newTestParty(t), newTestParty(t), newTestParty(t), newTestParty(t)
+	history := share(t, device, b, []byte("before"), 10, nil)
+
+	succession := &gen.SuccessionRecord{
+		OldPubkey: device.pub,
+		NewPubkey: successor.pub,
+		Timestamp: 20,
+		FinalHead: device.head,
+	}
+	succession.Signature, _ = crypto.Sign(device.priv, SuccessionSignableBytes(succession))
+	if err := ValidateSuccessionRecord(succession); err != nil {
+		t.Fatalf("expected valid succession, got %v", err)
+	}
+	if DetectSuccessionFork(history, succession) != nil {
+		t.Fatalf("records up to the final head are history, not a fork")
+	}
+
+	late := share(t, b, device, []byte("after"), 30, nil)
+	fork := DetectSuccessionFork(late, succession)
+	if fork == nil {
+		t.Fatalf("expected a record signed by the retired key to be a fork")
+	}
+	fork.ReporterPubkey = reporter.pub
+	fork.DetectedAt = 40
+	fork.ReporterSig, _ = crypto.Sign(reporter.priv, ForkEvidenceSignableBytes(fork))
+	if err := ValidateForkEvidence(fork); err != nil {
+		t.Fatalf("expected valid succession fork evidence, got %v", err)
+	}
+
+	fork.RecordA = history
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected evidence built from pre-rotation history to fail")
+	}
+
+	succession.NewPubkey = b.pub
+	if err := ValidateSuccessionRecord(succession); err == nil {
+		t.Fatalf("expected a redirected succession to fail")
+	}
+}
+
+func TestConflictingSuccessionEvidence(t *testing.T) {
+	device, first, second, reporter := newTestParty(t), newTestParty(t), newTestParty(t), newTestParty(t)
+	handOver := func(to *testParty) *gen.SuccessionRecord {
+		s := &gen.SuccessionRecord{OldPubkey: device.pub, NewPubkey: to.pub, Timestamp: 20, FinalHead: device.head}
+		s.Signature, _ = crypto.Sign(device.priv, SuccessionSignableBytes(s))
+		return s
+	}
+	a, b := handOver(first), handOver(second)
+	if DetectConflictingSuccession(a, a) != nil {
+		t.Fatalf("a succession does not conflict with itself")
+	}
+
+	fork := DetectConflictingSuccession(a, b)
+	if fork == nil {
+		t.Fatalf("expected two successions from one key to be a fork")
+	}
+	fork.ReporterPubkey = reporter.pub
+	fork.DetectedAt = 40
+	fork.ReporterSig, _ = crypto.Sign(reporter.priv, ForkEvidenceSignableBytes(fork))
+	if err := ValidateForkEvidence(fork); err != nil {
+		t.Fatalf("expected valid conflicting succession evidence, got %v", err)
+	}
+
+	fork.ConflictingSuccession = a
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected evidence repeating one succession to fail")
+	}
+	fork.ConflictingSuccession = b
+	b.NewPubkey = first.pub
+	if err := ValidateForkEvidence(fork); err == nil {
+		t.Fatalf("expected a tampered succession to fail")
+	}
+}
+
+func TestShareRecordSigningVersions(t *testing.T) {
+	a, b := newTestParty(t), newTestParty(t)
+	legacy := share(t, a, b, []byte("legacy"), 10, nil)
+	if err := ValidateShareRecord(legacy); err != nil {
+		t.Fatalf("expected a legacy record to keep verifying: %v", err)
+	}
+
+	canonical := share(t, a, b, []byte("canonical"), 20, func(r *gen.ShareRecord) {
+		r.SigningVersion = wire.CanonicalSigning
+	})
+	if err := ValidateShareRecord(canonical); err != nil {
+		t.Fatalf("expected a canonical record to verify: %v", err)
+	}
+
+	downgraded := proto.Clone(canonical).(*gen.ShareRecord)
+	downgraded.SigningVersion = wire.LegacySigning
+	if err := ValidateShareRecord(downgraded); err == nil {
+		t.Fatalf("expected a canonical signature not to verify as legacy")
+	}
+
+	unknown := proto.Clone(canonical).(*gen.ShareRecord)
+	unknown.SigningVersion = wire.CanonicalSigning + 1
+	if err := ValidateShareRecord(unknown); !errors.Is(err, wire.ErrSigningVersion) {
+		t.Fatalf("expected ErrSigningVersion, got %v", err)
+	}
+}
+
+func TestRequestHashCoversTheSignedRequestOnly(t *testing.T) {
+	requester := newTestParty(t)
+	req := &gen.TransferRequest{
+		RequesterPubkey: requester.pub,
+		FileHash:        []byte("file"),
+		ChunkIndices:    []uint32{0, 1},
+		Nonce:           []byte("nonce"),
+		Timestamp:       10,
+		SigningVersion:  wire.CanonicalSigning,
+	}
+	req.Signature, _ = crypto.Sign(requester.priv, TransferRequestSignableBytes(req))
+	want, err := RequestHash(req)
+	if err != nil {
+		t.Fatalf("request hash: %v", err)
+	}
+
+	// Fields a newer peer adds change the protobuf bytes but not what the requester signed.
+	extended := proto.Clone(req).(*gen.TransferRequest)
+	extended.ProtoReflect().SetUnknown(protowire.AppendBytes(protowire.AppendTag(nil, 99, protowire.BytesType), []byte("x")))
+	if got, _ := RequestHash(extended); !bytes.Equal(got, want) {
+		t.Fatalf("expected unknown fields to leave the request hash unchanged")
+	}
+
+	resigned := proto.Clone(req).(*gen.TransferRequest)
+	resigned.Signature, _ = crypto.Sign(newTestParty(t).priv, TransferRequestSignableBytes(resigned))
+	if got, _ := RequestHash(resigned); bytes.Equal(got, want) {
+		t.Fatalf("expected another signature to change the request hash")
+	}
+}
@@ -6,15 +6,51 @@ import (
 	"fmt"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
 )
 
+const (
+	capabilityDomain = "burnt-peanut/file-capability/v1"
+	revocationDomain = "burnt-peanut/capability-revocation/v1"
+)
+
+// CapabilityScope limits what a capability grants. The zero value grants the whole file without
+// a usage limit.
+type CapabilityScope struct {
+	ChunkRanges  []*pb.ChunkRange
+	MaxDownloads uint32
+	MaxBytes     uint64
+}
+
+func (scope CapabilityScope) apply(cap *pb.FileCapability) {
+	for _, r := range scope.ChunkRanges {
+		cap.ChunkRanges = append(cap.ChunkRanges, &pb.ChunkRange{Start: r.GetStart(), End: r.GetEnd()})
+	}
+	cap.MaxDownloads = scope.MaxDownloads
+	cap.MaxBytes = scope.MaxBytes
+}
+
 func CreateCapability(
 	fileHash []byte,
 	grantedTo []byte,
 	grantedByPubKey []byte,
 	grantedByPrivateKey []byte,
 	expiresAt int64,
+) (*pb.FileCapability, error) {
+	return CreateScopedCapability(fileHash, grantedTo, grantedByPubKey, grantedByPrivateKey, expiresAt, CapabilityScope{})
+}
+
+// CreateScopedCapability grants fileHash restricted to scope.
+func CreateScopedCapability(
+	fileHash []byte,
+	grantedTo []byte,
+	grantedByPubKey []byte,
+	grantedByPrivateKey []byte,
+	expiresAt int64,
+	scope CapabilityScope,
 ) (*pb.FileCapability, error) {
 	if len(fileHash) == 0 {
 		return nil, fmt.Errorf("file hash is required")
@@ -30,10 +66,15 @@ func CreateCapability(
 	}
 
 	cap := &pb.FileCapability{
-		FileHash:  append([]byte(nil), fileHash...),
-		GrantedTo: append([]byte(nil), grantedTo...),
-		GrantedBy: append([]byte(nil), grantedByPubKey...),
-		ExpiresAt: expiresAt,
+		FileHash:       append([]byte(nil), fileHash...),
+		GrantedTo:      append([]byte(nil), grantedTo...),
+		GrantedBy:      append([]byte(nil), grantedByPubKey...),
+		ExpiresAt:      expiresAt,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	scope.apply(cap)
+	if err := validateChunkRanges(cap); err != nil {
+		return nil, err
 	}
 
 	signable := capabilitySignableBytes(cap)
@@ -58,9 +99,15 @@ func ValidateCapability(capability *pb.FileCapability, requesterPubKey []byte, n
 	if len(capability.GetSignature()) == 0 {
 		return fmt.Errorf("capability signature is required")
 	}
+	if err := wire.CheckSigningVersion(capability.GetSigningVersion()); err != nil {
+		return err
+	}
 	if capability.GetExpiresAt() <= now {
 		return fmt.Errorf("capability expired")
 	}
+	if err := validateChunkRanges(capability); err != nil {
+		return err
+	}
 
 	// Targeted token: granted_to must match requester.
 	// Bearer token: granted_to is empty.
@@ -79,7 +126,299 @@ func ValidateCapability(capability *pb.FileCapability, requesterPubKey []byte, n
 	return nil
 }
 
+// MaxDelegationDepth bounds how many times a capability may be re-granted below its root.
+const MaxDelegationDepth = 8
+
+// DelegateCapability re-grants parent to grantedTo. The delegator is parent's grantee, signs
+// with its own key, and cannot extend the parent's expiry. scope can only narrow the grant:
+// the parent's own limits keep applying to everything delegated from it.
+func DelegateCapability(
+	parent *pb.FileCapability,
+	grantedTo []byte,
+	delegatorPrivateKey []byte,
+	expiresAt int64,
+	scope CapabilityScope,
+) (*pb.FileCapability, error) {
+	if parent == nil {
+		return nil, fmt.Errorf("parent capability is required")
+	}
+	if len(parent.GetGrantedTo()) == 0 {
+		return nil, fmt.Errorf("a bearer capability cannot be delegated")
+	}
+	if len(delegatorPrivateKey) == 0 {
+		return nil, fmt.Errorf("delegator private key is required")
+	}
+	if expiresAt <= 0 || expiresAt > parent.GetExpiresAt() {
+		return nil, fmt.Errorf("delegated expiry must be within the parent's expiry")
+	}
+
+	cap := &pb.FileCapability{
+		FileHash:       append([]byte(nil), parent.GetFileHash()...),
+		GrantedTo:      append([]byte(nil), grantedTo...),
+		GrantedBy:      append([]byte(nil), parent.GetGrantedTo()...),
+		ExpiresAt:      expiresAt,
+		Parent:         parent,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	scope.apply(cap)
+	if err := validateChunkRanges(cap); err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(delegatorPrivateKey, capabilitySignableBytes(cap))
+	if err != nil {
+		return nil, fmt.Errorf("sign capability: %w", err)
+	}
+	cap.Signature = sig
+	return cap, nil
+}
+
+// AttachFileMeta gives the grantee the file's metadata with the capability, since a private
+// file is never gossiped. The signature does not cover it, so a signed capability can carry it.
+func AttachFileMeta(capability *pb.FileCapability, meta *pb.FileMeta) error {
+	if capability == nil || meta == nil {
+		return fmt.Errorf("capability and file metadata are required")
+	}
+	if !bytes.Equal(meta.GetFileHash(), capability.GetFileHash()) {
+		return fmt.Errorf("file metadata is for a different file")
+	}
+	capability.FileMeta = meta
+	return nil
+}
+
+// GrantedFileMeta returns the file metadata carried anywhere in the capability's chain, checked
+// against the capability's file hash and its origin signature. It is nil when none is carried.
+func GrantedFileMeta(capability *pb.FileCapability) (*pb.FileMeta, error) {
+	for link := capability; link != nil; link = link.GetParent() {
+		meta := link.GetFileMeta()
+		if meta == nil {
+			continue
+		}
+		if !bytes.Equal(meta.GetFileHash(), capability.GetFileHash()) {
+			return nil, fmt.Errorf("capability carries metadata for a different file")
+		}
+		if err := dag.ValidateFileMeta(meta); err != nil {
+			return nil, fmt.Errorf("capability file metadata: %w", err)
+		}
+		return meta, nil
+	}
+	return nil, nil
+}
+
+// WithoutFileMeta returns a copy of the capability with the file metadata dropped from every
+// link, which is how a grantee keeps it and presents it in requests.
+func WithoutFileMeta(capability *pb.FileCapability) *pb.FileCapability {
+	out := proto.Clone(capability).(*pb.FileCapability)
+	for link := out; link != nil; link = link.GetParent() {
+		link.FileMeta = nil
+	}
+	return out
+}
+
+// CapabilityID identifies a capability for revocation. It covers the signature, and with it the
+// whole delegation chain above the capability.
+func CapabilityID(capability *pb.FileCapability) []byte {
+	buf := capabilitySignableBytes(capability)
+	buf = append(buf, capability.GetSignature()...)
+	id := crypto.Hash(buf)
+	return id[:]
+}
+
+// RevocationLookup returns the keys that revoked the capability with the given id.
+type RevocationLookup func(capabilityID []byte) ([][]byte, error)
+
+/*
+ValidateCapabilityChain checks a possibly delegated capability presented by requesterPubKey.
+
+  - the presented capability must pass ValidateCapability for the requester
+  - every parent must be a valid, unexpired, targeted grant to the key that signed its child,
+    for the same file, expiring no earlier than the child
+  - the root must be granted by one of issuers (the file's owner or the serving device)
+  - no link may be revoked by its own granter or by a granter above it
+
+issuers may be nil when the caller does not know who owns the file; the root is then only
+checked for its own signature. revoked may be nil when no revocation list is available.
+*/
+func ValidateCapabilityChain(capability *pb.FileCapability, requesterPubKey []byte, issuers [][]byte, revoked RevocationLookup, now int64) error {
+	if err := ValidateCapability(capability, requesterPubKey, now); err != nil {
+		return err
+	}
+
+	chain := []*pb.FileCapability{capability}
+	for child := capability; child.GetParent() != nil; child = child.GetParent() {
+		if len(chain) > MaxDelegationDepth {
+			return fmt.Errorf("capability delegated more than %d times", MaxDelegationDepth)
+		}
+		parent := child.GetParent()
+		if !bytes.Equal(parent.GetGrantedTo(), child.GetGrantedBy()) || len(parent.GetGrantedTo()) == 0 {
+			return fmt.Errorf("capability was not delegated by the parent's grantee")
+		}
+		if !bytes.Equal(parent.GetFileHash(), child.GetFileHash()) {
+			return fmt.Errorf("delegated capability is for a different file")
+		}
+		if child.GetExpiresAt() > parent.GetExpiresAt() {
+			return fmt.Errorf("delegated capability outlives its parent")
+		}
+		if err := ValidateCapability(parent, parent.GetGrantedTo(), now); err != nil {
+			return fmt.Errorf("parent capability: %w", err)
+		}
+		chain = append(chain, parent)
+	}
+
+	root := chain[len(chain)-1]
+	trusted := issuers == nil
+	for _, issuer := range issuers {
+		if len(issuer) > 0 && bytes.Equal(issuer, root.GetGrantedBy()) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("capability root is not granted by the file's owner")
+	}
+
+	if revoked == nil {
+		return nil
+	}
+	for i, link := range chain {
+		revokers, err := revoked(CapabilityID(link))
+		if err != nil {
+			return fmt.Errorf("revocation lookup: %w", err)
+		}
+		for _, revoker := range revokers {
+			// chain[i:] are this link and its ancestors; any of their granters may revoke it.
+			for _, above := range chain[i:] {
+				if bytes.Equal(revoker, above.GetGrantedBy()) {
+					return fmt.Errorf("capability revoked")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckCapabilityScope checks that every requested chunk lies within the chunk ranges of each
+// link in the chain. Download and byte limits depend on past use and are enforced by the serving
+// device's store.
+func CheckCapabilityScope(capability *pb.FileCapability, chunkIndices []uint32) error {
+	for link := capability; link != nil; link = link.GetParent() {
+		ranges := link.GetChunkRanges()
+		if len(ranges) == 0 {
+			continue
+		}
+		for _, idx := range chunkIndices {
+			if !inChunkRanges(ranges, idx) {
+				return fmt.Errorf("chunk %d is outside the capability's chunk ranges", idx)
+			}
+		}
+	}
+	return nil
+}
+
+func inChunkRanges(ranges []*pb.ChunkRange, idx uint32) bool {
+	for _, r := range ranges {
+		if idx >= r.GetStart() && idx < r.GetEnd() {
+			return true
+		}
+	}
+	return false
+}
+
+func validateChunkRanges(capability *pb.FileCapability) error {
+	for _, r := range capability.GetChunkRanges() {
+		if r == nil || r.GetStart() >= r.GetEnd() {
+			return fmt.Errorf("capability chunk range is empty")
+		}
+	}
+	return nil
+}
+
+func CreateRevocation(capability *pb.FileCapability, revokerPubKey []byte, revokerPrivateKey []byte, now int64) (*pb.CapabilityRevocation, error) {
+	if capability == nil {
+		return nil, fmt.Errorf("capability is required")
+	}
+	rev := &pb.CapabilityRevocation{
+		CapabilityId:   CapabilityID(capability),
+		RevokedBy:      append([]byte(nil), revokerPubKey...),
+		RevokedAt:      now,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	sig, err := crypto.Sign(revokerPrivateKey, RevocationSignableBytes(rev))
+	if err != nil {
+		return nil, fmt.Errorf("sign revocation: %w", err)
+	}
+	rev.Signature = sig
+	return rev, nil
+}
+
+// ValidateRevocation only checks the revoker's signature; whether the revoker had the right to
+// revoke is decided per chain in ValidateCapabilityChain.
+func ValidateRevocation(rev *pb.CapabilityRevocation) error {
+	if rev == nil {
+		return fmt.Errorf("revocation is required")
+	}
+	if len(rev.GetCapabilityId()) == 0 || len(rev.GetRevokedBy()) == 0 {
+		return fmt.Errorf("revocation capability id and revoker are required")
+	}
+	if err := wire.CheckSigningVersion(rev.GetSigningVersion()); err != nil {
+		return err
+	}
+	ok, err := crypto.Verify(rev.GetRevokedBy(), RevocationSignableBytes(rev), rev.GetSignature())
+	if err != nil {
+		return fmt.Errorf("verify revocation: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid revocation signature")
+	}
+	return nil
+}
+
+func RevocationSignableBytes(rev *pb.CapabilityRevocation) []byte {
+	if rev.GetSigningVersion() == wire.LegacySigning {
+		return legacyRevocationSignableBytes(rev)
+	}
+	return wire.NewCanonical(revocationDomain).
+		Bytes(1, rev.GetCapabilityId()).
+		Bytes(2, rev.GetRevokedBy()).
+		Int64(3, rev.GetRevokedAt()).
+		Encode()
+}
+
+// capabilitySignableBytes covers every field but the signature and the file metadata. A parent is covered by its
+// signature, which in turn covers the rest of the chain above it.
 func capabilitySignableBytes(capability *pb.FileCapability) []byte {
+	if capability.GetSigningVersion() == wire.LegacySigning {
+		return legacyCapabilitySignableBytes(capability)
+	}
+	ranges := make([]*wire.Canonical, 0, len(capability.GetChunkRanges()))
+	for _, r := range capability.GetChunkRanges() {
+		ranges = append(ranges, new(wire.Canonical).Uint32(1, r.GetStart()).Uint32(2, r.GetEnd()))
+	}
+	return wire.NewCanonical(capabilityDomain).
+		Bytes(1, capability.GetFileHash()).
+		Bytes(2, capability.GetGrantedTo()).
+		Bytes(3, capability.GetGrantedBy()).
+		Int64(4, capability.GetExpiresAt()).
+		Bytes(6, capability.GetParent().GetSignature()).
+		Messages(7, ranges).
+		Uint32(8, capability.GetMaxDownloads()).
+		Uint64(9, capability.GetMaxBytes()).
+		Encode()
+}
+
+// Legacy encodings, kept so capabilities and revocations signed before the canonical encoding
+// still verify.
+
+func legacyRevocationSignableBytes(rev *pb.CapabilityRevocation) []byte {
+	var out []byte
+	out = append(out, rev.GetCapabilityId()...)
+	out = append(out, rev.GetRevokedBy()...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(rev.GetRevokedAt()))
+	out = append(out, ts[:]...)
+	return out
+}
+
+func legacyCapabilitySignableBytes(capability *pb.FileCapability) []byte {
 	var out []byte
 	out = append(out, capability.GetFileHash()...)
 	out = append(out, capability.GetGrantedTo()...)
@@ -87,5 +426,21 @@ func capabilitySignableBytes(capability *pb.FileCapability) []byte {
 	var ts [8]byte
 	binary.BigEndian.PutUint64(ts[:], uint64(capability.GetExpiresAt()))
 	out = append(out, ts[:]...)
+	// Root capabilities keep their original encoding.
+	if parent := capability.GetParent(); parent != nil {
+		out = append(out, parent.GetSignature()...)
+	}
+	// So do unscoped ones. The marker and range count keep the scope from being read as part of
+	// a parent signature.
+	if len(capability.GetChunkRanges()) > 0 || capability.GetMaxDownloads() > 0 || capability.GetMaxBytes() > 0 {
+		out = append(out, 'S')
+		out = binary.BigEndian.AppendUint32(out, uint32(len(capability.GetChunkRanges())))
+		for _, r := range capability.GetChunkRanges() {
+			out = binary.BigEndian.AppendUint32(out, r.GetStart())
+			out = binary.BigEndian.AppendUint32(out, r.GetEnd())
+		}
+		out = binary.BigEndian.AppendUint32(out, capability.GetMaxDownloads())
+		out = binary.BigEndian.AppendUint64(out, capability.GetMaxBytes())
+	}
 	return out
 }
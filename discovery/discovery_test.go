@@ -5,6 +5,9 @@ import (
 	"time"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
 func TestFileIndexBasicFlow(t *testing.T) {
@@ -77,3 +80,126 @@ func TestCapabilityCreateAndValidate(t *testing.T) {
 		t.Fatalf("expected expired capability rejection")
 	}
 }
+
+func TestCapabilityDelegationAndRevocation(t *testing.T) {
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	alicePub, alicePriv, _ := crypto.GenerateKeyPair()
+	bobPub, _, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	root, err := CreateCapability([]byte("file-hash"), alicePub, ownerPub, ownerPriv, now+60)
+	if err != nil {
+		t.Fatalf("create capability: %v", err)
+	}
+	if _, err := DelegateCapability(root, bobPub, alicePriv, now+120, CapabilityScope{}); err == nil {
+		t.Fatalf("expected delegation past the parent's expiry to fail")
+	}
+	delegated, err := DelegateCapability(root, bobPub, alicePriv, now+30, CapabilityScope{})
+	if err != nil {
+		t.Fatalf("delegate capability: %v", err)
+	}
+
+	owners := [][]byte{ownerPub}
+	if err := ValidateCapabilityChain(delegated, bobPub, owners, nil, now); err != nil {
+		t.Fatalf("validate delegated capability: %v", err)
+	}
+	if err := ValidateCapabilityChain(delegated, bobPub, [][]byte{alicePub}, nil, now); err == nil {
+		t.Fatalf("expected chain rooted at another key to be rejected")
+	}
+	if err := ValidateCapabilityChain(delegated, bobPub, owners, nil, now+45); err == nil {
+		t.Fatalf("expected delegated capability to expire first")
+	}
+
+	revocations := map[string][][]byte{}
+	lookup := func(id []byte) ([][]byte, error) { return revocations[string(id)], nil }
+
+	// Bob holds the leaf but did not grant anything, so his revocation does not count.
+	revocations[string(CapabilityID(root))] = [][]byte{bobPub}
+	if err := ValidateCapabilityChain(delegated, bobPub, owners, lookup, now); err != nil {
+		t.Fatalf("expected revocation by a non-granter to be ignored, got %v", err)
+	}
+
+	rev, err := CreateRevocation(root, ownerPub, ownerPriv, now)
+	if err != nil {
+		t.Fatalf("create revocation: %v", err)
+	}
+	if err := ValidateRevocation(rev); err != nil {
+		t.Fatalf("validate revocation: %v", err)
+	}
+	revocations[string(rev.GetCapabilityId())] = [][]byte{rev.GetRevokedBy()}
+	if err := ValidateCapabilityChain(delegated, bobPub, owners, lookup, now); err == nil {
+		t.Fatalf("expected revoking the root to invalidate the delegated capability")
+	}
+}
+
+func TestCapabilityScopeLimitsChunks(t *testing.T) {
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	alicePub, alicePriv, _ := crypto.GenerateKeyPair()
+	bobPub, _, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	scope := CapabilityScope{ChunkRanges: []*pb.ChunkRange{{Start: 0, End: 10}}, MaxDownloads: 2}
+	root, err := CreateScopedCapability([]byte("file-hash"), alicePub, ownerPub, ownerPriv, now+60, scope)
+	if err != nil {
+		t.Fatalf("create capability: %v", err)
+	}
+	if err := ValidateCapability(root, alicePub, now); err != nil {
+		t.Fatalf("validate scoped capability: %v", err)
+	}
+	if err := CheckCapabilityScope(root, []uint32{0, 9}); err != nil {
+		t.Fatalf("expected chunks inside the range to pass, got %v", err)
+	}
+	if err := CheckCapabilityScope(root, []uint32{10}); err == nil {
+		t.Fatalf("expected chunk outside the range to fail")
+	}
+
+	// Widening the range in a delegation does not escape the parent's range.
+	delegated, err := DelegateCapability(root, bobPub, alicePriv, now+30, CapabilityScope{ChunkRanges: []*pb.ChunkRange{{Start: 0, End: 20}}})
+	if err != nil {
+		t.Fatalf("delegate capability: %v", err)
+	}
+	if err := CheckCapabilityScope(delegated, []uint32{15}); err == nil {
+		t.Fatalf("expected the parent's range to still apply")
+	}
+
+	root.MaxDownloads = 100
+	if err := ValidateCapability(root, alicePub, now); err == nil {
+		t.Fatalf("expected a raised download limit to break the signature")
+	}
+	if _, err := CreateScopedCapability([]byte("file-hash"), alicePub, ownerPub, ownerPriv, now+60, CapabilityScope{ChunkRanges: []*pb.ChunkRange{{Start: 5, End: 5}}}); err == nil {
+		t.Fatalf("expected an empty chunk range to be rejected")
+	}
+}
+
+func TestCapabilityCarriesCheckedFileMeta(t *testing.T) {
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	granteePub, _, _ := crypto.GenerateKeyPair()
+	fileHash := []byte("private-file")
+	meta := &pb.FileMeta{FileHash: fileHash, FileSize: 4, ChunkSize: 4, OriginPubkey: ownerPub, SigningVersion: wire.CanonicalSigning}
+	meta.OriginSig, _ = crypto.Sign(ownerPriv, dag.FileMetaSignableBytes(meta))
+
+	capability, err := CreateCapability(fileHash, granteePub, ownerPub, ownerPriv, time.Now().Unix()+60)
+	if err != nil {
+		t.Fatalf("create capability: %v", err)
+	}
+	if err := AttachFileMeta(capability, &pb.FileMeta{FileHash: []byte("other")}); err == nil {
+		t.Fatalf("expected metadata for another file to be refused")
+	}
+	if err := AttachFileMeta(capability, meta); err != nil {
+		t.Fatalf("attach file meta: %v", err)
+	}
+	if err := ValidateCapability(capability, granteePub, time.Now().Unix()); err != nil {
+		t.Fatalf("expected the signature to hold with metadata attached: %v", err)
+	}
+	if got, err := GrantedFileMeta(capability); err != nil || got == nil {
+		t.Fatalf("expected the carried metadata, got %v, %v", got, err)
+	}
+	if WithoutFileMeta(capability).GetFileMeta() != nil || capability.GetFileMeta() == nil {
+		t.Fatalf("expected a copy without the metadata")
+	}
+
+	meta.FileSize = 40
+	if _, err := GrantedFileMeta(capability); err == nil {
+		t.Fatalf("expected metadata without a valid origin signature to be refused")
+	}
+}
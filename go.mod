@@ -2,6 +2,10 @@ module github.com/nyshthefantastic/burnt-peanut-network-core
 
 go 1.25.7
 
-require google.golang.org/protobuf v1.36.11
+require (
+	github.com/mattn/go-sqlite3 v1.14.34
+	golang.org/x/crypto v0.54.0
+	google.golang.org/protobuf v1.36.11
+)
 
-require github.com/mattn/go-sqlite3 v1.14.34
+require golang.org/x/sys v0.47.0 // indirect
@@ -5,8 +5,17 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// maxGossipRevocations and maxGossipSuccessions are the revocations' and successions' own
+// budgets. They are trimmed to them separately so a flood of either cannot push peer summaries
+// and file metadata out of a payload.
+const (
+	maxGossipRevocations = 64
+	maxGossipSuccessions = 64
+)
+
 // ApplyByteBudget trims payload sections in priority order:
-// fork evidence (highest), peer summaries, then file metadata.
+// fork evidence (highest), peer summaries, then file metadata. Capability revocations and key
+// successions do not share that budget; they are cut to their own limits.
 // Returns proto.Clone(payload); protobuf messages must not be copied by value.
 func ApplyByteBudget(payload *pb.GossipPayload, maxItems int) *pb.GossipPayload {
 	if payload == nil || maxItems <= 0 {
@@ -14,6 +23,12 @@ func ApplyByteBudget(payload *pb.GossipPayload, maxItems int) *pb.GossipPayload
 	}
 
 	trimmed := proto.Clone(payload).(*pb.GossipPayload)
+	if len(trimmed.Revocations) > maxGossipRevocations {
+		trimmed.Revocations = trimmed.Revocations[:maxGossipRevocations]
+	}
+	if len(trimmed.Successions) > maxGossipSuccessions {
+		trimmed.Successions = trimmed.Successions[:maxGossipSuccessions]
+	}
 	remaining := maxItems
 
 	if len(trimmed.ForkEvidence) > remaining {
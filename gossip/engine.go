@@ -51,7 +51,7 @@ func (s *GossipSession) RunGossip(peerID string, transport Transport) error {
 		return fmt.Errorf("missing gossip response payload")
 	}
 
-	if err := ProcessGossipPayload(s.store, resp.GetGossip()); err != nil {
+	if err := ProcessGossipPayload(s.store, resp.GetGossip(), []byte(peerID)); err != nil {
 		return fmt.Errorf("process gossip payload: %w", err)
 	}
 
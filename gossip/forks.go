@@ -0,0 +1,138 @@
+package gossip
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// ForkMonitor checks incoming records against the store before they are inserted. Forks it finds
+// are signed as the local device, stored, and reported through notify.
+type ForkMonitor struct {
+	store          *storage.Store
+	reporterPubkey []byte
+	signer         Signer
+	notify         func(devicePubkey []byte)
+}
+
+func NewForkMonitor(store *storage.Store, reporterPubkey []byte, signer Signer, notify func(devicePubkey []byte)) *ForkMonitor {
+	return &ForkMonitor{store: store, reporterPubkey: reporterPubkey, signer: signer, notify: notify}
+}
+
+// CheckRecords runs fork detection over records and returns the evidence it stored. Records that
+// do not verify are skipped: they could not back valid evidence anyway.
+func (m *ForkMonitor) CheckRecords(records []*pb.ShareRecord) []*pb.ForkEvidence {
+	if m == nil || m.store == nil || m.signer == nil {
+		return nil
+	}
+	var stored []*pb.ForkEvidence
+	for _, r := range records {
+		if r == nil || dag.ValidateShareRecord(r) != nil {
+			continue
+		}
+		forks, err := m.store.FindForks(r)
+		if err != nil {
+			continue
+		}
+		stored = append(stored, m.record(forks)...)
+	}
+	return stored
+}
+
+// record signs, stores and reports forks not already known, returning the ones it stored.
+func (m *ForkMonitor) record(forks []*pb.ForkEvidence) []*pb.ForkEvidence {
+	var stored []*pb.ForkEvidence
+	for _, fork := range forks {
+		if m.known(fork) {
+			continue
+		}
+		if err := m.report(fork); err != nil {
+			continue
+		}
+		stored = append(stored, fork)
+		if m.notify != nil {
+			m.notify(fork.GetDevicePubkey())
+		}
+	}
+	return stored
+}
+
+// CheckGossip runs fork detection over the records carried by a payload's fork evidence. Those
+// records also place the accused device's counterparties at an index. Successions in the payload
+// are checked against records already stored.
+func (m *ForkMonitor) CheckGossip(payload *pb.GossipPayload) []*pb.ForkEvidence {
+	var records []*pb.ShareRecord
+	for _, e := range payload.GetForkEvidence() {
+		records = append(records, e.GetRecordA(), e.GetRecordB())
+	}
+	return append(m.CheckRecords(records), m.CheckSuccessions(payload.GetSuccessions())...)
+}
+
+// CheckSuccessions reports stored records that a key signed after succession retired it, and a
+// key that signed a succession other than the one stored for it.
+func (m *ForkMonitor) CheckSuccessions(successions []*pb.SuccessionRecord) []*pb.ForkEvidence {
+	if m == nil || m.store == nil || m.signer == nil {
+		return nil
+	}
+	var stored []*pb.ForkEvidence
+	for _, succession := range successions {
+		if dag.ValidateSuccessionRecord(succession) != nil {
+			continue
+		}
+		forks, err := m.store.FindSuccessionForks(succession)
+		if err != nil {
+			continue
+		}
+		if conflict, err := m.store.FindConflictingSuccession(succession); err == nil && conflict != nil {
+			forks = append(forks, conflict)
+		}
+		stored = append(stored, m.record(forks)...)
+	}
+	return stored
+}
+
+// known reports whether evidence for the same pair of records, or of successions, is already
+// stored, so a record seen again in a later handshake does not add a duplicate.
+func (m *ForkMonitor) known(fork *pb.ForkEvidence) bool {
+	existing, err := m.store.GetForkEvidence(fork.GetDevicePubkey())
+	if err != nil {
+		return false
+	}
+	if fork.GetConflictingSuccession() != nil {
+		// One key signing two successions is one fork, however many copies are seen.
+		for _, e := range existing {
+			if e.GetConflictingSuccession() != nil {
+				return true
+			}
+		}
+		return false
+	}
+	a, b := fork.GetRecordA().GetId(), fork.GetRecordB().GetId()
+	for _, e := range existing {
+		if e.GetConflictingSuccession() != nil {
+			continue
+		}
+		ea, eb := e.GetRecordA().GetId(), e.GetRecordB().GetId()
+		if (bytes.Equal(ea, a) && bytes.Equal(eb, b)) || (bytes.Equal(ea, b) && bytes.Equal(eb, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ForkMonitor) report(fork *pb.ForkEvidence) error {
+	fork.ReporterPubkey = m.reporterPubkey
+	fork.DetectedAt = time.Now().Unix()
+	fork.SigningVersion = wire.CanonicalSigning
+	sig, err := m.signer.Sign(dag.ForkEvidenceSignableBytes(fork))
+	if err != nil {
+		return fmt.Errorf("sign fork evidence: %w", err)
+	}
+	fork.ReporterSig = sig
+	return m.store.InsertForkEvidence(fork)
+}
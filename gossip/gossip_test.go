@@ -1,10 +1,15 @@
 package gossip
 
 import (
+	"bytes"
+	"errors"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/discovery"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
@@ -101,8 +106,9 @@ func TestProcessGossipPayloadPropagatesData(t *testing.T) {
 	store := openTestStore(t)
 	defer store.Close()
 
+	ckptPub, ckptPriv, _ := crypto.GenerateKeyPair()
 	checkpoint := &pb.Checkpoint{
-		DevicePubkey: []byte("peer-ckpt"),
+		DevicePubkey: ckptPub,
 		ChainHead:    []byte("ckpt-head"),
 		RecordIndex:  7,
 		Totals: &pb.CumulativeTotals{
@@ -111,17 +117,10 @@ func TestProcessGossipPayloadPropagatesData(t *testing.T) {
 		},
 		RawBalance: 50,
 		Timestamp:  time.Now().Unix(),
-		DeviceSig:  []byte("sig"),
 	}
+	checkpoint.DeviceSig, _ = crypto.Sign(ckptPriv, dag.CheckpointSignableBytes(checkpoint))
 
-	fork := &pb.ForkEvidence{
-		DevicePubkey:  []byte("peer-fork"),
-		RecordA:       &pb.ShareRecord{Id: []byte("a")},
-		RecordB:       &pb.ShareRecord{Id: []byte("b")},
-		ReporterPubkey: []byte("rep"),
-		ReporterSig:   []byte("rep-sig"),
-		DetectedAt:    time.Now().Unix(),
-	}
+	fork := signedFork(t)
 
 	payload := &pb.GossipPayload{
 		SelfSummary: &pb.PeerInfo{
@@ -154,7 +153,7 @@ func TestProcessGossipPayloadPropagatesData(t *testing.T) {
 		LatestCheckpoint: checkpoint,
 	}
 
-	if err := ProcessGossipPayload(store, payload); err != nil {
+	if err := ProcessGossipPayload(store, payload, []byte("relay")); err != nil {
 		t.Fatalf("process gossip payload: %v", err)
 	}
 
@@ -165,7 +164,7 @@ func TestProcessGossipPayloadPropagatesData(t *testing.T) {
 		t.Fatalf("expected peer summary upserted: %v", err)
 	}
 
-	hasFork, err := store.HasForkEvidence([]byte("peer-fork"))
+	hasFork, err := store.HasForkEvidence(fork.GetDevicePubkey())
 	if err != nil {
 		t.Fatalf("check fork evidence: %v", err)
 	}
@@ -173,7 +172,7 @@ func TestProcessGossipPayloadPropagatesData(t *testing.T) {
 		t.Fatalf("expected fork evidence to be stored")
 	}
 
-	latest, err := store.GetLatestCheckpoint([]byte("peer-ckpt"))
+	latest, err := store.GetLatestCheckpoint(ckptPub)
 	if err != nil {
 		t.Fatalf("load latest checkpoint: %v", err)
 	}
@@ -241,3 +240,453 @@ func TestApplyByteBudgetPrioritization(t *testing.T) {
 		t.Fatalf("expected 0 seeding files, got %d", len(trimmed.GetSeedingFiles()))
 	}
 }
+
+func TestApplyByteBudgetKeepsRevocationsAndSuccessionsOffTheSharedBudget(t *testing.T) {
+	payload := &pb.GossipPayload{SeedingFiles: []*pb.FileMeta{{}, {}}}
+	for i := 0; i < maxGossipRevocations+10; i++ {
+		payload.Revocations = append(payload.Revocations, &pb.CapabilityRevocation{})
+	}
+	for i := 0; i < maxGossipSuccessions+10; i++ {
+		payload.Successions = append(payload.Successions, &pb.SuccessionRecord{})
+	}
+
+	trimmed := ApplyByteBudget(payload, 3)
+	if len(trimmed.GetRevocations()) != maxGossipRevocations {
+		t.Fatalf("expected %d revocations, got %d", maxGossipRevocations, len(trimmed.GetRevocations()))
+	}
+	if len(trimmed.GetSuccessions()) != maxGossipSuccessions {
+		t.Fatalf("expected %d successions, got %d", maxGossipSuccessions, len(trimmed.GetSuccessions()))
+	}
+	if len(trimmed.GetSeedingFiles()) != 2 {
+		t.Fatalf("revocations and successions starved seeding files: got %d", len(trimmed.GetSeedingFiles()))
+	}
+}
+
+func TestPropagateRevocationsKeepsOnlyRelevantRevocations(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	strangerPub, strangerPriv, _ := crypto.GenerateKeyPair()
+	holderPub, _, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	if err := store.InsertFileMeta(&pb.FileMeta{FileHash: []byte("owned"), FileName: "f", OriginPubkey: ownerPub, OriginSig: []byte("sig")}); err != nil {
+		t.Fatalf("insert file meta: %v", err)
+	}
+	revoke := func(granterPub, granterPriv []byte, n int, at int64) *pb.CapabilityRevocation {
+		capability, _ := discovery.CreateCapability([]byte{byte(n), byte(n >> 8)}, holderPub, granterPub, granterPriv, now+60)
+		rev, err := discovery.CreateRevocation(capability, granterPub, granterPriv, at)
+		if err != nil {
+			t.Fatalf("create revocation: %v", err)
+		}
+		return rev
+	}
+
+	valid := revoke(ownerPub, ownerPriv, 0, now)
+	future := revoke(ownerPub, ownerPriv, 1, now+storage.MaxRevocationClockSkewSeconds+60)
+	stranger := revoke(strangerPub, strangerPriv, 2, now)
+	if err := PropagateRevocations(store, []*pb.CapabilityRevocation{valid, future, stranger}); err != nil {
+		t.Fatalf("propagate revocations: %v", err)
+	}
+	stored, err := store.GetRevocations(100, now)
+	if err != nil {
+		t.Fatalf("get revocations: %v", err)
+	}
+	if len(stored) != 1 || !bytes.Equal(stored[0].GetCapabilityId(), valid.GetCapabilityId()) {
+		t.Fatalf("expected only the owner's current revocation, got %d", len(stored))
+	}
+
+	var flood []*pb.CapabilityRevocation
+	for i := 3; i < storage.MaxRevocationsPerRevoker+10; i++ {
+		flood = append(flood, revoke(ownerPub, ownerPriv, i, now))
+	}
+	if err := PropagateRevocations(store, flood); err != nil {
+		t.Fatalf("propagate revocations: %v", err)
+	}
+	stored, err = store.GetRevocations(storage.MaxRevocationsPerRevoker*2, now)
+	if err != nil {
+		t.Fatalf("get revocations: %v", err)
+	}
+	if len(stored) != storage.MaxRevocationsPerRevoker {
+		t.Fatalf("expected %d revocations from one revoker, got %d", storage.MaxRevocationsPerRevoker, len(stored))
+	}
+}
+
+type keySigner struct {
+	priv []byte
+}
+
+func (k keySigner) Sign(message []byte) ([]byte, error) {
+	return crypto.Sign(k.priv, message)
+}
+
+func TestCheckpointWitnessRoundTrip(t *testing.T) {
+	deviceStore := openTestStore(t)
+	defer deviceStore.Close()
+	witnessStore := openTestStore(t)
+	defer witnessStore.Close()
+
+	devicePub, devicePriv, _ := crypto.GenerateKeyPair()
+	witnessPub, witnessPriv, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	cp := &pb.Checkpoint{DevicePubkey: devicePub, ChainHead: []byte("head"), RecordIndex: 3, Timestamp: now}
+	cp.DeviceSig, _ = crypto.Sign(devicePriv, dag.CheckpointSignableBytes(cp))
+	if err := deviceStore.InsertCheckpoint(cp); err != nil {
+		t.Fatalf("store own checkpoint: %v", err)
+	}
+
+	env, err := BuildWitnessRequest(cp)
+	if err != nil {
+		t.Fatalf("build witness request: %v", err)
+	}
+	resp, err := WitnessCheckpoint(witnessStore, env.GetWitnessRequest().GetCheckpoint(), witnessPub, "cafe", keySigner{priv: witnessPriv}, now)
+	if err != nil {
+		t.Fatalf("witness checkpoint: %v", err)
+	}
+
+	updated, err := AddWitness(deviceStore, devicePub, resp)
+	if err != nil {
+		t.Fatalf("add witness: %v", err)
+	}
+	if len(updated.GetWitnesses()) != 1 {
+		t.Fatalf("expected one witness attached, got %d", len(updated.GetWitnesses()))
+	}
+	stored, _ := deviceStore.GetLatestCheckpoint(devicePub)
+	if len(dag.VerifiedWitnesses(stored)) != 1 {
+		t.Fatalf("expected stored checkpoint to carry the verified witness")
+	}
+
+	resp.Witness.EncounterCluster = "elsewhere"
+	if _, err := AddWitness(deviceStore, devicePub, resp); err == nil {
+		t.Fatalf("expected witness with altered cluster to be rejected")
+	}
+
+	if _, err := WitnessCheckpoint(witnessStore, cp, witnessPub, "cafe", keySigner{priv: witnessPriv}, now+2*MaxWitnessClockSkewSeconds); err == nil {
+		t.Fatalf("expected stale checkpoint to be refused")
+	}
+}
+
+func TestPropagateCheckpointRejectsForgery(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+
+	devicePub, devicePriv, _ := crypto.GenerateKeyPair()
+	cp := &pb.Checkpoint{DevicePubkey: devicePub, ChainHead: []byte("head"), RecordIndex: 1, Timestamp: time.Now().Unix()}
+	cp.DeviceSig, _ = crypto.Sign(devicePriv, dag.CheckpointSignableBytes(cp))
+	cp.Confidence = pb.ConfidenceLevel_CONFIDENCE_HIGH
+	for i := 0; i < 5; i++ {
+		cp.Witnesses = append(cp.Witnesses, &pb.CheckpointWitness{WitnessPubkey: []byte{byte(i)}, EncounterCluster: "c"})
+	}
+
+	if err := PropagateCheckpoint(store, cp); err != nil {
+		t.Fatalf("propagate checkpoint: %v", err)
+	}
+	stored, err := store.GetLatestCheckpoint(devicePub)
+	if err != nil {
+		t.Fatalf("load checkpoint: %v", err)
+	}
+	if len(stored.GetWitnesses()) != 0 || stored.GetConfidence() != pb.ConfidenceLevel_CONFIDENCE_LOW {
+		t.Fatalf("expected forged witnesses dropped and confidence recomputed, got %d witnesses at %v", len(stored.GetWitnesses()), stored.GetConfidence())
+	}
+
+	cp.RecordIndex = 99
+	if err := PropagateCheckpoint(store, cp); !errors.Is(err, ErrInvalidCheckpoint) {
+		t.Fatalf("expected checkpoint edited after signing to be rejected, got %v", err)
+	}
+}
+
+// signedFork returns valid evidence of a device co-signing two different records at index 1.
+func signedFork(t *testing.T) *pb.ForkEvidence {
+	t.Helper()
+	devicePub, devicePriv, _ := crypto.GenerateKeyPair()
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	reporterPub, reporterPriv, _ := crypto.GenerateKeyPair()
+
+	record := func(data string) *pb.ShareRecord {
+		r, err := dag.BuildShareRecord(dag.ShareRecordParams{
+			SenderPubkey:   devicePub,
+			ReceiverPubkey: peerPub,
+			Request:        &pb.TransferRequest{RequesterPubkey: peerPub, FileHash: []byte(data)},
+			Chunks:         []*pb.ChunkData{{Data: []byte(data)}},
+			Timestamp:      time.Now().Unix(),
+		})
+		if err != nil {
+			t.Fatalf("build record: %v", err)
+		}
+		sig, _ := crypto.Sign(devicePriv, dag.SignableBytes(r))
+		dag.AttachSenderSig(r, sig)
+		sig, _ = crypto.Sign(peerPriv, dag.SignableBytes(r))
+		dag.AttachReceiverSig(r, sig)
+		return r
+	}
+
+	fork := dag.DetectFork(record("a"), record("b"), devicePub)
+	fork.ReporterPubkey = reporterPub
+	fork.DetectedAt = time.Now().Unix()
+	fork.ReporterSig, _ = crypto.Sign(reporterPriv, dag.ForkEvidenceSignableBytes(fork))
+	return fork
+}
+
+func TestPropagateForkEvidenceDropsForgeryAndPenalizesRelay(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+
+	valid := signedFork(t)
+	garbage := &pb.ForkEvidence{
+		DevicePubkey:   []byte("honest-peer"),
+		RecordA:        &pb.ShareRecord{Id: []byte("a"), SenderPubkey: []byte("honest-peer")},
+		RecordB:        &pb.ShareRecord{Id: []byte("b"), SenderPubkey: []byte("honest-peer")},
+		ReporterPubkey: []byte("rep"),
+		ReporterSig:    []byte("rep-sig"),
+	}
+	resigned := signedFork(t)
+	resigned.DetectedAt++
+
+	if err := PropagateForkEvidence(store, []*pb.ForkEvidence{garbage, valid, resigned}, []byte("relay")); err != nil {
+		t.Fatalf("propagate fork evidence: %v", err)
+	}
+
+	if forked, _ := store.HasForkEvidence([]byte("honest-peer")); forked {
+		t.Fatalf("expected unsigned evidence to be dropped")
+	}
+	if forked, _ := store.HasForkEvidence(resigned.GetDevicePubkey()); forked {
+		t.Fatalf("expected evidence with a stale reporter signature to be dropped")
+	}
+	if forked, _ := store.HasForkEvidence(valid.GetDevicePubkey()); !forked {
+		t.Fatalf("expected valid evidence to be stored")
+	}
+	if n, _ := store.PeerFaultCount([]byte("relay"), storage.PeerFaultBadForkEvidence); n != 2 {
+		t.Fatalf("expected relay to be charged 2 faults, got %d", n)
+	}
+
+	err := AcceptForkEvidence(store, garbage, []byte("relay"))
+	if !errors.Is(err, storage.ErrInvalidForkEvidence) {
+		t.Fatalf("expected ErrInvalidForkEvidence, got %v", err)
+	}
+}
+
+func TestForkMonitorDetectsReceiverSideFork(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+
+	devicePub, devicePriv, _ := crypto.GenerateKeyPair()
+	signed := func(senderPub, senderPriv []byte, data string) *pb.ShareRecord {
+		r, err := dag.BuildShareRecord(dag.ShareRecordParams{
+			SenderPubkey:   senderPub,
+			ReceiverPubkey: devicePub,
+			Request:        &pb.TransferRequest{RequesterPubkey: devicePub, FileHash: []byte(data)},
+			Chunks:         []*pb.ChunkData{{Data: []byte(data)}},
+			Timestamp:      time.Now().Unix(),
+		})
+		if err != nil {
+			t.Fatalf("build record: %v", err)
+		}
+		sig, _ := crypto.Sign(senderPriv, dag.SignableBytes(r))
+		dag.AttachSenderSig(r, sig)
+		sig, _ = crypto.Sign(devicePriv, dag.SignableBytes(r))
+		dag.AttachReceiverSig(r, sig)
+		return r
+	}
+	aPub, aPriv, _ := crypto.GenerateKeyPair()
+	bPub, bPriv, _ := crypto.GenerateKeyPair()
+	first := signed(aPub, aPriv, "one")
+	second := signed(bPub, bPriv, "two")
+	if err := store.InsertRecord(first); err != nil {
+		t.Fatalf("insert record: %v", err)
+	}
+
+	reporterPub, reporterPriv, _ := crypto.GenerateKeyPair()
+	var notified [][]byte
+	monitor := NewForkMonitor(store, reporterPub, keySigner{priv: reporterPriv}, func(device []byte) {
+		notified = append(notified, device)
+	})
+
+	// Both senders are at their own index 1 without conflict; only the shared receiver forked.
+	forks := monitor.CheckRecords([]*pb.ShareRecord{second})
+	if len(forks) != 1 || string(forks[0].GetDevicePubkey()) != string(devicePub) {
+		t.Fatalf("expected one fork against the receiver, got %d", len(forks))
+	}
+	if len(notified) != 1 {
+		t.Fatalf("expected one notification, got %d", len(notified))
+	}
+	if forked, _ := store.HasForkEvidence(devicePub); !forked {
+		t.Fatalf("expected signed evidence to be stored")
+	}
+
+	if again := monitor.CheckRecords([]*pb.ShareRecord{second}); len(again) != 0 {
+		t.Fatalf("expected the same fork not to be reported twice")
+	}
+	if same := monitor.CheckRecords([]*pb.ShareRecord{first}); len(same) != 0 {
+		t.Fatalf("expected a stored record not to fork with itself")
+	}
+}
+
+func TestForkMonitorDetectsRetiredKeySignature(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+
+	oldPub, oldPriv, _ := crypto.GenerateKeyPair()
+	newPub, _, _ := crypto.GenerateKeyPair()
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	signed := func(prev *pb.ShareRecord, data string) *pb.ShareRecord {
+		params := dag.ShareRecordParams{
+			SenderPubkey:   peerPub,
+			ReceiverPubkey: oldPub,
+			Request:        &pb.TransferRequest{RequesterPubkey: oldPub, FileHash: []byte(data)},
+			Chunks:         []*pb.ChunkData{{Data: []byte(data)}},
+			Timestamp:      time.Now().Unix(),
+		}
+		if prev != nil {
+			params.SenderHead, params.ReceiverHead = dag.HeadAfter(prev, peerPub), dag.HeadAfter(prev, oldPub)
+		}
+		r, err := dag.BuildShareRecord(params)
+		if err != nil {
+			t.Fatalf("build record: %v", err)
+		}
+		sig, _ := crypto.Sign(peerPriv, dag.SignableBytes(r))
+		dag.AttachSenderSig(r, sig)
+		sig, _ = crypto.Sign(oldPriv, dag.SignableBytes(r))
+		dag.AttachReceiverSig(r, sig)
+		return r
+	}
+	before := signed(nil, "before")
+	after := signed(before, "after")
+	for _, r := range []*pb.ShareRecord{before, after} {
+		if err := store.InsertRecord(r); err != nil {
+			t.Fatalf("insert record: %v", err)
+		}
+	}
+
+	succession := &pb.SuccessionRecord{
+		OldPubkey: oldPub,
+		NewPubkey: newPub,
+		Timestamp: time.Now().Unix(),
+		FinalHead: dag.HeadAfter(before, oldPub),
+	}
+	succession.Signature, _ = crypto.Sign(oldPriv, dag.SuccessionSignableBytes(succession))
+
+	reporterPub, reporterPriv, _ := crypto.GenerateKeyPair()
+	monitor := NewForkMonitor(store, reporterPub, keySigner{priv: reporterPriv}, nil)
+	payload := &pb.GossipPayload{Successions: []*pb.SuccessionRecord{succession}}
+	if err := ProcessGossipPayload(store, payload, []byte("relay")); err != nil {
+		t.Fatalf("process gossip: %v", err)
+	}
+	forks := monitor.CheckGossip(payload)
+	if len(forks) != 1 || forks[0].GetSuccession() == nil {
+		t.Fatalf("expected one succession fork, got %d", len(forks))
+	}
+
+	stored, err := store.GetForkEvidence(oldPub)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected stored evidence, got %d (%v)", len(stored), err)
+	}
+	if err := dag.ValidateForkEvidence(stored[0]); err != nil {
+		t.Fatalf("expected stored evidence to still verify, got %v", err)
+	}
+	if len(monitor.CheckRecords([]*pb.ShareRecord{after})) != 0 {
+		t.Fatalf("expected a known fork not to be reported again")
+	}
+	if forked, _ := store.HasForkEvidence(newPub); forked {
+		t.Fatalf("the new key itself is not forked")
+	}
+}
+
+func TestPropagateSuccessionsBoundsAndReportsConflicts(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+	now := time.Now().Unix()
+
+	handOver := func(oldPriv []byte, oldPub []byte, at int64) *pb.SuccessionRecord {
+		newPub, _, _ := crypto.GenerateKeyPair()
+		s := &pb.SuccessionRecord{OldPubkey: oldPub, NewPubkey: newPub, Timestamp: at}
+		s.Signature, _ = crypto.Sign(oldPriv, dag.SuccessionSignableBytes(s))
+		return s
+	}
+
+	// The local key handed over to known, so known is a key this device has history with.
+	localPub, localPriv, _ := crypto.GenerateKeyPair()
+	if err := store.InitIdentity(localPub, now); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	knownPub, knownPriv, _ := crypto.GenerateKeyPair()
+	toKnown := &pb.SuccessionRecord{OldPubkey: localPub, NewPubkey: knownPub, Timestamp: now}
+	toKnown.Signature, _ = crypto.Sign(localPriv, dag.SuccessionSignableBytes(toKnown))
+	if err := store.InsertSuccession(toKnown, now); err != nil {
+		t.Fatalf("insert succession: %v", err)
+	}
+
+	strangerPub, strangerPriv, _ := crypto.GenerateKeyPair()
+	future := handOver(knownPriv, knownPub, now+storage.MaxSuccessionClockSkewSeconds+60)
+	first := handOver(knownPriv, knownPub, now)
+	second := handOver(knownPriv, knownPub, now)
+	stranger := handOver(strangerPriv, strangerPub, now)
+
+	reporterPub, reporterPriv, _ := crypto.GenerateKeyPair()
+	monitor := NewForkMonitor(store, reporterPub, keySigner{priv: reporterPriv}, nil)
+	for _, succession := range []*pb.SuccessionRecord{future, stranger, first, second} {
+		payload := &pb.GossipPayload{Successions: []*pb.SuccessionRecord{succession}}
+		if err := ProcessGossipPayload(store, payload, []byte("relay")); err != nil {
+			t.Fatalf("process gossip: %v", err)
+		}
+		monitor.CheckGossip(payload)
+	}
+
+	stored, err := store.GetSuccessor(knownPub)
+	if err != nil || !bytes.Equal(stored.GetSignature(), first.GetSignature()) {
+		t.Fatalf("expected the first current succession to be kept, got %v", err)
+	}
+	if retired, _ := store.IsRetired(strangerPub); retired {
+		t.Fatalf("expected a succession retiring an unknown key to be dropped")
+	}
+
+	forks, err := store.GetForkEvidence(knownPub)
+	if err != nil || len(forks) != 1 || forks[0].GetConflictingSuccession() == nil {
+		t.Fatalf("expected one conflicting succession fork, got %d (%v)", len(forks), err)
+	}
+	if err := dag.ValidateForkEvidence(forks[0]); err != nil {
+		t.Fatalf("expected stored evidence to verify, got %v", err)
+	}
+	if again := monitor.CheckSuccessions([]*pb.SuccessionRecord{second}); len(again) != 0 {
+		t.Fatalf("expected the same conflict not to be reported twice")
+	}
+
+	gossiped, err := store.GetSuccessions(10, now)
+	if err != nil {
+		t.Fatalf("get successions: %v", err)
+	}
+	if len(gossiped) != 2 {
+		t.Fatalf("expected both successions in the known lineage to be gossiped, got %d", len(gossiped))
+	}
+}
+
+func TestFaultyRelayGossipIsDropped(t *testing.T) {
+	store := openTestStore(t)
+	defer store.Close()
+
+	for i := 0; i < MaxForkEvidenceFaults; i++ {
+		if err := store.RecordPeerFault([]byte("liar"), storage.PeerFaultBadForkEvidence, time.Now().Unix()); err != nil {
+			t.Fatalf("record fault: %v", err)
+		}
+	}
+	valid := signedFork(t)
+	payload := &pb.GossipPayload{ForkEvidence: []*pb.ForkEvidence{valid}}
+
+	if err := ProcessGossipPayload(store, payload, []byte("liar")); !errors.Is(err, ErrFaultyRelay) {
+		t.Fatalf("expected ErrFaultyRelay, got %v", err)
+	}
+	if err := AcceptForkEvidence(store, valid, []byte("liar")); !errors.Is(err, ErrFaultyRelay) {
+		t.Fatalf("expected ErrFaultyRelay for direct evidence, got %v", err)
+	}
+	if forked, _ := store.HasForkEvidence(valid.GetDevicePubkey()); forked {
+		t.Fatalf("expected nothing from a faulty relay to be stored")
+	}
+
+	// The same evidence from an honest relay is taken.
+	if err := ProcessGossipPayload(store, payload, []byte("relay")); err != nil {
+		t.Fatalf("process gossip: %v", err)
+	}
+	if forked, _ := store.HasForkEvidence(valid.GetDevicePubkey()); !forked {
+		t.Fatalf("expected evidence from an honest relay to be stored")
+	}
+}
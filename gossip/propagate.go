@@ -1,13 +1,61 @@
 package gossip
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
 )
 
-func PropagateForkEvidence(store *storage.Store, evidence []*pb.ForkEvidence) error {
+// MaxForkEvidenceFaults is how many pieces of invalid fork evidence a peer may deliver before
+// everything it gossips is dropped unread.
+const MaxForkEvidenceFaults = 3
+
+// ErrFaultyRelay is returned for gossip from a peer that has delivered MaxForkEvidenceFaults
+// pieces of invalid fork evidence.
+var ErrFaultyRelay = errors.New("relay has delivered too much invalid fork evidence")
+
+// CheckRelay returns ErrFaultyRelay when peer from may no longer be listened to. A peer with no
+// key cannot be charged, so it is never refused.
+func CheckRelay(store *storage.Store, from []byte) error {
+	if store == nil {
+		return fmt.Errorf("store is required")
+	}
+	if len(from) == 0 {
+		return nil
+	}
+	faults, err := store.PeerFaultCount(from, storage.PeerFaultBadForkEvidence)
+	if err != nil {
+		return fmt.Errorf("peer fault lookup: %w", err)
+	}
+	if faults >= MaxForkEvidenceFaults {
+		return ErrFaultyRelay
+	}
+	return nil
+}
+
+// AcceptForkEvidence stores one piece of fork evidence delivered by peer from. Evidence that does
+// not verify is dropped and counted as a fault against from, which is the relaying peer rather
+// than reporter_pubkey: an unverifiable reporter field could name anyone. Evidence from a faulty
+// relay is dropped unread; see CheckRelay.
+func AcceptForkEvidence(store *storage.Store, evidence *pb.ForkEvidence, from []byte) error {
+	if err := CheckRelay(store, from); err != nil {
+		return err
+	}
+	err := store.InsertForkEvidence(evidence)
+	if errors.Is(err, storage.ErrInvalidForkEvidence) && len(from) > 0 {
+		_ = store.RecordPeerFault(from, storage.PeerFaultBadForkEvidence, time.Now().Unix())
+	}
+	return err
+}
+
+// PropagateForkEvidence stores every valid entry; invalid entries are dropped as in AcceptForkEvidence.
+// Once from turns faulty the remaining entries are dropped too, and ErrFaultyRelay is returned.
+func PropagateForkEvidence(store *storage.Store, evidence []*pb.ForkEvidence, from []byte) error {
 	if store == nil {
 		return fmt.Errorf("store is required")
 	}
@@ -16,13 +64,62 @@ func PropagateForkEvidence(store *storage.Store, evidence []*pb.ForkEvidence) er
 		if e == nil {
 			continue
 		}
-		if err := store.InsertForkEvidence(e); err != nil {
+		err := AcceptForkEvidence(store, e, from)
+		if errors.Is(err, ErrFaultyRelay) {
+			return err
+		}
+		if err != nil && !errors.Is(err, storage.ErrInvalidForkEvidence) {
 			return fmt.Errorf("insert fork evidence: %w", err)
 		}
 	}
 	return nil
 }
 
+// PropagateRevocations stores the revocations storage accepts and drops the rest; see
+// storage.InsertRevocation.
+func PropagateRevocations(store *storage.Store, revocations []*pb.CapabilityRevocation) error {
+	if store == nil {
+		return fmt.Errorf("store is required")
+	}
+	now := time.Now().Unix()
+	for _, rev := range revocations {
+		if err := store.InsertRevocation(rev, now); err != nil && !errors.Is(err, storage.ErrInvalidRevocation) {
+			return fmt.Errorf("insert revocation: %w", err)
+		}
+	}
+	return nil
+}
+
+// PropagateSuccessions stores verified key successions that retire a key this device knows; see
+// storage.IsKnownKey. Forged ones, future-dated ones and ones retiring unknown keys are dropped.
+// One contradicting a stored succession is not stored either: ForkMonitor.CheckSuccessions turns
+// it into fork evidence against the key that signed both.
+func PropagateSuccessions(store *storage.Store, successions []*pb.SuccessionRecord) error {
+	if store == nil {
+		return fmt.Errorf("store is required")
+	}
+	now := time.Now().Unix()
+	for _, succession := range successions {
+		known, err := store.IsKnownKey(succession.GetOldPubkey())
+		if err != nil {
+			return fmt.Errorf("check succession key: %w", err)
+		}
+		if !known {
+			continue
+		}
+		err = store.InsertSuccession(succession, now)
+		if err != nil && !errors.Is(err, storage.ErrInvalidSuccession) && !errors.Is(err, storage.ErrConflictingSuccession) {
+			return fmt.Errorf("insert succession: %w", err)
+		}
+	}
+	return nil
+}
+
+// ErrInvalidCheckpoint is returned for a checkpoint whose device signature does not verify.
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// PropagateCheckpoint stores a checkpoint only if the device signed it. Witnesses whose signatures
+// fail are dropped and the confidence is recomputed from the ones that remain.
 func PropagateCheckpoint(store *storage.Store, checkpoint *pb.Checkpoint) error {
 	if store == nil {
 		return fmt.Errorf("store is required")
@@ -30,6 +127,13 @@ func PropagateCheckpoint(store *storage.Store, checkpoint *pb.Checkpoint) error
 	if checkpoint == nil {
 		return nil
 	}
+	if err := dag.ValidateCheckpoint(checkpoint); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCheckpoint, err)
+	}
+
+	checkpoint = proto.Clone(checkpoint).(*pb.Checkpoint)
+	checkpoint.Witnesses = dag.VerifiedWitnesses(checkpoint)
+	checkpoint.Confidence = checkpointConfidence(store, checkpoint)
 
 	if err := store.InsertCheckpoint(checkpoint); err != nil {
 		return fmt.Errorf("insert checkpoint: %w", err)
@@ -46,22 +46,46 @@ func BuildGossipPayload(store *storage.Store) (*pb.GossipPayload, error) {
 		payload.ForkEvidence = forks
 	}
 
+	revocations, err := store.GetRevocations(maxGossipRevocations, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("load revocations: %w", err)
+	}
+	payload.Revocations = revocations
+
+	successions, err := store.GetSuccessions(maxGossipSuccessions, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("load successions: %w", err)
+	}
+	payload.Successions = successions
+
 	files, err := store.ListFiles(defaultPeerSummaryLimit, 0)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, fmt.Errorf("load seeding files: %w", err)
 	}
-	payload.SeedingFiles = files
+	// Private files are not advertised; only capability holders should learn of them.
+	for _, f := range files {
+		if v, err := store.GetFileVisibility(f.GetFileHash()); err == nil && v == pb.Visibility_VISIBILITY_PRIVATE {
+			continue
+		}
+		payload.SeedingFiles = append(payload.SeedingFiles, f)
+	}
 
 	return ApplyByteBudget(payload, defaultGossipMaxItems), nil
 }
 
-func ProcessGossipPayload(store *storage.Store, payload *pb.GossipPayload) error {
+// ProcessGossipPayload applies a payload received from peer from, which is charged for any fork
+// evidence in it that fails validation. A payload from a faulty relay is dropped with
+// ErrFaultyRelay; see CheckRelay.
+func ProcessGossipPayload(store *storage.Store, payload *pb.GossipPayload, from []byte) error {
 	if store == nil {
 		return fmt.Errorf("store is required")
 	}
 	if payload == nil {
 		return fmt.Errorf("gossip payload is required")
 	}
+	if err := CheckRelay(store, from); err != nil {
+		return err
+	}
 
 	if payload.GetSelfSummary() != nil {
 		if err := store.UpsertPeer(payload.GetSelfSummary()); err != nil {
@@ -78,10 +102,17 @@ func ProcessGossipPayload(store *storage.Store, payload *pb.GossipPayload) error
 		}
 	}
 
-	if err := PropagateForkEvidence(store, payload.GetForkEvidence()); err != nil {
+	if err := PropagateForkEvidence(store, payload.GetForkEvidence(), from); err != nil {
+		return err
+	}
+	if err := PropagateRevocations(store, payload.GetRevocations()); err != nil {
+		return err
+	}
+	if err := PropagateSuccessions(store, payload.GetSuccessions()); err != nil {
 		return err
 	}
-	if err := PropagateCheckpoint(store, payload.GetLatestCheckpoint()); err != nil {
+	// A forged checkpoint is dropped without discarding the rest of the payload.
+	if err := PropagateCheckpoint(store, payload.GetLatestCheckpoint()); err != nil && !errors.Is(err, ErrInvalidCheckpoint) {
 		return err
 	}
 
@@ -0,0 +1,125 @@
+package gossip
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+/*
+Checkpoint witnessing.
+
+a device signs its checkpoint and sends it to a connected peer in a WitnessRequest. the peer
+checks the device signature, that the checkpoint is recent and does not roll back a checkpoint
+it already holds for that device, and that it knows no fork evidence against the device. it then
+signs the checkpoint together with the device signature and its encounter cluster and sends the
+witness back in a WitnessResponse. the device attaches it and recomputes confidence.
+*/
+
+// MaxWitnessClockSkewSeconds bounds how far a checkpoint's timestamp may be from the witness's clock.
+const MaxWitnessClockSkewSeconds = 10 * 60
+
+// checkpointRecordWindow is how many of the device's records are used to judge witness freshness.
+const checkpointRecordWindow = 500
+
+type Signer interface {
+	Sign(message []byte) ([]byte, error)
+}
+
+func BuildWitnessRequest(checkpoint *pb.Checkpoint) (*pb.Envelope, error) {
+	if err := dag.ValidateCheckpoint(checkpoint); err != nil {
+		return nil, err
+	}
+	return &pb.Envelope{
+		Payload: &pb.Envelope_WitnessRequest{WitnessRequest: &pb.WitnessRequest{Checkpoint: checkpoint}},
+	}, nil
+}
+
+// WitnessCheckpoint is the witness side: it decides whether to vouch for checkpoint and signs it.
+func WitnessCheckpoint(store *storage.Store, checkpoint *pb.Checkpoint, witnessPubkey []byte, cluster string, signer Signer, now int64) (*pb.WitnessResponse, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store is required")
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("signer is required")
+	}
+	if err := dag.ValidateCheckpoint(checkpoint); err != nil {
+		return nil, err
+	}
+	device := checkpoint.GetDevicePubkey()
+	if bytes.Equal(device, witnessPubkey) {
+		return nil, fmt.Errorf("device cannot witness its own checkpoint")
+	}
+	if skew := now - checkpoint.GetTimestamp(); skew > MaxWitnessClockSkewSeconds || skew < -MaxWitnessClockSkewSeconds {
+		return nil, fmt.Errorf("checkpoint timestamp outside witness window")
+	}
+
+	forked, err := store.HasForkEvidence(device)
+	if err != nil {
+		return nil, fmt.Errorf("fork evidence check failed: %w", err)
+	}
+	if forked {
+		return nil, fmt.Errorf("device has fork evidence")
+	}
+	if known, err := store.GetLatestCheckpoint(device); err == nil && known.GetRecordIndex() > checkpoint.GetRecordIndex() {
+		return nil, fmt.Errorf("checkpoint at index %d rolls back known index %d", checkpoint.GetRecordIndex(), known.GetRecordIndex())
+	}
+
+	witness := &pb.CheckpointWitness{
+		WitnessPubkey:    witnessPubkey,
+		EncounterCluster: cluster,
+		SigningVersion:   wire.CanonicalSigning,
+	}
+	sig, err := signer.Sign(dag.CheckpointWitnessSignableBytes(checkpoint, witness))
+	if err != nil {
+		return nil, fmt.Errorf("sign checkpoint witness: %w", err)
+	}
+	witness.WitnessSig = sig
+	return &pb.WitnessResponse{CheckpointSig: checkpoint.GetDeviceSig(), Witness: witness}, nil
+}
+
+// AddWitness is the device side: it attaches a returned witness to the matching local checkpoint
+// and stores the recomputed confidence.
+func AddWitness(store *storage.Store, devicePubkey []byte, resp *pb.WitnessResponse) (*pb.Checkpoint, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store is required")
+	}
+	if resp == nil || resp.GetWitness() == nil {
+		return nil, fmt.Errorf("witness response is empty")
+	}
+	checkpoint, err := store.GetLatestCheckpoint(devicePubkey)
+	if err != nil {
+		return nil, fmt.Errorf("load checkpoint: %w", err)
+	}
+	if !bytes.Equal(checkpoint.GetDeviceSig(), resp.GetCheckpointSig()) {
+		return nil, fmt.Errorf("witness is for a checkpoint that is no longer the latest")
+	}
+	if err := dag.ValidateCheckpointWitness(checkpoint, resp.GetWitness()); err != nil {
+		return nil, err
+	}
+
+	// Re-filtering also drops a repeated witness key.
+	checkpoint.Witnesses = append(checkpoint.Witnesses, resp.GetWitness())
+	checkpoint.Witnesses = dag.VerifiedWitnesses(checkpoint)
+	checkpoint.Confidence = checkpointConfidence(store, checkpoint)
+	if err := store.UpdateCheckpointWitnesses(devicePubkey, checkpoint.GetDeviceSig(), checkpoint.GetWitnesses(), checkpoint.GetConfidence()); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// checkpointConfidence derives confidence from the checkpoint's witnesses; callers must have
+// filtered them with dag.VerifiedWitnesses first.
+func checkpointConfidence(store *storage.Store, checkpoint *pb.Checkpoint) pb.ConfidenceLevel {
+	records, err := store.GetRecordsByDevice(checkpoint.GetDevicePubkey(), 0, checkpointRecordWindow)
+	if err != nil {
+		records = nil
+	}
+	confidence, _ := credit.CheckpointConfidence(checkpoint.GetWitnesses(), records, checkpoint.GetDevicePubkey())
+	return confidence
+}
@@ -1,92 +1,179 @@
 package identity
 
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
+	"fmt"
 	"time"
 
 	crypto "github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	storage "github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
 
-func NewIdentity(store *storage.Store) (*DeviceIdentity, error) {
-	pubkey, privateKey, err := crypto.GenerateKeyPair()
+// NewIdentity generates the device key in keys and persists the public identity.
+func NewIdentity(store *storage.Store, keys KeyStore) (*DeviceIdentity, error) {
+	if keys == nil {
+		return nil, errors.New("key store is required")
+	}
+	pubkey, err := keys.Generate()
 	if err != nil {
 		return nil, err
 	}
 	
-	// Persist public identity metadata in storage; private key is returned to caller/runtime.
 	createdAt := time.Now().Unix()
-	err = store.InitIdentity(pubkey, privateKey, createdAt)
+	err = store.InitIdentity(pubkey, createdAt)
 		if err != nil {
 		return nil, err
 	}
 
 	return &DeviceIdentity{
 		Pubkey: pubkey,
-		PrivateKey: privateKey,
 		CreatedAt: createdAt,
+		Keys: keys,
 	}, nil
 }
 
-func LoadIdentity(store *storage.Store) (*DeviceIdentity, error) {
+// LoadIdentity reads the stored identity and checks keys can still sign for it, so a missing
+// key or a wrong passphrase fails here rather than on the first signature.
+func LoadIdentity(store *storage.Store, keys KeyStore) (*DeviceIdentity, error) {
+	if keys == nil {
+		return nil, errors.New("key store is required")
+	}
 	identity, err := store.GetIdentity()
 	if err != nil {
 		return nil, err
 	}
 
-	return &DeviceIdentity{
+	dev := &DeviceIdentity{
 		Pubkey: identity.Pubkey,
-		PrivateKey: identity.PrivateKey,
 		ChainHead: identity.ChainHead,
 		CreatedAt: identity.CreatedAt,
-	}, nil
+		Keys: keys,
+	}
+	if err := dev.checkKey(); err != nil {
+		return nil, fmt.Errorf("load identity key: %w", err)
+	}
+	return dev, nil
 }
 
-func CreateSuccessionRecord(oldPrivateKey, oldPublicKey, newPublicKey []byte) (*SuccessionRecord, error) {
-
-	timestamp := time.Now().Unix()
-
-	message := generateSuccessionRecordMessage(oldPublicKey, newPublicKey, timestamp)
-
-	signature, err := crypto.Sign(oldPrivateKey, message)
+// RecoverIdentity replaces a stored identity whose private key is gone, as on installs that
+// kept no sealed key. Nothing can sign a succession for the lost key, so the device starts over
+// under a fresh key and is a new device to its peers.
+func RecoverIdentity(store *storage.Store, keys KeyStore) (*DeviceIdentity, error) {
+	if keys == nil {
+		return nil, errors.New("key store is required")
+	}
+	pubkey, err := keys.Generate()
 	if err != nil {
 		return nil, err
 	}
 
-	return &SuccessionRecord{
-		OldPubkey: oldPublicKey,
-		NewPubkey: newPublicKey,
-		Timestamp: timestamp,
-		Signature: signature,
+	createdAt := time.Now().Unix()
+	if err := store.ReplaceIdentity(pubkey, createdAt); err != nil {
+		return nil, err
+	}
+	return &DeviceIdentity{
+		Pubkey:    pubkey,
+		CreatedAt: createdAt,
+		Keys:      keys,
 	}, nil
 }
 
-func VerifySuccessionRecord(record *SuccessionRecord) (bool, error) {
-	message := generateSuccessionRecordMessage(record.OldPubkey, record.NewPubkey, record.Timestamp)
-	ok, err := crypto.Verify(record.OldPubkey, message, record.Signature)
+// Sign signs message with the identity key. DeviceIdentity satisfies the Signer interfaces
+// used by transfer, gossip and node.
+func (d *DeviceIdentity) Sign(message []byte) ([]byte, error) {
+	if d.Keys == nil {
+		return nil, errors.New("identity has no key store")
+	}
+	return d.Keys.Sign(d.Pubkey, message)
+}
+
+func (d *DeviceIdentity) checkKey() error {
+	probe := append([]byte("identity-key-check:"), d.Pubkey...)
+	signature, err := d.Sign(probe)
 	if err != nil {
-		return false, err
+		return err
+	}
+	ok, err := crypto.Verify(d.Pubkey, probe, signature)
+	if err != nil {
+		return err
 	}
 	if !ok {
-		return false, nil
+		return errors.New("key store signature does not match the identity")
 	}
-	return true, nil
+	return nil
 }
 
+// CreateSuccessionRecord hands the identity from the old key to the new one. finalHead is the
+// old key's chain head; the old key must not sign anything past it.
+func CreateSuccessionRecord(oldPrivateKey, oldPublicKey, newPublicKey []byte, finalHead *pb.ChainHead) (*pb.SuccessionRecord, error) {
+	record := &pb.SuccessionRecord{
+		OldPubkey: oldPublicKey,
+		NewPubkey: newPublicKey,
+		Timestamp: time.Now().Unix(),
+		FinalHead: finalHead,
+	}
 
-func generateSuccessionRecordMessage(oldPublicKey, newPublicKey []byte, timestamp int64) []byte {
+	return signSuccession(record, func(message []byte) ([]byte, error) {
+		return crypto.Sign(oldPrivateKey, message)
+	})
+}
 
-	// build message by appending raw bytes in a fixed order
-	message := make([]byte, 0, len(oldPublicKey)+len(newPublicKey)+8)
-	message = append(message, oldPublicKey...)
-	message = append(message, newPublicKey...)
+func signSuccession(record *pb.SuccessionRecord, sign func([]byte) ([]byte, error)) (*pb.SuccessionRecord, error) {
+	record.SigningVersion = wire.CanonicalSigning
+	signature, err := sign(dag.SuccessionSignableBytes(record))
+	if err != nil {
+		return nil, err
+	}
+	record.Signature = signature
+	return record, nil
+}
 
-	// timestamp needs to be exactly 8 bytes (uint64)
-	ts := make([]byte, 8)
+func VerifySuccessionRecord(record *pb.SuccessionRecord) (bool, error) {
+	if err := dag.ValidateSuccessionRecord(record); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	binary.BigEndian.PutUint64(ts, uint64(timestamp))
-	message = append(message, ts...)
+// RotateIdentity retires current's key in favour of a fresh one from the same key store. The
+// device keeps its creation time, and its history and balance carry over through the stored
+// succession.
+func RotateIdentity(store *storage.Store, current *DeviceIdentity) (*DeviceIdentity, *pb.SuccessionRecord, error) {
+	if current == nil || current.Keys == nil {
+		return nil, nil, errors.New("current key store is required")
+	}
+	head, err := store.LocalChainHead()
+	if err != nil {
+		return nil, nil, err
+	}
+	pubkey, err := current.Keys.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(pubkey, current.Pubkey) {
+		return nil, nil, errors.New("key store cannot generate a new key")
+	}
+	succession, err := signSuccession(&pb.SuccessionRecord{
+		OldPubkey: current.Pubkey,
+		NewPubkey: pubkey,
+		Timestamp: time.Now().Unix(),
+		FinalHead: head,
+	}, current.Sign)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.RotateIdentity(succession); err != nil {
+		return nil, nil, err
+	}
 
-	return message
-}
\ No newline at end of file
+	return &DeviceIdentity{
+		Pubkey:    pubkey,
+		CreatedAt: current.CreatedAt,
+		Keys:      current.Keys,
+	}, succession, nil
+}
@@ -0,0 +1,119 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	crypto "github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	storage "github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+)
+
+func TestPassphraseKeySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.db")
+	passphrase := []byte("correct horse battery staple")
+
+	store, err := storage.OpenDatabase(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	dev, err := NewIdentity(store, NewPassphraseKeyStore(store, passphrase, DefaultArgon2Params()))
+	if err != nil {
+		t.Fatalf("new identity: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close db: %v", err)
+	}
+
+	store, err = storage.OpenDatabase(path)
+	if err != nil {
+		t.Fatalf("reopen db: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := LoadIdentity(store, NewPassphraseKeyStore(store, []byte("wrong"), DefaultArgon2Params())); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	loaded, err := LoadIdentity(store, NewPassphraseKeyStore(store, passphrase, DefaultArgon2Params()))
+	if err != nil {
+		t.Fatalf("load identity: %v", err)
+	}
+	message := []byte("signed after restart")
+	sig, err := loaded.Sign(message)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, _ := crypto.Verify(dev.Pubkey, message, sig); !ok {
+		t.Fatalf("signature after restart does not verify under the original key")
+	}
+
+	rotated, succession, err := RotateIdentity(store, loaded)
+	if err != nil {
+		t.Fatalf("rotate identity: %v", err)
+	}
+	if ok, err := VerifySuccessionRecord(succession); !ok {
+		t.Fatalf("succession does not verify: %v", err)
+	}
+	if _, err := LoadIdentity(store, NewPassphraseKeyStore(store, passphrase, DefaultArgon2Params())); err != nil {
+		t.Fatalf("load rotated identity: %v", err)
+	}
+	if _, err := rotated.Sign(message); err != nil {
+		t.Fatalf("sign with rotated key: %v", err)
+	}
+}
+
+func TestLoadIdentityWithoutKeyFails(t *testing.T) {
+	store, err := storage.OpenDatabase(filepath.Join(t.TempDir(), "identity.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer store.Close()
+
+	keys := NewMemoryKeyStore()
+	if _, err := NewIdentity(store, keys); err != nil {
+		t.Fatalf("new identity: %v", err)
+	}
+	if _, err := LoadIdentity(store, keys); err != nil {
+		t.Fatalf("load with the same key store: %v", err)
+	}
+	if _, err := LoadIdentity(store, NewMemoryKeyStore()); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+}
+
+func TestRecoverIdentityStartsANewChain(t *testing.T) {
+	store, err := storage.OpenDatabase(filepath.Join(t.TempDir(), "identity.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer store.Close()
+
+	old, err := NewIdentity(store, NewMemoryKeyStore())
+	if err != nil {
+		t.Fatalf("new identity: %v", err)
+	}
+	if err := store.UpdateChainHead([]byte("head"), 4, 10, 20); err != nil {
+		t.Fatalf("update chain head: %v", err)
+	}
+
+	keys := NewMemoryKeyStore()
+	recovered, err := RecoverIdentity(store, keys)
+	if err != nil {
+		t.Fatalf("recover identity: %v", err)
+	}
+	if bytes.Equal(recovered.Pubkey, old.Pubkey) {
+		t.Fatalf("recovered identity kept the lost key")
+	}
+	stored, err := store.GetIdentity()
+	if err != nil {
+		t.Fatalf("get identity: %v", err)
+	}
+	if !bytes.Equal(stored.Pubkey, recovered.Pubkey) || stored.ChainHead != nil || stored.ChainIndex != 0 || stored.CumulativeSent != 0 {
+		t.Fatalf("recovered identity carried the old chain: %+v", stored)
+	}
+	if _, err := LoadIdentity(store, keys); err != nil {
+		t.Fatalf("load recovered identity: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	crypto "github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+)
+
+var (
+	// ErrNoKey is returned when a key store holds no private key for the requested public key.
+	ErrNoKey = errors.New("no private key for this public key")
+	// ErrWrongPassphrase is returned when a sealed key cannot be opened with the given passphrase.
+	ErrWrongPassphrase = errors.New("wrong passphrase for sealed key")
+)
+
+// KeyStore keeps the device's private keys. The rest of the node never handles a private key;
+// it asks the store to sign under a public key. Keys are addressed by public key so a rotation
+// can sign the succession with the old key after generating the new one.
+type KeyStore interface {
+	// Generate creates a key pair, keeps its private half and returns the public key.
+	Generate() ([]byte, error)
+	// Sign signs message with the private key belonging to pubkey, or returns ErrNoKey.
+	Sign(pubkey, message []byte) ([]byte, error)
+}
+
+// SecureElement is a hardware-backed key the native side signs with. The private key never
+// leaves the element.
+type SecureElement interface {
+	PublicKey() ([]byte, error)
+	Sign(message []byte) ([]byte, error)
+}
+
+// SecureElementKeyStore signs with a single key held in a secure element. The element owns its
+// key, so Generate returns that key rather than a new one and the identity cannot be rotated
+// from the Go side.
+type SecureElementKeyStore struct {
+	element SecureElement
+}
+
+func NewSecureElementKeyStore(element SecureElement) *SecureElementKeyStore {
+	return &SecureElementKeyStore{element: element}
+}
+
+func (k *SecureElementKeyStore) Generate() ([]byte, error) {
+	return k.element.PublicKey()
+}
+
+func (k *SecureElementKeyStore) Sign(pubkey, message []byte) ([]byte, error) {
+	own, err := k.element.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(own, pubkey) {
+		return nil, ErrNoKey
+	}
+	signature, err := k.element.Sign(message)
+	if err != nil {
+		return nil, err
+	}
+	// The element is native code; a signature that does not verify must not reach the wire.
+	ok, err := crypto.Verify(pubkey, message, signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("secure element returned an invalid signature")
+	}
+	return signature, nil
+}
+
+// MemoryKeyStore keeps plaintext keys in memory. It is meant for tests and tools: a node that
+// reopens its database with the same MemoryKeyStore signs with the same key, but nothing
+// survives the process.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string][]byte)}
+}
+
+func (k *MemoryKeyStore) Generate() ([]byte, error) {
+	pubkey, privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.keys[string(pubkey)] = privateKey
+	k.mu.Unlock()
+	return pubkey, nil
+}
+
+func (k *MemoryKeyStore) Sign(pubkey, message []byte) ([]byte, error) {
+	k.mu.Lock()
+	privateKey, ok := k.keys[string(pubkey)]
+	k.mu.Unlock()
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return crypto.Sign(privateKey, message)
+}
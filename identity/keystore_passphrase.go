@@ -0,0 +1,190 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	crypto "github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	storage "github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params sets the cost of deriving a sealing key from a passphrase. The parameters are
+// stored with every sealed key, so raising them later does not strand older keys.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// DefaultArgon2Params follows the RFC 9106 recommendation for memory-constrained devices.
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+const argon2SaltSize = 16
+
+// SealedKeyStore persists sealed keys. Implemented by storage.Store in production.
+type SealedKeyStore interface {
+	SaveSealedKey(key *storage.SealedKey) error
+	GetSealedKey(pubkey []byte) (*storage.SealedKey, error)
+}
+
+// PassphraseKeyStore keeps software keys encrypted at rest: each private key is sealed with
+// AES-256-GCM under a key derived from the passphrase with Argon2id and a per-key salt. Opened
+// keys are held in memory so the derivation runs once per key per process.
+type PassphraseKeyStore struct {
+	store      SealedKeyStore
+	passphrase []byte
+	params     Argon2Params
+
+	mu     sync.Mutex
+	opened map[string][]byte
+}
+
+func NewPassphraseKeyStore(store SealedKeyStore, passphrase []byte, params Argon2Params) *PassphraseKeyStore {
+	return &PassphraseKeyStore{
+		store:      store,
+		passphrase: append([]byte(nil), passphrase...),
+		params:     params,
+		opened:     make(map[string][]byte),
+	}
+}
+
+func (k *PassphraseKeyStore) Generate() ([]byte, error) {
+	pubkey, privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealKey(pubkey, privateKey, k.passphrase, k.params)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.store.SaveSealedKey(sealed); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.opened[string(pubkey)] = privateKey
+	k.mu.Unlock()
+	return pubkey, nil
+}
+
+func (k *PassphraseKeyStore) Sign(pubkey, message []byte) ([]byte, error) {
+	privateKey, err := k.open(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(privateKey, message)
+}
+
+func (k *PassphraseKeyStore) open(pubkey []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if privateKey, ok := k.opened[string(pubkey)]; ok {
+		return privateKey, nil
+	}
+
+	sealed, err := k.store.GetSealedKey(pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := openKey(sealed, k.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k.opened[string(pubkey)] = privateKey
+	return privateKey, nil
+}
+
+// Reseal re-encrypts the key for pubkey, sealed under oldPassphrase, under this store's
+// passphrase.
+func (k *PassphraseKeyStore) Reseal(pubkey, oldPassphrase []byte) error {
+	sealed, err := k.store.GetSealedKey(pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoKey
+	}
+	if err != nil {
+		return err
+	}
+	privateKey, err := openKey(sealed, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	resealed, err := sealKey(pubkey, privateKey, k.passphrase, k.params)
+	if err != nil {
+		return err
+	}
+	if err := k.store.SaveSealedKey(resealed); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.opened[string(pubkey)] = privateKey
+	k.mu.Unlock()
+	return nil
+}
+
+func sealKey(pubkey, privateKey, passphrase []byte, params Argon2Params) (*storage.SealedKey, error) {
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := sealingCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &storage.SealedKey{
+		Pubkey: pubkey,
+		Salt:   salt,
+		Nonce:  nonce,
+		// Binding the public key as additional data stops a box being moved to another key's row.
+		Ciphertext: aead.Seal(nil, nonce, privateKey, pubkey),
+		KDFTime:    params.Time,
+		KDFMemory:  params.Memory,
+		KDFThreads: params.Threads,
+		CreatedAt:  time.Now().Unix(),
+	}, nil
+}
+
+func openKey(sealed *storage.SealedKey, passphrase []byte) ([]byte, error) {
+	params := Argon2Params{Time: sealed.KDFTime, Memory: sealed.KDFMemory, Threads: sealed.KDFThreads}
+	aead, err := sealingCipher(passphrase, sealed.Salt, params)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, sealed.Pubkey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if len(privateKey) != ed25519.PrivateKeySize ||
+		!bytes.Equal(ed25519.PrivateKey(privateKey).Public().(ed25519.PublicKey), sealed.Pubkey) {
+		return nil, errors.New("sealed key does not match its public key")
+	}
+	return privateKey, nil
+}
+
+func sealingCipher(passphrase, salt []byte, params Argon2Params) (cipher.AEAD, error) {
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		return nil, errors.New("argon2 parameters must be non-zero")
+	}
+	key := argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,16 +2,10 @@ package identity
 
 type DeviceIdentity struct {
 	Pubkey []byte
-	PrivateKey []byte
 	ChainHead []byte
 	CreatedAt int64
-}
-
-type SuccessionRecord struct {
-    OldPubkey []byte
-    NewPubkey []byte
-    Timestamp int64
-    Signature []byte
+	// Keys holds the private half of Pubkey.
+	Keys KeyStore
 }
 
 
@@ -14,6 +14,7 @@ import (
 	"github.com/nyshthefantastic/burnt-peanut-network-core/node"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 	"google.golang.org/protobuf/proto"
 )
@@ -134,6 +135,17 @@ func (s *testFileStorage) HasChunk(fileHash []byte, chunkIndex uint32) (bool, er
 	return ok, nil
 }
 
+type testMetaSource struct {
+	meta *pb.FileMeta
+}
+
+func (m *testMetaSource) GetFileMeta(fileHash []byte) (*pb.FileMeta, error) {
+	if !bytes.Equal(fileHash, m.meta.GetFileHash()) {
+		return nil, fmt.Errorf("file meta not found")
+	}
+	return m.meta, nil
+}
+
 func openStore(t *testing.T, name string) *storage.Store {
 	t.Helper()
 	path := filepath.Join(t.TempDir(), name)
@@ -154,7 +166,15 @@ func TestEngC_TransferResumeCoSign_E2E(t *testing.T) {
 		t.Fatalf("generate peer keys: %v", err)
 	}
 
-	fileHash := []byte("file-hash")
+	chunks := [][]byte{[]byte("chunk-0"), []byte("chunk-1"), []byte("chunk-2")}
+	whole := mlcrypto.Hash(bytes.Join(chunks, nil))
+	fileHash := whole[:]
+	meta := &pb.FileMeta{FileHash: fileHash, FileSize: 21, ChunkSize: 7}
+	for _, c := range chunks {
+		h := mlcrypto.Hash(c)
+		meta.ChunkHashes = append(meta.ChunkHashes, h[:])
+	}
+
 	req := &pb.TransferRequest{
 		RequesterPubkey: localPub,
 		FileHash:        fileHash,
@@ -166,24 +186,27 @@ func TestEngC_TransferResumeCoSign_E2E(t *testing.T) {
 	// Expected resume request after chunk-0 already exists.
 	expectedReq := proto.Clone(req).(*pb.TransferRequest)
 	expectedReq.ChunkIndices = []uint32{1, 2}
+	expectedReq.SigningVersion = wire.CanonicalSigning
 	expectedSig, err := mlcrypto.Sign(localPriv, dag.TransferRequestSignableBytes(expectedReq))
 	if err != nil {
 		t.Fatalf("sign expected resume request: %v", err)
 	}
 	expectedReq.Signature = expectedSig
-	reqBytes, _ := proto.Marshal(expectedReq)
-	reqHash := mlcrypto.Hash(reqBytes)
-
-	record := &pb.ShareRecord{
-		SenderPubkey:       peerPub,
-		ReceiverPubkey:     localPub,
-		SenderRecordIndex:  1,
-		ReceiverRecordIndex: 1,
-		RequestHash:        reqHash[:],
-		FileHash:           fileHash,
-		BytesTotal:         512,
-		Timestamp:          999,
-		Visibility:         pb.Visibility_VISIBILITY_PUBLIC,
+	// The sender builds the record for what it delivered, linked onto both chains.
+	record, err := dag.BuildShareRecord(dag.ShareRecordParams{
+		SenderPubkey:   peerPub,
+		ReceiverPubkey: localPub,
+		Request:        expectedReq,
+		Chunks: []*pb.ChunkData{
+			{ChunkIndex: 1, Data: chunks[1]},
+			{ChunkIndex: 2, Data: chunks[2]},
+		},
+		Timestamp:      999,
+		Visibility:     pb.Visibility_VISIBILITY_PUBLIC,
+		SigningVersion: wire.CanonicalSigning,
+	})
+	if err != nil {
+		t.Fatalf("build share record: %v", err)
 	}
 	peerSig, err := mlcrypto.Sign(peerPriv, dag.SignableBytes(record))
 	if err != nil {
@@ -208,8 +231,8 @@ func TestEngC_TransferResumeCoSign_E2E(t *testing.T) {
 					ChunkBatch: &pb.ChunkBatch{
 						FileHash: fileHash,
 						Chunks: []*pb.ChunkData{
-							{ChunkIndex: 1, Data: []byte("chunk-1")},
-							{ChunkIndex: 2, Data: []byte("chunk-2")},
+							{ChunkIndex: 1, Data: chunks[1]},
+							{ChunkIndex: 2, Data: chunks[2]},
 						},
 					},
 				},
@@ -223,7 +246,7 @@ func TestEngC_TransferResumeCoSign_E2E(t *testing.T) {
 	}
 
 	fs := newTestFileStorage()
-	_ = fs.WriteChunk(fileHash, 0, []byte("already-have"))
+	_ = fs.WriteChunk(fileHash, 0, chunks[0])
 	chain := &testChainAppender{}
 	signer := &testSigner{priv: localPriv}
 
@@ -237,6 +260,7 @@ func TestEngC_TransferResumeCoSign_E2E(t *testing.T) {
 		signer,
 	)
 	session.SetFileStorage(fs)
+	session.SetFileMetaSource(&testMetaSource{meta: meta})
 	session.SetPendingRequest(req)
 	session.SetLocalPubKey(localPub)
 
@@ -294,7 +318,7 @@ func TestEngC_GossipDiscoveryNode_E2E(t *testing.T) {
 	storeB := openStore(t, "b.db")
 	defer storeB.Close()
 
-	if err := storeA.InitIdentity([]byte("node-a"), nil, time.Now().Unix()); err != nil {
+	if err := storeA.InitIdentity([]byte("node-a"), time.Now().Unix()); err != nil {
 		t.Fatalf("init identity A: %v", err)
 	}
 	if err := storeB.UpsertPeer(&pb.PeerInfo{
@@ -365,3 +389,185 @@ func TestEngC_GossipDiscoveryNode_E2E(t *testing.T) {
 		t.Fatalf("unexpected peer from node routing")
 	}
 }
+
+// linkTransport is one end of an in-memory link between two sessions.
+type linkTransport struct {
+	peerID  string
+	in      chan *pb.Envelope
+	out     chan *pb.Envelope
+	preRecv []*pb.Envelope
+}
+
+func newLinkPair() (*linkTransport, *linkTransport) {
+	ab := make(chan *pb.Envelope, 64)
+	ba := make(chan *pb.Envelope, 64)
+	return &linkTransport{peerID: "b", in: ba, out: ab}, &linkTransport{peerID: "a", in: ab, out: ba}
+}
+
+func (l *linkTransport) Send(env *pb.Envelope) error {
+	l.out <- proto.Clone(env).(*pb.Envelope)
+	return nil
+}
+
+func (l *linkTransport) Recv() (*pb.Envelope, error) {
+	if len(l.preRecv) > 0 {
+		env := l.preRecv[0]
+		l.preRecv = l.preRecv[1:]
+		return env, nil
+	}
+	select {
+	case env := <-l.in:
+		return env, nil
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("link idle")
+	}
+}
+
+func (l *linkTransport) TryRecv() (*pb.Envelope, bool) {
+	if len(l.preRecv) > 0 {
+		env := l.preRecv[0]
+		l.preRecv = l.preRecv[1:]
+		return env, true
+	}
+	select {
+	case env := <-l.in:
+		return env, true
+	default:
+		return nil, false
+	}
+}
+
+func (l *linkTransport) PutBack(env *pb.Envelope) {
+	l.preRecv = append([]*pb.Envelope{env}, l.preRecv...)
+}
+
+func (l *linkTransport) PeerID() string { return l.peerID }
+
+func (l *linkTransport) Close() error { return nil }
+
+func TestEngC_GranteeDownloadsPrivateFile_E2E(t *testing.T) {
+	ownerPub, ownerPriv, _ := mlcrypto.GenerateKeyPair()
+	granteePub, granteePriv, _ := mlcrypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	chunks := [][]byte{[]byte("private-0"), []byte("private-1"), []byte("priv-2")}
+	whole := mlcrypto.Hash(bytes.Join(chunks, nil))
+	fileHash := whole[:]
+	meta := &pb.FileMeta{
+		FileHash:       fileHash,
+		FileName:       "private.bin",
+		FileSize:       24,
+		ChunkSize:      9,
+		OriginPubkey:   ownerPub,
+		CreatedAt:      now,
+		SigningVersion: wire.CanonicalSigning,
+	}
+	ownerFiles := newTestFileStorage()
+	for i, c := range chunks {
+		h := mlcrypto.Hash(c)
+		meta.ChunkHashes = append(meta.ChunkHashes, h[:])
+		_ = ownerFiles.WriteChunk(fileHash, uint32(i), c)
+	}
+	originSig, err := mlcrypto.Sign(ownerPriv, dag.FileMetaSignableBytes(meta))
+	if err != nil {
+		t.Fatalf("sign file meta: %v", err)
+	}
+	meta.OriginSig = originSig
+
+	ownerStore := openStore(t, "owner.db")
+	defer ownerStore.Close()
+	if err := ownerStore.InitIdentity(ownerPub, now); err != nil {
+		t.Fatalf("init owner identity: %v", err)
+	}
+	if err := ownerStore.InsertFileMeta(meta); err != nil {
+		t.Fatalf("insert file meta: %v", err)
+	}
+	if err := ownerStore.SetFileVisibility(fileHash, pb.Visibility_VISIBILITY_PRIVATE); err != nil {
+		t.Fatalf("mark file private: %v", err)
+	}
+
+	// The grant reaches the grantee out of band, with the metadata it needs to request the file.
+	capability, err := discovery.CreateCapability(fileHash, granteePub, ownerPub, ownerPriv, now+600)
+	if err != nil {
+		t.Fatalf("create capability: %v", err)
+	}
+	if err := discovery.AttachFileMeta(capability, meta); err != nil {
+		t.Fatalf("attach file meta: %v", err)
+	}
+	granteeStore := openStore(t, "grantee.db")
+	defer granteeStore.Close()
+	if err := granteeStore.InitIdentity(granteePub, now); err != nil {
+		t.Fatalf("init grantee identity: %v", err)
+	}
+	if err := granteeStore.SaveCapability(capability); err != nil {
+		t.Fatalf("save capability: %v", err)
+	}
+	held, err := granteeStore.FindCapability(fileHash, now)
+	if err != nil {
+		t.Fatalf("find capability: %v", err)
+	}
+	if held.GetFileMeta() != nil {
+		t.Fatalf("expected the held capability to drop the file metadata")
+	}
+
+	granteeLink, ownerLink := newLinkPair()
+	served := make(chan error, 1)
+	go func() {
+		env, err := ownerLink.Recv()
+		if err != nil {
+			served <- err
+			return
+		}
+		req := env.GetTransferRequest()
+		s := transfer.NewSession("grantee", transfer.DirectionInbound, req.GetFileHash(), ownerLink, ownerStore, &testBalance{value: 1}, &testSigner{priv: ownerPriv})
+		s.SetFileStorage(ownerFiles)
+		s.SetLocalPubKey(ownerPub)
+		s.SetPolicyStore(ownerStore)
+		s.SetChainHeadSource(ownerStore)
+		s.SetPendingRequest(req)
+		served <- s.RunSession(t.Context())
+	}()
+
+	granteeFiles := newTestFileStorage()
+	req := &pb.TransferRequest{
+		RequesterPubkey: granteePub,
+		FileHash:        fileHash,
+		ChunkIndices:    []uint32{0, 1, 2},
+		Nonce:           []byte("grantee-nonce-0001"),
+		Timestamp:       now,
+		Capability:      held,
+	}
+	s := transfer.NewSession("owner", transfer.DirectionOutbound, fileHash, granteeLink, granteeStore, &testBalance{value: 1}, &testSigner{priv: granteePriv})
+	s.SetFileStorage(granteeFiles)
+	s.SetLocalPubKey(granteePub)
+	s.SetPolicyStore(granteeStore)
+	s.SetChainHeadSource(granteeStore)
+	s.SetPendingRequest(req)
+	if err := s.RunSession(t.Context()); err != nil {
+		t.Fatalf("grantee session: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("owner session: %v", err)
+	}
+	if err := transfer.VerifyFileHash(meta, granteeFiles); err != nil {
+		t.Fatalf("expected the grantee to hold the whole file: %v", err)
+	}
+
+	// The download stays private: its record says so and the grantee never seeds the file.
+	records, err := granteeStore.GetRecordsAtIndex(granteePub, 1)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected the settled record on the grantee's chain, got %d, %v", len(records), err)
+	}
+	if records[0].GetVisibility() != pb.Visibility_VISIBILITY_PRIVATE {
+		t.Fatalf("expected a private share record, got %v", records[0].GetVisibility())
+	}
+	payload, err := gossip.BuildGossipPayload(granteeStore)
+	if err != nil {
+		t.Fatalf("build gossip payload: %v", err)
+	}
+	for _, f := range payload.GetSeedingFiles() {
+		if bytes.Equal(f.GetFileHash(), fileHash) {
+			t.Fatalf("expected the downloaded private file not to be seeded")
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package node
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -12,6 +14,7 @@ import (
 	"github.com/nyshthefantastic/burnt-peanut-network-core/gossip"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
@@ -24,6 +27,14 @@ type Transport interface {
 	Close() error
 }
 
+// AuthenticatedTransport is a Transport whose link verified the peer's identity key, as the
+// handshake does. Without one the peer is unauthenticated and nothing is done on its word.
+type AuthenticatedTransport interface {
+	Transport
+	// PeerIdentity is the key the peer proved it holds, nil until it has.
+	PeerIdentity() []byte
+}
+
 type Signer interface {
 	Sign(message []byte) ([]byte, error)
 }
@@ -44,6 +55,14 @@ type Node struct {
 
 	checkpointInterval int
 	lastCheckpointAt   int64
+	// encounterCluster is the label this node puts on checkpoints it witnesses.
+	encounterCluster string
+	// policy is what requesters are held to before this node serves them.
+	policy pb.ServicePolicy
+
+	forks *gossip.ForkMonitor
+	// onFork, when set, is told about every device this node stores fork evidence against.
+	onFork func(devicePubkey []byte)
 }
 
 func New(store *storage.Store, transport Transport, maxConcurrentTransfers int, signer ...Signer) (*Node, error) {
@@ -66,7 +85,7 @@ func New(store *storage.Store, transport Transport, maxConcurrentTransfers int,
 		s = signer[0]
 	}
 
-	return &Node{
+	n := &Node{
 		store:     store,
 		identity:  identity,
 		transfer:  transfer.NewSessionManager(maxConcurrentTransfers),
@@ -77,7 +96,9 @@ func New(store *storage.Store, transport Transport, maxConcurrentTransfers int,
 		ctx:       ctx,
 		cancel:    cancel,
 		checkpointInterval: 100,
-	}, nil
+	}
+	n.forks = gossip.NewForkMonitor(store, identity.Pubkey, s, n.notifyFork)
+	return n, nil
 }
 
 func (n *Node) Start() error {
@@ -123,13 +144,27 @@ func (n *Node) eventLoop() {
 			continue
 		}
 
+		// Relay faults are charged to the key the peer proved; an unauthenticated peer is not
+		// charged, since its link id could name anyone.
+		relay := n.peerIdentity()
 		switch payload := env.Payload.(type) {
 		case *pb.Envelope_Gossip:
-			_ = gossip.ProcessGossipPayload(n.store, payload.Gossip)
+			// Nothing from a faulty relay is read, not even to look for forks.
+			if err := gossip.ProcessGossipPayload(n.store, payload.Gossip, relay); !errors.Is(err, gossip.ErrFaultyRelay) {
+				n.forks.CheckGossip(payload.Gossip)
+			}
+		case *pb.Envelope_ForkEvidence:
+			if gossip.AcceptForkEvidence(n.store, payload.ForkEvidence, relay) == nil {
+				n.notifyFork(payload.ForkEvidence.GetDevicePubkey())
+			}
 		case *pb.Envelope_TransferRequest:
 			_ = n.handleTransferRequest(payload.TransferRequest)
 		case *pb.Envelope_ShareRecord:
 			_ = n.handleShareRecord(payload.ShareRecord)
+		case *pb.Envelope_WitnessRequest:
+			_ = n.handleWitnessRequest(payload.WitnessRequest)
+		case *pb.Envelope_WitnessResponse:
+			_, _ = gossip.AddWitness(n.store, n.identity.Pubkey, payload.WitnessResponse)
 		default:
 			// Unknown or unhandled payload type.
 		}
@@ -147,36 +182,107 @@ func (n *Node) checkpointLoop() {
 		case <-n.ctx.Done():
 			return
 		case <-ticker.C:
-			records, err := n.store.GetRecordsByDevice(n.identity.Pubkey, 0, 500)
+			// Requests older than the window are rejected anyway, so their nonces can go.
+			_ = n.store.ExpireOldRequests(transfer.DefaultTransferRequestTTLSeconds)
+			head, err := n.store.GetLatestRecord(n.identity.Pubkey)
+			if err != nil {
+				continue
+			}
+			params, err := credit.LocalParams(n.store)
 			if err != nil {
 				continue
 			}
-			if len(records) == 0 {
+			ledger, window, err := n.store.LineageLedger(n.identity.Pubkey, params, nil)
+			if err != nil {
+				continue
+			}
+			cp, _, err := credit.LedgerCheckpoint(ledger, window, head, time.Now().Unix(), params, nil)
+			if err != nil {
 				continue
 			}
-			lastRecord := records[len(records)-1]
-			if !credit.ShouldCheckpoint(n.lastCheckpointAt, lastRecord.GetTimestamp(), len(records), n.checkpointInterval) {
+			recordsSince := int(cp.GetRecordIndex())
+			if last, err := n.store.GetLatestCheckpoint(n.identity.Pubkey); err == nil {
+				recordsSince -= int(last.GetRecordIndex())
+			}
+			if recordsSince <= 0 || !credit.ShouldCheckpoint(n.lastCheckpointAt, head.GetTimestamp(), recordsSince, n.checkpointInterval) {
+				continue
+			}
+			// An unsigned checkpoint would be rejected by every peer, so don't make one.
+			if n.signer == nil {
 				continue
 			}
-			cp, _, err := credit.ComputeCheckpoint(records, n.identity.Pubkey, time.Now().Unix(), credit.DefaultParams(), nil)
+			cp.SigningVersion = wire.CanonicalSigning
+			sig, err := n.signer.Sign(dag.CheckpointSignableBytes(cp))
 			if err != nil {
 				continue
 			}
-			if err := n.store.InsertCheckpoint(cp); err == nil {
-				n.lastCheckpointAt = cp.GetTimestamp()
+			cp.DeviceSig = sig
+			if err := n.store.InsertCheckpoint(cp); err != nil {
+				continue
+			}
+			n.lastCheckpointAt = cp.GetTimestamp()
+			// Witnesses come back asynchronously as WitnessResponse envelopes.
+			if env, err := gossip.BuildWitnessRequest(cp); err == nil {
+				_ = n.transport.Send(env)
 			}
 		}
 	}
 }
 
+// SetEncounterCluster sets the cluster label used when witnessing peers' checkpoints.
+func (n *Node) SetEncounterCluster(cluster string) {
+	n.encounterCluster = cluster
+}
+
+// SetServicePolicy sets the policy requesters are held to before this node serves them.
+func (n *Node) SetServicePolicy(policy pb.ServicePolicy) {
+	n.policy = policy
+}
+
+// peerIdentity is the key the transport's peer authenticated with, nil when it has not.
+func (n *Node) peerIdentity() []byte {
+	if t, ok := n.transport.(AuthenticatedTransport); ok {
+		return t.PeerIdentity()
+	}
+	return nil
+}
+
+// handleWitnessRequest co-signs the peer's own checkpoint. A witness vouches for having met the
+// device, so a checkpoint relayed for anyone else is refused.
+func (n *Node) handleWitnessRequest(req *pb.WitnessRequest) error {
+	if req == nil {
+		return fmt.Errorf("witness request is nil")
+	}
+	if n.signer == nil {
+		return fmt.Errorf("witnessing requires a signer")
+	}
+	peer := n.peerIdentity()
+	if len(peer) == 0 {
+		return fmt.Errorf("witnessing requires an authenticated peer")
+	}
+	if !bytes.Equal(req.GetCheckpoint().GetDevicePubkey(), peer) {
+		return fmt.Errorf("checkpoint does not belong to the authenticated peer")
+	}
+	resp, err := gossip.WitnessCheckpoint(n.store, req.GetCheckpoint(), n.identity.Pubkey, n.encounterCluster, n.signer, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return n.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_WitnessResponse{WitnessResponse: resp},
+	})
+}
+
 func (n *Node) handleTransferRequest(req *pb.TransferRequest) error {
 	if req == nil {
 		return fmt.Errorf("transfer request is nil")
 	}
-	if err := dag.ValidateTransferRequest(req); err != nil {
+	if err := transfer.AdmitTransferRequest(req, n.store, time.Now().Unix()); err != nil {
 		return err
 	}
-	if err := transfer.ValidateTransferRequestWindow(req, time.Now().Unix(), transfer.DefaultTransferRequestTTLSeconds); err != nil {
+	if err := transfer.AuthorizeFileAccess(n.store, req, n.identity.Pubkey, time.Now().Unix()); err != nil {
+		return err
+	}
+	if err := n.admitRequester(req.GetRequesterPubkey()); err != nil {
 		return err
 	}
 
@@ -188,13 +294,14 @@ func (n *Node) handleTransferRequest(req *pb.TransferRequest) error {
 			transfer.DirectionInbound,
 			req.GetFileHash(),
 			n.transport,
-			storeChainAppender{store: n.store},
+			storeChainAppender{store: n.store, forks: n.forks},
 			storeBalanceChecker{store: n.store},
 			n.signer,
 		)
 		s.ID = sessionID
 		s.SetPendingRequest(req)
 		s.SetPolicyStore(n.store)
+		s.SetForkDetector(n.forks)
 		_ = n.transfer.Add(s)
 		go func(sess *transfer.TransferSession) {
 			_ = sess.RunSession(n.ctx)
@@ -206,6 +313,15 @@ func (n *Node) handleTransferRequest(req *pb.TransferRequest) error {
 	return nil
 }
 
+// admitRequester holds a requester to the service policy. This node's transport carries no
+// hello, so the policy runs over what is stored for the requester.
+func (n *Node) admitRequester(pubkey []byte) error {
+	if approved, reason := transfer.EvaluateStoredPolicy(n.store, pubkey, n.policy); !approved {
+		return fmt.Errorf("policy rejected: %s", reason)
+	}
+	return nil
+}
+
 func (n *Node) handleShareRecord(record *pb.ShareRecord) error {
 	if record == nil {
 		return fmt.Errorf("share record is nil")
@@ -213,18 +329,20 @@ func (n *Node) handleShareRecord(record *pb.ShareRecord) error {
 	if err := dag.ValidateShareRecord(record); err != nil {
 		return err
 	}
-	if err := n.store.InsertRecord(record); err != nil {
-		return err
-	}
+	// Detection has to see the store without this record, or it would only compare it to itself.
+	n.forks.CheckRecords([]*pb.ShareRecord{record})
+	return n.store.InsertRecord(record)
+}
 
-	// Best-effort fork detection with latest local record.
-	latest, err := n.store.GetLatestRecord(record.GetSenderPubkey())
-	if err == nil && latest != nil {
-		if fork := dag.DetectFork(latest, record, record.GetSenderPubkey()); fork != nil {
-			_ = n.store.InsertForkEvidence(fork)
-		}
+// SetForkListener registers fn to be called for every device this node stores fork evidence against.
+func (n *Node) SetForkListener(fn func(devicePubkey []byte)) {
+	n.onFork = fn
+}
+
+func (n *Node) notifyFork(devicePubkey []byte) {
+	if n.onFork != nil {
+		n.onFork(devicePubkey)
 	}
-	return nil
 }
 
 func (n *Node) AdvertiseFile(meta *pb.FileMeta, chunkIndices []uint32) (*discovery.Advertisement, error) {
@@ -261,16 +379,48 @@ func (n *Node) MatchIncomingAdvertisement(ad *discovery.Advertisement) ([][]byte
 	return out, nil
 }
 
+// AuthorizeFileRequest checks a capability, possibly delegated, and the revocations this node
+// knows of. When the file is known locally its root must be granted by the file's origin or by
+// this node.
 func (n *Node) AuthorizeFileRequest(capability *pb.FileCapability, requesterPubKey []byte, now int64) error {
-	return discovery.ValidateCapability(capability, requesterPubKey, now)
+	var issuers [][]byte
+	if meta, err := n.store.GetFileMeta(capability.GetFileHash()); err == nil {
+		issuers = [][]byte{n.identity.Pubkey, meta.GetOriginPubkey()}
+	}
+	return discovery.ValidateCapabilityChain(capability, requesterPubKey, issuers, n.store.RevokersOf, now)
+}
+
+// RevokeCapability revokes a capability this node granted, or one delegated below it. The
+// revocation is stored and goes out with the next gossip payload.
+func (n *Node) RevokeCapability(capability *pb.FileCapability) (*pb.CapabilityRevocation, error) {
+	if n.signer == nil {
+		return nil, fmt.Errorf("revoking a capability requires a signer")
+	}
+	rev := &pb.CapabilityRevocation{
+		CapabilityId:   discovery.CapabilityID(capability),
+		RevokedBy:      n.identity.Pubkey,
+		RevokedAt:      time.Now().Unix(),
+		SigningVersion: wire.CanonicalSigning,
+	}
+	sig, err := n.signer.Sign(discovery.RevocationSignableBytes(rev))
+	if err != nil {
+		return nil, fmt.Errorf("sign revocation: %w", err)
+	}
+	rev.Signature = sig
+	if err := n.store.InsertRevocation(rev, rev.RevokedAt); err != nil {
+		return nil, err
+	}
+	return rev, nil
 }
 
 type storeChainAppender struct {
 	store *storage.Store
+	forks *gossip.ForkMonitor
 }
 
 func (s storeChainAppender) AppendRecord(record *pb.ShareRecord) error {
-	return s.store.InsertRecord(record)
+	s.forks.CheckRecords([]*pb.ShareRecord{record})
+	return s.store.AppendRecord(record)
 }
 
 type storeBalanceChecker struct {
@@ -278,14 +428,15 @@ type storeBalanceChecker struct {
 }
 
 func (s storeBalanceChecker) EffectiveBalance(records []*pb.ShareRecord, peerPubKey []byte, peerCreatedAt int64) int64 {
-	params := credit.DefaultParams()
-	now := time.Now().Unix()
-	if len(records) == 0 {
-		recs, err := s.store.GetRecordsByDevice(peerPubKey, 0, 1000)
-		if err == nil {
-			records = recs
-		}
+	params, err := credit.LocalParams(s.store)
+	if err != nil {
+		return 0
+	}
+	// The same balance the service policy holds the peer to.
+	breakdown, _, err := transfer.TrustedBreakdown(s.store, peerPubKey, nil, records, peerCreatedAt, params)
+	if err != nil {
+		return 0
 	}
-	return credit.ComputeEffectiveBalance(records, peerPubKey, peerCreatedAt, now, params)
+	return breakdown.Effective
 }
 
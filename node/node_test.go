@@ -1,11 +1,18 @@
 package node
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/transfer"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
@@ -13,9 +20,26 @@ type mockTransport struct {
 	peerID  string
 	recv    []*pb.Envelope
 	preRecv []*pb.Envelope
+	sent    []*pb.Envelope
 	closed  bool
 }
 
+// authedTransport is a link whose peer proved identity in a handshake.
+type authedTransport struct {
+	*mockTransport
+	identity []byte
+}
+
+func (a *authedTransport) PeerIdentity() []byte { return a.identity }
+
+type keySigner struct {
+	priv []byte
+}
+
+func (k keySigner) Sign(message []byte) ([]byte, error) {
+	return crypto.Sign(k.priv, message)
+}
+
 func (m *mockTransport) takePre() (*pb.Envelope, bool) {
 	if len(m.preRecv) == 0 {
 		return nil, false
@@ -25,8 +49,11 @@ func (m *mockTransport) takePre() (*pb.Envelope, bool) {
 	return env, true
 }
 
-func (m *mockTransport) Send(env *pb.Envelope) error { return nil }
-func (m *mockTransport) PeerID() string              { return m.peerID }
+func (m *mockTransport) Send(env *pb.Envelope) error {
+	m.sent = append(m.sent, env)
+	return nil
+}
+func (m *mockTransport) PeerID() string { return m.peerID }
 func (m *mockTransport) Close() error {
 	m.closed = true
 	return nil
@@ -91,7 +118,7 @@ func TestNodeStartStopAndGossipRoute(t *testing.T) {
 	s := testStore(t)
 	defer s.Close()
 
-	if err := s.InitIdentity([]byte("node-local"), nil, time.Now().Unix()); err != nil {
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
 		t.Fatalf("init identity: %v", err)
 	}
 
@@ -143,7 +170,7 @@ func TestNodeStartStopAndGossipRoute(t *testing.T) {
 func TestNodeRejectsExpiredTransferRequest(t *testing.T) {
 	s := testStore(t)
 	defer s.Close()
-	if err := s.InitIdentity([]byte("node-local"), nil, time.Now().Unix()); err != nil {
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
 		t.Fatalf("init identity: %v", err)
 	}
 
@@ -182,7 +209,7 @@ func TestNodeRejectsExpiredTransferRequest(t *testing.T) {
 func TestNodeAdvertiseAndMatchAndAuthorize(t *testing.T) {
 	s := testStore(t)
 	defer s.Close()
-	if err := s.InitIdentity([]byte("node-local"), nil, time.Now().Unix()); err != nil {
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
 		t.Fatalf("init identity: %v", err)
 	}
 	mt := &mockTransport{peerID: "p1"}
@@ -213,3 +240,323 @@ func TestNodeAdvertiseAndMatchAndAuthorize(t *testing.T) {
 		t.Fatalf("expected at least one match")
 	}
 }
+
+func TestNodeRejectsReplayedTransferRequest(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	n, err := New(s, &mockTransport{peerID: "peer-1"}, 4)
+	if err != nil {
+		t.Fatalf("new node: %v", err)
+	}
+	defer n.cancel()
+
+	pub, priv, _ := crypto.GenerateKeyPair()
+	req := &pb.TransferRequest{
+		RequesterPubkey: pub,
+		FileHash:        []byte("f"),
+		ChunkIndices:    []uint32{0},
+		Nonce:           []byte("nonce-1"),
+		Timestamp:       time.Now().Unix(),
+	}
+	req.Signature, _ = crypto.Sign(priv, dag.TransferRequestSignableBytes(req))
+
+	if err := n.handleTransferRequest(req); err != nil {
+		t.Fatalf("expected first request to be admitted: %v", err)
+	}
+	if err := n.handleTransferRequest(req); !errors.Is(err, storage.ErrReplayedNonce) {
+		t.Fatalf("expected replayed nonce to be rejected, got %v", err)
+	}
+
+	// Pruning only forgets nonces whose requests are already outside the window.
+	if err := s.ExpireOldRequests(transfer.DefaultTransferRequestTTLSeconds); err != nil {
+		t.Fatalf("expire old requests: %v", err)
+	}
+	if err := s.ClaimRequestNonce(pub, req.GetNonce(), req.GetTimestamp()); !errors.Is(err, storage.ErrReplayedNonce) {
+		t.Fatalf("expected a live nonce to survive pruning, got %v", err)
+	}
+}
+
+func TestNodeRejectsRequesterFailingPolicy(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	n, err := New(s, &mockTransport{peerID: "peer-1"}, 4)
+	if err != nil {
+		t.Fatalf("new node: %v", err)
+	}
+	defer n.cancel()
+	n.SetServicePolicy(pb.ServicePolicy_POLICY_LIGHT)
+
+	// The requester's checkpoint has no witness, which LIGHT requires.
+	pub, priv, _ := crypto.GenerateKeyPair()
+	cp := &pb.Checkpoint{DevicePubkey: pub, ChainHead: []byte("head"), RecordIndex: 1, Timestamp: time.Now().Unix()}
+	cp.DeviceSig, _ = crypto.Sign(priv, dag.CheckpointSignableBytes(cp))
+	if err := s.InsertCheckpoint(cp); err != nil {
+		t.Fatalf("insert checkpoint: %v", err)
+	}
+	req := &pb.TransferRequest{
+		RequesterPubkey: pub,
+		FileHash:        []byte("f"),
+		ChunkIndices:    []uint32{0},
+		Nonce:           []byte("nonce-1"),
+		Timestamp:       time.Now().Unix(),
+	}
+	req.Signature, _ = crypto.Sign(priv, dag.TransferRequestSignableBytes(req))
+
+	if err := n.handleTransferRequest(req); err == nil {
+		t.Fatalf("expected a requester failing the policy to be refused")
+	}
+	if n.transfer.ActiveCount() != 0 {
+		t.Fatalf("expected no session for a refused requester")
+	}
+}
+
+func TestStoreBalanceCheckerUsesLedgerPastHistoryCap(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	s.SetLedgerCrossCheck(true)
+
+	peer := []byte("heavy-sharer")
+	now := time.Now().Unix()
+	createdAt := now - 400*86400
+	record := func(index uint64) *pb.ShareRecord {
+		r := &pb.ShareRecord{
+			Id:                []byte(fmt.Sprintf("rec-%04d", index)),
+			SenderPubkey:      peer,
+			ReceiverPubkey:    []byte(fmt.Sprintf("peer-%d", index%7)),
+			SenderRecordIndex: index,
+			BytesTotal:        1000 + index,
+			Timestamp:         createdAt + int64(index)*25000,
+			RequestHash:       []byte("req"),
+			FileHash:          []byte("file"),
+			SenderSig:         []byte("sig"),
+			ReceiverSig:       []byte("sig"),
+		}
+		if index%5 == 0 {
+			r.SenderPubkey, r.ReceiverPubkey = r.ReceiverPubkey, peer
+			r.SenderRecordIndex, r.ReceiverRecordIndex = 0, index
+		}
+		return r
+	}
+
+	const total = 1300
+	var all []*pb.ShareRecord
+	insert := func(index uint64) {
+		r := record(index)
+		all = append(all, r)
+		if err := s.InsertRecord(r); err != nil {
+			t.Fatalf("insert record %d: %v", index, err)
+		}
+	}
+	for i := uint64(1); i <= 600; i++ {
+		if i != 250 {
+			insert(i)
+		}
+	}
+	checker := storeBalanceChecker{store: s}
+	params := credit.DefaultParams()
+	// Builds the ledger from storage on first use.
+	if _, _, err := s.BalanceLedger(peer, params); err != nil {
+		t.Fatalf("build ledger: %v", err)
+	}
+	if err := s.InsertCheckpoint(&pb.Checkpoint{
+		DevicePubkey: peer,
+		ChainHead:    []byte("rec-0400"),
+		RecordIndex:  400,
+		Timestamp:    now,
+		DeviceSig:    []byte("sig"),
+	}); err != nil {
+		t.Fatalf("insert checkpoint: %v", err)
+	}
+	for i := uint64(601); i <= total; i++ {
+		insert(i)
+	}
+	// Stored late, below the checkpoint snapshot.
+	insert(250)
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].GetTimestamp() < all[j].GetTimestamp() })
+	want := credit.ComputeEffectiveBalance(all, peer, createdAt, time.Now().Unix(), params)
+	got := checker.EffectiveBalance(nil, peer, createdAt)
+	if diff := got - want; diff > total || diff < -total {
+		t.Fatalf("ledger balance %d, full computation %d", got, want)
+	}
+
+	// A different half-life forces a rebuild, which must agree with the history as well.
+	params.HalfLifeSeconds /= 2
+	if _, _, err := s.BalanceLedger(peer, params); err != nil {
+		t.Fatalf("rebuilt ledger: %v", err)
+	}
+}
+
+func TestStoreBalanceCheckerSumsLineageLedgers(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	s.SetLedgerCrossCheck(true)
+
+	oldKey, oldPriv, _ := crypto.GenerateKeyPair()
+	newKey, _, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+	createdAt := now - 200*86400
+	var history []*pb.ShareRecord
+	insert := func(r *pb.ShareRecord, counts bool) {
+		r.RequestHash, r.FileHash = []byte("req"), []byte("file")
+		r.SenderSig, r.ReceiverSig = []byte("sig"), []byte("sig")
+		if err := s.InsertRecord(r); err != nil {
+			t.Fatalf("insert record %s: %v", r.GetId(), err)
+		}
+		if counts {
+			history = append(history, r)
+		}
+	}
+
+	// More history under the old key than any record window used to hold.
+	const oldRecords = 1200
+	for i := uint64(1); i <= oldRecords; i++ {
+		r := &pb.ShareRecord{
+			Id:                []byte(fmt.Sprintf("old-%04d", i)),
+			SenderPubkey:      oldKey,
+			ReceiverPubkey:    []byte(fmt.Sprintf("peer-%d", i%9)),
+			SenderRecordIndex: i,
+			BytesTotal:        2000 + i,
+			Timestamp:         createdAt + int64(i)*10000,
+		}
+		if i%4 == 0 {
+			r.SenderPubkey, r.ReceiverPubkey = r.ReceiverPubkey, oldKey
+			r.SenderRecordIndex, r.ReceiverRecordIndex = 0, i
+		}
+		insert(r, true)
+	}
+	// One peer is served past the per-peer cap only once both keys are counted together.
+	epochStart := (now - 3600) / credit.DefaultParams().EpochSeconds * credit.DefaultParams().EpochSeconds
+	insert(&pb.ShareRecord{Id: []byte("old-capped"), SenderPubkey: oldKey, ReceiverPubkey: []byte("greedy"),
+		SenderRecordIndex: oldRecords + 1, BytesTotal: 300 * credit.MB, Timestamp: epochStart + 1}, true)
+	// Moving credit between the device's own keys earns nothing.
+	handover := &pb.ShareRecord{Id: []byte("handover"), SenderPubkey: oldKey, ReceiverPubkey: newKey,
+		SenderRecordIndex: oldRecords + 2, ReceiverRecordIndex: 1, BytesTotal: 9 * credit.MB, Timestamp: epochStart + 2}
+	insert(handover, false)
+
+	succession := &pb.SuccessionRecord{
+		OldPubkey: oldKey,
+		NewPubkey: newKey,
+		Timestamp: now,
+		FinalHead: dag.HeadAfter(handover, oldKey),
+	}
+	succession.Signature, _ = crypto.Sign(oldPriv, dag.SuccessionSignableBytes(succession))
+	if err := s.InsertSuccession(succession, now); err != nil {
+		t.Fatalf("insert succession: %v", err)
+	}
+
+	// Signed by the retired key past its final head: a fork, not history.
+	insert(&pb.ShareRecord{Id: []byte("old-forked"), SenderPubkey: []byte("peer-1"), ReceiverPubkey: oldKey,
+		ReceiverRecordIndex: oldRecords + 3, BytesTotal: 50 * credit.MB, Timestamp: epochStart + 3}, false)
+	insert(&pb.ShareRecord{Id: []byte("new-capped"), SenderPubkey: newKey, ReceiverPubkey: []byte("greedy"),
+		SenderRecordIndex: 2, BytesTotal: 300 * credit.MB, Timestamp: epochStart + 4}, true)
+	insert(&pb.ShareRecord{Id: []byte("new-received"), SenderPubkey: []byte("peer-2"), ReceiverPubkey: newKey,
+		ReceiverRecordIndex: 3, BytesTotal: 7000, Timestamp: epochStart + 5}, true)
+
+	params := credit.DefaultParams()
+	ledger, _, err := s.LineageLedger(newKey, params, nil)
+	if err != nil {
+		t.Fatalf("lineage ledger: %v", err)
+	}
+	if ledger.CapReduction != 100*credit.MB {
+		t.Fatalf("expected the cap charged across both keys, got reduction %d", ledger.CapReduction)
+	}
+
+	sort.SliceStable(history, func(i, j int) bool { return history[i].GetTimestamp() < history[j].GetTimestamp() })
+	lineage := [][]byte{newKey, oldKey}
+	want := credit.ComputeLineageBalance(history, lineage, createdAt, time.Now().Unix(), params)
+	got := storeBalanceChecker{store: s}.EffectiveBalance(nil, newKey, createdAt)
+	if diff := got - want; diff > oldRecords || diff < -oldRecords {
+		t.Fatalf("lineage ledger balance %d, full computation %d", got, want)
+	}
+}
+
+func TestNodeWitnessesOnlyTheAuthenticatedPeer(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	localPub, localPriv, _ := crypto.GenerateKeyPair()
+	if err := s.InitIdentity(localPub, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	peerPub, peerPriv, _ := crypto.GenerateKeyPair()
+	otherPub, otherPriv, _ := crypto.GenerateKeyPair()
+	checkpoint := func(pub, priv []byte) *pb.WitnessRequest {
+		cp := &pb.Checkpoint{DevicePubkey: pub, ChainHead: []byte("head"), RecordIndex: 3, Timestamp: time.Now().Unix()}
+		cp.DeviceSig, _ = crypto.Sign(priv, dag.CheckpointSignableBytes(cp))
+		return &pb.WitnessRequest{Checkpoint: cp}
+	}
+
+	// Without an authenticated link nobody's checkpoint is witnessed.
+	mt := &mockTransport{peerID: "peer-1"}
+	n, err := New(s, mt, 2, keySigner{priv: localPriv})
+	if err != nil {
+		t.Fatalf("new node: %v", err)
+	}
+	n.SetEncounterCluster("cafe")
+	if err := n.handleWitnessRequest(checkpoint(peerPub, peerPriv)); err == nil {
+		t.Fatalf("expected an unauthenticated peer's checkpoint to be refused")
+	}
+
+	at := &authedTransport{mockTransport: &mockTransport{peerID: "peer-1"}, identity: peerPub}
+	n, err = New(s, at, 2, keySigner{priv: localPriv})
+	if err != nil {
+		t.Fatalf("new node: %v", err)
+	}
+	n.SetEncounterCluster("cafe")
+	if err := n.handleWitnessRequest(checkpoint(otherPub, otherPriv)); err == nil {
+		t.Fatalf("expected a relayed checkpoint to be refused")
+	}
+	if len(at.sent) != 0 {
+		t.Fatalf("expected no witness to be sent for a refused checkpoint")
+	}
+	if err := n.handleWitnessRequest(checkpoint(peerPub, peerPriv)); err != nil {
+		t.Fatalf("witness the peer's own checkpoint: %v", err)
+	}
+	if len(at.sent) != 1 || at.sent[0].GetWitnessResponse() == nil {
+		t.Fatalf("expected a witness response for the peer's own checkpoint")
+	}
+}
+
+func TestNodeChargesRelayFaultsToTheAuthenticatedPeer(t *testing.T) {
+	s := testStore(t)
+	defer s.Close()
+	if err := s.InitIdentity([]byte("node-local"), time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	bogus := func() *pb.Envelope {
+		return &pb.Envelope{Payload: &pb.Envelope_ForkEvidence{ForkEvidence: &pb.ForkEvidence{DevicePubkey: []byte("victim")}}}
+	}
+	run := func(tr Transport) {
+		t.Helper()
+		n, err := New(s, tr, 2)
+		if err != nil {
+			t.Fatalf("new node: %v", err)
+		}
+		if err := n.Start(); err != nil {
+			t.Fatalf("start node: %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		_ = n.Stop()
+	}
+
+	peerPub, _, _ := crypto.GenerateKeyPair()
+	run(&authedTransport{mockTransport: &mockTransport{peerID: "link-7", recv: []*pb.Envelope{bogus()}}, identity: peerPub})
+	if faults, _ := s.PeerFaultCount(peerPub, storage.PeerFaultBadForkEvidence); faults != 1 {
+		t.Fatalf("expected the fault charged to the peer's key, got %d", faults)
+	}
+	if faults, _ := s.PeerFaultCount([]byte("link-7"), storage.PeerFaultBadForkEvidence); faults != 0 {
+		t.Fatalf("expected nothing charged to the link id, got %d", faults)
+	}
+
+	// An unauthenticated link id could be anyone's key, so nobody is charged.
+	run(&mockTransport{peerID: string(peerPub), recv: []*pb.Envelope{bogus()}})
+	if faults, _ := s.PeerFaultCount(peerPub, storage.PeerFaultBadForkEvidence); faults != 1 {
+		t.Fatalf("expected an unauthenticated peer to charge nobody, got %d faults", faults)
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/discovery"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidRevocation is returned for a revocation this device will not store: one whose
+// signature does not verify, that is dated in the future, whose revoker granted nothing this
+// device knows of, or whose revoker is over MaxRevocationsPerRevoker.
+var ErrInvalidRevocation = errors.New("invalid capability revocation")
+
+// MaxRevocationClockSkewSeconds bounds how far past the local clock a revocation may be dated.
+const MaxRevocationClockSkewSeconds = 10 * 60
+
+// MaxRevocationsPerRevoker bounds the revocations kept from any one key other than this device's.
+const MaxRevocationsPerRevoker = 256
+
+// knownRevokerSQL matches a revoked_by that could have granted a capability this device sees: its
+// own key, the origin of a known file, or a granter in a held capability chain.
+const knownRevokerSQL = `(
+	revoked_by IN (SELECT pubkey FROM identity)
+	OR EXISTS (SELECT 1 FROM files WHERE files.origin_pubkey = revoked_by)
+	OR EXISTS (SELECT 1 FROM capability_granters WHERE capability_granters.pubkey = revoked_by))`
+
+// ErrCapabilityExhausted is returned when a request would exceed a capability's download or
+// byte limit.
+var ErrCapabilityExhausted = errors.New("capability exhausted")
+
+// SetFileVisibility marks a locally known file public or private. Private files are only served
+// to requesters presenting a valid capability.
+func (s *Store) SetFileVisibility(fileHash []byte, visibility pb.Visibility) error {
+	if fileHash == nil {
+		return errors.New("file hash is required")
+	}
+	res, err := s.writer.Exec("UPDATE files SET visibility = ? WHERE file_hash = ?", visibility, fileHash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) GetFileVisibility(fileHash []byte) (pb.Visibility, error) {
+	if fileHash == nil {
+		return pb.Visibility_VISIBILITY_PUBLIC, errors.New("file hash is required")
+	}
+	var visibility pb.Visibility
+	err := s.reader.QueryRow("SELECT visibility FROM files WHERE file_hash = ?", fileHash).Scan(&visibility)
+	return visibility, err
+}
+
+// InsertRevocation stores a revocation after checking its signature, its date against now and
+// that its revoker is one this device has reason to listen to; anything else wraps
+// ErrInvalidRevocation. Storing the same revocation twice is not an error.
+func (s *Store) InsertRevocation(rev *pb.CapabilityRevocation, now int64) error {
+	if err := discovery.ValidateRevocation(rev); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRevocation, err)
+	}
+	if rev.GetRevokedAt() > now+MaxRevocationClockSkewSeconds {
+		return fmt.Errorf("%w: revoked_at %d is in the future", ErrInvalidRevocation, rev.GetRevokedAt())
+	}
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var known, own bool
+	err = tx.QueryRow("SELECT "+knownRevokerSQL+", revoked_by IN (SELECT pubkey FROM identity) FROM (SELECT ? AS revoked_by)",
+		rev.GetRevokedBy()).Scan(&known, &own)
+	if err != nil {
+		return err
+	}
+	if !known {
+		return fmt.Errorf("%w: revoker granted no capability this device knows of", ErrInvalidRevocation)
+	}
+	if !own {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM capability_revocations WHERE revoked_by = ? AND capability_id != ?",
+			rev.GetRevokedBy(), rev.GetCapabilityId()).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count >= MaxRevocationsPerRevoker {
+			return fmt.Errorf("%w: revoker is over %d revocations", ErrInvalidRevocation, MaxRevocationsPerRevoker)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO capability_revocations (capability_id, revoked_by, revoked_at, signature, signing_version)
+		VALUES (?, ?, ?, ?, ?)`,
+		rev.CapabilityId, rev.RevokedBy, rev.RevokedAt, rev.Signature, rev.SigningVersion)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokersOf returns every key that revoked the capability; see discovery.RevocationLookup.
+func (s *Store) RevokersOf(capabilityID []byte) ([][]byte, error) {
+	rows, err := s.reader.Query("SELECT revoked_by FROM capability_revocations WHERE capability_id = ?", capabilityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revokers [][]byte
+	for rows.Next() {
+		var revoker []byte
+		if err := rows.Scan(&revoker); err != nil {
+			return nil, err
+		}
+		revokers = append(revokers, revoker)
+	}
+	return revokers, rows.Err()
+}
+
+// GetRevocations returns the most recent revocations, for gossip. Revocations whose revoker is no
+// longer known, or that were stored before revokers were checked, are not forwarded.
+func (s *Store) GetRevocations(limit int, now int64) ([]*pb.CapabilityRevocation, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	rows, err := s.reader.Query(`
+		SELECT capability_id, revoked_by, revoked_at, signature, signing_version
+		FROM capability_revocations
+		WHERE revoked_at <= ? AND `+knownRevokerSQL+`
+		ORDER BY revoked_at DESC LIMIT ?`, now+MaxRevocationClockSkewSeconds, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := make([]*pb.CapabilityRevocation, 0)
+	for rows.Next() {
+		var rev pb.CapabilityRevocation
+		if err := rows.Scan(&rev.CapabilityId, &rev.RevokedBy, &rev.RevokedAt, &rev.Signature, &rev.SigningVersion); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, &rev)
+	}
+	return revocations, rows.Err()
+}
+
+// SaveCapability keeps a capability granted to this device so requests for the file can carry it.
+// File metadata carried in the capability is installed as a private file and dropped from what
+// is kept.
+func (s *Store) SaveCapability(capability *pb.FileCapability) error {
+	if capability == nil || len(capability.GetFileHash()) == 0 {
+		return errors.New("capability with a file hash is required")
+	}
+	meta, err := discovery.GrantedFileMeta(capability)
+	if err != nil {
+		return err
+	}
+	capability = discovery.WithoutFileMeta(capability)
+	blob, err := proto.Marshal(capability)
+	if err != nil {
+		return err
+	}
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO held_capabilities (id, file_hash, expires_at, capability)
+		VALUES (?, ?, ?, ?)`,
+		discovery.CapabilityID(capability), capability.GetFileHash(), capability.GetExpiresAt(), blob)
+	if err != nil {
+		return err
+	}
+	if err := insertGranters(tx, capability); err != nil {
+		return err
+	}
+	if meta != nil {
+		// The file was granted privately; it stays private here, so it is never gossiped.
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO files (file_hash, file_name, file_size, chunk_size, chunk_hashes,
+				origin_pubkey, origin_sig, created_at, signing_version, visibility)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			meta.FileHash, meta.FileName, meta.FileSize, meta.ChunkSize, joinHashes(meta.ChunkHashes),
+			meta.OriginPubkey, meta.OriginSig, meta.CreatedAt, meta.SigningVersion, pb.Visibility_VISIBILITY_PRIVATE)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertGranters remembers every granter in capability's chain as a key whose revocations count.
+func insertGranters(tx *sql.Tx, capability *pb.FileCapability) error {
+	for link := capability; link != nil; link = link.GetParent() {
+		if len(link.GetGrantedBy()) == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO capability_granters (pubkey) VALUES (?)", link.GetGrantedBy()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindCapability returns the held capability for fileHash that expires last, or sql.ErrNoRows.
+func (s *Store) FindCapability(fileHash []byte, now int64) (*pb.FileCapability, error) {
+	var blob []byte
+	err := s.reader.QueryRow(`
+		SELECT capability FROM held_capabilities
+		WHERE file_hash = ? AND expires_at > ?
+		ORDER BY expires_at DESC LIMIT 1`, fileHash, now).Scan(&blob)
+	if err != nil {
+		return nil, err
+	}
+	var capability pb.FileCapability
+	if err := proto.Unmarshal(blob, &capability); err != nil {
+		return nil, err
+	}
+	return &capability, nil
+}
+
+// RedeemCapability charges the request identified by nonce against every link in the chain that
+// carries a download or byte limit. If any link would go over, nothing is charged and the error
+// wraps ErrCapabilityExhausted. A request already charged is not charged again, so the check can
+// run both when a request is admitted and when it is served.
+func (s *Store) RedeemCapability(capability *pb.FileCapability, nonce []byte, bytes uint64, now int64) error {
+	if capability == nil {
+		return errors.New("capability is required")
+	}
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for link := capability; link != nil; link = link.GetParent() {
+		if link.GetMaxDownloads() == 0 && link.GetMaxBytes() == 0 {
+			continue
+		}
+		if len(nonce) == 0 {
+			return errors.New("request nonce is required for a limited capability")
+		}
+		id := discovery.CapabilityID(link)
+		var charged int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM capability_redemptions WHERE capability_id = ? AND nonce = ?", id, nonce).Scan(&charged); err != nil {
+			return err
+		}
+		if charged > 0 {
+			continue
+		}
+		var downloads, used int64
+		err := tx.QueryRow(
+			"SELECT COUNT(*), COALESCE(SUM(bytes), 0) FROM capability_redemptions WHERE capability_id = ?", id,
+		).Scan(&downloads, &used)
+		if err != nil {
+			return err
+		}
+		if max := link.GetMaxDownloads(); max > 0 && uint64(downloads) >= uint64(max) {
+			return fmt.Errorf("%w: %d of %d downloads used", ErrCapabilityExhausted, downloads, max)
+		}
+		if max := link.GetMaxBytes(); max > 0 && uint64(used)+bytes > max {
+			return fmt.Errorf("%w: %d bytes requested with %d of %d used", ErrCapabilityExhausted, bytes, used, max)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO capability_redemptions (capability_id, nonce, bytes, expires_at, redeemed_at)
+			VALUES (?, ?, ?, ?, ?)`,
+			id, nonce, int64(bytes), link.GetExpiresAt(), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCapabilityUsage returns how many requests and bytes have been charged to a capability.
+func (s *Store) GetCapabilityUsage(capabilityID []byte) (downloads uint32, bytes uint64, err error) {
+	var n, total int64
+	err = s.reader.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(bytes), 0) FROM capability_redemptions WHERE capability_id = ?", capabilityID,
+	).Scan(&n, &total)
+	return uint32(n), uint64(total), err
+}
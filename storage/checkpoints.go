@@ -29,11 +29,17 @@ func (s *Store) InsertCheckpoint(checkpoint *pb.Checkpoint) error {
 		return err
 	}
 
-	_, err = s.writer.Exec(`
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
 		INSERT INTO checkpoints (device_pubkey, chain_head, record_index, 
 			cumulative_sent, cumulative_received, raw_balance, timestamp, 
-			device_sig, witnesses, confidence) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			device_sig, witnesses, confidence, signing_version) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		checkpoint.DevicePubkey,
 		checkpoint.ChainHead,
 		checkpoint.RecordIndex,
@@ -44,8 +50,20 @@ func (s *Store) InsertCheckpoint(checkpoint *pb.Checkpoint) error {
 		checkpoint.DeviceSig,
 		witnessesBlob,
 		checkpoint.Confidence,
+		checkpoint.SigningVersion,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	// the balance ledger is snapshotted at every checkpoint so it can be rebuilt from here.
+	if err := s.snapshotLedger(tx, checkpoint.DevicePubkey, checkpoint.RecordIndex); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.linkTrust(nil, checkpoint)
+	return nil
 }
 
 func (s *Store) GetLatestCheckpoint(pubkey []byte) (*pb.Checkpoint, error) {
@@ -55,7 +73,7 @@ func (s *Store) GetLatestCheckpoint(pubkey []byte) (*pb.Checkpoint, error) {
 	row := s.reader.QueryRow(`
 		SELECT device_pubkey, chain_head, record_index, cumulative_sent, 
 			cumulative_received, raw_balance, timestamp, device_sig, 
-			witnesses, confidence 
+			witnesses, confidence, signing_version 
 		FROM checkpoints 
 		WHERE device_pubkey = ? 
 		ORDER BY record_index DESC LIMIT 1`, pubkey)
@@ -63,6 +81,43 @@ func (s *Store) GetLatestCheckpoint(pubkey []byte) (*pb.Checkpoint, error) {
 	return scanCheckpoint(row)
 }
 
+// UpdateCheckpointWitnesses replaces the witnesses (and the confidence derived from them) of the
+// checkpoint identified by its device signature.
+func (s *Store) UpdateCheckpointWitnesses(devicePubkey []byte, deviceSig []byte, witnesses []*pb.CheckpointWitness, confidence pb.ConfidenceLevel) error {
+	if devicePubkey == nil || deviceSig == nil {
+		return errors.New("device pubkey and signature are required")
+	}
+	witnessesBlob, err := marshalWitnesses(witnesses)
+	if err != nil {
+		return err
+	}
+	res, err := s.writer.Exec(`
+		UPDATE checkpoints SET witnesses = ?, confidence = ?
+		WHERE device_pubkey = ? AND device_sig = ?`,
+		witnessesBlob, confidence, devicePubkey, deviceSig)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("checkpoint not found")
+	}
+	// the new witnesses are linked from the stored checkpoint, which they signed.
+	cp, err := scanCheckpoint(s.reader.QueryRow(`
+		SELECT device_pubkey, chain_head, record_index, cumulative_sent,
+			cumulative_received, raw_balance, timestamp, device_sig,
+			witnesses, confidence, signing_version
+		FROM checkpoints WHERE device_pubkey = ? AND device_sig = ?`, devicePubkey, deviceSig))
+	if err != nil {
+		return err
+	}
+	s.linkTrust(nil, cp)
+	return nil
+}
+
 func (s *Store) GetCheckpointAtIndex(pubkey []byte, index uint64) (*pb.Checkpoint, error) {
 	if pubkey == nil {
 		return nil, errors.New("public key is required")
@@ -70,13 +125,43 @@ func (s *Store) GetCheckpointAtIndex(pubkey []byte, index uint64) (*pb.Checkpoin
 	row := s.reader.QueryRow(`
 		SELECT device_pubkey, chain_head, record_index, cumulative_sent, 
 			cumulative_received, raw_balance, timestamp, device_sig, 
-			witnesses, confidence 
+			witnesses, confidence, signing_version 
 		FROM checkpoints 
 		WHERE device_pubkey = ? AND record_index = ?`, pubkey, index)
 
 	return scanCheckpoint(row)
 }
 
+// GetRecentCheckpoints returns the limit most recent checkpoints of any device, newest first.
+func (s *Store) GetRecentCheckpoints(limit int) ([]*pb.Checkpoint, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	rows, err := s.reader.Query(`
+		SELECT device_pubkey, chain_head, record_index, cumulative_sent, 
+			cumulative_received, raw_balance, timestamp, device_sig, 
+			witnesses, confidence, signing_version 
+		FROM checkpoints 
+		ORDER BY timestamp DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := make([]*pb.Checkpoint, 0)
+	for rows.Next() {
+		checkpoint, err := scanCheckpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
 func (s *Store) GetCheckpointsByDevice(pubkey []byte) ([]*pb.Checkpoint, error) {
 	if pubkey == nil {
 		return nil, errors.New("public key is required")
@@ -84,7 +169,7 @@ func (s *Store) GetCheckpointsByDevice(pubkey []byte) ([]*pb.Checkpoint, error)
 	rows, err := s.reader.Query(`
 		SELECT device_pubkey, chain_head, record_index, cumulative_sent, 
 			cumulative_received, raw_balance, timestamp, device_sig, 
-			witnesses, confidence 
+			witnesses, confidence, signing_version 
 		FROM checkpoints 
 		WHERE device_pubkey = ? 
 		ORDER BY record_index ASC`, pubkey)
@@ -124,6 +209,7 @@ func scanCheckpoint(scanner interface{ Scan(...any) error }) (*pb.Checkpoint, er
 		&checkpoint.DeviceSig,
 		&witnessesBlob,
 		&checkpoint.Confidence,
+		&checkpoint.SigningVersion,
 	)
 	if err != nil {
 		return nil, err
@@ -3,8 +3,13 @@ package storage
 import (
 	"database/sql"
 	"errors"
+	"sync"
+	"sync/atomic"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -15,6 +20,13 @@ const (
 type Store struct {
 	writer *sql.DB
 	reader *sql.DB
+	// ledgerCrossCheck makes every ledger read also replay the device's full history.
+	ledgerCrossCheck atomic.Bool
+	// headSlot is held by the one session signing onto the local chain head; see ReserveChainHead.
+	headSlot chan struct{}
+	// trust is the trust graph kept current as records and checkpoints are stored; see TrustGraph.
+	trustMu sync.Mutex
+	trust   *credit.TrustGraph
 }
 
 func OpenDatabase(path string) (*Store, error) {
@@ -41,7 +53,7 @@ func OpenDatabase(path string) (*Store, error) {
 	}
 	reader.SetMaxOpenConns(MaxReadOpenConns)
 	
-	store := &Store{writer: writer, reader: reader}
+	store := &Store{writer: writer, reader: reader, headSlot: make(chan struct{}, 1)}
 
 	err = store.migrate()
 	if err != nil {
@@ -91,6 +103,110 @@ func (s *Store) migrate() error {
         if err != nil {
             return err
         }
+        version = 2
+    }
+
+    if version < 3 {
+        err = s.runMigrationV3()
+        if err != nil {
+            return err
+        }
+        version = 3
+    }
+
+    if version < 4 {
+        err = s.runMigrationV4()
+        if err != nil {
+            return err
+        }
+        version = 4
+    }
+
+    if version < 5 {
+        err = s.runMigrationV5()
+        if err != nil {
+            return err
+        }
+        version = 5
+    }
+
+    if version < 6 {
+        err = s.runMigrationV6()
+        if err != nil {
+            return err
+        }
+        version = 6
+    }
+
+    if version < 7 {
+        err = s.runMigrationV7()
+        if err != nil {
+            return err
+        }
+        version = 7
+    }
+
+    if version < 8 {
+        err = s.runMigrationV8()
+        if err != nil {
+            return err
+        }
+        version = 8
+    }
+
+    if version < 9 {
+        err = s.runMigrationV9()
+        if err != nil {
+            return err
+        }
+        version = 9
+    }
+
+    if version < 10 {
+        err = s.runMigrationV10()
+        if err != nil {
+            return err
+        }
+        version = 10
+    }
+
+    if version < 11 {
+        err = s.runMigrationV11()
+        if err != nil {
+            return err
+        }
+        version = 11
+    }
+
+    if version < 12 {
+        err = s.runMigrationV12()
+        if err != nil {
+            return err
+        }
+        version = 12
+    }
+
+    if version < 13 {
+        err = s.runMigrationV13()
+        if err != nil {
+            return err
+        }
+        version = 13
+    }
+
+    if version < 14 {
+        err = s.runMigrationV14()
+        if err != nil {
+            return err
+        }
+        version = 14
+    }
+
+    if version < 15 {
+        err = s.runMigrationV15()
+        if err != nil {
+            return err
+        }
     }
 
     return nil
@@ -166,6 +282,390 @@ func (s *Store) runMigrationV2() error {
 	return tx.Commit()
 }
 
+func (s *Store) runMigrationV3() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createPeerFaultsTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 3")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runMigrationV4 indexes records by chain position so fork detection can look up any index.
+func (s *Store) runMigrationV4() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		indexShareRecordsSenderIndexTableSQL,
+		indexShareRecordsReceiverIndexTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 4")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV5() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createRequestNoncesTableSQL,
+		indexRequestNoncesTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 5")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV6() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		addFilesVisibilityColumnSQL,
+		createCapabilityRevocationsTableSQL,
+		createHeldCapabilitiesTableSQL,
+		indexHeldCapabilitiesTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 6")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV7() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createCapabilityRedemptionsTableSQL,
+		indexCapabilityRedemptionsTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 7")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV8() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createSuccessionsTableSQL,
+		addForkEvidenceSuccessionColumnSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 8")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV9() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createSealedKeysTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 9")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV10() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createNetworkParamsTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 10")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV11() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createBalanceLedgersTableSQL,
+		createLedgerSnapshotsTableSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 11")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV12() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		addLedgerPerPeerCapColumnSQL,
+		addLedgerEpochSecondsColumnSQL,
+		addLedgerCapReductionColumnSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 12")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV13() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		addRecordsSigningVersionColumnSQL,
+		addFilesSigningVersionColumnSQL,
+		addCheckpointsSigningVersionColumnSQL,
+		addForkEvidenceSigningVersionColumnSQL,
+		addRequestsSigningVersionColumnSQL,
+		addRevocationsSigningVersionColumnSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 13")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runMigrationV14 adds the granters of held capabilities, which with file origins decide whose
+// revocations are kept, and fills it from the capabilities already held.
+func (s *Store) runMigrationV14() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		createCapabilityGrantersTableSQL,
+		indexFilesOriginSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT capability FROM held_capabilities")
+	if err != nil {
+		return err
+	}
+	var held []*pb.FileCapability
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			rows.Close()
+			return err
+		}
+		var capability pb.FileCapability
+		if proto.Unmarshal(blob, &capability) == nil {
+			held = append(held, &capability)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, capability := range held {
+		if err := insertGranters(tx, capability); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 14")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) runMigrationV15() error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		addForkEvidenceConflictingSuccessionColumnSQL,
+		indexSuccessionsTimestampSQL,
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = 15")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 
 const createSchemaVersionTableSQL = `
 CREATE TABLE IF NOT EXISTS schema_version (
@@ -205,6 +705,14 @@ CREATE INDEX IF NOT EXISTS idx_records_receiver ON share_records(receiver_pubkey
 `
 
 
+const indexShareRecordsSenderIndexTableSQL = `
+CREATE INDEX IF NOT EXISTS idx_records_sender_index ON share_records(sender_pubkey, sender_record_index);
+`
+
+const indexShareRecordsReceiverIndexTableSQL = `
+CREATE INDEX IF NOT EXISTS idx_records_receiver_index ON share_records(receiver_pubkey, receiver_record_index);
+`
+
 const createPeersTableSQL = `
 CREATE TABLE IF NOT EXISTS peers (
     pubkey BLOB PRIMARY KEY,
@@ -321,3 +829,196 @@ const indexTransferStatePeerTableSQL = `
 CREATE INDEX IF NOT EXISTS idx_transfer_state_peer ON transfer_state(peer_id);
 `
 
+const createPeerFaultsTableSQL = `
+CREATE TABLE IF NOT EXISTS peer_faults (
+    peer_key BLOB NOT NULL,
+    kind TEXT NOT NULL,
+    count INTEGER NOT NULL DEFAULT 0,
+    last_at INTEGER NOT NULL,
+    PRIMARY KEY (peer_key, kind)
+);
+`
+
+// request_nonces remembers TransferRequest nonces until the request window has passed.
+const createRequestNoncesTableSQL = `
+CREATE TABLE IF NOT EXISTS request_nonces (
+    requester_pubkey BLOB NOT NULL,
+    nonce BLOB NOT NULL,
+    timestamp INTEGER NOT NULL,
+    PRIMARY KEY (requester_pubkey, nonce)
+);
+`
+
+const indexRequestNoncesTableSQL = `
+CREATE INDEX IF NOT EXISTS idx_request_nonces_timestamp ON request_nonces(timestamp);
+`
+
+const addFilesVisibilityColumnSQL = `
+ALTER TABLE files ADD COLUMN visibility INTEGER NOT NULL DEFAULT 0;
+`
+
+const createCapabilityRevocationsTableSQL = `
+CREATE TABLE IF NOT EXISTS capability_revocations (
+    capability_id BLOB NOT NULL,
+    revoked_by BLOB NOT NULL,
+    revoked_at INTEGER NOT NULL,
+    signature BLOB NOT NULL,
+    PRIMARY KEY (capability_id, revoked_by)
+);
+`
+
+// capability_granters are the keys that granted any link of a held capability.
+const createCapabilityGrantersTableSQL = `
+CREATE TABLE IF NOT EXISTS capability_granters (
+    pubkey BLOB PRIMARY KEY
+);
+`
+
+const indexFilesOriginSQL = `
+CREATE INDEX IF NOT EXISTS idx_files_origin ON files(origin_pubkey);
+`
+
+// held_capabilities are capabilities granted to this device, attached to its own requests.
+const createHeldCapabilitiesTableSQL = `
+CREATE TABLE IF NOT EXISTS held_capabilities (
+    id BLOB PRIMARY KEY,
+    file_hash BLOB NOT NULL,
+    expires_at INTEGER NOT NULL,
+    capability BLOB NOT NULL
+);
+`
+
+const indexHeldCapabilitiesTableSQL = `
+CREATE INDEX IF NOT EXISTS idx_held_capabilities_file ON held_capabilities(file_hash);
+`
+
+// capability_redemptions counts requests served against limited capabilities, one row per
+// capability and request nonce.
+const createCapabilityRedemptionsTableSQL = `
+CREATE TABLE IF NOT EXISTS capability_redemptions (
+    capability_id BLOB NOT NULL,
+    nonce BLOB NOT NULL,
+    bytes INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    redeemed_at INTEGER NOT NULL,
+    PRIMARY KEY (capability_id, nonce)
+);
+`
+
+const indexCapabilityRedemptionsTableSQL = `
+CREATE INDEX IF NOT EXISTS idx_capability_redemptions_expires ON capability_redemptions(expires_at);
+`
+
+// successions records key rotations. Each key can be retired once and succeed at most one key.
+const createSuccessionsTableSQL = `
+CREATE TABLE IF NOT EXISTS successions (
+    old_pubkey BLOB PRIMARY KEY,
+    new_pubkey BLOB NOT NULL UNIQUE,
+    timestamp INTEGER NOT NULL,
+    signature BLOB NOT NULL,
+    record BLOB NOT NULL
+);
+`
+
+const addForkEvidenceSuccessionColumnSQL = `
+ALTER TABLE fork_evidence ADD COLUMN succession BLOB;
+`
+
+const createSealedKeysTableSQL = `
+CREATE TABLE IF NOT EXISTS sealed_keys (
+    pubkey BLOB PRIMARY KEY,
+    salt BLOB NOT NULL,
+    nonce BLOB NOT NULL,
+    ciphertext BLOB NOT NULL,
+    kdf_time INTEGER NOT NULL,
+    kdf_memory INTEGER NOT NULL,
+    kdf_threads INTEGER NOT NULL,
+    created_at INTEGER NOT NULL
+);
+`
+
+const createNetworkParamsTableSQL = `
+CREATE TABLE IF NOT EXISTS network_params (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    network_id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    record BLOB NOT NULL
+);
+`
+
+const createBalanceLedgersTableSQL = `
+CREATE TABLE IF NOT EXISTS balance_ledgers (
+    device_pubkey BLOB PRIMARY KEY,
+    half_life_seconds INTEGER NOT NULL,
+    records INTEGER NOT NULL,
+    sent_records INTEGER NOT NULL,
+    cumulative_received INTEGER NOT NULL,
+    raw_sent INTEGER NOT NULL,
+    decayed_sent REAL NOT NULL,
+    decay_ref INTEGER NOT NULL
+);
+`
+
+const createLedgerSnapshotsTableSQL = `
+CREATE TABLE IF NOT EXISTS ledger_snapshots (
+    device_pubkey BLOB NOT NULL,
+    record_index INTEGER NOT NULL,
+    half_life_seconds INTEGER NOT NULL,
+    records INTEGER NOT NULL,
+    sent_records INTEGER NOT NULL,
+    cumulative_received INTEGER NOT NULL,
+    raw_sent INTEGER NOT NULL,
+    decayed_sent REAL NOT NULL,
+    decay_ref INTEGER NOT NULL,
+    PRIMARY KEY (device_pubkey, record_index)
+);
+`
+
+// ledgers built before caps were tracked keep zero settings, so they no longer match the
+// network's and are rebuilt on first read.
+const addLedgerPerPeerCapColumnSQL = `
+ALTER TABLE balance_ledgers ADD COLUMN per_peer_cap INTEGER NOT NULL DEFAULT 0;
+`
+
+const addLedgerEpochSecondsColumnSQL = `
+ALTER TABLE balance_ledgers ADD COLUMN epoch_seconds INTEGER NOT NULL DEFAULT 0;
+`
+
+const addLedgerCapReductionColumnSQL = `
+ALTER TABLE balance_ledgers ADD COLUMN cap_reduction INTEGER NOT NULL DEFAULT 0;
+`
+
+// rows stored before canonical signing were signed over the legacy encoding, which is
+// signing version 0.
+const addRecordsSigningVersionColumnSQL = `
+ALTER TABLE share_records ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+const addFilesSigningVersionColumnSQL = `
+ALTER TABLE files ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+const addCheckpointsSigningVersionColumnSQL = `
+ALTER TABLE checkpoints ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+const addForkEvidenceSigningVersionColumnSQL = `
+ALTER TABLE fork_evidence ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+const addRequestsSigningVersionColumnSQL = `
+ALTER TABLE transfer_requests ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+const addRevocationsSigningVersionColumnSQL = `
+ALTER TABLE capability_revocations ADD COLUMN signing_version INTEGER NOT NULL DEFAULT 0;
+`
+
+// conflicting_succession is set on evidence that a key signed two different successions.
+const addForkEvidenceConflictingSuccessionColumnSQL = `
+ALTER TABLE fork_evidence ADD COLUMN conflicting_succession BLOB;
+`
+
+const indexSuccessionsTimestampSQL = `
+CREATE INDEX IF NOT EXISTS idx_successions_timestamp ON successions(timestamp);
+`
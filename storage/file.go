@@ -14,7 +14,7 @@ func (s *Store) InsertFileMeta(file *pb.FileMeta) error{
 
 	chunkHashes := joinHashes(file.ChunkHashes)
 
-	_, err := s.writer.Exec("INSERT INTO files (file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", file.FileHash, file.FileName, file.FileSize, file.ChunkSize, chunkHashes, file.OriginPubkey, file.OriginSig, file.CreatedAt)
+	_, err := s.writer.Exec("INSERT INTO files (file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at, signing_version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", file.FileHash, file.FileName, file.FileSize, file.ChunkSize, chunkHashes, file.OriginPubkey, file.OriginSig, file.CreatedAt, file.SigningVersion)
 
 	if err != nil {
 		return err
@@ -28,7 +28,7 @@ func (s *Store) GetFileMeta(fileHash []byte) (*pb.FileMeta, error){
 		return nil, errors.New("file hash is required")
 	}
 
-	row := s.reader.QueryRow("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at FROM files WHERE file_hash = ?", fileHash)
+	row := s.reader.QueryRow("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at, signing_version FROM files WHERE file_hash = ?", fileHash)
 
 	return scanFileMeta(row)
 }
@@ -43,7 +43,7 @@ func (s *Store) ListFiles(limit int, offset int) ([]*pb.FileMeta, error){
 		return nil, errors.New("offset must be positive")
 	}
 
-	rows, err := s.reader.Query("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at FROM files ORDER BY created_at DESC LIMIT ? OFFSET ?", limit, offset)
+	rows, err := s.reader.Query("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at, signing_version FROM files ORDER BY created_at DESC LIMIT ? OFFSET ?", limit, offset)
 
 	if err != nil {
 		return nil, err
@@ -71,7 +71,7 @@ func (s *Store) SearchFileByName(query string) ([]*pb.FileMeta, error){
 		return nil, errors.New("query is required")
 	}
 
-	rows, err := s.reader.Query("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at FROM files WHERE file_name LIKE ?", "%"+query+"%")
+	rows, err := s.reader.Query("SELECT file_hash, file_name, file_size, chunk_size, chunk_hashes, origin_pubkey, origin_sig, created_at, signing_version FROM files WHERE file_name LIKE ?", "%"+query+"%")
 	if err != nil {
 		return nil, err
 	}
@@ -105,6 +105,7 @@ func scanFileMeta(scanner interface{ Scan(...any) error }) (*pb.FileMeta, error)
 		&file.OriginPubkey,
 		&file.OriginSig,
 		&file.CreatedAt,
+		&file.SigningVersion,
 	)
 	if err != nil {
 		return nil, err
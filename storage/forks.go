@@ -1,45 +1,133 @@
 package storage
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 	"google.golang.org/protobuf/proto"
 )
 
+// ErrInvalidForkEvidence is returned for evidence that does not prove a fork by the accused device.
+var ErrInvalidForkEvidence = errors.New("invalid fork evidence")
 
-
-
+// InsertForkEvidence stores evidence only after dag.ValidateForkEvidence accepts it, since a
+// stored entry permanently blocks the accused device.
 func (s *Store) InsertForkEvidence(evidence *pb.ForkEvidence) error {
 	if evidence == nil {
 		return errors.New("fork evidence is required")
 	}
+	if err := dag.ValidateForkEvidence(evidence); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidForkEvidence, err)
+	}
 
-	// RecordA and RecordB are full ShareRecord structs — serialize to blobs
-	recordABlob, err := proto.Marshal(evidence.RecordA)
-	if err != nil {
-		return err
+	// RecordA and RecordB are full ShareRecord structs — serialize to blobs.
+	// Evidence of two successions carries no records at all.
+	recordABlob := []byte{}
+	var err error
+	if evidence.RecordA != nil {
+		recordABlob, err = proto.Marshal(evidence.RecordA)
+		if err != nil {
+			return err
+		}
 	}
 
-	recordBBlob, err := proto.Marshal(evidence.RecordB)
-	if err != nil {
-		return err
+	// Evidence against a retired key has no second record.
+	recordBBlob := []byte{}
+	if evidence.RecordB != nil {
+		recordBBlob, err = proto.Marshal(evidence.RecordB)
+		if err != nil {
+			return err
+		}
+	}
+
+	var successionBlob, conflictingBlob []byte
+	if evidence.Succession != nil {
+		successionBlob, err = proto.Marshal(evidence.Succession)
+		if err != nil {
+			return err
+		}
+	}
+	if evidence.ConflictingSuccession != nil {
+		conflictingBlob, err = proto.Marshal(evidence.ConflictingSuccession)
+		if err != nil {
+			return err
+		}
 	}
 
 	_, err = s.writer.Exec(`
 		INSERT INTO fork_evidence (device_pubkey, record_a, record_b, 
-			reporter_pubkey, reporter_sig, detected_at) 
-		VALUES (?, ?, ?, ?, ?, ?)`,
+			reporter_pubkey, reporter_sig, detected_at, succession, signing_version, conflicting_succession) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		evidence.DevicePubkey,
 		recordABlob,
 		recordBBlob,
 		evidence.ReporterPubkey,
 		evidence.ReporterSig,
 		evidence.DetectedAt,
+		successionBlob,
+		evidence.SigningVersion,
+		conflictingBlob,
 	)
 	return err
 }
 
+// FindForks looks for stored records that conflict with record at the sender's or receiver's
+// index, and for a party whose key was retired before record was signed. It must run before
+// record itself is stored. The returned evidence is unsigned.
+func (s *Store) FindForks(record *pb.ShareRecord) ([]*pb.ForkEvidence, error) {
+	forks, err := dag.DetectForks(record, s.GetRecordsAtIndex)
+	if err != nil {
+		return nil, err
+	}
+	for _, party := range [][]byte{record.GetSenderPubkey(), record.GetReceiverPubkey()} {
+		succession, err := s.GetSuccessor(party)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fork := dag.DetectSuccessionFork(record, succession); fork != nil {
+			forks = append(forks, fork)
+		}
+	}
+	return forks, nil
+}
+
+// FindSuccessionForks returns unsigned evidence for stored records that the key retired by
+// succession signed past its final head.
+func (s *Store) FindSuccessionForks(succession *pb.SuccessionRecord) ([]*pb.ForkEvidence, error) {
+	final := succession.GetFinalHead().GetIndex()
+	for _, index := range []uint64{final, final + 1} {
+		records, err := s.GetRecordsAtIndex(succession.GetOldPubkey(), index)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if fork := dag.DetectSuccessionFork(r, succession); fork != nil {
+				return []*pb.ForkEvidence{fork}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// FindConflictingSuccession returns unsigned evidence when a stored succession retires the same
+// key as succession but differs from it, or nil.
+func (s *Store) FindConflictingSuccession(succession *pb.SuccessionRecord) (*pb.ForkEvidence, error) {
+	stored, err := s.GetSuccessor(succession.GetOldPubkey())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dag.DetectConflictingSuccession(stored, succession), nil
+}
+
 func (s *Store) GetForkEvidence(devicePubkey []byte) ([]*pb.ForkEvidence, error) {
 	if devicePubkey == nil {
 		return nil, errors.New("device public key is required")
@@ -47,7 +135,7 @@ func (s *Store) GetForkEvidence(devicePubkey []byte) ([]*pb.ForkEvidence, error)
 
 	rows, err := s.reader.Query(`
 		SELECT device_pubkey, record_a, record_b, reporter_pubkey, 
-			reporter_sig, detected_at 
+			reporter_sig, detected_at, succession, signing_version, conflicting_succession 
 		FROM fork_evidence 
 		WHERE device_pubkey = ?`, devicePubkey)
 
@@ -89,7 +177,7 @@ func (s *Store) HasForkEvidence(devicePubkey []byte) (bool, error) {
 
 func scanForkEvidence(scanner interface{ Scan(...any) error }) (*pb.ForkEvidence, error) {
 	var evidence pb.ForkEvidence
-	var recordABlob, recordBBlob []byte
+	var recordABlob, recordBBlob, successionBlob, conflictingBlob []byte
 
 	err := scanner.Scan(
 		&evidence.DevicePubkey,
@@ -98,17 +186,40 @@ func scanForkEvidence(scanner interface{ Scan(...any) error }) (*pb.ForkEvidence
 		&evidence.ReporterPubkey,
 		&evidence.ReporterSig,
 		&evidence.DetectedAt,
+		&successionBlob,
+		&evidence.SigningVersion,
+		&conflictingBlob,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(conflictingBlob) > 0 {
+		evidence.Succession = &pb.SuccessionRecord{}
+		if err := proto.Unmarshal(successionBlob, evidence.Succession); err != nil {
+			return nil, err
+		}
+		evidence.ConflictingSuccession = &pb.SuccessionRecord{}
+		if err := proto.Unmarshal(conflictingBlob, evidence.ConflictingSuccession); err != nil {
+			return nil, err
+		}
+		return &evidence, nil
+	}
+
 	// deserialize the two records from blobs back to structs
 	evidence.RecordA = &pb.ShareRecord{}
 	if err := proto.Unmarshal(recordABlob, evidence.RecordA); err != nil {
 		return nil, err
 	}
 
+	if len(successionBlob) > 0 {
+		evidence.Succession = &pb.SuccessionRecord{}
+		if err := proto.Unmarshal(successionBlob, evidence.Succession); err != nil {
+			return nil, err
+		}
+		return &evidence, nil
+	}
+
 	evidence.RecordB = &pb.ShareRecord{}
 	if err := proto.Unmarshal(recordBBlob, evidence.RecordB); err != nil {
 		return nil, err
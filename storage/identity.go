@@ -1,13 +1,16 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"sync"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
 // we dont  have this in proto as its only used in the storage layer.
 type Identity struct {
     Pubkey           []byte
-    PrivateKey       []byte
     CreatedAt        int64
     ChainHead        []byte
     ChainIndex       uint64
@@ -16,20 +19,34 @@ type Identity struct {
 }
 
 // hardcoding the id to 1 as we only have one identity per device.
-func (s *Store) InitIdentity(pubkey []byte, privateKey []byte, createdAt int64) error {
+// The private key is never stored here; it belongs to the identity's key store.
+func (s *Store) InitIdentity(pubkey []byte, createdAt int64) error {
 	if pubkey == nil {
 		return errors.New("pubkey is required")
 	}
 	if createdAt <= 0 {
 		return errors.New("createdAt is required")
 	}
-	_ = privateKey // private key persistence is intentionally deferred for this schema.
 	_, err := s.writer.Exec("INSERT INTO identity (id, pubkey, created_at) VALUES (1, ?, ?)", pubkey, createdAt)
 	return err
 }
 
 
 
+// ReplaceIdentity points the identity at a new key and starts its chain afresh. It is for
+// recovery when the old private key is gone and no succession can be signed; the old key's
+// records stay in the store but no longer count as the local chain.
+func (s *Store) ReplaceIdentity(pubkey []byte, createdAt int64) error {
+	if pubkey == nil {
+		return errors.New("pubkey is required")
+	}
+	if createdAt <= 0 {
+		return errors.New("createdAt is required")
+	}
+	_, err := s.writer.Exec("UPDATE identity SET pubkey = ?, created_at = ?, chain_head = NULL, chain_index = 0, cumulative_sent = 0, cumulative_received = 0 WHERE id = 1", pubkey, createdAt)
+	return err
+}
+
 func (s *Store) GetIdentity() (*Identity, error) {
 	row := s.reader.QueryRow("SELECT pubkey, created_at, chain_head, chain_index, cumulative_sent, cumulative_received FROM identity WHERE id = 1")
 
@@ -49,4 +66,40 @@ func (s *Store) UpdateChainHead(hash []byte, index uint64, cumSent uint64, cumRe
 
 	_, err := s.writer.Exec("UPDATE identity SET chain_head = ?, chain_index = ?, cumulative_sent = ?, cumulative_received = ? WHERE id = 1", hash, index, cumSent, cumRecv)
 	return err
-}
\ No newline at end of file
+}
+
+// ReserveChainHead waits until no other session holds the local chain head and returns it held
+// for the caller, so two sessions cannot each sign a record at the same index. The caller must
+// call release once the record extending the head is appended, or when it gives up.
+func (s *Store) ReserveChainHead(ctx context.Context) (head *pb.ChainHead, release func(), err error) {
+	select {
+	case s.headSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	var once sync.Once
+	release = func() { once.Do(func() { <-s.headSlot }) }
+
+	head, err = s.LocalChainHead()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return head, release, nil
+}
+
+// LocalChainHead is the identity's chain head in the form carried by TransferRequest.
+func (s *Store) LocalChainHead() (*pb.ChainHead, error) {
+	identity, err := s.GetIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ChainHead{
+		RecordId: identity.ChainHead,
+		Index:    identity.ChainIndex,
+		Totals: &pb.CumulativeTotals{
+			CumulativeSent:     identity.CumulativeSent,
+			CumulativeReceived: identity.CumulativeReceived,
+		},
+	}, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+)
+
+// SealedKey is a private key encrypted at rest. The storage layer never sees the plaintext or
+// the passphrase; it only keeps what is needed to derive the key again and open the box.
+type SealedKey struct {
+	Pubkey     []byte
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+	KDFTime    uint32
+	KDFMemory  uint32
+	KDFThreads uint8
+	CreatedAt  int64
+}
+
+// SaveSealedKey stores key under its public key. Sealing the same public key again replaces
+// the old box, which is how a key is re-encrypted under a new passphrase.
+func (s *Store) SaveSealedKey(key *SealedKey) error {
+	if key == nil || len(key.Pubkey) == 0 {
+		return errors.New("pubkey is required")
+	}
+	if len(key.Salt) == 0 || len(key.Nonce) == 0 || len(key.Ciphertext) == 0 {
+		return errors.New("sealed key is incomplete")
+	}
+
+	_, err := s.writer.Exec(`
+		INSERT INTO sealed_keys (pubkey, salt, nonce, ciphertext, kdf_time, kdf_memory, kdf_threads, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(pubkey) DO UPDATE SET
+			salt = excluded.salt,
+			nonce = excluded.nonce,
+			ciphertext = excluded.ciphertext,
+			kdf_time = excluded.kdf_time,
+			kdf_memory = excluded.kdf_memory,
+			kdf_threads = excluded.kdf_threads
+	`, key.Pubkey, key.Salt, key.Nonce, key.Ciphertext, key.KDFTime, key.KDFMemory, key.KDFThreads, key.CreatedAt)
+	return err
+}
+
+// GetSealedKey returns the box stored for pubkey, or sql.ErrNoRows.
+func (s *Store) GetSealedKey(pubkey []byte) (*SealedKey, error) {
+	if len(pubkey) == 0 {
+		return nil, errors.New("pubkey is required")
+	}
+
+	key := SealedKey{Pubkey: pubkey}
+	err := s.reader.QueryRow(`
+		SELECT salt, nonce, ciphertext, kdf_time, kdf_memory, kdf_threads, created_at
+		FROM sealed_keys WHERE pubkey = ?`, pubkey,
+	).Scan(&key.Salt, &key.Nonce, &key.Ciphertext, &key.KDFTime, &key.KDFMemory, &key.KDFThreads, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
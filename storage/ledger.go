@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+/*
+Balance ledgers keep each device's balance folded record by record (see credit.Ledger), so a
+balance is computed from a few totals and the last window of records instead of the device's
+whole history.
+
+the ledger row is updated in the same transaction as every record insert. a ledger is also
+snapshotted at each of the device's checkpoints. when a ledger is missing, e.g. on a database
+created before ledgers existed, or was built with other decay or cap settings, it is rebuilt
+from the latest snapshot with the same half-life plus the records after it. a record stored
+late below a snapshot invalidates that snapshot and every later one.
+
+per-peer caps are not snapshotted: a live insert asks the history for the record's bucket, and
+a rebuild sums the excess of every bucket in one query.
+*/
+
+// ErrLedgerMismatch is returned in cross-check mode when a ledger disagrees with the full history.
+var ErrLedgerMismatch = errors.New("balance ledger disagrees with full history")
+
+const ledgerColumns = "half_life_seconds, records, sent_records, cumulative_received, raw_sent, decayed_sent, decay_ref"
+
+const ledgerCapColumns = "per_peer_cap, epoch_seconds, cap_reduction"
+
+// deviceIndexSQL is the device's own chain index in a record, whichever role it had.
+const deviceIndexSQL = "CASE WHEN sender_pubkey = ? THEN sender_record_index ELSE receiver_record_index END"
+
+const recordColumns = "id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version"
+
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// SetLedgerCrossCheck turns cross-check mode on or off. In cross-check mode every BalanceLedger
+// read also replays the device's full history and fails with ErrLedgerMismatch on any
+// disagreement. It is meant for tests.
+func (s *Store) SetLedgerCrossCheck(enabled bool) {
+	s.ledgerCrossCheck.Store(enabled)
+}
+
+// BalanceLedger returns device's ledger under params' decay and cap settings, with its most
+// recent params.WindowSize records oldest first for the diversity term.
+func (s *Store) BalanceLedger(device []byte, params credit.CreditParams) (*credit.Ledger, []*pb.ShareRecord, error) {
+	if len(device) == 0 {
+		return nil, nil, errors.New("device public key is required")
+	}
+	ledger, err := loadLedger(s.reader, device)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !ledger.Matches(params)) {
+		ledger, err = s.rebuildLedger(device, params)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	window, err := queryRecords(s.reader,
+		"SELECT "+recordColumns+" FROM share_records WHERE sender_pubkey = ? OR receiver_pubkey = ? ORDER BY timestamp DESC, id DESC LIMIT ?",
+		device, device, params.WindowSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+
+	if s.ledgerCrossCheck.Load() {
+		history, err := deviceHistory(s.reader, device)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := credit.CrossCheckLedger(ledger, history, time.Now().Unix()); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrLedgerMismatch, err)
+		}
+	}
+	return ledger, window, nil
+}
+
+// LineageLedger is BalanceLedger for a device that may have rotated its key. The ledgers of
+// pubkey and of every key it succeeded are summed into one for pubkey, less the records
+// credit.FollowSuccession drops and those a retired key signed past its final head; per-peer caps
+// are charged across the whole lineage. presented are records the device showed us itself; those
+// not stored yet are folded in as well.
+func (s *Store) LineageLedger(pubkey []byte, params credit.CreditParams, presented []*pb.ShareRecord) (*credit.Ledger, []*pb.ShareRecord, error) {
+	chain, err := s.GetSuccessionChain(pubkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	scope := newLineageScope(pubkey, chain)
+	if len(chain) == 0 {
+		ledger, window, err := s.BalanceLedger(pubkey, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.foldPresented(ledger, window, scope, params, presented)
+	}
+
+	party, partyArgs := scope.party()
+	credited, creditedArgs := scope.credited()
+	args := append(append([]any{}, partyArgs...), creditedArgs...)
+	excluded, err := queryRecords(s.reader,
+		"SELECT "+recordColumns+" FROM share_records WHERE "+party+" AND NOT "+credited, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ledger := credit.NewLedger(pubkey, params)
+	for _, key := range scope.keys {
+		keyLedger, _, err := s.BalanceLedger(key, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range excluded {
+			keyLedger.Remove(r)
+		}
+		ledger.Merge(keyLedger)
+	}
+
+	sender, senderArgs := scope.in("sender_pubkey")
+	err = s.reader.QueryRow(`
+		SELECT COALESCE(SUM(MAX(total - ?, 0)), 0) FROM (
+			SELECT SUM(bytes_total) AS total FROM share_records WHERE `+sender+` AND `+credited+`
+			GROUP BY receiver_pubkey, timestamp / ?
+		)`, append(append(append([]any{params.PerPeerCap}, senderArgs...), creditedArgs...), params.EpochSeconds)...,
+	).Scan(&ledger.CapReduction)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	window, err := queryRecords(s.reader,
+		"SELECT "+recordColumns+" FROM share_records WHERE "+party+" AND "+credited+" ORDER BY timestamp DESC, id DESC LIMIT ?",
+		append(args, params.WindowSize)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+	window = credit.FollowSuccession(window, scope.keys)
+
+	if s.ledgerCrossCheck.Load() {
+		history, err := queryRecords(s.reader,
+			"SELECT "+recordColumns+" FROM share_records WHERE "+party+" AND "+credited+" ORDER BY timestamp ASC, id ASC", args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := credit.CrossCheckLedger(ledger, credit.FollowSuccession(history, scope.keys), time.Now().Unix()); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrLedgerMismatch, err)
+		}
+	}
+	return s.foldPresented(ledger, window, scope, params, presented)
+}
+
+// foldPresented adds the records of presented that are not stored to ledger and window.
+func (s *Store) foldPresented(ledger *credit.Ledger, window []*pb.ShareRecord, scope lineageScope, params credit.CreditParams, presented []*pb.ShareRecord) (*credit.Ledger, []*pb.ShareRecord, error) {
+	if len(presented) == 0 {
+		return ledger, window, nil
+	}
+	sender, senderArgs := scope.in("sender_pubkey")
+	credited, creditedArgs := scope.credited()
+	seen := make(map[string]bool)
+	buckets := make(map[credit.PeerEpoch]int64)
+	added := false
+	for _, r := range credit.FollowSuccession(presented, scope.keys) {
+		if r == nil || seen[string(r.GetId())] {
+			continue
+		}
+		seen[string(r.GetId())] = true
+		sent := bytes.Equal(r.GetSenderPubkey(), ledger.DevicePubkey)
+		if !sent && !bytes.Equal(r.GetReceiverPubkey(), ledger.DevicePubkey) {
+			continue
+		}
+		if _, err := s.GetRecord(r.GetId()); err == nil {
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, err
+		}
+
+		ledger.Apply(r)
+		if sent {
+			key := ledger.Bucket(r)
+			before, ok := buckets[key]
+			if !ok {
+				start := r.GetTimestamp() / ledger.EpochSeconds * ledger.EpochSeconds
+				args := append(append(append([]any{}, senderArgs...), creditedArgs...), r.GetReceiverPubkey(), start, start+ledger.EpochSeconds)
+				err := s.reader.QueryRow(`
+					SELECT COALESCE(SUM(bytes_total), 0) FROM share_records
+					WHERE `+sender+` AND `+credited+` AND receiver_pubkey = ? AND timestamp >= ? AND timestamp < ?`,
+					args...,
+				).Scan(&before)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			ledger.AddToBucket(before, int64(r.GetBytesTotal()))
+			buckets[key] = before + int64(r.GetBytesTotal())
+		}
+		window = append(window, r)
+		added = true
+	}
+	if added {
+		sort.SliceStable(window, func(i, j int) bool { return window[i].GetTimestamp() < window[j].GetTimestamp() })
+		if size := int(params.WindowSize); len(window) > size {
+			window = window[len(window)-size:]
+		}
+	}
+	return ledger, window, nil
+}
+
+// lineageScope builds the SQL conditions for the records credited to a device's key lineage: its
+// current key followed by the keys it succeeded.
+type lineageScope struct {
+	keys        [][]byte
+	successions []*pb.SuccessionRecord
+}
+
+func newLineageScope(pubkey []byte, chain []*pb.SuccessionRecord) lineageScope {
+	scope := lineageScope{keys: [][]byte{pubkey}, successions: chain}
+	for _, succession := range chain {
+		scope.keys = append(scope.keys, succession.GetOldPubkey())
+	}
+	return scope
+}
+
+// in matches column against every key of the lineage.
+func (l lineageScope) in(column string) (string, []any) {
+	args := make([]any, len(l.keys))
+	for i, key := range l.keys {
+		args[i] = key
+	}
+	return column + " IN (?" + strings.Repeat(", ?", len(l.keys)-1) + ")", args
+}
+
+// party matches records any key of the lineage is a party to.
+func (l lineageScope) party() (string, []any) {
+	sender, senderArgs := l.in("sender_pubkey")
+	receiver, receiverArgs := l.in("receiver_pubkey")
+	return "(" + sender + " OR " + receiver + ")", append(senderArgs, receiverArgs...)
+}
+
+// credited matches the records that move credit in or out of the lineage: exactly one party is a
+// lineage key, and no retired key signed it past its final head (see dag.PastFinalHead).
+func (l lineageScope) credited() (string, []any) {
+	sender, senderArgs := l.in("sender_pubkey")
+	receiver, receiverArgs := l.in("receiver_pubkey")
+	query := "((" + sender + ") <> (" + receiver + ")"
+	args := append(senderArgs, receiverArgs...)
+	for _, succession := range l.successions {
+		final := succession.GetFinalHead()
+		for _, role := range []string{"sender", "receiver"} {
+			query += " AND NOT (" + role + "_pubkey = ? AND (" + role + "_record_index > ? OR (" + role + "_record_index = ? AND ? > 0 AND id <> ?)))"
+			args = append(args, succession.GetOldPubkey(), final.GetIndex(), final.GetIndex(), final.GetIndex(), final.GetRecordId())
+		}
+	}
+	return query + ")", args
+}
+
+func (s *Store) rebuildLedger(device []byte, params credit.CreditParams) (*credit.Ledger, error) {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ledger, after, err := latestSnapshot(tx, device, params, -1)
+	if err != nil {
+		return nil, err
+	}
+	records, err := deviceRecordsBetween(tx, device, after, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		ledger.Apply(r)
+	}
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(MAX(total - ?, 0)), 0) FROM (
+			SELECT SUM(bytes_total) AS total FROM share_records WHERE sender_pubkey = ?
+			GROUP BY receiver_pubkey, timestamp / ?
+		)`, params.PerPeerCap, device, params.EpochSeconds).Scan(&ledger.CapReduction)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveLedger(tx, ledger); err != nil {
+		return nil, err
+	}
+	return ledger, tx.Commit()
+}
+
+// applyRecordToLedgers folds a newly stored record into its parties' ledgers. A party without a
+// ledger is skipped; its ledger is built from storage on first read and will include the record.
+func applyRecordToLedgers(tx *sql.Tx, record *pb.ShareRecord) error {
+	parties := [][]byte{record.GetSenderPubkey()}
+	if string(record.GetReceiverPubkey()) != string(record.GetSenderPubkey()) {
+		parties = append(parties, record.GetReceiverPubkey())
+	}
+	for i, party := range parties {
+		index := record.GetSenderRecordIndex()
+		if i == 1 {
+			index = record.GetReceiverRecordIndex()
+		}
+		if _, err := tx.Exec("DELETE FROM ledger_snapshots WHERE device_pubkey = ? AND record_index >= ?", party, index); err != nil {
+			return err
+		}
+
+		ledger, err := loadLedger(tx, party)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ledger.EpochSeconds <= 0 {
+			// built before caps were tracked; the next read rebuilds it.
+			if _, err := tx.Exec("DELETE FROM balance_ledgers WHERE device_pubkey = ?", party); err != nil {
+				return err
+			}
+			continue
+		}
+		ledger.Apply(record)
+		if i == 0 {
+			// the record is already stored, so the bucket total includes it.
+			start := record.GetTimestamp() / ledger.EpochSeconds * ledger.EpochSeconds
+			var bucket int64
+			err := tx.QueryRow(`
+				SELECT COALESCE(SUM(bytes_total), 0) FROM share_records
+				WHERE sender_pubkey = ? AND receiver_pubkey = ? AND timestamp >= ? AND timestamp < ?`,
+				party, record.GetReceiverPubkey(), start, start+ledger.EpochSeconds,
+			).Scan(&bucket)
+			if err != nil {
+				return err
+			}
+			ledger.AddToBucket(bucket-int64(record.GetBytesTotal()), int64(record.GetBytesTotal()))
+		}
+		if err := saveLedger(tx, ledger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotLedger stores device's ledger as of its chain index, built from the previous snapshot.
+func (s *Store) snapshotLedger(tx *sql.Tx, device []byte, index uint64) error {
+	params, err := credit.LocalParams(s)
+	if err != nil {
+		return err
+	}
+	ledger, after, err := latestSnapshot(tx, device, params, int64(index))
+	if err != nil {
+		return err
+	}
+	records, err := deviceRecordsBetween(tx, device, after, int64(index))
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		ledger.Apply(r)
+	}
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO ledger_snapshots (device_pubkey, record_index, `+ledgerColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		device, index, ledger.HalfLifeSeconds, ledger.Records, ledger.SentRecords,
+		ledger.CumulativeReceived, ledger.RawSent, ledger.DecayedSent, ledger.DecayRef)
+	return err
+}
+
+// latestSnapshot returns the newest snapshot with params' half-life below before (any when before
+// is negative) and its index, or an empty ledger and -1. Snapshots carry no cap reduction.
+func latestSnapshot(q querier, device []byte, params credit.CreditParams, before int64) (*credit.Ledger, int64, error) {
+	query := "SELECT record_index, " + ledgerColumns + " FROM ledger_snapshots WHERE device_pubkey = ? AND half_life_seconds = ?"
+	args := []any{device, params.HalfLifeSeconds}
+	if before >= 0 {
+		query += " AND record_index < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY record_index DESC LIMIT 1"
+
+	ledger := credit.NewLedger(device, params)
+	var index int64
+	err := q.QueryRow(query, args...).Scan(&index, &ledger.HalfLifeSeconds, &ledger.Records, &ledger.SentRecords,
+		&ledger.CumulativeReceived, &ledger.RawSent, &ledger.DecayedSent, &ledger.DecayRef)
+	if errors.Is(err, sql.ErrNoRows) {
+		return credit.NewLedger(device, params), -1, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return ledger, index, nil
+}
+
+func loadLedger(q querier, device []byte) (*credit.Ledger, error) {
+	ledger := credit.NewLedger(device, credit.CreditParams{})
+	err := q.QueryRow("SELECT "+ledgerColumns+", "+ledgerCapColumns+" FROM balance_ledgers WHERE device_pubkey = ?", device).Scan(
+		&ledger.HalfLifeSeconds, &ledger.Records, &ledger.SentRecords,
+		&ledger.CumulativeReceived, &ledger.RawSent, &ledger.DecayedSent, &ledger.DecayRef,
+		&ledger.PerPeerCap, &ledger.EpochSeconds, &ledger.CapReduction)
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+func saveLedger(tx *sql.Tx, ledger *credit.Ledger) error {
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO balance_ledgers (device_pubkey, `+ledgerColumns+`, `+ledgerCapColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ledger.DevicePubkey, ledger.HalfLifeSeconds, ledger.Records, ledger.SentRecords,
+		ledger.CumulativeReceived, ledger.RawSent, ledger.DecayedSent, ledger.DecayRef,
+		ledger.PerPeerCap, ledger.EpochSeconds, ledger.CapReduction)
+	return err
+}
+
+// deviceRecordsBetween returns device's records with its chain index in (after, upTo]; negative
+// bounds are open.
+func deviceRecordsBetween(q querier, device []byte, after int64, upTo int64) ([]*pb.ShareRecord, error) {
+	query := "SELECT " + recordColumns + " FROM share_records WHERE (sender_pubkey = ? OR receiver_pubkey = ?)"
+	args := []any{device, device}
+	if after >= 0 {
+		query += " AND " + deviceIndexSQL + " > ?"
+		args = append(args, device, after)
+	}
+	if upTo >= 0 {
+		query += " AND " + deviceIndexSQL + " <= ?"
+		args = append(args, device, upTo)
+	}
+	return queryRecords(q, query, args...)
+}
+
+// deviceHistory returns every record of device in the order full balance computations use.
+func deviceHistory(q querier, device []byte) ([]*pb.ShareRecord, error) {
+	return queryRecords(q,
+		"SELECT "+recordColumns+" FROM share_records WHERE sender_pubkey = ? OR receiver_pubkey = ? ORDER BY timestamp ASC, id ASC",
+		device, device)
+}
+
+func queryRecords(q querier, query string, args ...any) ([]*pb.ShareRecord, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*pb.ShareRecord
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
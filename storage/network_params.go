@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrStaleNetworkParams is returned when saving parameters that would roll the current network
+// back to an older version.
+var ErrStaleNetworkParams = errors.New("network params are older than the installed version")
+
+// SaveNetworkParams installs params as the ones this node computes balances with. Callers
+// validate the signature; the store only refuses to go back a version on the same network.
+func (s *Store) SaveNetworkParams(params *pb.NetworkParams) error {
+	if params == nil || params.GetNetworkId() == "" {
+		return errors.New("network id is required")
+	}
+	blob, err := proto.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var networkID string
+	var version uint32
+	err = tx.QueryRow("SELECT network_id, version FROM network_params WHERE id = 1").Scan(&networkID, &version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && networkID == params.GetNetworkId() && params.GetVersion() < version {
+		return ErrStaleNetworkParams
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO network_params (id, network_id, version, record) VALUES (1, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			network_id = excluded.network_id,
+			version = excluded.version,
+			record = excluded.record
+	`, params.GetNetworkId(), params.GetVersion(), blob)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetNetworkParams returns the installed parameters, or sql.ErrNoRows when the node still runs
+// the built-in default.
+func (s *Store) GetNetworkParams() (*pb.NetworkParams, error) {
+	var blob []byte
+	if err := s.reader.QueryRow("SELECT record FROM network_params WHERE id = 1").Scan(&blob); err != nil {
+		return nil, err
+	}
+	var params pb.NetworkParams
+	if err := proto.Unmarshal(blob, &params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
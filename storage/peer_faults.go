@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Kinds of misbehaviour counted per peer. peer_key is the peer's identity pubkey when the
+// handshake authenticated it, otherwise the transport-level peer id.
+const (
+	PeerFaultBadChunk = "bad_chunk"
+	PeerFaultBadFile  = "bad_file"
+	// PeerFaultBadForkEvidence is charged to the peer that delivered fork evidence failing validation.
+	PeerFaultBadForkEvidence = "bad_fork_evidence"
+)
+
+func (s *Store) RecordPeerFault(peerKey []byte, kind string, at int64) error {
+	if len(peerKey) == 0 {
+		return errors.New("peer key is required")
+	}
+	if kind == "" {
+		return errors.New("fault kind is required")
+	}
+
+	_, err := s.writer.Exec(`
+		INSERT INTO peer_faults (peer_key, kind, count, last_at)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT(peer_key, kind) DO UPDATE SET
+			count = count + 1,
+			last_at = excluded.last_at
+	`, peerKey, kind, at)
+	return err
+}
+
+func (s *Store) PeerFaultCount(peerKey []byte, kind string) (int64, error) {
+	if len(peerKey) == 0 {
+		return 0, errors.New("peer key is required")
+	}
+
+	var count int64
+	err := s.reader.QueryRow(
+		"SELECT count FROM peer_faults WHERE peer_key = ? AND kind = ?",
+		peerKey, kind,
+	).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
@@ -2,13 +2,123 @@ package storage
 
 import (
 	"bytes"
+	"database/sql"
 	"errors"
+	"fmt"
 
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
 // this is a method on the Store struct.
+// the parties' balance ledgers are updated in the same transaction.
 func (s *Store) InsertRecord(record *pb.ShareRecord) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRecord(tx, record); err != nil {
+		return err
+	}
+	if err := applyRecordToLedgers(tx, record); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.linkTrust(record, nil)
+	return nil
+}
+
+// ErrLocalIndexTaken is returned by AppendRecord for a record that would put a second record at
+// an index of the local chain: the local device would have forked its own chain.
+var ErrLocalIndexTaken = errors.New("local chain index already holds another record")
+
+// AppendRecord inserts a co-signed record and, when the local identity is a party to it,
+// advances the identity's chain head in the same transaction. Sessions reserve the head with
+// ReserveChainHead before signing; the index check here is the backstop.
+func (s *Store) AppendRecord(record *pb.ShareRecord) error {
+	if err := s.appendRecord(record); err != nil {
+		return err
+	}
+	s.linkTrust(record, nil)
+	return nil
+}
+
+func (s *Store) appendRecord(record *pb.ShareRecord) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pubkey []byte
+	var headIndex uint64
+	err = tx.QueryRow("SELECT pubkey, chain_index FROM identity WHERE id = 1").Scan(&pubkey, &headIndex)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := insertRecord(tx, record); err != nil {
+			return err
+		}
+		if err := applyRecordToLedgers(tx, record); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	var index uint64
+	var totals *pb.CumulativeTotals
+	local := true
+	switch {
+	case bytes.Equal(record.SenderPubkey, pubkey):
+		index, totals = record.SenderRecordIndex, record.SenderTotals
+	case bytes.Equal(record.ReceiverPubkey, pubkey):
+		index, totals = record.ReceiverRecordIndex, record.ReceiverTotals
+	default:
+		local = false
+	}
+	// Records at index 0 carry no chain position, so they cannot collide.
+	if local && index > 0 {
+		var taken int
+		err := tx.QueryRow(`
+			SELECT COUNT(*) FROM share_records
+			WHERE id != ? AND ((sender_pubkey = ? AND sender_record_index = ?) OR (receiver_pubkey = ? AND receiver_record_index = ?))`,
+			record.Id, pubkey, index, pubkey, index).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fmt.Errorf("%w: index %d", ErrLocalIndexTaken, index)
+		}
+	}
+
+	if err := insertRecord(tx, record); err != nil {
+		return err
+	}
+	if err := applyRecordToLedgers(tx, record); err != nil {
+		return err
+	}
+	if !local {
+		return tx.Commit()
+	}
+	// never move the head backwards, e.g. when an older record is stored late.
+	if index > headIndex {
+		_, err = tx.Exec("UPDATE identity SET chain_head = ?, chain_index = ?, cumulative_sent = ?, cumulative_received = ? WHERE id = 1", record.Id, index, totals.GetCumulativeSent(), totals.GetCumulativeReceived())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertRecord(exec execer, record *pb.ShareRecord) error {
 	/*
 the record come as a protobuf msg. 
 but we need to insert it as a sqlite row.
@@ -31,8 +141,8 @@ but we need to insert it as a sqlite row.
 	// as the chunk hashes are bytes array we need to join them into a single hashe as the sqlite doesnt have an array type.
 	chunkHashes := joinHashes(record.ChunkHashes)
 
-	_, err := s.writer.Exec(
-		"INSERT INTO share_records (id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	_, err := exec.Exec(
+		"INSERT INTO share_records (id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		record.Id,
 		record.SenderPubkey,
 		record.ReceiverPubkey,
@@ -52,6 +162,7 @@ but we need to insert it as a sqlite row.
 		record.ReceiverSig,
 		record.FileHash,
 		record.Visibility,
+		record.SigningVersion,
 	)
 	
 	return err
@@ -59,7 +170,7 @@ but we need to insert it as a sqlite row.
 
 func (s *Store) GetRecord(id []byte) (*pb.ShareRecord, error) {
 
-	row := s.reader.QueryRow("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility FROM share_records WHERE id = ?", id)
+	row := s.reader.QueryRow("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE id = ?", id)
 
 	return scanRecord(row)
 }
@@ -72,7 +183,7 @@ func (s *Store) GetRecordsByDevice(devicePublicKey []byte, fromIndex uint64, lim
 	if limit <= 0 {
 		return nil, errors.New("limit must be positive")
 	}
-	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility FROM share_records WHERE (sender_pubkey = ? OR receiver_pubkey = ?) AND (sender_record_index >= ? OR receiver_record_index >= ?) ORDER BY timestamp ASC LIMIT ?", devicePublicKey, devicePublicKey, fromIndex, fromIndex, limit)
+	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE (sender_pubkey = ? OR receiver_pubkey = ?) AND (sender_record_index >= ? OR receiver_record_index >= ?) ORDER BY timestamp ASC, id ASC LIMIT ?", devicePublicKey, devicePublicKey, fromIndex, fromIndex, limit)
 
 	if err != nil {
 		return nil, err
@@ -107,7 +218,7 @@ func (s *Store) GetRecordsBetween(publicKey []byte, fromIndex uint64, toIndex ui
 	if limit <= 0 {
 		return nil, errors.New("limit must be positive")
 	}
-	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility FROM share_records WHERE (sender_pubkey = ? OR receiver_pubkey = ?) AND (sender_record_index >= ? OR receiver_record_index >= ?) AND (sender_record_index <= ? OR receiver_record_index <= ?) ORDER BY timestamp ASC LIMIT ?", publicKey, publicKey, fromIndex, fromIndex, toIndex, toIndex, limit)
+	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE (sender_pubkey = ? OR receiver_pubkey = ?) AND (sender_record_index >= ? OR receiver_record_index >= ?) AND (sender_record_index <= ? OR receiver_record_index <= ?) ORDER BY timestamp ASC LIMIT ?", publicKey, publicKey, fromIndex, fromIndex, toIndex, toIndex, limit)
 
 	if err != nil {
 		return nil, err
@@ -135,11 +246,73 @@ func (s *Store) GetLatestRecord(publicKey []byte) (*pb.ShareRecord, error) {
 	if publicKey == nil {
 		return nil, errors.New("public key is required")
 	}
-	row := s.reader.QueryRow("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility FROM share_records WHERE sender_pubkey = ? OR receiver_pubkey = ? ORDER BY timestamp DESC LIMIT 1", publicKey, publicKey)
+	row := s.reader.QueryRow("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE sender_pubkey = ? OR receiver_pubkey = ? ORDER BY timestamp DESC LIMIT 1", publicKey, publicKey)
 
 	return scanRecord(row)
 }
 
+// GetRecentRecords returns the limit most recent records of any device, newest first.
+func (s *Store) GetRecentRecords(limit int) ([]*pb.ShareRecord, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	return queryRecords(s.reader, "SELECT "+recordColumns+" FROM share_records ORDER BY timestamp DESC, id DESC LIMIT ?", limit)
+}
+
+// GetRecordsAtIndex returns the records that claim index in devicePublicKey's chain, in either role.
+func (s *Store) GetRecordsAtIndex(devicePublicKey []byte, index uint64) ([]*pb.ShareRecord, error) {
+	if devicePublicKey == nil {
+		return nil, errors.New("device public key is required")
+	}
+	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE (sender_pubkey = ? AND sender_record_index = ?) OR (receiver_pubkey = ? AND receiver_record_index = ?)", devicePublicKey, index, devicePublicKey, index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*pb.ShareRecord, 0)
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetChainSegment returns devicePublicKey's records after afterIndex in chain order, i.e. ordered
+// by the device's own index in whichever role it had.
+func (s *Store) GetChainSegment(devicePublicKey []byte, afterIndex uint64, limit int) ([]*pb.ShareRecord, error) {
+	if devicePublicKey == nil {
+		return nil, errors.New("device public key is required")
+	}
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	rows, err := s.reader.Query("SELECT id, sender_pubkey, receiver_pubkey, prev_sender, prev_receiver, sender_record_index, receiver_record_index, sender_cumulative_sent, sender_cumulative_received, receiver_cumulative_sent, receiver_cumulative_received, request_hash, chunk_hashes, bytes_total, timestamp, sender_sig, receiver_sig, file_hash, visibility, signing_version FROM share_records WHERE (sender_pubkey = ? AND sender_record_index > ?) OR (receiver_pubkey = ? AND receiver_record_index > ?) ORDER BY CASE WHEN sender_pubkey = ? THEN sender_record_index ELSE receiver_record_index END ASC LIMIT ?", devicePublicKey, afterIndex, devicePublicKey, afterIndex, devicePublicKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*pb.ShareRecord, 0)
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
 func (s *Store) CounterpartyDiversity(devicePublicKey []byte, windowSize int) (map[string]int, error){
 
 	rows, err := s.reader.Query("SELECT sender_pubkey, receiver_pubkey FROM share_records WHERE sender_pubkey = ? OR receiver_pubkey = ? ORDER BY timestamp DESC LIMIT ?", devicePublicKey, devicePublicKey, windowSize)
@@ -217,6 +390,7 @@ func scanRecord(scanner interface{ Scan(...any) error }) (*pb.ShareRecord, error
         &record.ReceiverSig,
         &record.FileHash,
         &record.Visibility,
+        &record.SigningVersion,
     )
     if err != nil {
         return nil, err
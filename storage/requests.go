@@ -29,8 +29,8 @@ func (s *Store) InsertRequest(request *pb.TransferRequest) error {
 
 	_, err = s.writer.Exec(`
 		INSERT INTO transfer_requests (hash, requester_pubkey, file_hash, 
-			chunk_indices, nonce, timestamp, signature, status) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, 'pending')`,
+			chunk_indices, nonce, timestamp, signature, signing_version, status) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'pending')`,
 		hash[:],
 		request.RequesterPubkey,
 		request.FileHash,
@@ -38,6 +38,7 @@ func (s *Store) InsertRequest(request *pb.TransferRequest) error {
 		request.Nonce,
 		request.Timestamp,
 		request.Signature,
+		request.SigningVersion,
 	)
 	return err
 }
@@ -49,17 +50,48 @@ func (s *Store) GetRequest(hash []byte) (*pb.TransferRequest, error) {
 
 	row := s.reader.QueryRow(`
 		SELECT requester_pubkey, file_hash, chunk_indices, nonce, 
-			timestamp, signature 
+			timestamp, signature, signing_version 
 		FROM transfer_requests 
 		WHERE hash = ?`, hash)
 
 	return scanRequest(row)
 }
 
+// ErrReplayedNonce is returned when a requester's TransferRequest nonce was already used.
+var ErrReplayedNonce = errors.New("transfer request nonce already used")
+
+// ClaimRequestNonce remembers (requester, nonce) and returns ErrReplayedNonce if it was seen before.
+// timestamp is the request's own timestamp; ExpireOldRequests prunes by it.
+func (s *Store) ClaimRequestNonce(requesterPubkey []byte, nonce []byte, timestamp int64) error {
+	if len(requesterPubkey) == 0 {
+		return errors.New("requester public key is required")
+	}
+	if len(nonce) == 0 {
+		return errors.New("nonce is required")
+	}
+
+	res, err := s.writer.Exec(
+		"INSERT OR IGNORE INTO request_nonces (requester_pubkey, nonce, timestamp) VALUES (?, ?, ?)",
+		requesterPubkey, nonce, timestamp)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
 /* maxAge is in seconds. Delete requests where timestamp is older than the mac age value which is 5 minutes according to our design.
 
 cutoff = current time in seconds - maxAgeSeconds
 
+remembered nonces are pruned with the same cutoff. that is only safe while maxAge is at least
+the request window: a request older than that is rejected as expired before its nonce is checked.
 */
 
 func (s *Store) ExpireOldRequests(maxAge int64) error {
@@ -68,6 +100,17 @@ func (s *Store) ExpireOldRequests(maxAge int64) error {
 
     _, err := s.writer.Exec(
         "DELETE FROM transfer_requests WHERE timestamp < ?", cutoff)
+    if err != nil {
+        return err
+    }
+    _, err = s.writer.Exec(
+        "DELETE FROM request_nonces WHERE timestamp < ?", cutoff)
+    if err != nil {
+        return err
+    }
+    // Redemptions only matter while the capability can still be presented.
+    _, err = s.writer.Exec(
+        "DELETE FROM capability_redemptions WHERE expires_at < ?", time.Now().Unix())
     return err
 }
 
@@ -98,6 +141,7 @@ func scanRequest(scanner interface{ Scan(...any) error }) (*pb.TransferRequest,
 		&req.Nonce,
 		&req.Timestamp,
 		&req.Signature,
+		&req.SigningVersion,
 	)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxSuccessionDepth bounds how many earlier keys are followed when resolving a key's lineage.
+const MaxSuccessionDepth = 16
+
+// MaxSuccessionClockSkewSeconds bounds how far past the local clock a succession may be dated.
+const MaxSuccessionClockSkewSeconds = 10 * 60
+
+var (
+	// ErrInvalidSuccession is returned for a succession record whose signature does not verify
+	// or that is dated in the future.
+	ErrInvalidSuccession = errors.New("invalid succession record")
+	// ErrConflictingSuccession is returned when a key is already succeeded by a different key, or
+	// a key already succeeds a different one. Either would let one device claim two histories.
+	ErrConflictingSuccession = errors.New("conflicting succession record")
+)
+
+// InsertSuccession stores a verified succession record dated no later than now allows. Storing
+// the same record again is not an error.
+func (s *Store) InsertSuccession(succession *pb.SuccessionRecord, now int64) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertSuccessionTx(tx, succession, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertSuccessionTx(tx *sql.Tx, succession *pb.SuccessionRecord, now int64) error {
+	if err := dag.ValidateSuccessionRecord(succession); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSuccession, err)
+	}
+	if succession.GetTimestamp() > now+MaxSuccessionClockSkewSeconds {
+		return fmt.Errorf("%w: timestamp %d is in the future", ErrInvalidSuccession, succession.GetTimestamp())
+	}
+	var existing []byte
+	err := tx.QueryRow(
+		"SELECT signature FROM successions WHERE old_pubkey = ? OR new_pubkey = ?",
+		succession.OldPubkey, succession.NewPubkey,
+	).Scan(&existing)
+	if err == nil {
+		if bytes.Equal(existing, succession.Signature) {
+			return nil
+		}
+		return ErrConflictingSuccession
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	blob, err := proto.Marshal(succession)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO successions (old_pubkey, new_pubkey, timestamp, signature, record)
+		VALUES (?, ?, ?, ?, ?)`,
+		succession.OldPubkey, succession.NewPubkey, succession.Timestamp, succession.Signature, blob)
+	return err
+}
+
+// GetSuccessor returns the record that retired oldPubkey, or sql.ErrNoRows if it is current.
+func (s *Store) GetSuccessor(oldPubkey []byte) (*pb.SuccessionRecord, error) {
+	return s.scanSuccession("SELECT record FROM successions WHERE old_pubkey = ?", oldPubkey)
+}
+
+// GetPredecessor returns the record that handed over to newPubkey, or sql.ErrNoRows.
+func (s *Store) GetPredecessor(newPubkey []byte) (*pb.SuccessionRecord, error) {
+	return s.scanSuccession("SELECT record FROM successions WHERE new_pubkey = ?", newPubkey)
+}
+
+func (s *Store) IsRetired(pubkey []byte) (bool, error) {
+	_, err := s.GetSuccessor(pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetSuccessionChain returns the successions leading to pubkey, newest first.
+func (s *Store) GetSuccessionChain(pubkey []byte) ([]*pb.SuccessionRecord, error) {
+	var chain []*pb.SuccessionRecord
+	seen := map[string]bool{string(pubkey): true}
+	for key := pubkey; len(chain) < MaxSuccessionDepth; {
+		succession, err := s.GetPredecessor(key)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = succession.GetOldPubkey()
+		if seen[string(key)] {
+			break
+		}
+		seen[string(key)] = true
+		chain = append(chain, succession)
+	}
+	return chain, nil
+}
+
+// GetKeyLineage returns pubkey followed by the keys it succeeded, newest first.
+func (s *Store) GetKeyLineage(pubkey []byte) ([][]byte, error) {
+	chain, err := s.GetSuccessionChain(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	lineage := [][]byte{pubkey}
+	for _, succession := range chain {
+		lineage = append(lineage, succession.GetOldPubkey())
+	}
+	return lineage, nil
+}
+
+// knownKeySQL matches a key this device has history with, given as column: its own key, a party
+// to a stored record, or a key a stored succession handed over to. Peer summaries do not count;
+// anyone can gossip a summary for a key they just made up.
+func knownKeySQL(column string) string {
+	return `(
+		` + column + ` IN (SELECT pubkey FROM identity)
+		OR EXISTS (SELECT 1 FROM share_records WHERE share_records.sender_pubkey = ` + column + `)
+		OR EXISTS (SELECT 1 FROM share_records WHERE share_records.receiver_pubkey = ` + column + `)
+		OR EXISTS (SELECT 1 FROM successions AS handed WHERE handed.new_pubkey = ` + column + `))`
+}
+
+// IsKnownKey reports whether this device has history with pubkey; see knownKeySQL. Gossiped
+// successions are only kept for known keys, so made-up keys cannot fill the table.
+func (s *Store) IsKnownKey(pubkey []byte) (bool, error) {
+	var known bool
+	err := s.reader.QueryRow("SELECT "+knownKeySQL("candidate.pubkey")+" FROM (SELECT ? AS pubkey) AS candidate", pubkey).Scan(&known)
+	return known, err
+}
+
+// GetSuccessions returns the most recent succession records that retire a known key, for gossip.
+func (s *Store) GetSuccessions(limit int, now int64) ([]*pb.SuccessionRecord, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	rows, err := s.reader.Query(`
+		SELECT record FROM successions AS retiring
+		WHERE retiring.timestamp <= ? AND `+knownKeySQL("retiring.old_pubkey")+`
+		ORDER BY retiring.timestamp DESC LIMIT ?`, now+MaxSuccessionClockSkewSeconds, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*pb.SuccessionRecord
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		var succession pb.SuccessionRecord
+		if err := proto.Unmarshal(blob, &succession); err != nil {
+			return nil, err
+		}
+		out = append(out, &succession)
+	}
+	return out, rows.Err()
+}
+
+// RotateIdentity stores succession and moves the local identity to its new key. The new key
+// starts an empty chain; the old chain stays in the store and is credited through the lineage.
+func (s *Store) RotateIdentity(succession *pb.SuccessionRecord) error {
+	tx, err := s.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	if err := tx.QueryRow("SELECT pubkey FROM identity WHERE id = 1").Scan(&current); err != nil {
+		return err
+	}
+	if !bytes.Equal(current, succession.GetOldPubkey()) {
+		return errors.New("succession does not retire the local identity")
+	}
+	if err := insertSuccessionTx(tx, succession, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE identity SET pubkey = ?, chain_head = NULL, chain_index = 0,
+			cumulative_sent = 0, cumulative_received = 0
+		WHERE id = 1`, succession.GetNewPubkey())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) scanSuccession(query string, key []byte) (*pb.SuccessionRecord, error) {
+	if key == nil {
+		return nil, errors.New("public key is required")
+	}
+	var blob []byte
+	if err := s.reader.QueryRow(query, key).Scan(&blob); err != nil {
+		return nil, err
+	}
+	var succession pb.SuccessionRecord
+	if err := proto.Unmarshal(blob, &succession); err != nil {
+		return nil, err
+	}
+	return &succession, nil
+}
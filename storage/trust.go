@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+/*
+The trust graph (see credit.TrustGraph) is built from every stored record and checkpoint the first
+time it is asked for, and from then on kept current in memory: each record, checkpoint and witness
+is linked in once it is committed. Linking twice changes nothing, so a record committed while the
+graph is being built is never missed.
+*/
+
+// TrustGraph returns the trust graph around localPubkey. It is a copy the caller may extend.
+func (s *Store) TrustGraph(localPubkey []byte) (*credit.TrustGraph, error) {
+	if len(localPubkey) == 0 {
+		return nil, errors.New("local public key is required")
+	}
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+	if s.trust == nil || !s.trust.IsLocal(localPubkey) {
+		g, err := s.loadTrustGraph(localPubkey)
+		if err != nil {
+			return nil, err
+		}
+		s.trust = g
+	}
+	return s.trust.Clone(), nil
+}
+
+func (s *Store) loadTrustGraph(localPubkey []byte) (*credit.TrustGraph, error) {
+	g := credit.NewTrustGraph(localPubkey)
+	rows, err := s.reader.Query("SELECT sender_pubkey, receiver_pubkey FROM share_records")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r pb.ShareRecord
+		if err := rows.Scan(&r.SenderPubkey, &r.ReceiverPubkey); err != nil {
+			return nil, err
+		}
+		g.AddRecords([]*pb.ShareRecord{&r})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	checkpoints, err := s.reader.Query(`
+		SELECT device_pubkey, chain_head, record_index, cumulative_sent,
+			cumulative_received, raw_balance, timestamp, device_sig,
+			witnesses, confidence, signing_version
+		FROM checkpoints`)
+	if err != nil {
+		return nil, err
+	}
+	defer checkpoints.Close()
+	for checkpoints.Next() {
+		cp, err := scanCheckpoint(checkpoints)
+		if err != nil {
+			return nil, err
+		}
+		g.AddCheckpoint(cp)
+	}
+	return g, checkpoints.Err()
+}
+
+// linkTrust adds a committed record or checkpoint to the trust graph, once it has been built.
+func (s *Store) linkTrust(record *pb.ShareRecord, checkpoint *pb.Checkpoint) {
+	s.trustMu.Lock()
+	defer s.trustMu.Unlock()
+	if s.trust == nil {
+		return
+	}
+	if record != nil {
+		s.trust.AddRecords([]*pb.ShareRecord{record})
+	}
+	s.trust.AddCheckpoint(checkpoint)
+}
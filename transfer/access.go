@@ -0,0 +1,120 @@
+package transfer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/discovery"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// FileAccessSource is implemented by storage.Store in production.
+// The serving side uses it to decide whether a request may fetch a file.
+type FileAccessSource interface {
+	GetFileVisibility(fileHash []byte) (pb.Visibility, error)
+	GetFileMeta(fileHash []byte) (*pb.FileMeta, error)
+	RevokersOf(capabilityID []byte) ([][]byte, error)
+	RedeemCapability(capability *pb.FileCapability, nonce []byte, bytes uint64, now int64) error
+}
+
+// AuthorizeFileAccess lets anyone fetch a public file. A private file needs a capability in the
+// request that validates for the requester and is rooted at the file's origin or at localPubkey.
+// The requested chunks must lie within the capability's chunk ranges, and the request is charged
+// against its download and byte limits; a byte-limited capability is refused for a file whose
+// size is not known.
+func AuthorizeFileAccess(src FileAccessSource, req *pb.TransferRequest, localPubkey []byte, now int64) error {
+	if src == nil {
+		return fmt.Errorf("file access source is required")
+	}
+	if req == nil {
+		return fmt.Errorf("transfer request is required")
+	}
+	visibility, err := src.GetFileVisibility(req.GetFileHash())
+	if errors.Is(err, sql.ErrNoRows) {
+		// Not a file we hold; the transfer will fail on its own.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load file visibility: %w", err)
+	}
+	if visibility != pb.Visibility_VISIBILITY_PRIVATE {
+		return nil
+	}
+
+	capability := req.GetCapability()
+	if capability == nil {
+		return fmt.Errorf("private file requires a capability")
+	}
+	if string(capability.GetFileHash()) != string(req.GetFileHash()) {
+		return fmt.Errorf("capability is for a different file")
+	}
+	issuers := [][]byte{localPubkey}
+	meta, err := src.GetFileMeta(req.GetFileHash())
+	if err == nil {
+		issuers = append(issuers, meta.GetOriginPubkey())
+	} else {
+		meta = nil
+	}
+	if err := discovery.ValidateCapabilityChain(capability, req.GetRequesterPubkey(), issuers, src.RevokersOf, now); err != nil {
+		return fmt.Errorf("capability rejected: %w", err)
+	}
+	if err := discovery.CheckCapabilityScope(capability, req.GetChunkIndices()); err != nil {
+		return fmt.Errorf("capability rejected: %w", err)
+	}
+	// Without the file's size the request would be charged nothing against a byte limit.
+	if (meta == nil || meta.GetChunkSize() == 0) && limitsBytes(capability) {
+		return fmt.Errorf("capability rejected: file size unknown, cannot charge its byte limit")
+	}
+	if err := src.RedeemCapability(capability, req.GetNonce(), requestedBytes(meta, req.GetChunkIndices()), now); err != nil {
+		return fmt.Errorf("capability rejected: %w", err)
+	}
+	return nil
+}
+
+// FileVisibilitySource reports how a locally known file is shared.
+type FileVisibilitySource interface {
+	GetFileVisibility(fileHash []byte) (pb.Visibility, error)
+}
+
+// RecordVisibility is the visibility of the share record that settles req: private when the
+// request presents a capability or the file is private here. src may be nil.
+func RecordVisibility(src FileVisibilitySource, req *pb.TransferRequest) pb.Visibility {
+	if req.GetCapability() != nil {
+		return pb.Visibility_VISIBILITY_PRIVATE
+	}
+	if src != nil {
+		if visibility, err := src.GetFileVisibility(req.GetFileHash()); err == nil {
+			return visibility
+		}
+	}
+	return pb.Visibility_VISIBILITY_PUBLIC
+}
+
+// limitsBytes reports whether any link of the capability's chain caps the bytes it serves.
+func limitsBytes(capability *pb.FileCapability) bool {
+	for link := capability; link != nil; link = link.GetParent() {
+		if link.GetMaxBytes() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedBytes is how much data serving chunkIndices of the file sends. The last chunk may be
+// short; indices past the end of the file count for nothing.
+func requestedBytes(meta *pb.FileMeta, chunkIndices []uint32) uint64 {
+	if meta == nil || meta.GetChunkSize() == 0 {
+		return 0
+	}
+	size, chunkSize := meta.GetFileSize(), meta.GetChunkSize()
+	var total uint64
+	for _, idx := range chunkIndices {
+		start := uint64(idx) * chunkSize
+		if start >= size {
+			continue
+		}
+		total += min(chunkSize, size-start)
+	}
+	return total
+}
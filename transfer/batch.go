@@ -2,8 +2,10 @@ package transfer
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
@@ -11,6 +13,30 @@ import (
 
 const MaxChunksPerBatch = 64
 
+// DefaultChunkWindow is how many chunks a receiver lets the sender have outstanding
+// before it must wait for a ChunkAck.
+const DefaultChunkWindow = 2 * MaxChunksPerBatch
+
+// ChunkGauge counts the chunks in ChunkBatch envelopes a transport has queued and not yet handed
+// out, for ReceiveBuffer. Other envelopes count as nothing.
+type ChunkGauge struct {
+	chunks atomic.Int64
+}
+
+// Queued counts env in as it joins the queue.
+func (g *ChunkGauge) Queued(env *pb.Envelope) {
+	g.chunks.Add(int64(len(env.GetChunkBatch().GetChunks())))
+}
+
+// Taken counts env out as it leaves the queue, whether read or dropped.
+func (g *ChunkGauge) Taken(env *pb.Envelope) {
+	g.chunks.Add(-int64(len(env.GetChunkBatch().GetChunks())))
+}
+
+func (g *ChunkGauge) BufferedChunks() int {
+	return int(g.chunks.Load())
+}
+
 // ChunkRange represents an inclusive chunk interval [Start, End].
 type ChunkRange struct {
 	Start uint32
@@ -18,7 +44,7 @@ type ChunkRange struct {
 }
 
 // MultiSourcePlan tracks which peers can provide which chunk indices/ranges.
-// This is a data model for phase-1 planning only; scheduling logic is phase-2.
+// SwarmDownloader schedules chunk requests across peers from this plan.
 type MultiSourcePlan struct {
 	mu sync.Mutex
 	// peerID -> ranges advertised by that peer
@@ -209,6 +235,62 @@ func VerifyAndStoreBatch(batch *pb.ChunkBatch, meta *pb.FileMeta, storage FileSt
 	return verified, nil
 }
 
+// SplitVerifiedChunks checks every chunk in the batch against meta.ChunkHashes. Unlike
+// VerifyAndStoreBatch it does not stop at the first bad chunk, so the caller can keep the good
+// ones and ask again for the rest.
+func SplitVerifiedChunks(batch *pb.ChunkBatch, meta *pb.FileMeta) (verified []*pb.ChunkData, rejected []uint32, err error) {
+	if batch == nil {
+		return nil, nil, fmt.Errorf("batch is required")
+	}
+	if meta == nil {
+		return nil, nil, fmt.Errorf("file metadata is required")
+	}
+	if !bytes.Equal(batch.GetFileHash(), meta.GetFileHash()) {
+		return nil, nil, fmt.Errorf("batch file hash does not match metadata")
+	}
+
+	for _, chunk := range batch.GetChunks() {
+		if chunk == nil {
+			continue
+		}
+		if chunkMatchesMeta(meta, chunk.GetChunkIndex(), chunk.GetData()) {
+			verified = append(verified, chunk)
+		} else {
+			rejected = append(rejected, chunk.GetChunkIndex())
+		}
+	}
+	return verified, rejected, nil
+}
+
+// VerifyFileHash hashes every chunk of the file in order and compares the result with
+// meta.FileHash (SHA-256 of the whole file, as computed when the file was shared).
+func VerifyFileHash(meta *pb.FileMeta, storage FileStorage) error {
+	if meta == nil {
+		return fmt.Errorf("file metadata is required")
+	}
+	if storage == nil {
+		return fmt.Errorf("storage is required")
+	}
+
+	h := sha256.New()
+	var size uint64
+	for idx := range meta.GetChunkHashes() {
+		data, err := storage.ReadChunk(meta.GetFileHash(), uint32(idx))
+		if err != nil {
+			return fmt.Errorf("read chunk %d: %w", idx, err)
+		}
+		h.Write(data)
+		size += uint64(len(data))
+	}
+	if meta.GetFileSize() > 0 && size != meta.GetFileSize() {
+		return fmt.Errorf("file size mismatch: %d != %d", size, meta.GetFileSize())
+	}
+	if !bytes.Equal(h.Sum(nil), meta.GetFileHash()) {
+		return fmt.Errorf("whole-file hash mismatch")
+	}
+	return nil
+}
+
 func MissingChunkIndices(storage FileStorage, fileHash []byte, requestedIndices []uint32) ([]uint32, error) {
 	if storage == nil {
 		return nil, fmt.Errorf("storage is required")
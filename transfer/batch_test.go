@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
@@ -40,6 +41,16 @@ func (m *memoryFileStorage) HasChunk(fileHash []byte, chunkIndex uint32) (bool,
 	return ok, nil
 }
 
+func (m *memoryFileStorage) DeleteFile(fileHash []byte) error {
+	prefix := fmt.Sprintf("%x:", fileHash)
+	for k := range m.chunks {
+		if strings.HasPrefix(k, prefix) {
+			delete(m.chunks, k)
+		}
+	}
+	return nil
+}
+
 func TestBuildBatch(t *testing.T) {
 	st := newMemoryFileStorage()
 	fileHash := []byte("file-hash")
@@ -167,3 +178,51 @@ func TestMultiSourcePlanMerge(t *testing.T) {
 		t.Fatalf("expected 2 providers for chunk 1 after merge, got %d", len(providers))
 	}
 }
+
+func TestSplitVerifiedChunks(t *testing.T) {
+	fileHash := []byte("file-hash")
+	h0 := crypto.Hash([]byte("chunk-0"))
+	h1 := crypto.Hash([]byte("chunk-1"))
+	meta := &pb.FileMeta{FileHash: fileHash, ChunkHashes: [][]byte{h0[:], h1[:]}}
+	batch := &pb.ChunkBatch{
+		FileHash: fileHash,
+		Chunks: []*pb.ChunkData{
+			{ChunkIndex: 0, Data: []byte("chunk-0")},
+			{ChunkIndex: 1, Data: []byte("forged")},
+			{ChunkIndex: 7, Data: []byte("chunk-1")},
+		},
+	}
+
+	verified, rejected, err := SplitVerifiedChunks(batch, meta)
+	if err != nil {
+		t.Fatalf("SplitVerifiedChunks failed: %v", err)
+	}
+	if len(verified) != 1 || verified[0].GetChunkIndex() != 0 {
+		t.Fatalf("expected only chunk 0 to verify, got %v", verified)
+	}
+	if len(rejected) != 2 || rejected[0] != 1 || rejected[1] != 7 {
+		t.Fatalf("expected chunks 1 and 7 rejected, got %v", rejected)
+	}
+
+	batch.FileHash = []byte("other-file")
+	if _, _, err := SplitVerifiedChunks(batch, meta); err == nil {
+		t.Fatalf("expected batch for another file to be refused")
+	}
+}
+
+func TestVerifyFileHash(t *testing.T) {
+	st := newMemoryFileStorage()
+	whole := crypto.Hash([]byte("chunk-0chunk-1"))
+	meta := &pb.FileMeta{FileHash: whole[:], FileSize: 14, ChunkHashes: [][]byte{{0}, {1}}}
+	_ = st.WriteChunk(meta.GetFileHash(), 0, []byte("chunk-0"))
+	_ = st.WriteChunk(meta.GetFileHash(), 1, []byte("chunk-1"))
+
+	if err := VerifyFileHash(meta, st); err != nil {
+		t.Fatalf("expected file to verify: %v", err)
+	}
+
+	_ = st.WriteChunk(meta.GetFileHash(), 1, []byte("chunk-X"))
+	if err := VerifyFileHash(meta, st); err == nil {
+		t.Fatalf("expected whole-file hash mismatch")
+	}
+}
@@ -3,13 +3,17 @@ package transfer
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 	"google.golang.org/protobuf/proto"
 )
@@ -30,6 +34,17 @@ const (
 
 const maxVerificationPayloadBytes = 512 * 1024
 
+const (
+	// maxChunkResends bounds how often a sender re-sends a chunk the receiver rejected.
+	maxChunkResends = 3
+	// maxWholeFileRetries bounds how often a receiver discards and re-requests a file whose
+	// whole-file hash does not match its metadata.
+	maxWholeFileRetries = 2
+)
+
+// DefaultChunkAckTimeout is how long a sending session waits for the receiver's next chunk ack.
+const DefaultChunkAckTimeout = 30 * time.Second
+
 type SessionDirection string
 
 const (
@@ -53,8 +68,35 @@ type TransferSession struct {
 	policyStore *storage.Store
 
 	localPubKey     []byte
+	localPolicy     pb.ServicePolicy
 	pendingRequest  *pb.TransferRequest
 
+	// Ephemeral X25519 keys for this session; generated in handleHandshake when not preset.
+	ephemeralPub  []byte
+	ephemeralPriv []byte
+	// peerHello is only set once the peer has proven possession of its identity key.
+	peerHello    *pb.HandshakeMsg
+	peerIdentity []byte
+	// protocol is the version and features negotiated with the peer, ours until then.
+	protocol wire.Protocol
+
+	metaSource FileMetaSource
+	faults     PeerFaultRecorder
+	// meta is loaded before the first outbound request; every received chunk is checked against it.
+	meta        *pb.FileMeta
+	fileRetries int
+
+	heads ChainHeadSource
+	forks ForkDetector
+	// proposed is the record this session built as sender, waiting for the receiver's signature.
+	proposed *pb.ShareRecord
+	// ackedHead is the receiver's chain head from its latest ack, when it sent one.
+	ackedHead *pb.ChainHead
+	// ackTimeout is how long the sender waits for the receiver's next ack.
+	ackTimeout time.Duration
+	// releaseHeadFunc ends this session's hold on the local chain head; see localHead.
+	releaseHeadFunc func()
+
 	// Outbound (requester): after the signed TransferRequest is sent on the wire, wait for
 	// ChunkBatch before co-signing. Prevents jumping to CoSigning while Recv would steal batches.
 	outboundChunkRequestSent bool
@@ -83,6 +125,8 @@ func NewSession(
 		chain:     chain,
 		balance:   balance,
 		signer:    signer,
+		protocol:  wire.LocalProtocol(),
+		ackTimeout: DefaultChunkAckTimeout,
 	}
 }
 
@@ -92,6 +136,81 @@ func (s *TransferSession) SetLocalPubKey(pubKey []byte) {
 	s.localPubKey = append([]byte(nil), pubKey...)
 }
 
+func (s *TransferSession) SetLocalPolicy(policy pb.ServicePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.localPolicy = policy
+}
+
+// SetEphemeralKeyPair lets the caller reuse the ephemeral key it already advertised on the link.
+func (s *TransferSession) SetEphemeralKeyPair(pub []byte, priv []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ephemeralPub = append([]byte(nil), pub...)
+	s.ephemeralPriv = append([]byte(nil), priv...)
+}
+
+// PeerIdentity returns the identity key the peer authenticated with, or nil before the handshake completes.
+func (s *TransferSession) PeerIdentity() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.peerIdentity...)
+}
+
+// Protocol is the version and features negotiated in the handshake.
+func (s *TransferSession) Protocol() wire.Protocol {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocol
+}
+
+// SetProtocol is used with SetPeerIdentity when the link negotiated its protocol outside the session.
+func (s *TransferSession) SetProtocol(p wire.Protocol) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protocol = p
+}
+
+// SetPeerIdentity is used when the link was authenticated outside the session (cabi does the
+// handshake per connection, not per transfer).
+func (s *TransferSession) SetPeerIdentity(pubKey []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerIdentity = append([]byte(nil), pubKey...)
+}
+
+func (s *TransferSession) SetFileMetaSource(src FileMetaSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metaSource = src
+}
+
+func (s *TransferSession) SetPeerFaultRecorder(r PeerFaultRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = r
+}
+
+// SetAckTimeout sets how long a sending session waits for each chunk ack; see
+// DefaultChunkAckTimeout.
+func (s *TransferSession) SetAckTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackTimeout = d
+}
+
+func (s *TransferSession) SetChainHeadSource(src ChainHeadSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heads = src
+}
+
+func (s *TransferSession) SetForkDetector(d ForkDetector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forks = d
+}
+
 func (s *TransferSession) SetFileStorage(storage FileStorage) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -158,6 +277,7 @@ func (s *TransferSession) RunSession(ctx context.Context) error {
 	s.mu.Unlock()
 
 	defer cancel()
+	defer s.releaseHead()
 
 	if s.pendingRequest != nil {
 		if err := s.TransitionTo(StateHandshake); err != nil {
@@ -262,72 +382,122 @@ func (s *TransferSession) RunSession(ctx context.Context) error {
 }
 
 func (s *TransferSession) handleHandshake(_ context.Context) (TransferState, error) {
-	return StateVerifying, nil
-}
-
-func (s *TransferSession) handleVerifying(_ context.Context) (TransferState, error) {
 	if s.transport == nil {
-		return StateFailed, fmt.Errorf("verifying requires transport")
+		return StateFailed, fmt.Errorf("handshake requires transport")
 	}
-
-	env, err := s.transport.Recv()
-	if err != nil {
-		return StateFailed, fmt.Errorf("failed to receive verification payload: %w", err)
+	if s.signer == nil {
+		return StateFailed, fmt.Errorf("handshake requires signer")
 	}
-	if env == nil {
-		return StateFailed, fmt.Errorf("received nil verification envelope")
+	if len(s.localPubKey) == 0 {
+		return StateFailed, fmt.Errorf("handshake requires local identity pubkey")
+	}
+	if len(s.ephemeralPub) == 0 {
+		pub, priv, err := crypto.GenerateSessionKeyPair()
+		if err != nil {
+			return StateFailed, fmt.Errorf("generate ephemeral key: %w", err)
+		}
+		s.SetEphemeralKeyPair(pub, priv)
 	}
 
-	handshake := env.GetHandshake()
-	if handshake == nil {
-		return StateFailed, fmt.Errorf("verification envelope missing handshake payload")
+	ours := &pb.HandshakeMsg{
+		SessionId:       []byte(s.ID),
+		EphemeralPubkey: s.ephemeralPub,
+		IdentityPubkey:  s.localPubKey,
+		Policy:          s.localPolicy,
+	}
+	AdvertiseProtocol(ours)
+	if s.policyStore != nil {
+		// Without a proof the peer can only treat us as a new device.
+		_ = AttachChainProof(ours, s.policyStore)
+		_ = AttachNetworkParams(ours, s.policyStore)
+	}
+	if err := s.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_Handshake{Handshake: ours},
+	}); err != nil {
+		return StateFailed, fmt.Errorf("send handshake failed: %w", err)
 	}
 
-	if size := proto.Size(handshake); size > maxVerificationPayloadBytes {
+	env, err := s.transport.Recv()
+	if err != nil {
+		return StateFailed, fmt.Errorf("failed to receive handshake: %w", err)
+	}
+	hello := env.GetHandshake()
+	if hello == nil {
+		return StateRejected, fmt.Errorf("expected handshake, got %T", env.GetPayload())
+	}
+	if size := proto.Size(hello); size > maxVerificationPayloadBytes {
 		return StateRejected, fmt.Errorf(
 			"verification payload too large: %d > %d",
 			size,
 			maxVerificationPayloadBytes,
 		)
 	}
-
-	peerPub, peerPolicy, err := ProcessHandshake(handshake)
+	_, peerPolicy, err := ProcessHandshake(hello)
 	if err != nil {
 		return StateRejected, fmt.Errorf("invalid handshake payload: %w", err)
 	}
+	negotiated := NegotiatePolicy(s.localPolicy, peerPolicy)
+	protocol, err := NegotiateProtocol(hello)
+	if err != nil {
+		return StateRejected, err
+	}
 
-	// New-device fallback: allow drip-only path when no checkpoint/records exist.
-	if handshake.GetLatestCheckpoint() == nil && len(handshake.GetRecordsSinceCheckpoint()) == 0 {
-		if s.balance == nil {
-			return StateRejected, fmt.Errorf("new-device verify requires balance checker")
-		}
-		if s.balance.EffectiveBalance(nil, peerPub, 0) > 0 {
-			return StateTransferring, nil
-		}
-		// Fresh BLE / MVP nodes have no ledger rows yet; drip is 0. Identity still passed
-		// ProcessHandshake. Rejecting here prevents any first-hop file transfer (see session logs:
-		// UI shows "request OK" but no NativeHooks send / no writeChunk on peer).
-		return StateTransferring, nil
+	auth, err := BuildHandshakeAuth(s.signer, s.localPubKey, s.ephemeralPub, hello, negotiated, protocol)
+	if err != nil {
+		return StateFailed, err
+	}
+	if err := s.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_HandshakeAuth{HandshakeAuth: auth},
+	}); err != nil {
+		return StateFailed, fmt.Errorf("send handshake auth failed: %w", err)
 	}
 
-	recordsForPolicy := handshake.GetRecordsSinceCheckpoint()
-	if s.policyStore != nil && len(recordsForPolicy) == 0 {
-		from := uint64(0)
-		if cp := handshake.GetLatestCheckpoint(); cp != nil {
-			from = cp.GetRecordIndex()
-		}
-		if fetched, fetchErr := s.policyStore.GetRecordsByDevice(peerPub, from, 200); fetchErr == nil {
-			recordsForPolicy = fetched
-		}
+	env, err = s.transport.Recv()
+	if err != nil {
+		return StateFailed, fmt.Errorf("failed to receive handshake auth: %w", err)
 	}
-	approved, reason := EvaluatePolicy(s.policyStore, peerPub, peerPolicy, handshake.GetLatestCheckpoint(), recordsForPolicy)
-	if approved {
-		return StateTransferring, nil
+	if err := VerifyHandshakeAuth(env.GetHandshakeAuth(), hello, s.ephemeralPub, negotiated, protocol); err != nil {
+		return StateRejected, fmt.Errorf("peer failed handshake authentication: %w", err)
 	}
-	return StateRejected, fmt.Errorf("policy rejected: %s", reason)
+
+	// Everything after the handshake is sealed with keys from the two ephemeral keys just
+	// authenticated, so chunks and records cannot be read or altered on the link.
+	secure, err := KeyTransport(s.transport, s.ephemeralPub, s.ephemeralPriv, hello.GetEphemeralPubkey())
+	if err != nil {
+		return StateFailed, fmt.Errorf("key session transport: %w", err)
+	}
+
+	s.mu.Lock()
+	s.peerHello = hello
+	s.peerIdentity = append([]byte(nil), hello.GetIdentityPubkey()...)
+	s.protocol = protocol
+	s.transport = secure
+	s.mu.Unlock()
+	return StateVerifying, nil
+}
+
+func (s *TransferSession) handleVerifying(_ context.Context) (TransferState, error) {
+	s.mu.Lock()
+	handshake := s.peerHello
+	forks := s.forks
+	s.mu.Unlock()
+	if handshake == nil {
+		return StateFailed, fmt.Errorf("verifying requires an authenticated handshake")
+	}
+
+	_, peerPolicy, err := ProcessHandshake(handshake)
+	if err != nil {
+		return StateRejected, fmt.Errorf("invalid handshake payload: %w", err)
+	}
+	// The peer is held to the policy both sides signed, not only the one it advertised.
+	policy := NegotiatePolicy(s.localPolicy, peerPolicy)
+	if err := VerifyPeer(s.policyStore, handshake, policy, forks, s.fileMetaLookup()); err != nil {
+		return StateRejected, err
+	}
+	return StateTransferring, nil
 }
 
-func (s *TransferSession) handleTransferring(_ context.Context) (TransferState, error) {
+func (s *TransferSession) handleTransferring(ctx context.Context) (TransferState, error) {
 	if s.pendingRequest == nil || s.storage == nil {
 		return StateCoSigning, nil
 	}
@@ -339,37 +509,49 @@ func (s *TransferSession) handleTransferring(_ context.Context) (TransferState,
 
 	// Inbound = we received a TransferRequest; we are the sender and must have every chunk locally.
 	if s.Direction == DirectionInbound {
+		if s.policyStore != nil {
+			if err := AuthorizeFileAccess(s.policyStore, s.pendingRequest, s.localPubKey, time.Now().Unix()); err != nil {
+				return StateRejected, err
+			}
+		}
 		if len(missing) > 0 {
 			return StateFailed, fmt.Errorf("sender missing %d requested chunks locally", len(missing))
 		}
-		if len(s.pendingRequest.ChunkIndices) > 0 {
-			indices := s.pendingRequest.ChunkIndices
-			if len(indices) > MaxChunksPerBatch {
-				indices = append([]uint32(nil), s.pendingRequest.ChunkIndices[:MaxChunksPerBatch]...)
-			}
-			batch, berr := BuildBatch(s.pendingRequest.FileHash, indices, len(indices), s.storage)
-			if berr != nil {
-				return StateFailed, fmt.Errorf("build chunk batch: %w", berr)
-			}
-			if s.transport != nil {
-				if err := s.transport.Send(&pb.Envelope{
-					Payload: &pb.Envelope_ChunkBatch{ChunkBatch: batch},
-				}); err != nil {
-					return StateFailed, fmt.Errorf("send chunk batch: %w", err)
-				}
-			}
+		if len(s.pendingRequest.ChunkIndices) == 0 {
+			return StateComplete, nil
 		}
-		return StateComplete, nil
+		if err := s.streamChunks(ctx, s.pendingRequest.FileHash, s.pendingRequest.ChunkIndices); err != nil {
+			return StateFailed, err
+		}
+		if err := s.proposeShareRecord(ctx); err != nil {
+			return StateFailed, err
+		}
+		return StateCoSigning, nil
 	}
 
 	// Outbound: requester — receive chunk data from peer before co-signing.
-	if len(missing) == 0 {
+	if len(missing) == 0 && !s.outboundChunkRequestSent {
 		return StateComplete, nil
 	}
 
 	if !s.outboundChunkRequestSent {
+		if s.meta == nil {
+			meta, err := s.loadFileMeta()
+			if err != nil {
+				return StateFailed, err
+			}
+			s.meta = meta
+		}
 		s.pendingRequest.ChunkIndices = missing
+		if src := s.chainHeadSource(); src != nil {
+			head, err := src.LocalChainHead()
+			if err != nil {
+				return StateFailed, fmt.Errorf("load local chain head: %w", err)
+			}
+			s.pendingRequest.RequesterHead = head
+		}
 		if s.signer != nil {
+			s.pendingRequest.SigningVersion = s.Protocol().SigningVersion()
 			signable := dag.TransferRequestSignableBytes(s.pendingRequest)
 			sig, err := s.signer.Sign(signable)
 			if err != nil {
@@ -403,18 +585,21 @@ func (s *TransferSession) handleTransferring(_ context.Context) (TransferState,
 				if env == nil {
 					continue
 				}
-				if batch := env.GetChunkBatch(); batch != nil && s.storage != nil {
-					for _, ch := range batch.GetChunks() {
-						if err := s.storage.WriteChunk(batch.GetFileHash(), ch.GetChunkIndex(), ch.GetData()); err != nil {
-							return StateFailed, fmt.Errorf("store received chunk: %w", err)
-						}
+				if batch := env.GetChunkBatch(); batch != nil {
+					if err := s.receiveBatch(batch); err != nil {
+						return StateFailed, err
 					}
 				} else {
 					s.transport.PutBack(env)
 					break
 				}
 			}
-			return StateComplete, nil
+			// Chunks persisted by the transport layer may never pass through Recv here, so ack the
+			// whole request once it is complete; the sender treats repeated acks as no-ops.
+			if err := s.ackChunkIndices(s.pendingRequest.FileHash, s.pendingRequest.ChunkIndices, nil); err != nil {
+				return StateFailed, fmt.Errorf("send chunk ack: %w", err)
+			}
+			return s.verifyCompletedFile()
 		}
 		if s.transport == nil {
 			return StateFailed, fmt.Errorf("transfer requires transport while waiting for chunks")
@@ -426,17 +611,310 @@ func (s *TransferSession) handleTransferring(_ context.Context) (TransferState,
 		if env == nil {
 			return StateFailed, fmt.Errorf("transport returned nil envelope while waiting for chunks")
 		}
-		if batch := env.GetChunkBatch(); batch != nil && s.storage != nil {
-			for _, ch := range batch.GetChunks() {
-				if err := s.storage.WriteChunk(batch.GetFileHash(), ch.GetChunkIndex(), ch.GetData()); err != nil {
-					return StateFailed, fmt.Errorf("store received chunk: %w", err)
-				}
+		if batch := env.GetChunkBatch(); batch != nil {
+			if err := s.receiveBatch(batch); err != nil {
+				return StateFailed, err
+			}
+		}
+	}
+}
+
+func (s *TransferSession) loadFileMeta() (*pb.FileMeta, error) {
+	src := s.metaSource
+	if src == nil && s.policyStore != nil {
+		src = s.policyStore
+	}
+	if src == nil {
+		return nil, fmt.Errorf("no file metadata source to verify chunks against")
+	}
+	meta, err := src.GetFileMeta(s.pendingRequest.FileHash)
+	if err != nil {
+		return nil, fmt.Errorf("load file metadata: %w", err)
+	}
+	if !bytes.Equal(meta.GetFileHash(), s.pendingRequest.FileHash) {
+		return nil, fmt.Errorf("file metadata does not match requested file")
+	}
+	return meta, nil
+}
+
+// receiveBatch writes only chunks that match the file metadata, reports the peer for the rest
+// and acks both lists so the sender re-sends what was rejected.
+func (s *TransferSession) receiveBatch(batch *pb.ChunkBatch) error {
+	if s.meta == nil {
+		return fmt.Errorf("received chunks before file metadata was loaded")
+	}
+	if !bytes.Equal(batch.GetFileHash(), s.meta.GetFileHash()) {
+		// Batches for another transfer on the same link are not ours to verify or ack.
+		return nil
+	}
+	verified, rejected, err := SplitVerifiedChunks(batch, s.meta)
+	if err != nil {
+		return err
+	}
+
+	stored := make([]uint32, 0, len(verified))
+	for _, ch := range verified {
+		if err := s.storage.WriteChunk(batch.GetFileHash(), ch.GetChunkIndex(), ch.GetData()); err != nil {
+			return fmt.Errorf("store received chunk: %w", err)
+		}
+		stored = append(stored, ch.GetChunkIndex())
+	}
+	for range rejected {
+		s.recordPeerFault(storage.PeerFaultBadChunk)
+	}
+
+	if err := s.ackChunkIndices(batch.GetFileHash(), stored, rejected); err != nil {
+		return fmt.Errorf("send chunk ack: %w", err)
+	}
+	return nil
+}
+
+// verifyCompletedFile runs the whole-file hash check once every chunk of the file is present.
+// On mismatch the file is deleted and requested again from scratch.
+func (s *TransferSession) verifyCompletedFile() (TransferState, error) {
+	all := make([]uint32, len(s.meta.GetChunkHashes()))
+	for i := range all {
+		all[i] = uint32(i)
+	}
+	missing, err := MissingChunkIndices(s.storage, s.meta.GetFileHash(), all)
+	if err != nil {
+		return StateFailed, fmt.Errorf("completed file check failed: %w", err)
+	}
+	if len(missing) > 0 {
+		// Partial request: the rest of the file is still to come from elsewhere.
+		return StateCoSigning, nil
+	}
+
+	verifyErr := VerifyFileHash(s.meta, s.storage)
+	if verifyErr == nil {
+		return StateCoSigning, nil
+	}
+	s.recordPeerFault(storage.PeerFaultBadFile)
+
+	deleter, ok := s.storage.(FileDeleter)
+	if !ok || s.fileRetries >= maxWholeFileRetries {
+		return StateFailed, fmt.Errorf("received file rejected: %w", verifyErr)
+	}
+	if err := deleter.DeleteFile(s.meta.GetFileHash()); err != nil {
+		return StateFailed, fmt.Errorf("discard rejected file: %w", err)
+	}
+	s.fileRetries++
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return StateFailed, err
+	}
+	s.pendingRequest.ChunkIndices = all
+	s.pendingRequest.Nonce = nonce
+	s.pendingRequest.Timestamp = time.Now().Unix()
+	s.pendingRequest.Signature = nil
+	s.outboundChunkRequestSent = false
+	return StateTransferring, nil
+}
+
+func (s *TransferSession) recordPeerFault(kind string) {
+	rec := s.faults
+	if rec == nil && s.policyStore != nil {
+		rec = s.policyStore
+	}
+	if rec == nil {
+		return
+	}
+	key := s.PeerIdentity()
+	if len(key) == 0 {
+		key = []byte(s.PeerID)
+	}
+	_ = rec.RecordPeerFault(key, kind, time.Now().Unix())
+}
+
+// streamChunks sends every requested chunk in batches of at most MaxChunksPerBatch. The receiver
+// acks each batch and advertises a credit window; we never have more than that many chunks
+// outstanding, and we only return once every chunk has been acked. A window of zero sends
+// nothing until a later ack grants credit. A receiver that sends nothing for the ack timeout
+// fails the session.
+func (s *TransferSession) streamChunks(ctx context.Context, fileHash []byte, indices []uint32) error {
+	if s.transport == nil {
+		return fmt.Errorf("streaming requires transport")
+	}
+
+	remaining := append([]uint32(nil), indices...)
+	outstanding := make(map[uint32]struct{})
+	resends := make(map[uint32]int)
+	window := DefaultChunkWindow
+	headPending := false
+
+	for len(remaining) > 0 || len(outstanding) > 0 {
+		for len(remaining) > 0 && len(outstanding) < window {
+			n := window - len(outstanding)
+			if n > MaxChunksPerBatch {
+				n = MaxChunksPerBatch
+			}
+			if n > len(remaining) {
+				n = len(remaining)
+			}
+			next := remaining[:n]
+			batch, err := BuildBatch(fileHash, next, len(next), s.storage)
+			if err != nil {
+				return fmt.Errorf("build chunk batch: %w", err)
+			}
+			if err := s.transport.Send(&pb.Envelope{
+				Payload: &pb.Envelope_ChunkBatch{ChunkBatch: batch},
+			}); err != nil {
+				return fmt.Errorf("send chunk batch: %w", err)
+			}
+			for _, idx := range next {
+				outstanding[idx] = struct{}{}
+			}
+			remaining = remaining[n:]
+		}
+
+		env, err := s.recvAck(ctx)
+		if err != nil {
+			return err
+		}
+		ack := env.GetChunkAck()
+		if ack == nil || !bytes.Equal(ack.GetFileHash(), fileHash) {
+			// Stale handshakes or duplicate requests can sit in the queue; acks are all we need here.
+			continue
+		}
+		for _, idx := range ack.GetChunkIndices() {
+			delete(outstanding, idx)
+		}
+		for _, idx := range ack.GetRejectedIndices() {
+			if _, ok := outstanding[idx]; !ok {
+				continue
+			}
+			resends[idx]++
+			if resends[idx] > maxChunkResends {
+				return fmt.Errorf("receiver rejected chunk %d %d times", idx, resends[idx])
 			}
+			delete(outstanding, idx)
+			remaining = append(remaining, idx)
+		}
+		headPending = ack.GetHeadPending()
+		if head := ack.GetRequesterHead(); head != nil {
+			s.ackedHead = head
 		}
+		window = int(ack.GetCredits())
 	}
+	if headPending {
+		return s.awaitRequesterHead(fileHash)
+	}
+	return nil
 }
 
-func (s *TransferSession) handleCoSigning(_ context.Context) (TransferState, error) {
+// awaitRequesterHead waits for the ack naming the head the receiver reserved for our record,
+// after a final ack marked head_pending. The receiver is settling with another peer first; like
+// the countersignature, that wait is not bounded by the ack timeout.
+func (s *TransferSession) awaitRequesterHead(fileHash []byte) error {
+	for {
+		env, err := s.transport.Recv()
+		if err != nil {
+			return fmt.Errorf("waiting for requester head: %w", err)
+		}
+		ack := env.GetChunkAck()
+		if ack == nil || !bytes.Equal(ack.GetFileHash(), fileHash) {
+			continue
+		}
+		if head := ack.GetRequesterHead(); head != nil {
+			s.ackedHead = head
+			return nil
+		}
+	}
+}
+
+// recvAck waits for the receiver's next envelope for at most the ack timeout. Unless one is
+// already queued, the wait blocks in the transport's Recv on its own goroutine; an envelope it
+// reads after we stopped waiting is put back for the link's other readers.
+func (s *TransferSession) recvAck(ctx context.Context) (*pb.Envelope, error) {
+	s.mu.Lock()
+	timeout := s.ackTimeout
+	s.mu.Unlock()
+	if env, ok := s.transport.TryRecv(); ok && env != nil {
+		return env, nil
+	}
+
+	type received struct {
+		env *pb.Envelope
+		err error
+	}
+	transport := s.transport
+	got := make(chan received, 1)
+	var mu sync.Mutex
+	abandoned := false
+	go func() {
+		env, err := transport.Recv()
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			if err == nil && env != nil {
+				transport.PutBack(env)
+			}
+			return
+		}
+		got <- received{env: env, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var waitErr error
+	select {
+	case r := <-got:
+		return ackReceived(r.env, r.err)
+	case <-timer.C:
+		waitErr = fmt.Errorf("no chunk ack within %s", timeout)
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("waiting for chunk ack: %w", ctx.Err())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	abandoned = true
+	select {
+	case r := <-got:
+		// It arrived as we gave up.
+		return ackReceived(r.env, r.err)
+	default:
+	}
+	return nil, waitErr
+}
+
+func ackReceived(env *pb.Envelope, err error) (*pb.Envelope, error) {
+	if err != nil {
+		return nil, fmt.Errorf("receive chunk ack: %w", err)
+	}
+	return env, nil
+}
+
+// ackChunkIndices tells the sender which chunks were stored and which must be sent again,
+// and how many chunks it may have outstanding; see receiveCredits.
+func (s *TransferSession) ackChunkIndices(fileHash []byte, stored []uint32, rejected []uint32) error {
+	if s.transport == nil {
+		return nil
+	}
+	return s.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{
+			FileHash:        fileHash,
+			ChunkIndices:    stored,
+			Credits:         s.receiveCredits(),
+			RejectedIndices: rejected,
+		}},
+	})
+}
+
+// receiveCredits is the chunk window less the chunks our transport has queued and we have not
+// read yet. A transport that does not report its buffer gets the full window.
+func (s *TransferSession) receiveCredits() uint32 {
+	credits := DefaultChunkWindow
+	if buf, ok := s.transport.(ReceiveBuffer); ok {
+		credits -= buf.BufferedChunks()
+	}
+	if credits < 0 {
+		credits = 0
+	}
+	return uint32(credits)
+}
+
+func (s *TransferSession) handleCoSigning(ctx context.Context) (TransferState, error) {
 	if s.transport == nil {
 		return StateFailed, fmt.Errorf("co-signing requires transport")
 	}
@@ -447,14 +925,14 @@ func (s *TransferSession) handleCoSigning(_ context.Context) (TransferState, err
 		return StateFailed, fmt.Errorf("co-signing requires chain appender")
 	}
 
-	env, err := s.transport.Recv()
+	if s.proposed != nil {
+		return s.awaitCountersignature()
+	}
+
+	record, err := s.recvShareRecord()
 	if err != nil {
 		return StateFailed, fmt.Errorf("failed to receive co-sign record: %w", err)
 	}
-	if env == nil || env.GetShareRecord() == nil {
-		return StateFailed, fmt.Errorf("co-sign envelope missing share record")
-	}
-	record := env.GetShareRecord()
 
 	if len(record.GetRequestHash()) == 0 {
 		return StateRejected, fmt.Errorf("share record missing request hash")
@@ -463,13 +941,8 @@ func (s *TransferSession) handleCoSigning(_ context.Context) (TransferState, err
 		return StateRejected, fmt.Errorf("share record file hash mismatch")
 	}
 	if s.pendingRequest != nil {
-		reqBytes, err := proto.Marshal(s.pendingRequest)
-		if err != nil {
-			return StateFailed, fmt.Errorf("marshal pending request failed: %w", err)
-		}
-		reqHash := crypto.Hash(reqBytes)
-		if !bytes.Equal(record.GetRequestHash(), reqHash[:]) {
-			return StateRejected, fmt.Errorf("share record request hash does not match pending request")
+		if err := s.checkProposedRecord(ctx, record); err != nil {
+			return StateRejected, err
 		}
 	}
 
@@ -493,14 +966,10 @@ func (s *TransferSession) handleCoSigning(_ context.Context) (TransferState, err
 	}
 
 	if len(record.GetSenderSig()) == 0 || len(record.GetReceiverSig()) == 0 {
-		finalEnv, err := s.transport.Recv()
+		record, err = s.recvShareRecord()
 		if err != nil {
 			return StateFailed, fmt.Errorf("receive final co-signed record failed: %w", err)
 		}
-		if finalEnv == nil || finalEnv.GetShareRecord() == nil {
-			return StateFailed, fmt.Errorf("final co-signed envelope missing share record")
-		}
-		record = finalEnv.GetShareRecord()
 	}
 
 	if err := dag.ValidateShareRecord(record); err != nil {
@@ -510,10 +979,261 @@ func (s *TransferSession) handleCoSigning(_ context.Context) (TransferState, err
 	if err := s.chain.AppendRecord(record); err != nil {
 		return StateFailed, fmt.Errorf("append record failed: %w", err)
 	}
+	s.releaseHead()
+	if err := s.keepPrivate(record); err != nil {
+		return StateFailed, err
+	}
+
+	return StateGossiping, nil
+}
+
+// recordVisibility is the visibility the record settling this session's request carries.
+func (s *TransferSession) recordVisibility() pb.Visibility {
+	if s.policyStore == nil {
+		return RecordVisibility(nil, s.pendingRequest)
+	}
+	return RecordVisibility(s.policyStore, s.pendingRequest)
+}
+
+// keepPrivate marks the file of a private record private here too, so a downloaded private file
+// is never seeded in gossip.
+func (s *TransferSession) keepPrivate(record *pb.ShareRecord) error {
+	if s.policyStore == nil || record.GetVisibility() != pb.Visibility_VISIBILITY_PRIVATE {
+		return nil
+	}
+	err := s.policyStore.SetFileVisibility(record.GetFileHash(), pb.Visibility_VISIBILITY_PRIVATE)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("mark file private: %w", err)
+	}
+	return nil
+}
+
+// proposeShareRecord builds the record for the chunks just streamed, linked onto our chain head
+// and the requester's, signs it as sender and sends it for the receiver's signature.
+func (s *TransferSession) proposeShareRecord(ctx context.Context) error {
+	if s.signer == nil {
+		return fmt.Errorf("co-signing requires signer")
+	}
+	if len(s.localPubKey) == 0 {
+		return fmt.Errorf("building share record requires local identity pubkey")
+	}
+	senderHead, err := s.localHead(ctx)
+	if err != nil {
+		return err
+	}
+	chunks, err := s.deliveredChunks()
+	if err != nil {
+		return err
+	}
+	// A receiver that names its head in an ack has reserved it for this record; the one in the
+	// request may have moved on since.
+	receiverHead := s.pendingRequest.GetRequesterHead()
+	if s.ackedHead != nil {
+		receiverHead = s.ackedHead
+	}
+
+	record, err := dag.BuildShareRecord(dag.ShareRecordParams{
+		SenderPubkey:   s.localPubKey,
+		ReceiverPubkey: s.pendingRequest.GetRequesterPubkey(),
+		SenderHead:     senderHead,
+		ReceiverHead:   receiverHead,
+		Request:        s.pendingRequest,
+		Chunks:         chunks,
+		Timestamp:      time.Now().Unix(),
+		Visibility:     s.recordVisibility(),
+		SigningVersion: s.Protocol().SigningVersion(),
+	})
+	if err != nil {
+		return fmt.Errorf("build share record: %w", err)
+	}
+	sig, err := s.signer.Sign(dag.SignableBytes(record))
+	if err != nil {
+		return fmt.Errorf("sign share record failed: %w", err)
+	}
+	dag.AttachSenderSig(record, sig)
+
+	if err := s.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_ShareRecord{ShareRecord: record},
+	}); err != nil {
+		return fmt.Errorf("send share record failed: %w", err)
+	}
+	s.proposed = record
+	return nil
+}
 
+// awaitCountersignature takes back the record we proposed. The receiver may only add its own
+// signature; anything else about the record must be unchanged.
+func (s *TransferSession) awaitCountersignature() (TransferState, error) {
+	record, err := s.recvShareRecord()
+	if err != nil {
+		return StateFailed, fmt.Errorf("receive co-signed record failed: %w", err)
+	}
+	if !bytes.Equal(dag.SignableBytes(record), dag.SignableBytes(s.proposed)) {
+		return StateRejected, fmt.Errorf("peer altered the proposed share record")
+	}
+	record.SenderSig = s.proposed.GetSenderSig()
+	if err := dag.ValidateShareRecord(record); err != nil {
+		return StateFailed, fmt.Errorf("share record validation failed: %w", err)
+	}
+	if err := s.chain.AppendRecord(record); err != nil {
+		return StateFailed, fmt.Errorf("append record failed: %w", err)
+	}
+	s.releaseHead()
 	return StateGossiping, nil
 }
 
+// checkProposedRecord is the receiver's check of a sender-built record: it must settle our
+// request, list exactly the chunks we stored and link onto our own chain head.
+func (s *TransferSession) checkProposedRecord(ctx context.Context, record *pb.ShareRecord) error {
+	reqHash, err := dag.RequestHash(s.pendingRequest)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(record.GetRequestHash(), reqHash) {
+		return fmt.Errorf("share record request hash does not match pending request")
+	}
+	if len(s.localPubKey) > 0 && !bytes.Equal(record.GetReceiverPubkey(), s.localPubKey) {
+		return fmt.Errorf("share record names another receiver")
+	}
+	if peer := s.PeerIdentity(); len(peer) > 0 && !bytes.Equal(record.GetSenderPubkey(), peer) {
+		return fmt.Errorf("share record names another sender")
+	}
+	// A peer that negotiated the canonical encoding must not fall back to the legacy one.
+	if record.GetSigningVersion() < s.Protocol().SigningVersion() {
+		return fmt.Errorf("share record uses signing version %d, below the negotiated %d", record.GetSigningVersion(), s.Protocol().SigningVersion())
+	}
+	// A record for a private file that claims to be public would have it gossiped to everyone.
+	if s.recordVisibility() == pb.Visibility_VISIBILITY_PRIVATE && record.GetVisibility() != pb.Visibility_VISIBILITY_PRIVATE {
+		return fmt.Errorf("share record makes a private file public")
+	}
+
+	if s.storage != nil {
+		chunks, err := s.deliveredChunks()
+		if err != nil {
+			return err
+		}
+		var total uint64
+		if len(record.GetChunkHashes()) != len(chunks) {
+			return fmt.Errorf("share record lists %d chunks, %d were delivered", len(record.GetChunkHashes()), len(chunks))
+		}
+		for i, ch := range chunks {
+			h := crypto.Hash(ch.GetData())
+			if !bytes.Equal(record.GetChunkHashes()[i], h[:]) {
+				return fmt.Errorf("share record chunk %d does not match delivered data", ch.GetChunkIndex())
+			}
+			total += uint64(len(ch.GetData()))
+		}
+		if record.GetBytesTotal() != total {
+			return fmt.Errorf("share record claims %d bytes, %d were delivered", record.GetBytesTotal(), total)
+		}
+	}
+
+	if s.chainHeadSource() != nil && len(s.localPubKey) > 0 {
+		head, err := s.localHead(ctx)
+		if err != nil {
+			return err
+		}
+		if err := dag.CheckLinksTo(record, s.localPubKey, head); err != nil {
+			return fmt.Errorf("share record rejected: %w", err)
+		}
+	}
+	return nil
+}
+
+// recvShareRecord skips chunk traffic still in flight (late acks, duplicate batches).
+func (s *TransferSession) recvShareRecord() (*pb.ShareRecord, error) {
+	for {
+		env, err := s.transport.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if env == nil {
+			return nil, fmt.Errorf("envelope missing share record")
+		}
+		if env.GetChunkAck() != nil || env.GetChunkBatch() != nil {
+			continue
+		}
+		if env.GetShareRecord() == nil {
+			return nil, fmt.Errorf("envelope missing share record")
+		}
+		return env.GetShareRecord(), nil
+	}
+}
+
+func (s *TransferSession) deliveredChunks() ([]*pb.ChunkData, error) {
+	chunks := make([]*pb.ChunkData, 0, len(s.pendingRequest.GetChunkIndices()))
+	for _, idx := range s.pendingRequest.GetChunkIndices() {
+		data, err := s.storage.ReadChunk(s.pendingRequest.GetFileHash(), idx)
+		if err != nil {
+			return nil, fmt.Errorf("read delivered chunk %d: %w", idx, err)
+		}
+		chunks = append(chunks, &pb.ChunkData{ChunkIndex: idx, Data: data})
+	}
+	return chunks, nil
+}
+
+// fileMetaLookup lets chain validation check chunk hashes for files we know about.
+func (s *TransferSession) fileMetaLookup() dag.FileMetaLookup {
+	if s.metaSource != nil {
+		return MetaLookup(s.metaSource)
+	}
+	if s.policyStore != nil {
+		return MetaLookup(s.policyStore)
+	}
+	return nil
+}
+
+// MetaLookup adapts src for chain validation.
+func MetaLookup(src FileMetaSource) dag.FileMetaLookup {
+	return func(fileHash []byte) (*pb.FileMeta, bool) {
+		meta, err := src.GetFileMeta(fileHash)
+		return meta, err == nil && meta != nil
+	}
+}
+
+// localHead returns the local chain head this session signs onto, or nil without a head source.
+// A source that can reserve the head holds it for this session until releaseHead, so a
+// concurrent session cannot build or accept another record at the same index meanwhile.
+func (s *TransferSession) localHead(ctx context.Context) (*pb.ChainHead, error) {
+	src := s.chainHeadSource()
+	if src == nil {
+		return nil, nil
+	}
+	reserver, ok := src.(ChainHeadReserver)
+	if !ok || s.releaseHeadFunc != nil {
+		head, err := src.LocalChainHead()
+		if err != nil {
+			return nil, fmt.Errorf("load local chain head: %w", err)
+		}
+		return head, nil
+	}
+	head, release, err := reserver.ReserveChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reserve local chain head: %w", err)
+	}
+	s.releaseHeadFunc = release
+	return head, nil
+}
+
+// releaseHead ends the session's hold on the local chain head, once its record is appended or
+// the session has failed.
+func (s *TransferSession) releaseHead() {
+	if s.releaseHeadFunc != nil {
+		s.releaseHeadFunc()
+		s.releaseHeadFunc = nil
+	}
+}
+
+func (s *TransferSession) chainHeadSource() ChainHeadSource {
+	if s.heads != nil {
+		return s.heads
+	}
+	if s.policyStore != nil {
+		return s.policyStore
+	}
+	return nil
+}
+
 func (s *TransferSession) handleGossiping(_ context.Context) (TransferState, error) {
 	return StateComplete, nil
 }
@@ -1,15 +1,20 @@
 package transfer
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	mlcrypto "github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
 )
 
 // --- Mocks ---
@@ -199,19 +204,23 @@ func TestRunSessionHappyPath(t *testing.T) {
 	}
 	dag.AttachSenderSig(record, peerSig)
 
-	verifyEnv := &pb.Envelope{
-		Payload: &pb.Envelope_Handshake{
-			Handshake: &pb.HandshakeMsg{
-				SessionId:      []byte("session-1"),
-				IdentityPubkey: []byte("peer-pub"),
-				Policy:         pb.ServicePolicy_POLICY_LIGHT,
-			},
-		},
+	localEphPub, localEphPriv, err := mlcrypto.GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("generate local ephemeral key: %v", err)
+	}
+	helloEnv, authEnv, peerEphPriv := peerHandshake(t, peerPub, peerPriv, localEphPub, pb.ServicePolicy_POLICY_LIGHT)
+	// After the handshake the peer only talks over the sealed session.
+	peerLink, err := KeyTransport(&mockTransport{}, helloEnv.GetHandshake().GetEphemeralPubkey(), peerEphPriv, localEphPub)
+	if err != nil {
+		t.Fatalf("key peer link: %v", err)
 	}
-	coSignEnv := &pb.Envelope{
+	coSignEnv, err := wire.SealEnvelope(&pb.Envelope{
 		Payload: &pb.Envelope_ShareRecord{
 			ShareRecord: record,
 		},
+	}, peerLink.sealer)
+	if err != nil {
+		t.Fatalf("seal co-sign envelope: %v", err)
 	}
 
 	s := NewSession(
@@ -220,12 +229,14 @@ func TestRunSessionHappyPath(t *testing.T) {
 		[]byte("file-hash"),
 		&mockTransport{
 			peerID:    "peer-1",
-			recvQueue: []*pb.Envelope{verifyEnv, coSignEnv},
+			recvQueue: []*pb.Envelope{helloEnv, authEnv, coSignEnv},
 		},
 		&mockChainAppender{},
 		&mockBalanceChecker{value: 1},
 		&mockSigner{priv: localPriv},
 	)
+	s.SetLocalPubKey(localPub)
+	s.SetEphemeralKeyPair(localEphPub, localEphPriv)
 
 	ctx := context.Background()
 	if err := s.RunSession(ctx); err != nil {
@@ -237,6 +248,160 @@ func TestRunSessionHappyPath(t *testing.T) {
 	}
 }
 
+// legacyProtocol is what a hello without versions negotiates.
+var legacyProtocol = wire.Protocol{Version: wire.LegacyProtocolVersion}
+
+// peerHandshake builds the hello and auth a peer holding peerPriv would send to a session
+// that advertised localEph, and returns the peer's ephemeral private key with them.
+func peerHandshake(t *testing.T, peerPub, peerPriv, localEph []byte, policy pb.ServicePolicy) (*pb.Envelope, *pb.Envelope, []byte) {
+	t.Helper()
+	peerEphPub, peerEphPriv, err := mlcrypto.GenerateSessionKeyPair()
+	if err != nil {
+		t.Fatalf("generate peer ephemeral key: %v", err)
+	}
+	auth, err := BuildHandshakeAuth(&mockSigner{priv: peerPriv}, peerPub, peerEphPub, &pb.HandshakeMsg{EphemeralPubkey: localEph}, policy, legacyProtocol)
+	if err != nil {
+		t.Fatalf("build peer handshake auth: %v", err)
+	}
+	// The peer is a version 1 build, which signs no full transcript.
+	auth.TranscriptSignature = nil
+	hello := &pb.Envelope{
+		Payload: &pb.Envelope_Handshake{
+			Handshake: &pb.HandshakeMsg{
+				SessionId:       []byte("session-1"),
+				EphemeralPubkey: peerEphPub,
+				IdentityPubkey:  peerPub,
+				Policy:          policy,
+			},
+		},
+	}
+	return hello, &pb.Envelope{Payload: &pb.Envelope_HandshakeAuth{HandshakeAuth: auth}}, peerEphPriv
+}
+
+func TestRunSessionRejectsUnprovenIdentity(t *testing.T) {
+	localPub, localPriv, _ := mlcrypto.GenerateKeyPair()
+	claimedPub, _, _ := mlcrypto.GenerateKeyPair()
+	_, attackerPriv, _ := mlcrypto.GenerateKeyPair()
+	localEphPub, localEphPriv, _ := mlcrypto.GenerateSessionKeyPair()
+
+	// The attacker claims claimedPub but can only sign with its own key.
+	helloEnv, authEnv, _ := peerHandshake(t, claimedPub, attackerPriv, localEphPub, pb.ServicePolicy_POLICY_NONE)
+	chain := &mockChainAppender{}
+	s := NewSession(
+		"peer-1",
+		DirectionOutbound,
+		[]byte("file-hash"),
+		&mockTransport{peerID: "peer-1", recvQueue: []*pb.Envelope{helloEnv, authEnv}},
+		chain,
+		&mockBalanceChecker{value: 1},
+		&mockSigner{priv: localPriv},
+	)
+	s.SetLocalPubKey(localPub)
+	s.SetEphemeralKeyPair(localEphPub, localEphPriv)
+
+	if err := s.RunSession(context.Background()); err == nil {
+		t.Fatalf("expected session to fail for unproven identity")
+	}
+	if s.PeerIdentity() != nil {
+		t.Fatalf("expected no authenticated peer identity")
+	}
+	if len(chain.records) != 0 {
+		t.Fatalf("expected no records appended")
+	}
+}
+
+func TestVerifyHandshakeAuthRejectsPolicyDowngrade(t *testing.T) {
+	peerPub, peerPriv, _ := mlcrypto.GenerateKeyPair()
+	localEphPub, _, _ := mlcrypto.GenerateSessionKeyPair()
+	helloEnv, authEnv, _ := peerHandshake(t, peerPub, peerPriv, localEphPub, pb.ServicePolicy_POLICY_NONE)
+
+	hello := helloEnv.GetHandshake()
+	auth := authEnv.GetHandshakeAuth()
+	if err := VerifyHandshakeAuth(auth, hello, localEphPub, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err != nil {
+		t.Fatalf("expected valid auth, got %v", err)
+	}
+	if err := VerifyHandshakeAuth(auth, hello, localEphPub, pb.ServicePolicy_POLICY_STRICT, legacyProtocol); err == nil {
+		t.Fatalf("expected policy mismatch to be rejected")
+	}
+	otherEph, _, _ := mlcrypto.GenerateSessionKeyPair()
+	if err := VerifyHandshakeAuth(auth, hello, otherEph, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err == nil {
+		t.Fatalf("expected auth from another session to be rejected")
+	}
+}
+
+func TestVerifyHandshakeAuthRejectsVersionDowngrade(t *testing.T) {
+	peerPub, peerPriv, _ := mlcrypto.GenerateKeyPair()
+	peerEph, _, _ := mlcrypto.GenerateSessionKeyPair()
+	localEph, _, _ := mlcrypto.GenerateSessionKeyPair()
+	hello := BuildHandshake(nil, pb.ServicePolicy_POLICY_NONE, "s", peerEph, nil)
+	hello.IdentityPubkey = peerPub
+
+	protocol, err := NegotiateProtocol(hello)
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if protocol != wire.LocalProtocol() {
+		t.Fatalf("expected two current builds to run %+v, got %+v", wire.LocalProtocol(), protocol)
+	}
+	ours := BuildHandshake(nil, pb.ServicePolicy_POLICY_NONE, "l", localEph, nil)
+	auth, err := BuildHandshakeAuth(&mockSigner{priv: peerPriv}, peerPub, peerEph, ours, pb.ServicePolicy_POLICY_NONE, protocol)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := VerifyHandshakeAuth(auth, hello, localEph, pb.ServicePolicy_POLICY_NONE, protocol); err != nil {
+		t.Fatalf("expected valid auth, got %v", err)
+	}
+
+	// Our hello reached the peer stripped of its version, so we are asked to settle for version 1.
+	if err := VerifyHandshakeAuth(auth, hello, localEph, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err == nil {
+		t.Fatalf("expected a downgraded protocol to be rejected")
+	}
+	auth.NegotiatedVersion, auth.NegotiatedFeatures = 0, 0
+	if err := VerifyHandshakeAuth(auth, hello, localEph, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err == nil {
+		t.Fatalf("expected an auth with its protocol stripped not to verify")
+	}
+}
+
+func TestVerifyHandshakeAuthChecksAdvertisedRanges(t *testing.T) {
+	peerPub, peerPriv, _ := mlcrypto.GenerateKeyPair()
+	peerEph, _, _ := mlcrypto.GenerateSessionKeyPair()
+	localEph, _, _ := mlcrypto.GenerateSessionKeyPair()
+	hello := BuildHandshake(nil, pb.ServicePolicy_POLICY_NONE, "s", peerEph, nil)
+	hello.IdentityPubkey = peerPub
+	ours := BuildHandshake(nil, pb.ServicePolicy_POLICY_NONE, "l", localEph, nil)
+	signer := &mockSigner{priv: peerPriv}
+
+	// Our hello reached the peer with a narrower range that still negotiates the same protocol.
+	narrowed := proto.Clone(ours).(*pb.HandshakeMsg)
+	narrowed.MinProtocolVersion = wire.ProtocolVersion
+	auth, err := BuildHandshakeAuth(signer, peerPub, peerEph, narrowed, pb.ServicePolicy_POLICY_NONE, wire.LocalProtocol())
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := VerifyHandshakeAuth(auth, hello, localEph, pb.ServicePolicy_POLICY_NONE, wire.LocalProtocol()); err == nil {
+		t.Fatalf("expected a range altered in transit to be rejected")
+	}
+
+	// Both hellos were stripped of their versions, so each side reads the other as version 1.
+	stripped := proto.Clone(hello).(*pb.HandshakeMsg)
+	stripped.ProtocolVersion, stripped.MinProtocolVersion, stripped.Features = 0, 0, 0
+	strippedOurs := proto.Clone(ours).(*pb.HandshakeMsg)
+	strippedOurs.ProtocolVersion, strippedOurs.MinProtocolVersion, strippedOurs.Features = 0, 0, 0
+	auth, err = BuildHandshakeAuth(signer, peerPub, peerEph, strippedOurs, pb.ServicePolicy_POLICY_NONE, legacyProtocol)
+	if err != nil {
+		t.Fatalf("build auth: %v", err)
+	}
+	if err := VerifyHandshakeAuth(auth, stripped, localEph, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err == nil {
+		t.Fatalf("expected a version 2 peer posing as version 1 to be rejected")
+	}
+
+	// A genuine version 1 peer sends no full transcript signature and is accepted.
+	auth.TranscriptSignature = nil
+	if err := VerifyHandshakeAuth(auth, stripped, localEph, pb.ServicePolicy_POLICY_NONE, legacyProtocol); err != nil {
+		t.Fatalf("expected a version 1 peer to be accepted, got %v", err)
+	}
+}
+
 func TestCheckpointAndRecoverSessions(t *testing.T) {
 	tmpDir := t.TempDir()
 	dbPath := filepath.Join(tmpDir, "test.db")
@@ -298,3 +463,520 @@ func TestValidateTransferRequestWindow(t *testing.T) {
 	}
 }
 
+
+// ackingTransport plays the receiver: it acks every ChunkBatch it is sent, unless acks are withheld,
+// and countersigns the share record the sender proposes.
+type ackingTransport struct {
+	mockTransport
+	receiverPriv []byte
+	records      []*pb.ShareRecord
+	withholdAcks bool
+	rejectOnce   map[uint32]bool // chunks the receiver rejects the first time they arrive
+	batches      []*pb.ChunkBatch
+	outstanding  int
+	maxInFlight  int
+	// countersignDelay holds the receiver's signature back, widening the window between a
+	// sender building its record and appending it.
+	countersignDelay time.Duration
+	// zeroCredits acks with no credit until the sender has read every ack and is left waiting;
+	// then an ack grants the window again.
+	zeroCredits        bool
+	readZero           bool
+	sentWithoutCredits bool
+}
+
+// Recv blocks while acks are withheld, like a live link that never hears back.
+func (a *ackingTransport) Recv() (*pb.Envelope, error) {
+	if env, ok := a.TryRecv(); ok {
+		return env, nil
+	}
+	if a.withholdAcks {
+		select {}
+	}
+	return a.mockTransport.Recv()
+}
+
+func (a *ackingTransport) TryRecv() (*pb.Envelope, bool) {
+	if env, ok := a.mockTransport.TryRecv(); ok {
+		if ack := env.GetChunkAck(); ack != nil && ack.GetCredits() == 0 {
+			a.readZero = true
+		}
+		return env, true
+	}
+	if a.zeroCredits && a.readZero {
+		a.zeroCredits, a.readZero = false, false
+		return &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{
+			FileHash: []byte("big-file"),
+			Credits:  uint32(DefaultChunkWindow),
+		}}}, true
+	}
+	return nil, false
+}
+
+func (a *ackingTransport) Send(env *pb.Envelope) error {
+	if record := env.GetShareRecord(); record != nil {
+		time.Sleep(a.countersignDelay)
+		a.records = append(a.records, record)
+		countersigned := proto.Clone(record).(*pb.ShareRecord)
+		sig, err := mlcrypto.Sign(a.receiverPriv, dag.SignableBytes(countersigned))
+		if err != nil {
+			return err
+		}
+		dag.AttachReceiverSig(countersigned, sig)
+		a.recvQueue = append(a.recvQueue, &pb.Envelope{Payload: &pb.Envelope_ShareRecord{ShareRecord: countersigned}})
+		return nil
+	}
+	batch := env.GetChunkBatch()
+	if batch == nil {
+		return nil
+	}
+	if a.readZero {
+		a.sentWithoutCredits = true
+	}
+	a.batches = append(a.batches, batch)
+	a.outstanding += len(batch.GetChunks())
+	if a.outstanding > a.maxInFlight {
+		a.maxInFlight = a.outstanding
+	}
+	if a.withholdAcks {
+		return nil
+	}
+	ack := &pb.ChunkAck{FileHash: batch.GetFileHash(), Credits: uint32(DefaultChunkWindow)}
+	for _, ch := range batch.GetChunks() {
+		if a.rejectOnce[ch.GetChunkIndex()] {
+			delete(a.rejectOnce, ch.GetChunkIndex())
+			ack.RejectedIndices = append(ack.RejectedIndices, ch.GetChunkIndex())
+			continue
+		}
+		ack.ChunkIndices = append(ack.ChunkIndices, ch.GetChunkIndex())
+	}
+	a.outstanding -= len(ack.ChunkIndices) + len(ack.RejectedIndices)
+	if a.zeroCredits {
+		ack.Credits = 0
+	}
+	a.recvQueue = append(a.recvQueue, &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: ack}})
+	return nil
+}
+
+func newStreamingSession(t *testing.T, chunkCount int, tr *ackingTransport) *TransferSession {
+	t.Helper()
+	senderPub, senderPriv, err := mlcrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate sender keys: %v", err)
+	}
+	receiverPub, receiverPriv, err := mlcrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate receiver keys: %v", err)
+	}
+	tr.receiverPriv = receiverPriv
+
+	st := newMemoryFileStorage()
+	fileHash := []byte("big-file")
+	indices := make([]uint32, chunkCount)
+	for i := range indices {
+		indices[i] = uint32(i)
+		_ = st.WriteChunk(fileHash, uint32(i), []byte{byte(i)})
+	}
+	s := NewSession("peer-1", DirectionInbound, fileHash, tr, &mockChainAppender{}, &mockBalanceChecker{value: 1}, &mockSigner{priv: senderPriv})
+	s.SetFileStorage(st)
+	s.SetLocalPubKey(senderPub)
+	s.SetPendingRequest(&pb.TransferRequest{RequesterPubkey: receiverPub, FileHash: fileHash, ChunkIndices: indices})
+	return s
+}
+
+func TestInboundSessionStreamsEveryChunk(t *testing.T) {
+	tr := &ackingTransport{mockTransport: mockTransport{peerID: "peer-1"}}
+	s := newStreamingSession(t, 3*MaxChunksPerBatch+5, tr)
+
+	if err := s.RunSession(context.Background()); err != nil {
+		t.Fatalf("RunSession returned error: %v", err)
+	}
+
+	seen := make(map[uint32]struct{})
+	for _, b := range tr.batches {
+		if len(b.GetChunks()) > MaxChunksPerBatch {
+			t.Fatalf("batch of %d chunks exceeds protocol limit", len(b.GetChunks()))
+		}
+		for _, ch := range b.GetChunks() {
+			seen[ch.GetChunkIndex()] = struct{}{}
+		}
+	}
+	if len(seen) != 3*MaxChunksPerBatch+5 {
+		t.Fatalf("expected every chunk to be sent, got %d", len(seen))
+	}
+}
+
+func TestInboundSessionStopsAtCreditWindow(t *testing.T) {
+	tr := &ackingTransport{mockTransport: mockTransport{peerID: "peer-1"}, withholdAcks: true}
+	s := newStreamingSession(t, DefaultChunkWindow+10, tr)
+	s.SetAckTimeout(50 * time.Millisecond)
+
+	if err := s.RunSession(context.Background()); err == nil || !strings.Contains(err.Error(), "no chunk ack within") {
+		t.Fatalf("expected session to time out when the receiver never acks, got %v", err)
+	}
+	if tr.maxInFlight != DefaultChunkWindow {
+		t.Fatalf("expected sender to stop at %d outstanding chunks, got %d", DefaultChunkWindow, tr.maxInFlight)
+	}
+}
+
+func TestInboundSessionWaitsOutZeroCredits(t *testing.T) {
+	tr := &ackingTransport{mockTransport: mockTransport{peerID: "peer-1"}, zeroCredits: true}
+	s := newStreamingSession(t, DefaultChunkWindow+10, tr)
+
+	if err := s.RunSession(context.Background()); err != nil {
+		t.Fatalf("RunSession returned error: %v", err)
+	}
+	if tr.sentWithoutCredits {
+		t.Fatalf("expected the sender to hold its chunks until the receiver granted credit")
+	}
+	if tr.zeroCredits {
+		t.Fatalf("expected the sender to wait for the ack granting credit")
+	}
+}
+
+// bufferedTransport reports a fixed receive buffer and keeps what is sent on it.
+type bufferedTransport struct {
+	mockTransport
+	buffered int
+	sent     []*pb.Envelope
+}
+
+func (b *bufferedTransport) Send(env *pb.Envelope) error {
+	b.sent = append(b.sent, env)
+	return nil
+}
+
+func (b *bufferedTransport) BufferedChunks() int {
+	return b.buffered
+}
+
+func TestReceiverCreditsFollowItsBuffer(t *testing.T) {
+	tr := &bufferedTransport{mockTransport: mockTransport{peerID: "peer-1"}}
+	s := NewSession("peer-1", DirectionOutbound, []byte("file"), tr, &mockChainAppender{}, &mockBalanceChecker{value: 1}, nil)
+
+	for _, tc := range []struct{ buffered, credits int }{
+		{0, DefaultChunkWindow},
+		{MaxChunksPerBatch + 3, DefaultChunkWindow - MaxChunksPerBatch - 3},
+		{DefaultChunkWindow + 1, 0},
+	} {
+		tr.buffered = tc.buffered
+		if err := s.ackChunkIndices([]byte("file"), []uint32{1}, nil); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+		ack := tr.sent[len(tr.sent)-1].GetChunkAck()
+		if int(ack.GetCredits()) != tc.credits {
+			t.Fatalf("with %d chunks buffered expected %d credits, got %d", tc.buffered, tc.credits, ack.GetCredits())
+		}
+	}
+}
+
+func TestInboundSessionResendsRejectedChunk(t *testing.T) {
+	tr := &ackingTransport{mockTransport: mockTransport{peerID: "peer-1"}, rejectOnce: map[uint32]bool{2: true}}
+	s := newStreamingSession(t, 4, tr)
+
+	if err := s.RunSession(context.Background()); err != nil {
+		t.Fatalf("RunSession returned error: %v", err)
+	}
+	sent := 0
+	for _, b := range tr.batches {
+		for _, ch := range b.GetChunks() {
+			if ch.GetChunkIndex() == 2 {
+				sent++
+			}
+		}
+	}
+	if sent != 2 {
+		t.Fatalf("expected rejected chunk to be sent twice, got %d", sent)
+	}
+}
+
+// recordingTransport keeps everything the session sends.
+type recordingTransport struct {
+	mockTransport
+	sent []*pb.Envelope
+}
+
+func (r *recordingTransport) Send(env *pb.Envelope) error {
+	r.sent = append(r.sent, env)
+	return nil
+}
+
+type countingFaultRecorder struct {
+	faults map[string]int
+}
+
+func (c *countingFaultRecorder) RecordPeerFault(peerKey []byte, kind string, _ int64) error {
+	c.faults[string(peerKey)+"/"+kind]++
+	return nil
+}
+
+type staticMetaSource struct {
+	meta *pb.FileMeta
+}
+
+func (m staticMetaSource) GetFileMeta(fileHash []byte) (*pb.FileMeta, error) {
+	if !bytes.Equal(fileHash, m.meta.GetFileHash()) {
+		return nil, fmt.Errorf("file meta not found")
+	}
+	return m.meta, nil
+}
+
+func TestOutboundSessionRejectsChunksNotMatchingMeta(t *testing.T) {
+	chunks := [][]byte{[]byte("chunk-0"), []byte("chunk-1")}
+	whole := mlcrypto.Hash(bytes.Join(chunks, nil))
+	meta := &pb.FileMeta{FileHash: whole[:], FileSize: 14}
+	for _, c := range chunks {
+		h := mlcrypto.Hash(c)
+		meta.ChunkHashes = append(meta.ChunkHashes, h[:])
+	}
+	batch := func(data ...[]byte) *pb.Envelope {
+		b := &pb.ChunkBatch{FileHash: meta.GetFileHash()}
+		for i, d := range data {
+			if d != nil {
+				b.Chunks = append(b.Chunks, &pb.ChunkData{ChunkIndex: uint32(i), Data: d})
+			}
+		}
+		return &pb.Envelope{Payload: &pb.Envelope_ChunkBatch{ChunkBatch: b}}
+	}
+
+	tr := &recordingTransport{mockTransport: mockTransport{
+		peerID:    "peer-1",
+		recvQueue: []*pb.Envelope{batch(chunks[0], []byte("forged")), batch(nil, chunks[1])},
+	}}
+	st := newMemoryFileStorage()
+	faults := &countingFaultRecorder{faults: make(map[string]int)}
+	s := NewSession("peer-1", DirectionOutbound, meta.GetFileHash(), tr, &mockChainAppender{}, &mockBalanceChecker{value: 1}, &mockSigner{sig: []byte("ok")})
+	s.SetFileStorage(st)
+	s.SetFileMetaSource(staticMetaSource{meta: meta})
+	s.SetPeerFaultRecorder(faults)
+	s.SetPeerIdentity([]byte("peer-key"))
+	s.SetPendingRequest(&pb.TransferRequest{FileHash: meta.GetFileHash(), ChunkIndices: []uint32{0, 1}})
+
+	_ = s.RunSession(context.Background())
+
+	for i, c := range chunks {
+		data, err := st.ReadChunk(meta.GetFileHash(), uint32(i))
+		if err != nil || !bytes.Equal(data, c) {
+			t.Fatalf("expected verified chunk %d in storage, got %q (%v)", i, data, err)
+		}
+	}
+	if faults.faults["peer-key/"+storage.PeerFaultBadChunk] != 1 {
+		t.Fatalf("expected one bad chunk counted against the peer, got %v", faults.faults)
+	}
+	var rejected []uint32
+	for _, env := range tr.sent {
+		rejected = append(rejected, env.GetChunkAck().GetRejectedIndices()...)
+	}
+	if len(rejected) != 1 || rejected[0] != 1 {
+		t.Fatalf("expected chunk 1 to be acked as rejected, got %v", rejected)
+	}
+}
+
+type staticHeadSource struct {
+	head *pb.ChainHead
+}
+
+func (h staticHeadSource) LocalChainHead() (*pb.ChainHead, error) {
+	return h.head, nil
+}
+
+func TestInboundSessionProposesLinkedRecord(t *testing.T) {
+	tr := &ackingTransport{mockTransport: mockTransport{peerID: "peer-1"}}
+	s := newStreamingSession(t, 3, tr)
+	chain := &mockChainAppender{}
+	s.chain = chain
+	s.SetChainHeadSource(staticHeadSource{head: &pb.ChainHead{
+		RecordId: []byte("sender-head"),
+		Index:    4,
+		Totals:   &pb.CumulativeTotals{CumulativeSent: 100, CumulativeReceived: 50},
+	}})
+	s.pendingRequest.RequesterHead = &pb.ChainHead{
+		RecordId: []byte("receiver-head"),
+		Index:    9,
+		Totals:   &pb.CumulativeTotals{CumulativeSent: 7, CumulativeReceived: 8},
+	}
+
+	if err := s.RunSession(context.Background()); err != nil {
+		t.Fatalf("RunSession returned error: %v", err)
+	}
+	if len(tr.records) != 1 || len(chain.records) != 1 {
+		t.Fatalf("expected one proposed and one appended record, got %d and %d", len(tr.records), len(chain.records))
+	}
+
+	r := chain.records[0]
+	if string(r.GetPrevSender()) != "sender-head" || r.GetSenderRecordIndex() != 5 {
+		t.Fatalf("record not linked to sender head: prev=%q index=%d", r.GetPrevSender(), r.GetSenderRecordIndex())
+	}
+	if string(r.GetPrevReceiver()) != "receiver-head" || r.GetReceiverRecordIndex() != 10 {
+		t.Fatalf("record not linked to receiver head: prev=%q index=%d", r.GetPrevReceiver(), r.GetReceiverRecordIndex())
+	}
+	if r.GetBytesTotal() != 3 || len(r.GetChunkHashes()) != 3 {
+		t.Fatalf("expected 3 bytes over 3 chunks, got %d over %d", r.GetBytesTotal(), len(r.GetChunkHashes()))
+	}
+	if r.GetSenderTotals().GetCumulativeSent() != 103 || r.GetSenderTotals().GetCumulativeReceived() != 50 {
+		t.Fatalf("unexpected sender totals %v", r.GetSenderTotals())
+	}
+	if r.GetReceiverTotals().GetCumulativeSent() != 7 || r.GetReceiverTotals().GetCumulativeReceived() != 11 {
+		t.Fatalf("unexpected receiver totals %v", r.GetReceiverTotals())
+	}
+	reqHash, _ := dag.RequestHash(s.pendingRequest)
+	if !bytes.Equal(r.GetRequestHash(), reqHash) {
+		t.Fatalf("record does not commit to the served request")
+	}
+	if err := dag.ValidateShareRecord(r); err != nil {
+		t.Fatalf("appended record not fully signed: %v", err)
+	}
+}
+
+func TestConcurrentInboundSessionsDoNotForkTheChain(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+	senderPub, senderPriv, _ := mlcrypto.GenerateKeyPair()
+	if err := store.InitIdentity(senderPub, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	st := newMemoryFileStorage()
+	fileHash := []byte("shared-file")
+	_ = st.WriteChunk(fileHash, 0, []byte("chunk-0"))
+
+	const sessions = 3
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		receiverPub, receiverPriv, _ := mlcrypto.GenerateKeyPair()
+		peerID := fmt.Sprintf("peer-%d", i)
+		tr := &ackingTransport{mockTransport: mockTransport{peerID: peerID}, receiverPriv: receiverPriv, countersignDelay: 20 * time.Millisecond}
+		s := NewSession(peerID, DirectionInbound, fileHash, tr, store, &mockBalanceChecker{value: 1}, &mockSigner{priv: senderPriv})
+		s.SetFileStorage(st)
+		s.SetLocalPubKey(senderPub)
+		s.SetChainHeadSource(store)
+		s.SetPendingRequest(&pb.TransferRequest{RequesterPubkey: receiverPub, FileHash: fileHash, ChunkIndices: []uint32{0}})
+		go func() { errs <- s.RunSession(context.Background()) }()
+	}
+	for i := 0; i < sessions; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("RunSession returned error: %v", err)
+		}
+	}
+
+	for index := uint64(1); index <= sessions; index++ {
+		records, err := store.GetRecordsAtIndex(senderPub, index)
+		if err != nil {
+			t.Fatalf("records at index %d: %v", index, err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("expected one record at index %d of the local chain, got %d", index, len(records))
+		}
+	}
+	head, err := store.LocalChainHead()
+	if err != nil {
+		t.Fatalf("local chain head: %v", err)
+	}
+	if head.GetIndex() != sessions {
+		t.Fatalf("expected the local chain to reach index %d, got %d", sessions, head.GetIndex())
+	}
+}
+
+func TestCoSigningRejectsRecordNotLinkedToLocalHead(t *testing.T) {
+	localPub, localPriv, _ := mlcrypto.GenerateKeyPair()
+	peerPub, _, _ := mlcrypto.GenerateKeyPair()
+	st := newMemoryFileStorage()
+	fileHash := []byte("file-hash")
+	_ = st.WriteChunk(fileHash, 0, []byte("chunk-0"))
+	req := &pb.TransferRequest{RequesterPubkey: localPub, FileHash: fileHash, ChunkIndices: []uint32{0}}
+	head := &pb.ChainHead{RecordId: []byte("local-head"), Index: 3}
+
+	record, err := dag.BuildShareRecord(dag.ShareRecordParams{
+		SenderPubkey:   peerPub,
+		ReceiverPubkey: localPub,
+		ReceiverHead:   &pb.ChainHead{RecordId: []byte("stale-head"), Index: 2},
+		Request:        req,
+		Chunks:         []*pb.ChunkData{{ChunkIndex: 0, Data: []byte("chunk-0")}},
+		SigningVersion: wire.CanonicalSigning,
+	})
+	if err != nil {
+		t.Fatalf("build record: %v", err)
+	}
+
+	s := NewSession("peer-1", DirectionOutbound, fileHash, &mockTransport{peerID: "peer-1"}, &mockChainAppender{}, &mockBalanceChecker{value: 1}, &mockSigner{priv: localPriv})
+	s.SetFileStorage(st)
+	s.SetLocalPubKey(localPub)
+	s.SetPendingRequest(req)
+	s.SetChainHeadSource(staticHeadSource{head: head})
+
+	if err := s.checkProposedRecord(context.Background(), record); err == nil {
+		t.Fatalf("expected record built on a stale receiver head to be rejected")
+	}
+
+	record.PrevReceiver = head.GetRecordId()
+	record.ReceiverRecordIndex = head.GetIndex() + 1
+	if err := s.checkProposedRecord(context.Background(), record); err != nil {
+		t.Fatalf("expected linked record to be accepted: %v", err)
+	}
+}
+
+type staticVerificationSource struct {
+	checkpoint *pb.Checkpoint
+	records    []*pb.ShareRecord
+	after      uint64
+}
+
+func (s *staticVerificationSource) GetLatestCheckpoint([]byte) (*pb.Checkpoint, error) {
+	if s.checkpoint == nil {
+		return nil, fmt.Errorf("no checkpoint")
+	}
+	return s.checkpoint, nil
+}
+
+func (s *staticVerificationSource) GetChainSegment(_ []byte, afterIndex uint64, limit int) ([]*pb.ShareRecord, error) {
+	s.after = afterIndex
+	if len(s.records) > limit {
+		return s.records[:limit], nil
+	}
+	return s.records, nil
+}
+
+func (s *staticVerificationSource) GetSuccessionChain([]byte) ([]*pb.SuccessionRecord, error) {
+	return nil, nil
+}
+
+func TestBuildHandshakeAttachesChainProofWithinBudget(t *testing.T) {
+	pub, priv, _ := mlcrypto.GenerateKeyPair()
+	cp := &pb.Checkpoint{DevicePubkey: pub, ChainHead: []byte("head"), RecordIndex: 4, Timestamp: 100}
+	cp.DeviceSig, _ = mlcrypto.Sign(priv, dag.CheckpointSignableBytes(cp))
+
+	// Each record is ~100 KiB, so only a prefix fits under maxVerificationPayloadBytes.
+	var records []*pb.ShareRecord
+	for i := 0; i < 10; i++ {
+		records = append(records, &pb.ShareRecord{Id: []byte{byte(i)}, SenderPubkey: pub, RequestHash: make([]byte, 100*1024)})
+	}
+	src := &staticVerificationSource{checkpoint: cp, records: records}
+
+	hello := BuildHandshake(nil, pb.ServicePolicy_POLICY_LIGHT, "sess", []byte("eph"), nil)
+	hello.IdentityPubkey = pub
+	if err := AttachChainProof(hello, src); err != nil {
+		t.Fatalf("attach chain proof: %v", err)
+	}
+	if hello.GetLatestCheckpoint() != cp || src.after != 4 {
+		t.Fatalf("expected signed checkpoint attached and segment loaded after index 4, got after=%d", src.after)
+	}
+	n := len(hello.GetRecordsSinceCheckpoint())
+	if n == 0 || n == len(records) {
+		t.Fatalf("expected a trimmed, non-empty segment, got %d records", n)
+	}
+	if size := proto.Size(hello); size > maxVerificationPayloadBytes {
+		t.Fatalf("hello is %d bytes, over the %d budget", size, maxVerificationPayloadBytes)
+	}
+	for i, r := range hello.GetRecordsSinceCheckpoint() {
+		if r != records[i] {
+			t.Fatalf("expected a contiguous prefix of the segment")
+		}
+	}
+
+	cp.DeviceSig = []byte("forged")
+	if err := AttachChainProof(hello, src); err != nil {
+		t.Fatalf("attach chain proof: %v", err)
+	}
+	if hello.GetLatestCheckpoint() != nil || src.after != 0 {
+		t.Fatalf("expected an unsigned checkpoint to be left out and the segment to start at genesis")
+	}
+}
@@ -1,25 +1,216 @@
 package transfer
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/identity"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
-func BuildHandshake(identity *identity.DeviceIdentity, policy pb.ServicePolicy, sessionID string) *pb.HandshakeMsg {
+/*
+The handshake runs in two rounds.
+
+ 1. hello: both sides send a HandshakeMsg with their identity key, a fresh ephemeral X25519 key
+    and their service policy. nothing in it is trusted yet.
+ 2. auth: once both hellos are in, each side signs a transcript with its identity key and sends
+    a HandshakeAuth. the transcript covers a session id derived from both ephemeral keys, the
+    signer's ephemeral key, the peer's ephemeral key and the negotiated policy, so a signature
+    cannot be replayed into another session or used to downgrade the policy.
+
+a peer whose auth does not verify against the identity key it claimed in its hello is rejected
+before any policy evaluation or chunk exchange.
+
+the hello also carries the protocol versions and features its sender supports. both sides
+negotiate from the peer's hello (see wire.NegotiateProtocol) and, from version 2 on, sign the
+result into the transcript, so a hello stripped of its version in transit fails the auth.
+version 2 builds also sign the full transcript, which adds the range they advertised and the
+range they received, whatever they negotiated. version 1 peers ignore that signature; a peer
+that sends it while its hello reads as version 1 had its hello stripped and is rejected.
+*/
+
+const (
+	handshakeTranscriptDomain     = "burnt-peanut/handshake/v1"
+	fullHandshakeTranscriptDomain = "burnt-peanut/handshake-transcript/v2"
+)
+
+// maxHandshakeRecords caps how many records are loaded for the chain proof before size trimming.
+const maxHandshakeRecords = 256
+
+// VerificationSource is implemented by storage.Store in production.
+// It provides the chain proof a handshake carries for the peer's policy check.
+type VerificationSource interface {
+	GetLatestCheckpoint(pubkey []byte) (*pb.Checkpoint, error)
+	GetChainSegment(pubkey []byte, afterIndex uint64, limit int) ([]*pb.ShareRecord, error)
+	GetSuccessionChain(pubkey []byte) ([]*pb.SuccessionRecord, error)
+}
+
+// BuildHandshake builds our hello. When src is set it also carries our chain proof, see AttachChainProof.
+func BuildHandshake(identity *identity.DeviceIdentity, policy pb.ServicePolicy, sessionID string, ephemeralPubkey []byte, src VerificationSource) *pb.HandshakeMsg {
 	msg := &pb.HandshakeMsg{
-		SessionId:      []byte(sessionID),
-		IdentityPubkey: nil,
-		Policy:         policy,
+		SessionId:       []byte(sessionID),
+		EphemeralPubkey: append([]byte(nil), ephemeralPubkey...),
+		IdentityPubkey:  nil,
+		Policy:          policy,
 	}
+	AdvertiseProtocol(msg)
 	if identity != nil {
 		msg.IdentityPubkey = append([]byte(nil), identity.Pubkey...)
 	}
+	if src != nil {
+		_ = AttachChainProof(msg, src)
+	}
+	if params, ok := src.(credit.NetworkParamsSource); ok {
+		_ = AttachNetworkParams(msg, params)
+	}
 	return msg
 }
 
+// AdvertiseProtocol sets the protocol range and features of this build in a hello.
+func AdvertiseProtocol(msg *pb.HandshakeMsg) {
+	local := localAdvertisement()
+	msg.ProtocolVersion = local.GetProtocolVersion()
+	msg.MinProtocolVersion = local.GetMinProtocolVersion()
+	msg.Features = local.GetFeatures()
+}
+
+// AttachNetworkParams sets the parameters we compute balances with, so the peer can check it
+// agrees with them.
+func AttachNetworkParams(msg *pb.HandshakeMsg, src credit.NetworkParamsSource) error {
+	if msg == nil {
+		return nil
+	}
+	params, err := credit.LocalNetworkParams(src)
+	if err != nil {
+		return fmt.Errorf("load network params: %w", err)
+	}
+	msg.NetworkParams = params
+	return nil
+}
+
+/*
+AttachChainProof fills successions, latest_checkpoint and records_since_checkpoint for msg's identity.
+
+the checkpoint is only attached when its device signature verifies; otherwise the segment starts
+at genesis. records are added in chain order until the whole hello would exceed
+maxVerificationPayloadBytes, so the peer always gets a contiguous prefix it can validate.
+a device with no checkpoint and no records sends neither and gets the new-device path.
+*/
+func AttachChainProof(msg *pb.HandshakeMsg, src VerificationSource) error {
+	if msg == nil || src == nil {
+		return nil
+	}
+	pubkey := msg.GetIdentityPubkey()
+	if len(pubkey) == 0 {
+		return fmt.Errorf("handshake identity pubkey is required")
+	}
+
+	successions, err := src.GetSuccessionChain(pubkey)
+	if err != nil {
+		return fmt.Errorf("load successions: %w", err)
+	}
+	msg.Successions = successions
+
+	var after uint64
+	msg.LatestCheckpoint = nil
+	if cp, err := src.GetLatestCheckpoint(pubkey); err == nil && dag.ValidateCheckpoint(cp) == nil {
+		msg.LatestCheckpoint = cp
+		after = cp.GetRecordIndex()
+	}
+	if proto.Size(msg) > maxVerificationPayloadBytes {
+		msg.LatestCheckpoint = nil
+		after = 0
+	}
+
+	records, err := src.GetChainSegment(pubkey, after, maxHandshakeRecords)
+	if err != nil {
+		return fmt.Errorf("load chain segment: %w", err)
+	}
+	size := proto.Size(msg)
+	msg.RecordsSinceCheckpoint = nil
+	for _, r := range records {
+		size += protowire.SizeTag(6) + protowire.SizeBytes(proto.Size(r))
+		if size > maxVerificationPayloadBytes {
+			break
+		}
+		msg.RecordsSinceCheckpoint = append(msg.RecordsSinceCheckpoint, r)
+	}
+	return nil
+}
+
+// ErrRetiredKey is returned for a peer identifying with a key it has handed over to a successor.
+var ErrRetiredKey = errors.New("peer key has been retired")
+
+// SuccessionStore is implemented by storage.Store in production.
+type SuccessionStore interface {
+	InsertSuccession(succession *pb.SuccessionRecord, now int64) error
+	IsRetired(pubkey []byte) (bool, error)
+}
+
+// AcceptPeerSuccessions stores the successions carried by a peer's hello, which must lead back
+// from its identity key newest first, and refuses a peer whose key is retired.
+func AcceptPeerSuccessions(store SuccessionStore, msg *pb.HandshakeMsg) error {
+	if store == nil || msg == nil {
+		return nil
+	}
+	want := msg.GetIdentityPubkey()
+	now := time.Now().Unix()
+	for i, succession := range msg.GetSuccessions() {
+		if !bytes.Equal(succession.GetNewPubkey(), want) {
+			return fmt.Errorf("succession %d does not lead to the peer's key", i)
+		}
+		if err := store.InsertSuccession(succession, now); err != nil {
+			return fmt.Errorf("peer succession %d: %w", i, err)
+		}
+		want = succession.GetOldPubkey()
+	}
+	retired, err := store.IsRetired(msg.GetIdentityPubkey())
+	if err != nil {
+		return fmt.Errorf("succession check failed: %w", err)
+	}
+	if retired {
+		return ErrRetiredKey
+	}
+	return nil
+}
+
+// NetworkParamsStore is implemented by storage.Store in production.
+type NetworkParamsStore interface {
+	GetNetworkParams() (*pb.NetworkParams, error)
+	SaveNetworkParams(params *pb.NetworkParams) error
+}
+
+// AcceptPeerNetworkParams refuses a peer whose network parameters are incompatible with ours
+// (see credit.CheckCompatibility) and installs a newer version of our own network it carries.
+func AcceptPeerNetworkParams(store NetworkParamsStore, msg *pb.HandshakeMsg) error {
+	if store == nil || msg == nil {
+		return nil
+	}
+	local, err := credit.LocalNetworkParams(store)
+	if err != nil {
+		return fmt.Errorf("load network params: %w", err)
+	}
+	adopt, err := credit.CheckCompatibility(local, msg.GetNetworkParams())
+	if err != nil {
+		return err
+	}
+	if adopt {
+		if err := store.SaveNetworkParams(msg.GetNetworkParams()); err != nil {
+			return fmt.Errorf("install peer network params: %w", err)
+		}
+	}
+	return nil
+}
+
 func ProcessHandshake(msg *pb.HandshakeMsg) (peerIdentityPubkey []byte, peerPolicy pb.ServicePolicy, err error) {
 	if msg == nil {
 		return nil, pb.ServicePolicy_POLICY_NONE, fmt.Errorf("handshake message is required")
@@ -30,6 +221,9 @@ func ProcessHandshake(msg *pb.HandshakeMsg) (peerIdentityPubkey []byte, peerPoli
 	if len(msg.GetIdentityPubkey()) == 0 {
 		return nil, pb.ServicePolicy_POLICY_NONE, fmt.Errorf("handshake identity pubkey is required")
 	}
+	if len(msg.GetEphemeralPubkey()) == 0 {
+		return nil, pb.ServicePolicy_POLICY_NONE, fmt.Errorf("handshake ephemeral pubkey is required")
+	}
 	if !isKnownPolicy(msg.GetPolicy()) {
 		return nil, pb.ServicePolicy_POLICY_NONE, fmt.Errorf("unknown service policy: %v", msg.GetPolicy())
 	}
@@ -37,6 +231,12 @@ func ProcessHandshake(msg *pb.HandshakeMsg) (peerIdentityPubkey []byte, peerPoli
 	return append([]byte(nil), msg.GetIdentityPubkey()...), msg.GetPolicy(), nil
 }
 
+// NegotiateProtocol picks the protocol version and features for a session with the peer that
+// sent msg. It fails with wire.ErrIncompatibleVersion when there is no version in common.
+func NegotiateProtocol(msg *pb.HandshakeMsg) (wire.Protocol, error) {
+	return wire.NegotiateProtocol(msg.GetMinProtocolVersion(), msg.GetProtocolVersion(), wire.Features(msg.GetFeatures()))
+}
+
 func NegotiatePolicy(localPolicy pb.ServicePolicy, peerPolicy pb.ServicePolicy) pb.ServicePolicy {
 	// Stricter policy has the greater enum value in proto (NONE < LIGHT < STRICT).
 	if peerPolicy > localPolicy {
@@ -45,6 +245,173 @@ func NegotiatePolicy(localPolicy pb.ServicePolicy, peerPolicy pb.ServicePolicy)
 	return localPolicy
 }
 
+// HandshakeSessionID is the same on both sides regardless of who connected first.
+func HandshakeSessionID(localEphemeral []byte, peerEphemeral []byte) []byte {
+	low, high := localEphemeral, peerEphemeral
+	if bytes.Compare(low, high) > 0 {
+		low, high = high, low
+	}
+	var buf []byte
+	buf = append(buf, []byte(handshakeTranscriptDomain)...)
+	buf = append(buf, low...)
+	buf = append(buf, high...)
+	id := crypto.Hash(buf)
+	return id[:]
+}
+
+// HandshakeTranscript is the message signed by HandshakeAuth.signature.
+func HandshakeTranscript(auth *pb.HandshakeAuth) []byte {
+	var buf []byte
+	buf = append(buf, []byte(handshakeTranscriptDomain)...)
+	buf = appendLenPrefixed(buf, auth.GetSessionId())
+	buf = appendLenPrefixed(buf, auth.GetIdentityPubkey())
+	buf = appendLenPrefixed(buf, auth.GetEphemeralPubkey())
+	buf = appendLenPrefixed(buf, auth.GetPeerEphemeralPubkey())
+	buf = binary.BigEndian.AppendUint32(buf, uint32(auth.GetNegotiatedPolicy()))
+	// version 1 peers sign no protocol, and their transcript must stay as it was.
+	if auth.GetNegotiatedVersion() > wire.LegacyProtocolVersion {
+		buf = binary.BigEndian.AppendUint32(buf, auth.GetNegotiatedVersion())
+		buf = binary.BigEndian.AppendUint64(buf, auth.GetNegotiatedFeatures())
+	}
+	return buf
+}
+
+// FullHandshakeTranscript is the message signed by HandshakeAuth.transcript_signature: the
+// transcript plus the protocol range the signer advertised in its hello and the one it received.
+func FullHandshakeTranscript(auth *pb.HandshakeAuth, advertised *pb.HandshakeMsg, received *pb.HandshakeMsg) []byte {
+	return wire.NewCanonical(fullHandshakeTranscriptDomain).
+		Bytes(1, HandshakeTranscript(auth)).
+		Message(2, advertisedRange(advertised)).
+		Message(3, advertisedRange(received)).
+		Encode()
+}
+
+func advertisedRange(hello *pb.HandshakeMsg) *wire.Canonical {
+	return new(wire.Canonical).
+		Uint32(1, hello.GetMinProtocolVersion()).
+		Uint32(2, hello.GetProtocolVersion()).
+		Uint64(3, hello.GetFeatures())
+}
+
+// localAdvertisement is the protocol range every hello of this build carries.
+func localAdvertisement() *pb.HandshakeMsg {
+	return &pb.HandshakeMsg{
+		ProtocolVersion:    wire.ProtocolVersion,
+		MinProtocolVersion: wire.MinProtocolVersion,
+		Features:           uint64(wire.SupportedFeatures),
+	}
+}
+
+// setAuthProtocol records protocol in auth the way a peer at that version would.
+func setAuthProtocol(auth *pb.HandshakeAuth, protocol wire.Protocol) {
+	if protocol.Version > wire.LegacyProtocolVersion {
+		auth.NegotiatedVersion = protocol.Version
+		auth.NegotiatedFeatures = uint64(protocol.Features)
+	}
+}
+
+// BuildHandshakeAuth answers peerHello, whose ephemeral key the auth is bound to.
+func BuildHandshakeAuth(signer Signer, identityPubkey []byte, localEphemeral []byte, peerHello *pb.HandshakeMsg, negotiated pb.ServicePolicy, protocol wire.Protocol) (*pb.HandshakeAuth, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("handshake auth requires signer")
+	}
+	if len(identityPubkey) == 0 {
+		return nil, fmt.Errorf("handshake auth requires identity pubkey")
+	}
+	peerEphemeral := peerHello.GetEphemeralPubkey()
+	if len(localEphemeral) == 0 || len(peerEphemeral) == 0 {
+		return nil, fmt.Errorf("handshake auth requires both ephemeral keys")
+	}
+
+	auth := &pb.HandshakeAuth{
+		SessionId:           HandshakeSessionID(localEphemeral, peerEphemeral),
+		IdentityPubkey:      append([]byte(nil), identityPubkey...),
+		EphemeralPubkey:     append([]byte(nil), localEphemeral...),
+		PeerEphemeralPubkey: append([]byte(nil), peerEphemeral...),
+		NegotiatedPolicy:    negotiated,
+	}
+	setAuthProtocol(auth, protocol)
+	sig, err := signer.Sign(HandshakeTranscript(auth))
+	if err != nil {
+		return nil, fmt.Errorf("sign handshake transcript: %w", err)
+	}
+	auth.Signature = sig
+	full, err := signer.Sign(FullHandshakeTranscript(auth, localAdvertisement(), peerHello))
+	if err != nil {
+		return nil, fmt.Errorf("sign full handshake transcript: %w", err)
+	}
+	auth.TranscriptSignature = full
+	return auth, nil
+}
+
+// VerifyHandshakeAuth checks that the peer's auth matches the hello it sent, is bound to our
+// ephemeral key and the policy and protocol we negotiated, and is signed by the identity it claimed.
+func VerifyHandshakeAuth(auth *pb.HandshakeAuth, peerHello *pb.HandshakeMsg, localEphemeral []byte, negotiated pb.ServicePolicy, protocol wire.Protocol) error {
+	if auth == nil {
+		return fmt.Errorf("handshake auth is required")
+	}
+	if peerHello == nil {
+		return fmt.Errorf("peer handshake is required")
+	}
+	if !bytes.Equal(auth.GetIdentityPubkey(), peerHello.GetIdentityPubkey()) {
+		return fmt.Errorf("handshake auth identity does not match hello")
+	}
+	if !bytes.Equal(auth.GetEphemeralPubkey(), peerHello.GetEphemeralPubkey()) {
+		return fmt.Errorf("handshake auth ephemeral key does not match hello")
+	}
+	if !bytes.Equal(auth.GetPeerEphemeralPubkey(), localEphemeral) {
+		return fmt.Errorf("handshake auth is not bound to this session")
+	}
+	if !bytes.Equal(auth.GetSessionId(), HandshakeSessionID(localEphemeral, peerHello.GetEphemeralPubkey())) {
+		return fmt.Errorf("handshake auth session id mismatch")
+	}
+	if auth.GetNegotiatedPolicy() != negotiated {
+		return fmt.Errorf("handshake auth policy mismatch: %v != %v", auth.GetNegotiatedPolicy(), negotiated)
+	}
+	want := &pb.HandshakeAuth{}
+	setAuthProtocol(want, protocol)
+	if auth.GetNegotiatedVersion() != want.GetNegotiatedVersion() || auth.GetNegotiatedFeatures() != want.GetNegotiatedFeatures() {
+		return fmt.Errorf("handshake auth protocol mismatch: version %d features %#x, want version %d features %#x",
+			auth.GetNegotiatedVersion(), auth.GetNegotiatedFeatures(), want.GetNegotiatedVersion(), want.GetNegotiatedFeatures())
+	}
+
+	ok, err := crypto.Verify(auth.GetIdentityPubkey(), HandshakeTranscript(auth), auth.GetSignature())
+	if err != nil {
+		return fmt.Errorf("handshake auth signature verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid handshake auth signature")
+	}
+	return verifyFullTranscript(auth, peerHello, protocol)
+}
+
+// verifyFullTranscript checks the signature over both advertised ranges. Only version 1 peers
+// may leave it out, and a peer whose hello reads as version 1 must not send it.
+func verifyFullTranscript(auth *pb.HandshakeAuth, peerHello *pb.HandshakeMsg, protocol wire.Protocol) error {
+	if protocol.Version <= wire.LegacyProtocolVersion {
+		if len(auth.GetTranscriptSignature()) > 0 {
+			return fmt.Errorf("handshake downgraded: peer signs the full transcript but its hello reads as version %d", wire.LegacyProtocolVersion)
+		}
+		return nil
+	}
+	if len(auth.GetTranscriptSignature()) == 0 {
+		return fmt.Errorf("handshake auth does not sign the full transcript")
+	}
+	ok, err := crypto.Verify(auth.GetIdentityPubkey(), FullHandshakeTranscript(auth, peerHello, localAdvertisement()), auth.GetTranscriptSignature())
+	if err != nil {
+		return fmt.Errorf("full transcript signature verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("handshake ranges do not match what the peer signed")
+	}
+	return nil
+}
+
+func appendLenPrefixed(buf []byte, field []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+	return append(buf, field...)
+}
+
 func isKnownPolicy(policy pb.ServicePolicy) bool {
 	switch policy {
 	case pb.ServicePolicy_POLICY_NONE, pb.ServicePolicy_POLICY_LIGHT, pb.ServicePolicy_POLICY_STRICT:
@@ -1,6 +1,8 @@
 package transfer
 
 import (
+	"context"
+
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
@@ -23,7 +25,6 @@ type Signer interface {
 }
 
 // Transport abstracts the underlying connection (BLE, WiFi Direct, TCP).
-// It wraps wire.WriteEnvelope / wire.ReadEnvelope.
 type Transport interface {
 	Send(env *pb.Envelope) error
 	Recv() (*pb.Envelope, error)
@@ -35,9 +36,54 @@ type Transport interface {
 	Close() error
 }
 
+// ReceiveBuffer is optionally implemented by a Transport that queues inbound envelopes
+// (StreamTransport and cabi's peer transport do). A receiving session advertises its chunk window
+// less the chunks still queued, so a sender cannot run ahead of a receiver that has fallen behind.
+type ReceiveBuffer interface {
+	BufferedChunks() int
+}
+
 // FileStorage abstracts chunk-level file reads/writes for transfer batching.
 type FileStorage interface {
 	ReadChunk(fileHash []byte, chunkIndex uint32) ([]byte, error)
 	WriteChunk(fileHash []byte, chunkIndex uint32, data []byte) error
 	HasChunk(fileHash []byte, chunkIndex uint32) (bool, error)
 }
+
+// FileDeleter is optionally implemented by FileStorage so a file that fails whole-file
+// verification can be thrown away and fetched again.
+type FileDeleter interface {
+	DeleteFile(fileHash []byte) error
+}
+
+// FileMetaSource is implemented by storage.Store in production.
+// Receiving sessions use it to verify chunks before writing them.
+type FileMetaSource interface {
+	GetFileMeta(fileHash []byte) (*pb.FileMeta, error)
+}
+
+// PeerFaultRecorder is implemented by storage.Store in production.
+// Sessions report peers that send chunks which fail verification.
+type PeerFaultRecorder interface {
+	RecordPeerFault(peerKey []byte, kind string, at int64) error
+}
+
+// ChainHeadSource is implemented by storage.Store in production.
+// Sessions use it to link the share record they build or co-sign onto the local chain.
+type ChainHeadSource interface {
+	LocalChainHead() (*pb.ChainHead, error)
+}
+
+// ChainHeadReserver is optionally implemented by a ChainHeadSource (storage.Store does). A
+// session that signs a record onto the local chain holds the head from building or checking the
+// record until it is appended, so concurrent sessions cannot fork the chain.
+type ChainHeadReserver interface {
+	ReserveChainHead(ctx context.Context) (head *pb.ChainHead, release func(), err error)
+}
+
+// ForkDetector is implemented by gossip.ForkMonitor in production.
+// Sessions pass it the records and successions a peer presents in its handshake.
+type ForkDetector interface {
+	CheckRecords(records []*pb.ShareRecord) []*pb.ForkEvidence
+	CheckSuccessions(successions []*pb.SuccessionRecord) []*pb.ForkEvidence
+}
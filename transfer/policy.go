@@ -2,6 +2,8 @@ package transfer
 
 import (
 	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -15,6 +17,9 @@ const (
 	MinStrictWitnesses = 5
 	MinStrictClusters  = 3
 	MinStrictFresh     = 2
+	// MinStrictTrust is the lowest trust score a STRICT peer may have: two hops from a device
+	// we met directly, with a fully clustered neighbourhood.
+	MinStrictTrust = 0.25
 )
 
 func EvaluatePolicy(
@@ -31,12 +36,36 @@ func EvaluatePolicy(
 		return false, "store is required"
 	}
 
-	hasForkEvidence, err := store.HasForkEvidence(peerPubkey)
+	retired, err := store.IsRetired(peerPubkey)
 	if err != nil {
-		return false, fmt.Sprintf("fork evidence check failed: %v", err)
+		return false, fmt.Sprintf("succession check failed: %v", err)
 	}
-	if hasForkEvidence {
-		return false, "peer has fork evidence"
+	if retired {
+		return false, "peer key has been retired"
+	}
+	// A checkpoint borrowed from another device would lend the peer its witnesses and balance.
+	if checkpoint != nil && !bytes.Equal(checkpoint.GetDevicePubkey(), peerPubkey) {
+		return false, "checkpoint belongs to another device"
+	}
+
+	// A device cannot shed fork evidence by rotating its key, and keeps the credit it earned
+	// under earlier keys.
+	lineage, err := store.GetKeyLineage(peerPubkey)
+	if err != nil {
+		return false, fmt.Sprintf("succession lookup failed: %v", err)
+	}
+	for _, key := range lineage {
+		hasForkEvidence, err := store.HasForkEvidence(key)
+		if err != nil {
+			return false, fmt.Sprintf("fork evidence check failed: %v", err)
+		}
+		if hasForkEvidence {
+			return false, "peer has fork evidence"
+		}
+	}
+	params, err := credit.LocalParams(store)
+	if err != nil {
+		return false, fmt.Sprintf("network params lookup failed: %v", err)
 	}
 
 	switch policy {
@@ -47,20 +76,20 @@ func EvaluatePolicy(
 		if checkpoint == nil {
 			return false, "light policy requires checkpoint"
 		}
-		if len(checkpoint.GetWitnesses()) < 1 {
+		if err := dag.ValidateCheckpoint(checkpoint); err != nil {
+			return false, fmt.Sprintf("light policy checkpoint rejected: %v", err)
+		}
+		if len(dag.VerifiedWitnesses(checkpoint)) < 1 {
 			return false, "light policy requires at least one witness"
 		}
 		if err := dag.VerifyChainSegment(recentRecords, peerPubkey); err != nil {
 			return false, fmt.Sprintf("light chain verification failed: %v", err)
 		}
-		balance := credit.ComputeEffectiveBalance(
-			recentRecords,
-			peerPubkey,
-			checkpoint.GetTimestamp(),
-			time.Now().Unix(),
-			credit.DefaultParams(),
-		)
-		if balance <= 0 {
+		breakdown, _, err := TrustedBreakdown(store, peerPubkey, checkpoint, recentRecords, checkpoint.GetTimestamp(), params)
+		if err != nil {
+			return false, fmt.Sprintf("balance lookup failed: %v", err)
+		}
+		if breakdown.Effective <= 0 {
 			return false, "light policy requires positive balance"
 		}
 		return true, "approved: policy light"
@@ -69,38 +98,44 @@ func EvaluatePolicy(
 		if checkpoint == nil {
 			return false, "strict policy requires checkpoint"
 		}
-		if checkpoint.GetConfidence() != pb.ConfidenceLevel_CONFIDENCE_HIGH {
+		if err := dag.ValidateCheckpoint(checkpoint); err != nil {
+			return false, fmt.Sprintf("strict policy checkpoint rejected: %v", err)
+		}
+		// Only witnesses whose signatures verify count; the claimed confidence is not trusted.
+		witnesses := dag.VerifiedWitnesses(checkpoint)
+		if confidence, _ := credit.CheckpointConfidence(witnesses, recentRecords, peerPubkey); confidence != pb.ConfidenceLevel_CONFIDENCE_HIGH {
 			return false, "strict policy requires high confidence checkpoint"
 		}
-		if len(checkpoint.GetWitnesses()) < MinStrictWitnesses {
+		if len(witnesses) < MinStrictWitnesses {
 			return false, "strict policy requires at least 5 witnesses"
 		}
-		if distinctClusters(checkpoint.GetWitnesses()) < MinStrictClusters {
+		if distinctClusters(witnesses) < MinStrictClusters {
 			return false, "strict policy requires at least 3 witness clusters"
 		}
-		if freshWitnessCount(checkpoint.GetWitnesses(), recentRecords, peerPubkey) < MinStrictFresh {
+		if freshWitnessCount(witnesses, recentRecords, peerPubkey) < MinStrictFresh {
 			return false, "strict policy requires at least 2 fresh witnesses"
 		}
 		if err := dag.VerifyChainSegment(recentRecords, peerPubkey); err != nil {
 			return false, fmt.Sprintf("strict chain verification failed: %v", err)
 		}
 
-		params := credit.DefaultParams()
-		diversity := credit.DiversityWeightedCredit(recentRecords, peerPubkey, params.WindowSize)
-		capped := credit.ApplyPerPeerCaps(recentRecords, peerPubkey, params)
-		effective := credit.ComputeEffectiveBalance(
-			recentRecords,
-			peerPubkey,
-			checkpoint.GetTimestamp(),
-			time.Now().Unix(),
-			params,
-		)
+		breakdown, graph, err := TrustedBreakdown(store, peerPubkey, checkpoint, recentRecords, checkpoint.GetTimestamp(), params)
+		if err != nil {
+			return false, fmt.Sprintf("balance lookup failed: %v", err)
+		}
+		if graph == nil || graph.Score(peerPubkey) < MinStrictTrust {
+			return false, "strict policy requires a peer trusted through our encounters"
+		}
+		effective, diversity, capped := breakdown.Effective, breakdown.DiversityCredit, breakdown.CappedCredit()
 		if effective <= 0 {
 			return false, "strict policy requires positive effective balance"
 		}
 		if diversity <= 0 {
 			return false, "strict policy requires non-zero diversity credit"
 		}
+		if breakdown.TrustedCredit() <= 0 {
+			return false, "strict policy requires credit from trusted counterparties"
+		}
 		if capped <= 0 {
 			return false, "strict policy requires non-zero capped credit"
 		}
@@ -111,6 +146,123 @@ func EvaluatePolicy(
 	}
 }
 
+// VerifyPeer decides whether to serve the peer that authenticated hello, under the negotiated
+// policy. Sessions run it in their verifying state; cabi authenticates each link once and runs
+// it before marking the link verified.
+func VerifyPeer(store *storage.Store, hello *pb.HandshakeMsg, policy pb.ServicePolicy, forks ForkDetector, lookup dag.FileMetaLookup) error {
+	peerPub, _, err := ProcessHandshake(hello)
+	if err != nil {
+		return fmt.Errorf("invalid handshake payload: %w", err)
+	}
+	if forks != nil {
+		// Before the successions are stored, so one contradicting a stored succession is
+		// reported as a fork rather than only refused.
+		forks.CheckSuccessions(hello.GetSuccessions())
+	}
+	if store != nil {
+		if err := AcceptPeerSuccessions(store, hello); err != nil {
+			return err
+		}
+		if err := AcceptPeerNetworkParams(store, hello); err != nil {
+			return err
+		}
+	}
+
+	checkpoint, records := hello.GetLatestCheckpoint(), hello.GetRecordsSinceCheckpoint()
+	if checkpoint == nil && len(records) == 0 {
+		if store == nil {
+			// New-device fallback: with nothing presented and nothing stored to look up, the
+			// peer is served on its drip allowance alone.
+			return nil
+		}
+		// Leaving the proof out of the hello does not make a peer new; what we hold on it counts.
+		if approved, reason := EvaluateStoredPolicy(store, peerPub, policy); !approved {
+			return fmt.Errorf("policy rejected: %s", reason)
+		}
+		return nil
+	}
+
+	if forks != nil && len(records) > 0 {
+		// Evidence is stored before the policy runs, so a forked peer is rejected below.
+		forks.CheckRecords(records)
+	}
+	if len(records) > 0 {
+		report := dag.ValidateChain(peerPub, checkpoint, records, lookup)
+		if !report.Valid() {
+			return fmt.Errorf("peer chain rejected: %w", report.Violation)
+		}
+	}
+	if store != nil && len(records) == 0 {
+		if fetched, err := store.GetChainSegment(peerPub, checkpoint.GetRecordIndex(), maxHandshakeRecords); err == nil {
+			records = fetched
+		}
+	}
+	if approved, reason := EvaluatePolicy(store, peerPub, policy, checkpoint, records); !approved {
+		return fmt.Errorf("policy rejected: %s", reason)
+	}
+	return nil
+}
+
+// EvaluateStoredPolicy runs EvaluatePolicy over the checkpoint and records stored for the peer,
+// for when there is no chain proof from the peer itself. A peer we hold nothing on is a new
+// device: it is served on its drip allowance alone (fresh BLE / MVP nodes have no ledger rows
+// yet, and rejecting them would prevent any first-hop transfer), but a retired key or a forked
+// lineage is still refused.
+func EvaluateStoredPolicy(store *storage.Store, peerPubkey []byte, policy pb.ServicePolicy) (approved bool, reason string) {
+	if store == nil {
+		return false, "store is required"
+	}
+	checkpoint, err := store.GetLatestCheckpoint(peerPubkey)
+	if err != nil {
+		checkpoint = nil
+	}
+	records, err := store.GetChainSegment(peerPubkey, checkpoint.GetRecordIndex(), maxHandshakeRecords)
+	if err != nil {
+		return false, fmt.Sprintf("record lookup failed: %v", err)
+	}
+	if checkpoint == nil && len(records) == 0 {
+		policy = pb.ServicePolicy_POLICY_NONE
+	}
+	return EvaluatePolicy(store, peerPubkey, policy, checkpoint, records)
+}
+
+// TrustedBreakdown is a device's balance as this node sees it, and the trust graph it was
+// discounted by. Every path that decides on or reports a balance uses it, so they all agree.
+//
+// The credit is the device's stored ledgers, summed over its key lineage, plus the records it
+// presented that are not stored. Diversity credit is discounted by the local trust graph, extended
+// with what the device presented: its checkpoint's witnesses and its records. A store without a
+// local identity has no graph, and discounts nothing.
+func TrustedBreakdown(
+	store *storage.Store,
+	devicePubkey []byte,
+	checkpoint *pb.Checkpoint,
+	presented []*pb.ShareRecord,
+	deviceCreatedAt int64,
+	params credit.CreditParams,
+) (credit.BalanceBreakdown, *credit.TrustGraph, error) {
+	ledger, window, err := store.LineageLedger(devicePubkey, params, presented)
+	if err != nil {
+		return credit.BalanceBreakdown{}, nil, err
+	}
+	var graph *credit.TrustGraph
+	identity, err := store.GetIdentity()
+	if err == nil {
+		graph, err = store.TrustGraph(identity.Pubkey)
+		if err != nil {
+			return credit.BalanceBreakdown{}, nil, err
+		}
+		graph.AddCheckpoint(checkpoint)
+		graph.AddRecords(presented)
+		// The window carries records over from earlier keys under the current one.
+		graph.AddRecords(window)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return credit.BalanceBreakdown{}, nil, err
+	}
+	breakdown := ledger.Breakdown(window, deviceCreatedAt, time.Now().Unix(), params).WithTrust(window, devicePubkey, graph, params)
+	return breakdown, graph, nil
+}
+
 func distinctClusters(witnesses []*pb.CheckpointWitness) int {
 	clusters := map[string]struct{}{}
 	for _, w := range witnesses {
@@ -1,12 +1,18 @@
 package transfer
 
 import (
+	"errors"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/credit"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/discovery"
 	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
 )
 
 func testPolicyStore(t *testing.T) *storage.Store {
@@ -30,18 +36,32 @@ func makeRecord(sender, receiver []byte, idx uint64, prev []byte, bytesTotal uin
 	}
 }
 
+// signCheckpoint signs cp as the device and adds one signed witness per cluster.
+func signCheckpoint(t *testing.T, cp *pb.Checkpoint, devicePriv []byte, clusters ...string) {
+	t.Helper()
+	sig, err := crypto.Sign(devicePriv, dag.CheckpointSignableBytes(cp))
+	if err != nil {
+		t.Fatalf("sign checkpoint: %v", err)
+	}
+	cp.DeviceSig = sig
+	for _, cluster := range clusters {
+		pub, priv, _ := crypto.GenerateKeyPair()
+		w := &pb.CheckpointWitness{WitnessPubkey: pub, EncounterCluster: cluster}
+		w.WitnessSig, _ = crypto.Sign(priv, dag.CheckpointWitnessSignableBytes(cp, w))
+		cp.Witnesses = append(cp.Witnesses, w)
+	}
+}
+
 func TestEvaluatePolicyLightApprove(t *testing.T) {
 	store := testPolicyStore(t)
 	defer store.Close()
 
-	device := []byte("peer")
+	device, devicePriv, _ := crypto.GenerateKeyPair()
 	cp := &pb.Checkpoint{
 		DevicePubkey: device,
 		Timestamp:    time.Now().Unix() - 3600,
-		Witnesses: []*pb.CheckpointWitness{
-			{WitnessPubkey: []byte("w1"), EncounterCluster: "c1"},
-		},
 	}
+	signCheckpoint(t, cp, devicePriv, "c1")
 	records := []*pb.ShareRecord{
 		makeRecord(device, []byte("a"), 1, nil, 2000, time.Now().Unix()-100),
 		makeRecord(device, []byte("b"), 2, []byte{1}, 1500, time.Now().Unix()-50),
@@ -53,6 +73,53 @@ func TestEvaluatePolicyLightApprove(t *testing.T) {
 	}
 }
 
+func TestEvaluatePolicyRejectsBorrowedCheckpoint(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+
+	device, devicePriv, _ := crypto.GenerateKeyPair()
+	cp := &pb.Checkpoint{DevicePubkey: device, Timestamp: time.Now().Unix() - 3600}
+	signCheckpoint(t, cp, devicePriv, "c1")
+
+	// The borrower presents its own records behind another device's witnessed checkpoint.
+	borrower, _, _ := crypto.GenerateKeyPair()
+	records := []*pb.ShareRecord{makeRecord(borrower, []byte("a"), 1, nil, 2000, time.Now().Unix()-100)}
+	for _, policy := range []pb.ServicePolicy{pb.ServicePolicy_POLICY_LIGHT, pb.ServicePolicy_POLICY_STRICT} {
+		if ok, reason := EvaluatePolicy(store, borrower, policy, cp, records); ok || reason != "checkpoint belongs to another device" {
+			t.Fatalf("expected %v to reject a borrowed checkpoint, got ok=%v reason=%q", policy, ok, reason)
+		}
+	}
+}
+
+func TestEvaluatePolicyIgnoresForgedWitnesses(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+
+	device, devicePriv, _ := crypto.GenerateKeyPair()
+	records := []*pb.ShareRecord{makeRecord(device, []byte("a"), 1, nil, 2000, time.Now().Unix()-100)}
+	cp := &pb.Checkpoint{DevicePubkey: device, Timestamp: time.Now().Unix() - 3600}
+	signCheckpoint(t, cp, devicePriv)
+	cp.Witnesses = []*pb.CheckpointWitness{
+		{WitnessPubkey: []byte("w1"), WitnessSig: []byte("typed-in"), EncounterCluster: "c1"},
+	}
+	if ok, _ := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_LIGHT, cp, records); ok {
+		t.Fatalf("expected light policy to ignore an unsigned witness")
+	}
+
+	strict := &pb.Checkpoint{DevicePubkey: device, Timestamp: time.Now().Unix() - 3600}
+	signCheckpoint(t, strict, devicePriv, "c1", "c2", "c3", "c4")
+	strict.Confidence = pb.ConfidenceLevel_CONFIDENCE_HIGH
+	strict.Witnesses = append(strict.Witnesses, &pb.CheckpointWitness{WitnessPubkey: []byte("w5"), EncounterCluster: "c5"})
+	if ok, reason := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_STRICT, strict, records); ok || reason != "strict policy requires high confidence checkpoint" {
+		t.Fatalf("expected strict policy to recompute confidence from verified witnesses, got ok=%v reason=%q", ok, reason)
+	}
+
+	cp.DeviceSig = []byte("typed-in")
+	if ok, _ := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_LIGHT, cp, records); ok {
+		t.Fatalf("expected checkpoint with a bad device signature to be rejected")
+	}
+}
+
 func TestEvaluatePolicyStrictRejectOnLowConfidence(t *testing.T) {
 	store := testPolicyStore(t)
 	defer store.Close()
@@ -76,20 +143,63 @@ func TestEvaluatePolicyStrictRejectOnLowConfidence(t *testing.T) {
 	}
 }
 
+func TestEvaluatePolicyStrictRequiresTrustedPeer(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+	if err := store.InitIdentity([]byte("me"), time.Now().Unix()-86400); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+
+	device, devicePriv, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+	records := []*pb.ShareRecord{
+		makeRecord(device, []byte("a"), 1, nil, 2000, now-100),
+		makeRecord(device, []byte("b"), 2, []byte{1}, 1500, now-50),
+	}
+	cp := &pb.Checkpoint{DevicePubkey: device, Timestamp: now - 3600}
+	signCheckpoint(t, cp, devicePriv, "c1", "c2", "c3", "c1", "c2")
+
+	// Nobody we have met has dealt with the peer or its counterparties.
+	ok, reason := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_STRICT, cp, records)
+	if ok || reason != "strict policy requires a peer trusted through our encounters" {
+		t.Fatalf("expected strict policy to reject an unreachable peer, got ok=%v reason=%q", ok, reason)
+	}
+
+	met := makeRecord([]byte("a"), []byte("me"), 1, nil, 100, now-200)
+	met.Id, met.RequestHash, met.FileHash = []byte("met"), []byte("req"), []byte("file")
+	met.SenderSig, met.ReceiverSig = []byte("s"), []byte("r")
+	if err := store.InsertRecord(met); err != nil {
+		t.Fatalf("seed encounter: %v", err)
+	}
+	if ok, reason := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_STRICT, cp, records); !ok {
+		t.Fatalf("expected strict approve for a peer two hops away, got reject: %s", reason)
+	}
+}
+
 func TestEvaluatePolicyRejectsOnForkEvidence(t *testing.T) {
 	store := testPolicyStore(t)
 	defer store.Close()
 
-	device := []byte("peer")
-	err := store.InsertForkEvidence(&pb.ForkEvidence{
-		DevicePubkey:   device,
-		RecordA:        &pb.ShareRecord{Id: []byte("a")},
-		RecordB:        &pb.ShareRecord{Id: []byte("b")},
-		ReporterPubkey: []byte("r"),
-		ReporterSig:    []byte("s"),
-		DetectedAt:     time.Now().Unix(),
-	})
-	if err != nil {
+	device, devicePriv, _ := crypto.GenerateKeyPair()
+	other, otherPriv, _ := crypto.GenerateKeyPair()
+	record := func(data string) *pb.ShareRecord {
+		r, _ := dag.BuildShareRecord(dag.ShareRecordParams{
+			SenderPubkey:   device,
+			ReceiverPubkey: other,
+			Request:        &pb.TransferRequest{RequesterPubkey: other, FileHash: []byte(data)},
+			Chunks:         []*pb.ChunkData{{Data: []byte(data)}},
+		})
+		sig, _ := crypto.Sign(devicePriv, dag.SignableBytes(r))
+		dag.AttachSenderSig(r, sig)
+		sig, _ = crypto.Sign(otherPriv, dag.SignableBytes(r))
+		dag.AttachReceiverSig(r, sig)
+		return r
+	}
+	fork := dag.DetectFork(record("a"), record("b"), device)
+	fork.ReporterPubkey = other
+	fork.DetectedAt = time.Now().Unix()
+	fork.ReporterSig, _ = crypto.Sign(otherPriv, dag.ForkEvidenceSignableBytes(fork))
+	if err := store.InsertForkEvidence(fork); err != nil {
 		t.Fatalf("seed fork evidence: %v", err)
 	}
 
@@ -98,3 +208,286 @@ func TestEvaluatePolicyRejectsOnForkEvidence(t *testing.T) {
 		t.Fatalf("expected reject when fork evidence exists")
 	}
 }
+
+func TestAuthorizeFileAccessGatesPrivateFiles(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	requesterPub, _, _ := crypto.GenerateKeyPair()
+	strangerPub, strangerPriv, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	hash := []byte("private-file")
+	if err := store.InsertFileMeta(&pb.FileMeta{FileHash: hash, FileName: "f", OriginPubkey: ownerPub, OriginSig: []byte("sig")}); err != nil {
+		t.Fatalf("insert file meta: %v", err)
+	}
+	req := &pb.TransferRequest{RequesterPubkey: requesterPub, FileHash: hash}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err != nil {
+		t.Fatalf("expected public file to be served, got %v", err)
+	}
+
+	if err := store.SetFileVisibility(hash, pb.Visibility_VISIBILITY_PRIVATE); err != nil {
+		t.Fatalf("set visibility: %v", err)
+	}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err == nil {
+		t.Fatalf("expected private file without a capability to be refused")
+	}
+
+	req.Capability, _ = discovery.CreateCapability(hash, requesterPub, strangerPub, strangerPriv, now+60)
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err == nil {
+		t.Fatalf("expected capability from a key that does not own the file to be refused")
+	}
+
+	req.Capability, _ = discovery.CreateCapability(hash, requesterPub, ownerPub, ownerPriv, now+60)
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err != nil {
+		t.Fatalf("expected owner's capability to be accepted, got %v", err)
+	}
+
+	rev, _ := discovery.CreateRevocation(req.Capability, ownerPub, ownerPriv, now)
+	if err := store.InsertRevocation(rev, now); err != nil {
+		t.Fatalf("insert revocation: %v", err)
+	}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err == nil {
+		t.Fatalf("expected revoked capability to be refused")
+	}
+}
+
+func TestAuthorizeFileAccessChargesCapabilityLimits(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	hash := []byte("media-collection")
+	meta := &pb.FileMeta{FileHash: hash, FileName: "f", FileSize: 250, ChunkSize: 100, OriginPubkey: ownerPub, OriginSig: []byte("sig")}
+	if err := store.InsertFileMeta(meta); err != nil {
+		t.Fatalf("insert file meta: %v", err)
+	}
+	if err := store.SetFileVisibility(hash, pb.Visibility_VISIBILITY_PRIVATE); err != nil {
+		t.Fatalf("set visibility: %v", err)
+	}
+
+	// A bearer token good for two downloads of the first two chunks.
+	bearer, _ := discovery.CreateScopedCapability(hash, nil, ownerPub, ownerPriv, now+60, discovery.CapabilityScope{
+		ChunkRanges:  []*pb.ChunkRange{{Start: 0, End: 2}},
+		MaxDownloads: 2,
+	})
+	request := func(nonce string, chunks ...uint32) *pb.TransferRequest {
+		requesterPub, _, _ := crypto.GenerateKeyPair()
+		return &pb.TransferRequest{RequesterPubkey: requesterPub, FileHash: hash, ChunkIndices: chunks, Nonce: []byte(nonce), Capability: bearer}
+	}
+
+	if err := AuthorizeFileAccess(store, request("n1", 2), ownerPub, now); err == nil {
+		t.Fatalf("expected a chunk outside the capability's range to be refused")
+	}
+	first := request("n1", 0, 1)
+	if err := AuthorizeFileAccess(store, first, ownerPub, now); err != nil {
+		t.Fatalf("first download: %v", err)
+	}
+	if err := AuthorizeFileAccess(store, first, ownerPub, now); err != nil {
+		t.Fatalf("re-checking the same request must not charge it twice: %v", err)
+	}
+	if err := AuthorizeFileAccess(store, request("n2", 0), ownerPub, now); err != nil {
+		t.Fatalf("second download: %v", err)
+	}
+	err := AuthorizeFileAccess(store, request("n3", 0), ownerPub, now)
+	if !errors.Is(err, storage.ErrCapabilityExhausted) {
+		t.Fatalf("expected third download to exhaust the capability, got %v", err)
+	}
+	downloads, bytes, _ := store.GetCapabilityUsage(discovery.CapabilityID(bearer))
+	if downloads != 2 || bytes != 300 {
+		t.Fatalf("expected 2 downloads and 300 bytes charged, got %d and %d", downloads, bytes)
+	}
+
+	// A byte budget also caps what is delegated from it.
+	alicePub, alicePriv, _ := crypto.GenerateKeyPair()
+	bobPub, _, _ := crypto.GenerateKeyPair()
+	budget, _ := discovery.CreateScopedCapability(hash, alicePub, ownerPub, ownerPriv, now+60, discovery.CapabilityScope{MaxBytes: 200})
+	delegated, _ := discovery.DelegateCapability(budget, bobPub, alicePriv, now+60, discovery.CapabilityScope{})
+	req := &pb.TransferRequest{RequesterPubkey: bobPub, FileHash: hash, ChunkIndices: []uint32{1, 2}, Nonce: []byte("d1"), Capability: delegated}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err != nil {
+		t.Fatalf("expected 150 bytes to fit the budget, got %v", err)
+	}
+	req = &pb.TransferRequest{RequesterPubkey: bobPub, FileHash: hash, ChunkIndices: []uint32{0}, Nonce: []byte("d2"), Capability: delegated}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); !errors.Is(err, storage.ErrCapabilityExhausted) {
+		t.Fatalf("expected the root's byte budget to cover the delegated capability, got %v", err)
+	}
+}
+
+func TestAuthorizeFileAccessRefusesByteLimitWithoutFileSize(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+	ownerPub, ownerPriv, _ := crypto.GenerateKeyPair()
+	alicePub, alicePriv, _ := crypto.GenerateKeyPair()
+	bobPub, _, _ := crypto.GenerateKeyPair()
+	now := time.Now().Unix()
+
+	// The metadata names no chunk size, so a request's bytes cannot be worked out.
+	hash := []byte("unsized-file")
+	if err := store.InsertFileMeta(&pb.FileMeta{FileHash: hash, FileName: "f", OriginPubkey: ownerPub, OriginSig: []byte("sig")}); err != nil {
+		t.Fatalf("insert file meta: %v", err)
+	}
+	if err := store.SetFileVisibility(hash, pb.Visibility_VISIBILITY_PRIVATE); err != nil {
+		t.Fatalf("set visibility: %v", err)
+	}
+
+	budget, _ := discovery.CreateScopedCapability(hash, alicePub, ownerPub, ownerPriv, now+60, discovery.CapabilityScope{MaxBytes: 200})
+	delegated, _ := discovery.DelegateCapability(budget, bobPub, alicePriv, now+60, discovery.CapabilityScope{})
+	req := &pb.TransferRequest{RequesterPubkey: bobPub, FileHash: hash, ChunkIndices: []uint32{0}, Nonce: []byte("n1"), Capability: delegated}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err == nil {
+		t.Fatalf("expected a byte limit higher up the chain to refuse an unsized file")
+	}
+	if _, bytes, _ := store.GetCapabilityUsage(discovery.CapabilityID(delegated)); bytes != 0 {
+		t.Fatalf("expected nothing charged for a refused request, got %d bytes", bytes)
+	}
+
+	// Download limits do not depend on the size.
+	counted, _ := discovery.CreateScopedCapability(hash, bobPub, ownerPub, ownerPriv, now+60, discovery.CapabilityScope{MaxDownloads: 1})
+	req = &pb.TransferRequest{RequesterPubkey: bobPub, FileHash: hash, ChunkIndices: []uint32{0}, Nonce: []byte("n2"), Capability: counted}
+	if err := AuthorizeFileAccess(store, req, ownerPub, now); err != nil {
+		t.Fatalf("expected a download-limited capability to be served, got %v", err)
+	}
+}
+
+func TestEvaluatePolicyFollowsKeySuccession(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+
+	oldKey, oldPriv, _ := crypto.GenerateKeyPair()
+	newKey, newPriv, _ := crypto.GenerateKeyPair()
+	history := makeRecord(oldKey, []byte("a"), 1, nil, 2000, time.Now().Unix()-100)
+	history.SenderSig, history.ReceiverSig = []byte("s"), []byte("r")
+	history.RequestHash, history.FileHash = []byte("req"), []byte("file")
+	if err := store.InsertRecord(history); err != nil {
+		t.Fatalf("insert record: %v", err)
+	}
+
+	// A fresh key has no drip and no history of its own yet.
+	cp := &pb.Checkpoint{DevicePubkey: newKey, Timestamp: time.Now().Unix()}
+	signCheckpoint(t, cp, newPriv, "c1")
+	if ok, _ := EvaluatePolicy(store, newKey, pb.ServicePolicy_POLICY_LIGHT, cp, nil); ok {
+		t.Fatalf("expected a fresh key without history to be rejected")
+	}
+
+	succession := &pb.SuccessionRecord{
+		OldPubkey: oldKey,
+		NewPubkey: newKey,
+		Timestamp: time.Now().Unix(),
+		FinalHead: dag.HeadAfter(history, oldKey),
+	}
+	succession.Signature, _ = crypto.Sign(oldPriv, dag.SuccessionSignableBytes(succession))
+	if err := store.InsertSuccession(succession, time.Now().Unix()); err != nil {
+		t.Fatalf("insert succession: %v", err)
+	}
+
+	if ok, reason := EvaluatePolicy(store, newKey, pb.ServicePolicy_POLICY_LIGHT, cp, nil); !ok {
+		t.Fatalf("expected credit earned under the old key to carry forward, got %s", reason)
+	}
+	if ok, reason := EvaluatePolicy(store, oldKey, pb.ServicePolicy_POLICY_NONE, nil, nil); ok || reason != "peer key has been retired" {
+		t.Fatalf("expected the retired key to be rejected, got ok=%v reason=%q", ok, reason)
+	}
+}
+
+func TestAcceptPeerNetworkParamsAdoptsAndRejects(t *testing.T) {
+	store := testPolicyStore(t)
+	issuerPub, issuerPriv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	sign := func(msg []byte) ([]byte, error) { return crypto.Sign(issuerPriv, msg) }
+	issue := func(network string, version uint32, drip int64) *pb.NetworkParams {
+		params := credit.DefaultParams()
+		params.DripRate = drip
+		p, err := credit.SignNetworkParams(network, version, params, issuerPub, time.Now().Unix(), sign)
+		if err != nil {
+			t.Fatalf("sign params: %v", err)
+		}
+		return p
+	}
+
+	// A peer that sends nothing runs the default network, like us.
+	if err := AcceptPeerNetworkParams(store, &pb.HandshakeMsg{}); err != nil {
+		t.Fatalf("default peer rejected: %v", err)
+	}
+	// Another network is never compatible.
+	err = AcceptPeerNetworkParams(store, &pb.HandshakeMsg{NetworkParams: issue("village", 1, credit.MB)})
+	if !errors.Is(err, credit.ErrIncompatibleParams) {
+		t.Fatalf("expected ErrIncompatibleParams for another network, got %v", err)
+	}
+
+	v1 := issue("village", 1, credit.MB)
+	if err := store.SaveNetworkParams(v1); err != nil {
+		t.Fatalf("install v1: %v", err)
+	}
+	// A newer version from our issuer is adopted and its economics used from then on.
+	v2 := issue("village", 2, 3*credit.MB)
+	if err := AcceptPeerNetworkParams(store, &pb.HandshakeMsg{NetworkParams: v2}); err != nil {
+		t.Fatalf("newer version rejected: %v", err)
+	}
+	params, err := credit.LocalParams(store)
+	if err != nil {
+		t.Fatalf("local params: %v", err)
+	}
+	if params.DripRate != 3*credit.MB {
+		t.Fatalf("expected adopted drip rate, got %d", params.DripRate)
+	}
+	// A peer still on v1 disagrees on balances, and we do not roll back.
+	if err := AcceptPeerNetworkParams(store, &pb.HandshakeMsg{NetworkParams: v1}); !errors.Is(err, credit.ErrIncompatibleParams) {
+		t.Fatalf("expected stale peer to be incompatible, got %v", err)
+	}
+	// Tampered economics fail the issuer signature.
+	forged := proto.Clone(v2).(*pb.NetworkParams)
+	forged.Version = 3
+	if err := AcceptPeerNetworkParams(store, &pb.HandshakeMsg{NetworkParams: forged}); !errors.Is(err, credit.ErrIncompatibleParams) {
+		t.Fatalf("expected forged params to be rejected, got %v", err)
+	}
+}
+
+func TestLightPolicyDiscountsUntrustedCredit(t *testing.T) {
+	store := testPolicyStore(t)
+	defer store.Close()
+
+	local, _, _ := crypto.GenerateKeyPair()
+	if err := store.InitIdentity(local, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	device, devicePriv, _ := crypto.GenerateKeyPair()
+	// No drip: the checkpoint is the device's age, so only sent credit counts.
+	cp := &pb.Checkpoint{DevicePubkey: device, Timestamp: time.Now().Unix()}
+	signCheckpoint(t, cp, devicePriv, "c1")
+	records := []*pb.ShareRecord{
+		makeRecord(device, []byte("a"), 1, nil, 2000, time.Now().Unix()-100),
+		makeRecord(device, []byte("b"), 2, []byte{1}, 1500, time.Now().Unix()-50),
+	}
+
+	// Credit earned only from devices nobody we know has met is worth nothing.
+	if ok, _ := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_LIGHT, cp, records); ok {
+		t.Fatalf("expected credit from unknown counterparties to be discounted")
+	}
+	breakdown, _, err := TrustedBreakdown(store, device, cp, records, cp.GetTimestamp(), credit.DefaultParams())
+	if err != nil {
+		t.Fatalf("trusted breakdown: %v", err)
+	}
+	if breakdown.TrustDiscount != breakdown.DiversityCredit || breakdown.Effective > 0 {
+		t.Fatalf("expected the whole diversity credit discounted, got %+v", breakdown)
+	}
+
+	// Once we have met one of them, the graph built above picks the encounter up.
+	met := makeRecord(local, []byte("a"), 1, nil, 10, time.Now().Unix()-10)
+	met.Id = []byte("met")
+	met.RequestHash, met.FileHash = []byte("req"), []byte("file")
+	met.SenderSig, met.ReceiverSig = []byte("s"), []byte("r")
+	if err := store.AppendRecord(met); err != nil {
+		t.Fatalf("append record: %v", err)
+	}
+	if ok, reason := EvaluatePolicy(store, device, pb.ServicePolicy_POLICY_LIGHT, cp, records); !ok {
+		t.Fatalf("expected credit from a met counterparty to count, got %s", reason)
+	}
+	breakdown, _, err = TrustedBreakdown(store, device, cp, records, cp.GetTimestamp(), credit.DefaultParams())
+	if err != nil {
+		t.Fatalf("trusted breakdown: %v", err)
+	}
+	if breakdown.TrustDiscount <= 0 || breakdown.TrustedCredit() <= 0 {
+		t.Fatalf("expected discounted but positive trusted credit, got %+v", breakdown)
+	}
+}
@@ -0,0 +1,133 @@
+package transfer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// SecureTransport seals every outgoing envelope and opens every incoming one with the
+// session cipher negotiated during the handshake. The handshake itself stays in plaintext.
+// A session that runs the handshake itself moves onto one as soon as the peer's auth verifies.
+type SecureTransport struct {
+	inner  Transport
+	sealer wire.Sealer
+
+	mu      sync.Mutex
+	pending []*pb.Envelope
+	// buffered counts the chunks put back and not yet read again, for ReceiveBuffer.
+	buffered ChunkGauge
+}
+
+func NewSecureTransport(inner Transport, sealer wire.Sealer) (*SecureTransport, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("transport is required")
+	}
+	if sealer == nil {
+		return nil, fmt.Errorf("session cipher is required")
+	}
+	return &SecureTransport{inner: inner, sealer: sealer}, nil
+}
+
+// KeyTransport wraps inner in a SecureTransport keyed from our ephemeral key pair and the
+// peer's ephemeral public key, the way both ends of an authenticated handshake derive it.
+func KeyTransport(inner Transport, localPub, localPriv, peerPub []byte) (*SecureTransport, error) {
+	shared, err := crypto.DeriveSharedSecret(localPriv, peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("derive shared secret: %w", err)
+	}
+	c, err := crypto.NewSessionCipher(shared, localPub, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	return NewSecureTransport(inner, c)
+}
+
+func (t *SecureTransport) Send(env *pb.Envelope) error {
+	if env.GetHandshake() != nil {
+		return t.inner.Send(env)
+	}
+	sealed, err := wire.SealEnvelope(env, t.sealer)
+	if err != nil {
+		return fmt.Errorf("seal envelope: %w", err)
+	}
+	return t.inner.Send(sealed)
+}
+
+func (t *SecureTransport) Recv() (*pb.Envelope, error) {
+	if env, ok := t.popPending(); ok {
+		return env, nil
+	}
+	env, err := t.inner.Recv()
+	if err != nil {
+		return nil, err
+	}
+	opened, err := wire.OpenEnvelope(env, t.sealer)
+	if err != nil {
+		return nil, fmt.Errorf("open envelope: %w", err)
+	}
+	return opened, nil
+}
+
+// TryRecv drops frames that fail to open so a forged or replayed frame cannot stall
+// a drain loop; the next authentic frame is returned instead.
+func (t *SecureTransport) TryRecv() (*pb.Envelope, bool) {
+	if env, ok := t.popPending(); ok {
+		return env, true
+	}
+	for {
+		env, ok := t.inner.TryRecv()
+		if !ok {
+			return nil, false
+		}
+		opened, err := wire.OpenEnvelope(env, t.sealer)
+		if err != nil {
+			continue
+		}
+		return opened, true
+	}
+}
+
+// PutBack keeps already-opened envelopes locally; pushing them back into the inner
+// transport would make them look like plaintext frames.
+func (t *SecureTransport) PutBack(env *pb.Envelope) {
+	if env == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buffered.Queued(env)
+	t.pending = append([]*pb.Envelope{env}, t.pending...)
+}
+
+// BufferedChunks adds the chunks put back here to those the inner transport holds.
+func (t *SecureTransport) BufferedChunks() int {
+	n := t.buffered.BufferedChunks()
+	if buf, ok := t.inner.(ReceiveBuffer); ok {
+		n += buf.BufferedChunks()
+	}
+	return n
+}
+
+func (t *SecureTransport) PeerID() string {
+	return t.inner.PeerID()
+}
+
+func (t *SecureTransport) Close() error {
+	return t.inner.Close()
+}
+
+func (t *SecureTransport) popPending() (*pb.Envelope, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return nil, false
+	}
+	env := t.pending[0]
+	t.pending = t.pending[1:]
+	t.buffered.Taken(env)
+	return env, true
+}
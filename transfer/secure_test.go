@@ -0,0 +1,50 @@
+package transfer
+
+import (
+	"testing"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func TestSecureTransportSealsTheLink(t *testing.T) {
+	aPub, aPriv, _ := crypto.GenerateSessionKeyPair()
+	bPub, bPriv, _ := crypto.GenerateSessionKeyPair()
+	aLink, bLink := newSwarmLinkPair("peer-1")
+	var onWire []*pb.Envelope
+	aLink.tamper = func(env *pb.Envelope) { onWire = append(onWire, env) }
+
+	a, err := KeyTransport(aLink, aPub, aPriv, bPub)
+	if err != nil {
+		t.Fatalf("key a: %v", err)
+	}
+	b, err := KeyTransport(bLink, bPub, bPriv, aPub)
+	if err != nil {
+		t.Fatalf("key b: %v", err)
+	}
+
+	ack := &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{ChunkIndices: []uint32{7}}}}
+	if err := a.Send(ack); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(onWire) != 1 || onWire[0].GetSealed() == nil {
+		t.Fatalf("expected the ack to leave sealed, got %v", onWire)
+	}
+	env, err := b.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if got := env.GetChunkAck().GetChunkIndices(); len(got) != 1 || got[0] != 7 {
+		t.Fatalf("expected the opened ack, got %v", env)
+	}
+
+	// A plaintext frame injected on the link is dropped; the next sealed one still opens.
+	_ = aLink.Send(ack)
+	_ = a.Send(ack)
+	if env, ok := b.TryRecv(); !ok || env.GetChunkAck() == nil {
+		t.Fatalf("expected the sealed ack after the injected one, got %v", env)
+	}
+	if _, ok := b.TryRecv(); ok {
+		t.Fatalf("expected nothing else on the link")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
 	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
 )
 
@@ -28,6 +29,30 @@ func ValidateTransferRequestWindow(req *pb.TransferRequest, now int64, maxAgeSec
 	return nil
 }
 
+// NonceCache is implemented by storage.Store in production.
+type NonceCache interface {
+	ClaimRequestNonce(requesterPubkey []byte, nonce []byte, timestamp int64) error
+}
+
+// AdmitTransferRequest decides whether an inbound request may start a session: it must be signed
+// by its requester, inside the request window, and carry a nonce that requester has not used.
+// The nonce is claimed last so a request failing the other checks cannot burn it.
+func AdmitTransferRequest(req *pb.TransferRequest, nonces NonceCache, now int64) error {
+	if err := dag.ValidateTransferRequest(req); err != nil {
+		return err
+	}
+	if err := ValidateTransferRequestWindow(req, now, DefaultTransferRequestTTLSeconds); err != nil {
+		return err
+	}
+	if nonces == nil {
+		return fmt.Errorf("nonce cache is required")
+	}
+	if err := nonces.ClaimRequestNonce(req.GetRequesterPubkey(), req.GetNonce(), req.GetTimestamp()); err != nil {
+		return fmt.Errorf("transfer request rejected: %w", err)
+	}
+	return nil
+}
+
 func IsTransferRequestExpired(req *pb.TransferRequest, now time.Time) bool {
 	if req == nil {
 		return true
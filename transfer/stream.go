@@ -0,0 +1,149 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+// StreamTransport carries envelopes over a byte stream such as a WiFi Direct or TCP socket.
+// Frames use wire's resynchronizing stream framing, so corrupted bytes cost the frames they hit
+// instead of the session.
+type StreamTransport struct {
+	peerID string
+	conn   io.ReadWriteCloser
+
+	writeMu sync.Mutex
+	recv    chan *pb.Envelope
+	done    chan struct{}
+	closed  sync.Once
+
+	mu      sync.Mutex
+	pending []*pb.Envelope
+	readErr error
+	dropped uint64
+	// buffered counts the chunks decoded and not yet read, for ReceiveBuffer.
+	buffered ChunkGauge
+}
+
+func NewStreamTransport(peerID string, conn io.ReadWriteCloser) (*StreamTransport, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("connection is required")
+	}
+	t := &StreamTransport{
+		peerID: peerID,
+		conn:   conn,
+		recv:   make(chan *pb.Envelope, 16),
+		done:   make(chan struct{}),
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+// readLoop decodes frames until the stream ends, so TryRecv never blocks on the connection.
+func (t *StreamTransport) readLoop() {
+	defer close(t.recv)
+	dec := wire.NewStreamDecoder(t.conn)
+	for {
+		env, dropped, err := dec.ReadEnvelope()
+		t.mu.Lock()
+		t.dropped += uint64(dropped)
+		if err != nil {
+			t.readErr = err
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return
+		}
+		t.buffered.Queued(env)
+		select {
+		case t.recv <- env:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *StreamTransport) Send(env *pb.Envelope) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return wire.WriteStreamEnvelope(t.conn, env)
+}
+
+func (t *StreamTransport) Recv() (*pb.Envelope, error) {
+	if env, ok := t.popPending(); ok {
+		return env, nil
+	}
+	env, ok := <-t.recv
+	if !ok {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.readErr == nil {
+			return nil, fmt.Errorf("stream closed")
+		}
+		return nil, fmt.Errorf("stream closed: %w", t.readErr)
+	}
+	t.buffered.Taken(env)
+	return env, nil
+}
+
+func (t *StreamTransport) TryRecv() (*pb.Envelope, bool) {
+	if env, ok := t.popPending(); ok {
+		return env, true
+	}
+	select {
+	case env, ok := <-t.recv:
+		if ok {
+			t.buffered.Taken(env)
+		}
+		return env, ok
+	default:
+		return nil, false
+	}
+}
+
+func (t *StreamTransport) PutBack(env *pb.Envelope) {
+	if env == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buffered.Queued(env)
+	t.pending = append([]*pb.Envelope{env}, t.pending...)
+}
+
+// BufferedChunks is how many chunks have arrived on the stream and not been read yet.
+func (t *StreamTransport) BufferedChunks() int {
+	return t.buffered.BufferedChunks()
+}
+
+func (t *StreamTransport) PeerID() string {
+	return t.peerID
+}
+
+func (t *StreamTransport) Close() error {
+	t.closed.Do(func() { close(t.done) })
+	return t.conn.Close()
+}
+
+// Dropped is how many corrupted or truncated bytes have been skipped on this stream.
+func (t *StreamTransport) Dropped() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+func (t *StreamTransport) popPending() (*pb.Envelope, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return nil, false
+	}
+	env := t.pending[0]
+	t.pending = t.pending[1:]
+	t.buffered.Taken(env)
+	return env, true
+}
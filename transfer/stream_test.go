@@ -0,0 +1,44 @@
+package transfer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func TestStreamTransportSurvivesCorruption(t *testing.T) {
+	local, remote := net.Pipe()
+	tr, err := NewStreamTransport("peer-1", local)
+	if err != nil {
+		t.Fatalf("new transport: %v", err)
+	}
+	defer tr.Close()
+
+	ack := func(index uint32) *pb.Envelope {
+		return &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{ChunkIndices: []uint32{index}}}}
+	}
+	go func() {
+		corrupted, _ := wire.EncodeStreamFrame(ack(1))
+		corrupted[len(corrupted)-1] ^= 0xFF
+		remote.Write(corrupted)
+		wire.WriteStreamEnvelope(remote, ack(2))
+	}()
+
+	env, err := tr.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if got := env.GetChunkAck().GetChunkIndices(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("expected the frame after the corrupted one, got %v", got)
+	}
+	if tr.Dropped() == 0 {
+		t.Fatalf("expected the corrupted frame to be counted as dropped")
+	}
+
+	go wire.NewStreamDecoder(remote).ReadEnvelope()
+	if err := tr.Send(ack(3)); err != nil {
+		t.Fatalf("expected the session to keep sending after corruption: %v", err)
+	}
+}
@@ -0,0 +1,702 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+/*
+SwarmDownloader fetches one file from several peers at once, using a MultiSourcePlan to know
+who holds which chunks. Each peer serves the swarm's requests with an ordinary inbound session,
+so the swarm speaks the receiver's side of the engine protocol to every peer.
+
+scheduling:
+  - rarest first: missing chunks are ordered by how many live peers can serve them, so chunks
+    only one peer holds are requested before that peer goes away.
+  - per-peer in-flight limit: a peer serves one TransferRequest at a time, of at most
+    MaxInFlightPerPeer chunks. among the idle providers of a chunk, the least loaded one gets it.
+  - stall reassignment: a peer that delivers nothing for StallTimeout while it has chunks in
+    flight, or that does not propose its record in time, is marked stalled and its chunks go
+    back to the pending set for other providers.
+
+every chunk is checked against FileMeta.ChunkHashes before it is written and acked; chunks that
+fail are acked as rejected so the peer sends them again. once every chunk is stored the whole
+file is checked against FileMeta.FileHash, and a file that fails is deleted.
+
+settlement: each request a peer serves in full is settled with one ShareRecord, built and
+proposed by the peer (the sender) and countersigned by us after checking it lists exactly the
+chunks of that request. records are settled one at a time: the ack that completes a request
+carries our chain head, reserved until the record is appended, so every record links onto the
+one before it even though peers stream in parallel. a peer with FeatureDeferredHead that
+completes its request while another peer is settling gets its final ack at once, marked
+head_pending, and the head in a later ack when its turn comes; older peers wait for their final
+ack, which can outlast their ack timeout behind a slow settlement.
+*/
+
+const (
+	DefaultSwarmInFlightPerPeer = 8
+	DefaultSwarmStallTimeout    = 10 * time.Second
+	swarmPollInterval           = 5 * time.Millisecond
+)
+
+type SwarmOptions struct {
+	MaxInFlightPerPeer int
+	StallTimeout       time.Duration
+}
+
+type swarmPeer struct {
+	id        string
+	identity  []byte
+	transport Transport
+	// protocol is what was negotiated with the peer, ours until SetPeerProtocol.
+	protocol wire.Protocol
+
+	// request is the TransferRequest the peer is serving, nil while it is idle.
+	request  *pb.TransferRequest
+	inFlight map[uint32]struct{}
+	// finalAck is sent on the peer's turn to settle and names our head: the ack completing its
+	// request, or only the head when that ack already went out marked head_pending.
+	finalAck *pb.ChunkAck
+	settling bool
+
+	delivered    map[uint32]uint64 // chunk index -> verified bytes
+	lastProgress time.Time
+	stalled      bool
+}
+
+type SwarmDownloader struct {
+	meta        *pb.FileMeta
+	plan        *MultiSourcePlan
+	storage     FileStorage
+	signer      Signer
+	chain       ChainAppender
+	heads       ChainHeadSource
+	localPubKey []byte
+	opts        SwarmOptions
+
+	peers   map[string]*swarmPeer
+	pending map[uint32]struct{}
+	// chunk index -> peer currently asked for it
+	assigned map[uint32]string
+
+	// ready holds peers whose request is delivered, in the order they wait to settle.
+	ready    []*swarmPeer
+	settling *swarmPeer
+	// settlingHead is the head named in the settling peer's final ack.
+	settlingHead    *pb.ChainHead
+	releaseHeadFunc func()
+
+	records   []*pb.ShareRecord
+	settleErr error
+}
+
+func NewSwarmDownloader(
+	meta *pb.FileMeta,
+	plan *MultiSourcePlan,
+	storage FileStorage,
+	signer Signer,
+	chain ChainAppender,
+	localPubKey []byte,
+	opts SwarmOptions,
+) (*SwarmDownloader, error) {
+	if meta == nil || len(meta.GetFileHash()) == 0 {
+		return nil, fmt.Errorf("file metadata is required")
+	}
+	if plan == nil {
+		return nil, fmt.Errorf("multi-source plan is required")
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("storage is required")
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("signer is required")
+	}
+	if chain == nil {
+		return nil, fmt.Errorf("chain appender is required")
+	}
+	if len(localPubKey) == 0 {
+		return nil, fmt.Errorf("local pubkey is required")
+	}
+	if opts.MaxInFlightPerPeer <= 0 {
+		opts.MaxInFlightPerPeer = DefaultSwarmInFlightPerPeer
+	}
+	if opts.MaxInFlightPerPeer > MaxChunksPerBatch {
+		opts.MaxInFlightPerPeer = MaxChunksPerBatch
+	}
+	if opts.StallTimeout <= 0 {
+		opts.StallTimeout = DefaultSwarmStallTimeout
+	}
+
+	return &SwarmDownloader{
+		meta:        meta,
+		plan:        plan,
+		storage:     storage,
+		signer:      signer,
+		chain:       chain,
+		localPubKey: append([]byte(nil), localPubKey...),
+		opts:        opts,
+		peers:       make(map[string]*swarmPeer),
+		pending:     make(map[uint32]struct{}),
+		assigned:    make(map[uint32]string),
+	}, nil
+}
+
+// SetChainHeadSource links settled records onto the local chain. A source that can reserve the
+// head holds it for each record from the final ack until the record is appended. Without a
+// source records are built as the first on our chain.
+func (d *SwarmDownloader) SetChainHeadSource(src ChainHeadSource) {
+	d.heads = src
+}
+
+// AddPeer registers a connected peer. peerID must match the id used in the plan, and identity is
+// the key the peer authenticated with during the handshake.
+func (d *SwarmDownloader) AddPeer(peerID string, identity []byte, transport Transport) error {
+	if peerID == "" {
+		return fmt.Errorf("peer id is required")
+	}
+	if len(identity) == 0 {
+		return fmt.Errorf("peer identity is required")
+	}
+	if transport == nil {
+		return fmt.Errorf("peer transport is required")
+	}
+	if _, exists := d.peers[peerID]; exists {
+		return fmt.Errorf("peer %s already added", peerID)
+	}
+	d.peers[peerID] = &swarmPeer{
+		id:        peerID,
+		identity:  append([]byte(nil), identity...),
+		transport: transport,
+		protocol:  wire.LocalProtocol(),
+		inFlight:  make(map[uint32]struct{}),
+		delivered: make(map[uint32]uint64),
+	}
+	return nil
+}
+
+// SetPeerProtocol records the protocol negotiated with a peer during its handshake. Requests to
+// the peer are signed in its encoding, and its records may not use an older one.
+func (d *SwarmDownloader) SetPeerProtocol(peerID string, protocol wire.Protocol) error {
+	p, ok := d.peers[peerID]
+	if !ok {
+		return fmt.Errorf("peer %s not added", peerID)
+	}
+	p.protocol = protocol
+	return nil
+}
+
+// Delivered returns the verified bytes each peer has delivered so far.
+func (d *SwarmDownloader) Delivered() map[string]uint64 {
+	out := make(map[string]uint64, len(d.peers))
+	for id, p := range d.peers {
+		out[id] = p.deliveredBytes()
+	}
+	return out
+}
+
+// Run downloads every missing chunk and returns the co-signed records, one per request a peer
+// served in full. If the download cannot finish, the records settled so far are returned with
+// the download error. A peer whose proposed record is refused is dropped from the swarm and
+// the first such refusal is returned once the download is done.
+func (d *SwarmDownloader) Run(ctx context.Context) ([]*pb.ShareRecord, error) {
+	if len(d.peers) == 0 {
+		return nil, fmt.Errorf("swarm has no peers")
+	}
+	defer d.releaseHead()
+	if err := d.download(ctx); err != nil {
+		return d.records, err
+	}
+	if err := d.verifyFile(); err != nil {
+		return d.records, err
+	}
+	return d.records, d.settleErr
+}
+
+// verifyFile is the receiver's whole-file hash check, run once every chunk is stored. Each chunk
+// matched its hash in the metadata, so a mismatch means the metadata itself was wrong; the file
+// is deleted and the download fails.
+func (d *SwarmDownloader) verifyFile() error {
+	verifyErr := VerifyFileHash(d.meta, d.storage)
+	if verifyErr == nil {
+		return nil
+	}
+	if deleter, ok := d.storage.(FileDeleter); ok {
+		if err := deleter.DeleteFile(d.meta.GetFileHash()); err != nil {
+			return fmt.Errorf("discard rejected file: %w", err)
+		}
+	}
+	return fmt.Errorf("downloaded file rejected: %w", verifyErr)
+}
+
+func (d *SwarmDownloader) download(ctx context.Context) error {
+	all := make([]uint32, len(d.meta.GetChunkHashes()))
+	for i := range all {
+		all[i] = uint32(i)
+	}
+	missing, err := MissingChunkIndices(d.storage, d.meta.GetFileHash(), all)
+	if err != nil {
+		return err
+	}
+	for _, idx := range missing {
+		d.pending[idx] = struct{}{}
+	}
+
+	for len(d.pending) > 0 || d.busy() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		unservable := d.schedule()
+		if unservable != nil && !d.busy() {
+			// Peers still serving may settle, but nobody is left to ask for these chunks.
+			return unservable
+		}
+
+		progressed := false
+		for _, p := range d.sortedPeers() {
+			if p.stalled || p.request == nil {
+				continue
+			}
+			got, err := d.drain(ctx, p)
+			if err != nil {
+				return err
+			}
+			progressed = progressed || got
+		}
+		if err := d.settleNext(ctx); err != nil {
+			return err
+		}
+		d.reassignStalled(time.Now())
+
+		if !progressed {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(swarmPollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+// busy reports whether any live peer is still serving or settling a request.
+func (d *SwarmDownloader) busy() bool {
+	for _, p := range d.peers {
+		if !p.stalled && p.request != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule hands pending chunks to idle providers, rarest first, within the in-flight limit. It
+// returns an error naming a chunk no live peer can serve.
+func (d *SwarmDownloader) schedule() error {
+	order := d.rarestFirst()
+	requests := make(map[string][]uint32)
+	var unservable error
+
+	for _, idx := range order {
+		providers := d.liveProviders(idx)
+		if len(providers) == 0 {
+			if unservable == nil {
+				unservable = fmt.Errorf("no live provider for chunk %d", idx)
+			}
+			continue
+		}
+		var best *swarmPeer
+		for _, p := range providers {
+			if p.request != nil || len(requests[p.id]) >= d.opts.MaxInFlightPerPeer {
+				continue
+			}
+			if best == nil || len(requests[p.id]) < len(requests[best.id]) {
+				best = p
+			}
+		}
+		if best == nil {
+			continue
+		}
+		requests[best.id] = append(requests[best.id], idx)
+	}
+
+	for peerID, indices := range requests {
+		p := d.peers[peerID]
+		if err := d.sendRequest(p, indices); err != nil {
+			// nothing was asked of the peer; its chunks stay pending for the others.
+			p.stalled = true
+			continue
+		}
+		for _, idx := range indices {
+			p.inFlight[idx] = struct{}{}
+			d.assigned[idx] = p.id
+			delete(d.pending, idx)
+		}
+		// the stall clock starts from this request.
+		p.lastProgress = time.Now()
+	}
+	return unservable
+}
+
+// rarestFirst orders pending chunks by live provider count, then by index.
+func (d *SwarmDownloader) rarestFirst() []uint32 {
+	order := make([]uint32, 0, len(d.pending))
+	rarity := make(map[uint32]int, len(d.pending))
+	for idx := range d.pending {
+		order = append(order, idx)
+		rarity[idx] = len(d.liveProviders(idx))
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if rarity[order[i]] != rarity[order[j]] {
+			return rarity[order[i]] < rarity[order[j]]
+		}
+		return order[i] < order[j]
+	})
+	return order
+}
+
+func (d *SwarmDownloader) liveProviders(idx uint32) []*swarmPeer {
+	ids := d.plan.ProvidersForChunk(idx)
+	sort.Strings(ids)
+	out := make([]*swarmPeer, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := d.peers[id]; ok && !p.stalled {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (d *SwarmDownloader) sortedPeers() []*swarmPeer {
+	ids := make([]string, 0, len(d.peers))
+	for id := range d.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := make([]*swarmPeer, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, d.peers[id])
+	}
+	return out
+}
+
+func (d *SwarmDownloader) sendRequest(p *swarmPeer, indices []uint32) error {
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req := &pb.TransferRequest{
+		RequesterPubkey: d.localPubKey,
+		FileHash:        d.meta.GetFileHash(),
+		ChunkIndices:    indices,
+		Nonce:           nonce,
+		Timestamp:       time.Now().Unix(),
+		SigningVersion:  p.protocol.SigningVersion(),
+	}
+	// Peers that do not read heads from acks link their record to this one.
+	if d.heads != nil {
+		head, err := d.heads.LocalChainHead()
+		if err != nil {
+			return fmt.Errorf("load local chain head: %w", err)
+		}
+		req.RequesterHead = head
+	}
+	sig, err := d.signer.Sign(dag.TransferRequestSignableBytes(req))
+	if err != nil {
+		return fmt.Errorf("sign swarm request: %w", err)
+	}
+	req.Signature = sig
+	if err := p.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_TransferRequest{TransferRequest: req},
+	}); err != nil {
+		return err
+	}
+	p.request = req
+	return nil
+}
+
+// drain consumes whatever the peer has queued: chunk batches for this file and, while the peer
+// is settling, its proposed record. Anything else is put back in order for the link's other
+// readers.
+func (d *SwarmDownloader) drain(ctx context.Context, p *swarmPeer) (bool, error) {
+	var others []*pb.Envelope
+	defer func() {
+		for i := len(others) - 1; i >= 0; i-- {
+			p.transport.PutBack(others[i])
+		}
+	}()
+
+	progressed := false
+	for !p.stalled && p.request != nil {
+		env, ok := p.transport.TryRecv()
+		if !ok {
+			break
+		}
+		if batch := env.GetChunkBatch(); batch != nil && bytes.Equal(batch.GetFileHash(), d.meta.GetFileHash()) {
+			got, err := d.receiveBatch(p, batch)
+			if err != nil {
+				return progressed, err
+			}
+			progressed = progressed || got
+			continue
+		}
+		if record := env.GetShareRecord(); record != nil && p.settling {
+			if err := d.settle(ctx, p, record); err != nil {
+				return progressed, err
+			}
+			progressed = true
+			continue
+		}
+		others = append(others, env)
+	}
+	return progressed, nil
+}
+
+// receiveBatch stores the chunks that were asked of this peer and match the metadata hash, and
+// acks them. The peer then waits in ready for its turn to settle; see finalAck.
+func (d *SwarmDownloader) receiveBatch(p *swarmPeer, batch *pb.ChunkBatch) (bool, error) {
+	verified, rejected, err := SplitVerifiedChunks(batch, d.meta)
+	if err != nil {
+		return false, err
+	}
+	ack := &pb.ChunkAck{FileHash: d.meta.GetFileHash(), Credits: uint32(d.opts.MaxInFlightPerPeer)}
+	for _, ch := range verified {
+		idx := ch.GetChunkIndex()
+		if _, asked := p.inFlight[idx]; !asked {
+			continue
+		}
+		if err := d.storage.WriteChunk(d.meta.GetFileHash(), idx, ch.GetData()); err != nil {
+			return false, fmt.Errorf("write chunk %d: %w", idx, err)
+		}
+		delete(p.inFlight, idx)
+		delete(d.assigned, idx)
+		p.delivered[idx] = uint64(len(ch.GetData()))
+		ack.ChunkIndices = append(ack.ChunkIndices, idx)
+	}
+	for _, idx := range rejected {
+		if _, asked := p.inFlight[idx]; asked {
+			ack.RejectedIndices = append(ack.RejectedIndices, idx)
+		}
+	}
+	if len(ack.ChunkIndices) == 0 && len(ack.RejectedIndices) == 0 {
+		return false, nil
+	}
+	p.lastProgress = time.Now()
+
+	if len(p.inFlight) == 0 {
+		if p.protocol.Features.Has(wire.FeatureDeferredHead) && (d.settling != nil || len(d.ready) > 0) {
+			// Our head is taken: ack the chunks now, before the peer's ack timeout runs out.
+			ack.HeadPending = true
+			if err := p.transport.Send(&pb.Envelope{
+				Payload: &pb.Envelope_ChunkAck{ChunkAck: ack},
+			}); err != nil {
+				d.markStalled(p)
+				return true, nil
+			}
+			ack = &pb.ChunkAck{FileHash: d.meta.GetFileHash()}
+		}
+		p.finalAck = ack
+		d.ready = append(d.ready, p)
+		return true, nil
+	}
+	if err := p.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_ChunkAck{ChunkAck: ack},
+	}); err != nil {
+		d.markStalled(p)
+	}
+	return true, nil
+}
+
+// settleNext sends the next waiting peer its final ack, naming our reserved chain head, unless
+// another peer is still settling.
+func (d *SwarmDownloader) settleNext(ctx context.Context) error {
+	for d.settling == nil && len(d.ready) > 0 {
+		p := d.ready[0]
+		d.ready = d.ready[1:]
+		if p.stalled {
+			continue
+		}
+		head, err := d.reserveHead(ctx)
+		if err != nil {
+			return err
+		}
+		ack := p.finalAck
+		ack.RequesterHead = head
+		p.finalAck = nil
+		if err := p.transport.Send(&pb.Envelope{
+			Payload: &pb.Envelope_ChunkAck{ChunkAck: ack},
+		}); err != nil {
+			d.markStalled(p)
+			continue
+		}
+		p.settling = true
+		p.lastProgress = time.Now()
+		d.settling = p
+		d.settlingHead = head
+	}
+	return nil
+}
+
+// settle checks the record the peer proposed for its request, countersigns it and appends it.
+// A record we cannot sign drops the peer; only a failure to append ends the download.
+func (d *SwarmDownloader) settle(ctx context.Context, p *swarmPeer, record *pb.ShareRecord) error {
+	if err := d.checkProposal(p, record); err != nil {
+		d.refuse(p, err)
+		return nil
+	}
+	sig, err := d.signer.Sign(dag.SignableBytes(record))
+	if err != nil {
+		return fmt.Errorf("sign share record failed: %w", err)
+	}
+	dag.AttachReceiverSig(record, sig)
+	if err := dag.ValidateShareRecord(record); err != nil {
+		d.refuse(p, err)
+		return nil
+	}
+	if err := p.transport.Send(&pb.Envelope{
+		Payload: &pb.Envelope_ShareRecord{ShareRecord: record},
+	}); err != nil {
+		d.refuse(p, fmt.Errorf("send co-signed record: %w", err))
+		return nil
+	}
+	if err := d.chain.AppendRecord(record); err != nil {
+		return fmt.Errorf("append record failed: %w", err)
+	}
+	d.records = append(d.records, record)
+	d.releaseHead()
+
+	p.request = nil
+	p.settling = false
+	d.settling = nil
+	d.settlingHead = nil
+	return nil
+}
+
+// checkProposal is the swarm's version of the receiver's record check: the record must settle
+// the peer's request, list exactly its chunks and link onto the head named in the final ack.
+func (d *SwarmDownloader) checkProposal(p *swarmPeer, record *pb.ShareRecord) error {
+	reqHash, err := dag.RequestHash(p.request)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(record.GetRequestHash(), reqHash) {
+		return fmt.Errorf("share record request hash does not match the request")
+	}
+	if !bytes.Equal(record.GetSenderPubkey(), p.identity) || !bytes.Equal(record.GetReceiverPubkey(), d.localPubKey) {
+		return fmt.Errorf("share record names other parties")
+	}
+	// A peer that negotiated the canonical encoding must not fall back to the legacy one.
+	if record.GetSigningVersion() < p.protocol.SigningVersion() {
+		return fmt.Errorf("share record uses signing version %d, below the negotiated %d", record.GetSigningVersion(), p.protocol.SigningVersion())
+	}
+	indices := p.request.GetChunkIndices()
+	if len(record.GetChunkHashes()) != len(indices) {
+		return fmt.Errorf("share record lists %d chunks, %d were delivered", len(record.GetChunkHashes()), len(indices))
+	}
+	var total uint64
+	for i, idx := range indices {
+		if !bytes.Equal(record.GetChunkHashes()[i], d.meta.GetChunkHashes()[idx]) {
+			return fmt.Errorf("share record chunk %d does not match delivered data", idx)
+		}
+		total += p.delivered[idx]
+	}
+	if record.GetBytesTotal() != total {
+		return fmt.Errorf("share record claims %d bytes, %d were delivered", record.GetBytesTotal(), total)
+	}
+	if err := dag.CheckLinksTo(record, d.localPubKey, d.settlingHead); err != nil {
+		return fmt.Errorf("share record rejected: %w", err)
+	}
+	return nil
+}
+
+func (d *SwarmDownloader) refuse(p *swarmPeer, err error) {
+	if d.settleErr == nil {
+		d.settleErr = fmt.Errorf("settle with peer %s: %w", p.id, err)
+	}
+	d.markStalled(p)
+}
+
+func (d *SwarmDownloader) reassignStalled(now time.Time) {
+	for _, p := range d.peers {
+		// A peer waiting in ready has delivered; it is our turn to act, not its.
+		if p.stalled || p.request == nil || p.finalAck != nil {
+			continue
+		}
+		if now.Sub(p.lastProgress) >= d.opts.StallTimeout {
+			d.markStalled(p)
+		}
+	}
+}
+
+// markStalled drops the peer from the swarm. Chunks it has not delivered go back to pending;
+// chunks it delivered stay stored but its unsettled request earns it no record.
+func (d *SwarmDownloader) markStalled(p *swarmPeer) {
+	p.stalled = true
+	for idx := range p.inFlight {
+		delete(d.assigned, idx)
+		d.pending[idx] = struct{}{}
+	}
+	p.inFlight = make(map[uint32]struct{})
+	p.request = nil
+	p.finalAck = nil
+	if p.settling {
+		p.settling = false
+		d.settling = nil
+		d.settlingHead = nil
+		d.releaseHead()
+	}
+}
+
+// reserveHead returns the local chain head the next record links onto, holding it until
+// releaseHead when the source can reserve it.
+func (d *SwarmDownloader) reserveHead(ctx context.Context) (*pb.ChainHead, error) {
+	if d.heads == nil {
+		return nil, nil
+	}
+	reserver, ok := d.heads.(ChainHeadReserver)
+	if !ok {
+		head, err := d.heads.LocalChainHead()
+		if err != nil {
+			return nil, fmt.Errorf("load local chain head: %w", err)
+		}
+		return head, nil
+	}
+	head, release, err := reserver.ReserveChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reserve local chain head: %w", err)
+	}
+	d.releaseHeadFunc = release
+	return head, nil
+}
+
+func (d *SwarmDownloader) releaseHead() {
+	if d.releaseHeadFunc != nil {
+		d.releaseHeadFunc()
+		d.releaseHeadFunc = nil
+	}
+}
+
+func (p *swarmPeer) deliveredBytes() uint64 {
+	var total uint64
+	for _, n := range p.delivered {
+		total += n
+	}
+	return total
+}
+
+func chunkMatchesMeta(meta *pb.FileMeta, idx uint32, data []byte) bool {
+	hashes := meta.GetChunkHashes()
+	if int(idx) >= len(hashes) {
+		return false
+	}
+	computed := crypto.Hash(data)
+	return bytes.Equal(hashes[idx], computed[:])
+}
@@ -0,0 +1,535 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyshthefantastic/burnt-peanut-network-core/crypto"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/dag"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/storage"
+	"github.com/nyshthefantastic/burnt-peanut-network-core/wire"
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+// swarmLink is one end of an in-memory link; what is sent on it arrives at the other end.
+type swarmLink struct {
+	id     string
+	other  *swarmLink
+	mu     *sync.Mutex
+	cond   *sync.Cond
+	queue  []*pb.Envelope
+	closed bool
+	// tamper, when set, may alter envelopes before they leave this end.
+	tamper func(*pb.Envelope)
+}
+
+func newSwarmLinkPair(id string) (*swarmLink, *swarmLink) {
+	mu := &sync.Mutex{}
+	cond := sync.NewCond(mu)
+	a := &swarmLink{id: id, mu: mu, cond: cond}
+	b := &swarmLink{id: id, mu: mu, cond: cond}
+	a.other, b.other = b, a
+	return a, b
+}
+
+func (l *swarmLink) Send(env *pb.Envelope) error {
+	if l.tamper != nil {
+		l.tamper(env)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return context.Canceled
+	}
+	// Like a real link, the other end gets its own copy.
+	l.other.queue = append(l.other.queue, proto.Clone(env).(*pb.Envelope))
+	l.cond.Broadcast()
+	return nil
+}
+
+func (l *swarmLink) Recv() (*pb.Envelope, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.queue) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if len(l.queue) == 0 {
+		return nil, context.Canceled
+	}
+	env := l.queue[0]
+	l.queue = l.queue[1:]
+	return env, nil
+}
+
+func (l *swarmLink) TryRecv() (*pb.Envelope, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 {
+		return nil, false
+	}
+	env := l.queue[0]
+	l.queue = l.queue[1:]
+	return env, true
+}
+
+func (l *swarmLink) PutBack(env *pb.Envelope) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queue = append([]*pb.Envelope{env}, l.queue...)
+}
+
+func (l *swarmLink) PeerID() string { return l.id }
+
+func (l *swarmLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed, l.other.closed = true, true
+	l.cond.Broadcast()
+	return nil
+}
+
+// swarmTestPeer serves every TransferRequest on its link with an inbound session, the way a
+// node serves any requester.
+type swarmTestPeer struct {
+	id      string
+	pub     []byte
+	priv    []byte
+	storage *memoryFileStorage
+	store   *storage.Store
+	silent  bool // never answers chunk requests
+	legacy  bool // signs its records in the legacy encoding
+	// ackTimeout, when set, bounds the peer's wait for each chunk ack.
+	ackTimeout time.Duration
+
+	link  *swarmLink // the swarm's end
+	serve *swarmLink // the peer's end
+
+	mu       sync.Mutex
+	requests [][]uint32
+}
+
+func (p *swarmTestPeer) run() {
+	for {
+		env, err := p.serve.Recv()
+		if err != nil {
+			return
+		}
+		req := env.GetTransferRequest()
+		if req == nil {
+			continue
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, req.GetChunkIndices())
+		p.mu.Unlock()
+		if p.silent {
+			continue
+		}
+		s := NewSession(p.id, DirectionInbound, req.GetFileHash(), p.serve, p.store, &mockBalanceChecker{value: 1}, &mockSigner{priv: p.priv})
+		s.SetFileStorage(p.storage)
+		s.SetLocalPubKey(p.pub)
+		s.SetChainHeadSource(p.store)
+		s.SetPendingRequest(req)
+		if p.legacy {
+			s.SetProtocol(wire.Protocol{Version: wire.LegacyProtocolVersion})
+		}
+		if p.ackTimeout > 0 {
+			s.SetAckTimeout(p.ackTimeout)
+		}
+		_ = s.RunSession(context.Background())
+	}
+}
+
+func (p *swarmTestPeer) requested() [][]uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]uint32(nil), p.requests...)
+}
+
+func newSwarmFile(t *testing.T, chunks int) (*pb.FileMeta, [][]byte) {
+	t.Helper()
+	meta := &pb.FileMeta{ChunkSize: 16}
+	data := make([][]byte, chunks)
+	var whole []byte
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("chunk-%02d-payload", i))
+		h := crypto.Hash(data[i])
+		meta.ChunkHashes = append(meta.ChunkHashes, h[:])
+		meta.FileSize += uint64(len(data[i]))
+		whole = append(whole, data[i]...)
+	}
+	h := crypto.Hash(whole)
+	meta.FileHash = h[:]
+	return meta, data
+}
+
+func newSwarmTestPeer(t *testing.T, id string, meta *pb.FileMeta, data [][]byte, indices []uint32) *swarmTestPeer {
+	t.Helper()
+	pub, priv, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
+	store := testPolicyStore(t)
+	t.Cleanup(func() { store.Close() })
+	if err := store.InitIdentity(pub, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	st := newMemoryFileStorage()
+	for _, idx := range indices {
+		_ = st.WriteChunk(meta.GetFileHash(), idx, data[idx])
+	}
+	link, serve := newSwarmLinkPair(id)
+	p := &swarmTestPeer{id: id, pub: pub, priv: priv, storage: st, store: store, link: link, serve: serve}
+	go p.run()
+	t.Cleanup(func() { link.Close() })
+	return p
+}
+
+// newSwarmLocal returns the downloading node's store, with its identity set up.
+func newSwarmLocal(t *testing.T) (*storage.Store, []byte, []byte) {
+	t.Helper()
+	pub, priv, _ := crypto.GenerateKeyPair()
+	store := testPolicyStore(t)
+	t.Cleanup(func() { store.Close() })
+	if err := store.InitIdentity(pub, time.Now().Unix()); err != nil {
+		t.Fatalf("init identity: %v", err)
+	}
+	return store, pub, priv
+}
+
+// checkSwarmChain verifies the settled records sit one per index on the local chain.
+func checkSwarmChain(t *testing.T, store *storage.Store, localPub []byte, records []*pb.ShareRecord) {
+	t.Helper()
+	head, err := store.LocalChainHead()
+	if err != nil {
+		t.Fatalf("local chain head: %v", err)
+	}
+	if head.GetIndex() != uint64(len(records)) {
+		t.Fatalf("expected the local chain to reach index %d, got %d", len(records), head.GetIndex())
+	}
+	for index := uint64(1); index <= uint64(len(records)); index++ {
+		at, err := store.GetRecordsAtIndex(localPub, index)
+		if err != nil {
+			t.Fatalf("records at index %d: %v", index, err)
+		}
+		if len(at) != 1 {
+			t.Fatalf("expected one record at index %d of the local chain, got %d", index, len(at))
+		}
+	}
+}
+
+func TestSwarmDownloaderSpreadsAndSettlesPerRequest(t *testing.T) {
+	meta, data := newSwarmFile(t, 10)
+	all := []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	a := newSwarmTestPeer(t, "a", meta, data, all)
+	b := newSwarmTestPeer(t, "b", meta, data, all)
+
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("a", []ChunkRange{{Start: 0, End: 9}})
+	_ = plan.AddPeerRanges("b", []ChunkRange{{Start: 0, End: 9}})
+
+	store, localPub, localPriv := newSwarmLocal(t)
+	local := newMemoryFileStorage()
+	d, err := NewSwarmDownloader(meta, plan, local, &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 3})
+	if err != nil {
+		t.Fatalf("new swarm downloader: %v", err)
+	}
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("a", a.pub, a.link)
+	_ = d.AddPeer("b", b.pub, b.link)
+
+	// Traffic for another reader of the link must survive the download.
+	gossip := &pb.Envelope{Payload: &pb.Envelope_Handshake{Handshake: &pb.HandshakeMsg{SessionId: []byte("other")}}}
+	a.link.PutBack(gossip)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := d.Run(ctx)
+	if err != nil {
+		t.Fatalf("swarm run: %v", err)
+	}
+
+	missing, _ := MissingChunkIndices(local, meta.GetFileHash(), all)
+	if len(missing) != 0 {
+		t.Fatalf("expected complete file, missing %v", missing)
+	}
+	served := 0
+	for _, p := range []*swarmTestPeer{a, b} {
+		reqs := p.requested()
+		if len(reqs) == 0 {
+			t.Fatalf("expected peer %s to serve part of the file", p.id)
+		}
+		for _, req := range reqs {
+			if len(req) > 3 {
+				t.Fatalf("peer %s got %d chunks in flight, limit is 3", p.id, len(req))
+			}
+		}
+		served += len(reqs)
+	}
+	if len(records) != served {
+		t.Fatalf("expected one record per served request, got %d for %d requests", len(records), served)
+	}
+	checkSwarmChain(t, store, localPub, records)
+
+	var total uint64
+	delivered := d.Delivered()
+	credited := map[string]uint64{}
+	for _, r := range records {
+		if err := dag.ValidateShareRecord(r); err != nil {
+			t.Fatalf("record not co-signed: %v", err)
+		}
+		peerID := "a"
+		if string(r.GetSenderPubkey()) == string(b.pub) {
+			peerID = "b"
+		}
+		credited[peerID] += r.GetBytesTotal()
+		total += r.GetBytesTotal()
+	}
+	for id, n := range delivered {
+		if credited[id] != n {
+			t.Fatalf("records credit %s with %d bytes, peer delivered %d", id, credited[id], n)
+		}
+	}
+	if total != meta.GetFileSize() {
+		t.Fatalf("expected records to cover %d bytes, got %d", meta.GetFileSize(), total)
+	}
+
+	if env, ok := a.link.TryRecv(); !ok || env.GetHandshake() == nil {
+		t.Fatalf("expected the foreign envelope to be left on the link")
+	}
+}
+
+func TestSwarmDownloaderRarestFirst(t *testing.T) {
+	meta, _ := newSwarmFile(t, 4)
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("a", []ChunkRange{{Start: 0, End: 3}})
+	_ = plan.AddPeerRanges("b", []ChunkRange{{Start: 0, End: 1}})
+	_ = plan.AddPeerRanges("c", []ChunkRange{{Start: 0, End: 0}})
+
+	localPub, localPriv, _ := crypto.GenerateKeyPair()
+	d, _ := NewSwarmDownloader(meta, plan, newMemoryFileStorage(), &mockSigner{priv: localPriv}, &mockChainAppender{}, localPub, SwarmOptions{})
+	for _, id := range []string{"a", "b", "c"} {
+		_ = d.AddPeer(id, []byte(id), &mockTransport{peerID: id})
+	}
+	for idx := uint32(0); idx < 4; idx++ {
+		d.pending[idx] = struct{}{}
+	}
+
+	order := d.rarestFirst()
+	want := []uint32{2, 3, 1, 0}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected rarest-first order %v, got %v", want, order)
+		}
+	}
+}
+
+func TestSwarmDownloaderReassignsStalledPeer(t *testing.T) {
+	meta, data := newSwarmFile(t, 6)
+	all := []uint32{0, 1, 2, 3, 4, 5}
+	good := newSwarmTestPeer(t, "good", meta, data, all)
+	stuck := newSwarmTestPeer(t, "stuck", meta, data, all)
+	stuck.silent = true
+
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("good", []ChunkRange{{Start: 0, End: 5}})
+	_ = plan.AddPeerRanges("stuck", []ChunkRange{{Start: 0, End: 5}})
+
+	store, localPub, localPriv := newSwarmLocal(t)
+	local := newMemoryFileStorage()
+	d, _ := NewSwarmDownloader(meta, plan, local, &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{
+		MaxInFlightPerPeer: 2,
+		StallTimeout:       100 * time.Millisecond,
+	})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("good", good.pub, good.link)
+	_ = d.AddPeer("stuck", stuck.pub, stuck.link)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := d.Run(ctx)
+	if err != nil {
+		t.Fatalf("swarm run: %v", err)
+	}
+	if len(stuck.requested()) == 0 {
+		t.Fatalf("expected stalled peer to have been asked for chunks")
+	}
+	missing, _ := MissingChunkIndices(local, meta.GetFileHash(), all)
+	if len(missing) != 0 {
+		t.Fatalf("expected stalled chunks to be reassigned, missing %v", missing)
+	}
+	var total uint64
+	for _, r := range records {
+		if string(r.GetSenderPubkey()) != string(good.pub) {
+			t.Fatalf("expected only the serving peer to be credited")
+		}
+		total += r.GetBytesTotal()
+	}
+	if total != meta.GetFileSize() {
+		t.Fatalf("expected serving peer to be credited %d bytes, got %d", meta.GetFileSize(), total)
+	}
+	checkSwarmChain(t, store, localPub, records)
+}
+
+func TestSwarmDownloaderRefusesInflatedRecord(t *testing.T) {
+	meta, data := newSwarmFile(t, 4)
+	all := []uint32{0, 1, 2, 3}
+	honest := newSwarmTestPeer(t, "honest", meta, data, all)
+	greedy := newSwarmTestPeer(t, "greedy", meta, data, all)
+	greedy.serve.tamper = func(env *pb.Envelope) {
+		if r := env.GetShareRecord(); r != nil {
+			r.BytesTotal++
+		}
+	}
+
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("honest", []ChunkRange{{Start: 0, End: 3}})
+	_ = plan.AddPeerRanges("greedy", []ChunkRange{{Start: 0, End: 3}})
+
+	store, localPub, localPriv := newSwarmLocal(t)
+	local := newMemoryFileStorage()
+	d, _ := NewSwarmDownloader(meta, plan, local, &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 2})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("honest", honest.pub, honest.link)
+	_ = d.AddPeer("greedy", greedy.pub, greedy.link)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := d.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "greedy") {
+		t.Fatalf("expected the inflated record to be refused, got %v", err)
+	}
+	missing, _ := MissingChunkIndices(local, meta.GetFileHash(), all)
+	if len(missing) != 0 {
+		t.Fatalf("expected the honest peer to finish the file, missing %v", missing)
+	}
+	for _, r := range records {
+		if string(r.GetSenderPubkey()) != string(honest.pub) {
+			t.Fatalf("expected no record from the refused peer")
+		}
+	}
+	checkSwarmChain(t, store, localPub, records)
+}
+
+func TestSwarmDownloaderHoldsPeersToNegotiatedSigning(t *testing.T) {
+	meta, data := newSwarmFile(t, 4)
+	all := []uint32{0, 1, 2, 3}
+
+	// A peer that negotiated the legacy encoding is asked and settled in it.
+	old := newSwarmTestPeer(t, "old", meta, data, all)
+	old.legacy = true
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("old", []ChunkRange{{Start: 0, End: 3}})
+	store, localPub, localPriv := newSwarmLocal(t)
+	d, _ := NewSwarmDownloader(meta, plan, newMemoryFileStorage(), &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 2})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("old", old.pub, old.link)
+	_ = d.SetPeerProtocol("old", wire.Protocol{Version: wire.LegacyProtocolVersion})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := d.Run(ctx)
+	if err != nil {
+		t.Fatalf("legacy peer download: %v", err)
+	}
+	for _, r := range records {
+		if r.GetSigningVersion() != wire.LegacySigning {
+			t.Fatalf("expected legacy records, got signing version %d", r.GetSigningVersion())
+		}
+	}
+	checkSwarmChain(t, store, localPub, records)
+
+	// A peer that negotiated the canonical encoding may not sign in the legacy one.
+	honest := newSwarmTestPeer(t, "honest", meta, data, all)
+	downgraded := newSwarmTestPeer(t, "downgraded", meta, data, all)
+	downgraded.legacy = true
+	plan = NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("honest", []ChunkRange{{Start: 0, End: 3}})
+	_ = plan.AddPeerRanges("downgraded", []ChunkRange{{Start: 0, End: 3}})
+	store, localPub, localPriv = newSwarmLocal(t)
+	d, _ = NewSwarmDownloader(meta, plan, newMemoryFileStorage(), &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 2})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("honest", honest.pub, honest.link)
+	_ = d.AddPeer("downgraded", downgraded.pub, downgraded.link)
+	records, err = d.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "downgraded") {
+		t.Fatalf("expected the downgraded record to be refused, got %v", err)
+	}
+	for _, r := range records {
+		if r.GetSigningVersion() != wire.CanonicalSigning {
+			t.Fatalf("expected only canonical records, got signing version %d", r.GetSigningVersion())
+		}
+	}
+	checkSwarmChain(t, store, localPub, records)
+}
+
+func TestSwarmDownloaderDeletesFileFailingWholeHash(t *testing.T) {
+	meta, data := newSwarmFile(t, 4)
+	all := []uint32{0, 1, 2, 3}
+	// Every chunk matches its hash, but the file hash was made up.
+	meta.FileHash = []byte("not-the-file-hash-of-these-bytes")
+	peer := newSwarmTestPeer(t, "peer", meta, data, all)
+
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("peer", []ChunkRange{{Start: 0, End: 3}})
+	store, localPub, localPriv := newSwarmLocal(t)
+	local := newMemoryFileStorage()
+	d, _ := NewSwarmDownloader(meta, plan, local, &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 4})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("peer", peer.pub, peer.link)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := d.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "whole-file hash mismatch") {
+		t.Fatalf("expected the file to fail its whole-file hash, got %v", err)
+	}
+	missing, _ := MissingChunkIndices(local, meta.GetFileHash(), all)
+	if len(missing) != len(all) {
+		t.Fatalf("expected the rejected file to be deleted, still have %d chunks", len(all)-len(missing))
+	}
+}
+
+func TestSwarmDownloaderAcksWhilePeersWaitToSettle(t *testing.T) {
+	meta, data := newSwarmFile(t, 4)
+	all := []uint32{0, 1, 2, 3}
+	// Each settlement takes longer than a peer will wait for an ack, so a final ack held until
+	// the other peer has settled would time its sender out.
+	slowPropose := func(env *pb.Envelope) {
+		if env.GetShareRecord() != nil {
+			time.Sleep(300 * time.Millisecond)
+		}
+	}
+	a := newSwarmTestPeer(t, "a", meta, data, all)
+	b := newSwarmTestPeer(t, "b", meta, data, all)
+	for _, p := range []*swarmTestPeer{a, b} {
+		p.ackTimeout = 100 * time.Millisecond
+		p.serve.tamper = slowPropose
+	}
+
+	plan := NewMultiSourcePlan()
+	_ = plan.AddPeerRanges("a", []ChunkRange{{Start: 0, End: 3}})
+	_ = plan.AddPeerRanges("b", []ChunkRange{{Start: 0, End: 3}})
+	store, localPub, localPriv := newSwarmLocal(t)
+	d, _ := NewSwarmDownloader(meta, plan, newMemoryFileStorage(), &mockSigner{priv: localPriv}, store, localPub, SwarmOptions{MaxInFlightPerPeer: 2})
+	d.SetChainHeadSource(store)
+	_ = d.AddPeer("a", a.pub, a.link)
+	_ = d.AddPeer("b", b.pub, b.link)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := d.Run(ctx)
+	if err != nil {
+		t.Fatalf("swarm download: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected one record per peer, got %d", len(records))
+	}
+	if string(records[0].GetSenderPubkey()) == string(records[1].GetSenderPubkey()) {
+		t.Fatalf("expected both peers to settle")
+	}
+	checkSwarmChain(t, store, localPub, records)
+}
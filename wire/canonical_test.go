@@ -0,0 +1,59 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCanonicalFieldBoundaries(t *testing.T) {
+	// concatenation would encode both as "abc"
+	a := NewCanonical("test/v1").Bytes(1, []byte("ab")).Bytes(2, []byte("c")).Encode()
+	b := NewCanonical("test/v1").Bytes(1, []byte("a")).Bytes(2, []byte("bc")).Encode()
+	if bytes.Equal(a, b) {
+		t.Fatalf("expected moving a byte between fields to change the encoding")
+	}
+
+	list := NewCanonical("test/v1").BytesList(1, [][]byte{[]byte("ab"), []byte("c")}).Encode()
+	merged := NewCanonical("test/v1").BytesList(1, [][]byte{[]byte("abc")}).Encode()
+	if bytes.Equal(list, merged) {
+		t.Fatalf("expected list item boundaries to change the encoding")
+	}
+
+	if bytes.Equal(NewCanonical("test/v1").Bytes(1, []byte("x")).Encode(), NewCanonical("other/v1").Bytes(1, []byte("x")).Encode()) {
+		t.Fatalf("expected the domain tag to separate encodings of the same fields")
+	}
+}
+
+func TestCanonicalOmitsZeroValues(t *testing.T) {
+	empty := NewCanonical("test/v1").Encode()
+	zeros := NewCanonical("test/v1").
+		Bytes(1, nil).
+		String(2, "").
+		Uint64(3, 0).
+		Uint32(4, 0).
+		BytesList(5, nil).
+		Message(6, nil).
+		Message(7, &Canonical{}).
+		Encode()
+	if !bytes.Equal(empty, zeros) {
+		t.Fatalf("expected unset and zero fields to encode the same")
+	}
+}
+
+func TestCheckSigningVersion(t *testing.T) {
+	for _, v := range []uint32{LegacySigning, CanonicalSigning} {
+		if err := CheckSigningVersion(v); err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+	}
+	if err := CheckSigningVersion(CanonicalSigning + 1); !errors.Is(err, ErrSigningVersion) {
+		t.Fatalf("expected ErrSigningVersion, got %v", err)
+	}
+	if got := (Protocol{Version: LegacyProtocolVersion}).SigningVersion(); got != LegacySigning {
+		t.Fatalf("expected a legacy session to sign legacy, got %d", got)
+	}
+	if got := LocalProtocol().SigningVersion(); got != CanonicalSigning {
+		t.Fatalf("expected our own protocol to sign canonical, got %d", got)
+	}
+}
@@ -0,0 +1,213 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Compressed envelopes shrink what goes over slow links once both peers negotiated
+FeatureCompression.
+
+the envelope is marshalled, deflated and carried in Envelope.compressed together with its
+uncompressed size. compression happens before sealing, so the ciphertext carries the smaller
+bytes, and the framing on the wire does not change.
+
+only envelope types that carry bulk data are compressed: chunk batches, gossip payloads and
+fork evidence. hellos are never compressed because they are sent before the peer's features
+are known, and small envelopes or ones that would not get smaller are sent as they are. chunk
+batches whose data already looks compressed (jpeg, mp4, zip, ...) are skipped, since deflating
+them costs battery and saves nothing.
+
+a compressed envelope can claim to inflate to at most MaxMessageSize, the same bound an
+uncompressed frame has, and inflating stops as soon as the output passes the claimed size, so
+a small frame cannot make the receiver allocate more than a full-size one could.
+*/
+
+const (
+	// CompressionThreshold is the smallest marshalled envelope worth compressing.
+	CompressionThreshold = 512
+	// compressionSample is how much of a chunk is looked at to tell whether it is already compressed.
+	compressionSample = 4096
+	// compressedEntropy is the bits per byte above which data is treated as already compressed.
+	compressedEntropy = 7.5
+)
+
+// ErrDecompressionLimit is returned for a compressed envelope that inflates past its claimed
+// size or claims more than MaxMessageSize.
+var ErrDecompressionLimit = errors.New("decompressed envelope exceeds its limit")
+
+// CompressEnvelope returns env compressed for a session running p, or env itself when p did not
+// negotiate compression or compressing it is not worthwhile.
+func CompressEnvelope(env *pb.Envelope, p Protocol) (*pb.Envelope, error) {
+	if env == nil {
+		return nil, fmt.Errorf("envelope is nil")
+	}
+	if !p.Features.Has(FeatureCompression) || !compressible(env) {
+		return env, nil
+	}
+	plain, err := proto.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < CompressionThreshold {
+		return env, nil
+	}
+	if len(plain) > MaxMessageSize {
+		return nil, fmt.Errorf("message length is greater than chunk size")
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(plain) {
+		return env, nil
+	}
+
+	return &pb.Envelope{
+		Payload: &pb.Envelope_Compressed{
+			Compressed: &pb.CompressedEnvelope{
+				Algorithm:        pb.Compression_COMPRESSION_DEFLATE,
+				UncompressedSize: uint32(len(plain)),
+				Data:             buf.Bytes(),
+			},
+		},
+		ProtocolVersion: env.GetProtocolVersion(),
+	}, nil
+}
+
+// DecompressEnvelope returns the envelope env carries if it is compressed, and env itself
+// otherwise. A compressed envelope is refused on a session that did not negotiate compression.
+func DecompressEnvelope(env *pb.Envelope, p Protocol) (*pb.Envelope, error) {
+	if env == nil {
+		return nil, fmt.Errorf("envelope is nil")
+	}
+	compressed := env.GetCompressed()
+	if compressed == nil {
+		return env, nil
+	}
+	if !p.Features.Has(FeatureCompression) {
+		return nil, fmt.Errorf("compressed envelope on a session without compression")
+	}
+	if compressed.GetAlgorithm() != pb.Compression_COMPRESSION_DEFLATE {
+		return nil, fmt.Errorf("unsupported compression %v", compressed.GetAlgorithm())
+	}
+	size := compressed.GetUncompressedSize()
+	if size > MaxMessageSize {
+		return nil, fmt.Errorf("%w: claims %d bytes, more than %d", ErrDecompressionLimit, size, MaxMessageSize)
+	}
+
+	r := flate.NewReader(bytes.NewReader(compressed.GetData()))
+	defer r.Close()
+	// one byte past the claimed size is enough to tell it was exceeded
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(r, int64(size)+1)); err != nil {
+		return nil, fmt.Errorf("inflate envelope: %w", err)
+	}
+	if buf.Len() > int(size) {
+		return nil, fmt.Errorf("%w: inflates past the claimed %d bytes", ErrDecompressionLimit, size)
+	}
+	if buf.Len() != int(size) {
+		return nil, fmt.Errorf("compressed envelope inflates to %d bytes, claimed %d", buf.Len(), size)
+	}
+
+	inner := pb.Envelope{}
+	if err := proto.Unmarshal(buf.Bytes(), &inner); err != nil {
+		return nil, err
+	}
+	if inner.GetCompressed() != nil || inner.GetSealed() != nil {
+		return nil, fmt.Errorf("nested envelope inside a compressed envelope")
+	}
+	return &inner, nil
+}
+
+// compressible reports whether env's type carries enough data to be worth compressing.
+func compressible(env *pb.Envelope) bool {
+	switch payload := env.GetPayload().(type) {
+	case *pb.Envelope_ChunkBatch:
+		return !batchLooksCompressed(payload.ChunkBatch)
+	case *pb.Envelope_Gossip, *pb.Envelope_ForkEvidence:
+		return true
+	}
+	return false
+}
+
+// batchLooksCompressed reports whether most of a batch's data is already compressed.
+func batchLooksCompressed(batch *pb.ChunkBatch) bool {
+	total, compressed := 0, 0
+	for _, chunk := range batch.GetChunks() {
+		total += len(chunk.GetData())
+		if looksCompressed(chunk.GetData()) {
+			compressed += len(chunk.GetData())
+		}
+	}
+	return compressed*2 > total
+}
+
+// compressedMagic are the leading bytes of common compressed media and archive formats.
+var compressedMagic = [][]byte{
+	{0xFF, 0xD8, 0xFF},                 // jpeg
+	{0x89, 'P', 'N', 'G'},              // png
+	[]byte("GIF8"),                     // gif
+	{0x1A, 0x45, 0xDF, 0xA3},           // matroska, webm
+	[]byte("ID3"),                      // mp3
+	[]byte("OggS"),                     // ogg
+	[]byte("fLaC"),                     // flac
+	{'P', 'K', 0x03, 0x04},             // zip, apk, docx, epub
+	{0x1F, 0x8B},                       // gzip
+	{0x28, 0xB5, 0x2F, 0xFD},           // zstd
+	[]byte("BZh"),                      // bzip2
+	{0xFD, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, // 7z
+	[]byte("Rar!"),                     // rar
+}
+
+// looksCompressed tells compressed data apart by its format's magic bytes, or, for chunks from
+// the middle of a file, by how close its bytes are to random.
+func looksCompressed(data []byte) bool {
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	if len(data) >= 12 && (string(data[4:8]) == "ftyp" || // mp4, mov, heic
+		string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP") {
+		return true
+	}
+	return entropy(data[:min(len(data), compressionSample)]) > compressedEntropy
+}
+
+// entropy is the Shannon entropy of data in bits per byte.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var bits float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(data))
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
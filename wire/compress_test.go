@@ -0,0 +1,117 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+func gossipWithFiles(n int) *pb.Envelope {
+	gossip := &pb.GossipPayload{}
+	for i := 0; i < n; i++ {
+		gossip.SeedingFiles = append(gossip.SeedingFiles, &pb.FileMeta{FileName: "holiday-photos.zip", FileSize: 1 << 20, ChunkSize: 1 << 14})
+	}
+	return &pb.Envelope{Payload: &pb.Envelope_Gossip{Gossip: gossip}}
+}
+
+func TestCompressEnvelopeRoundTrip(t *testing.T) {
+	env := gossipWithFiles(256)
+	LocalProtocol().Stamp(env)
+
+	compressed, err := CompressEnvelope(env, LocalProtocol())
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if compressed.GetCompressed() == nil {
+		t.Fatalf("expected a repetitive gossip payload to be compressed")
+	}
+	if proto.Size(compressed) >= proto.Size(env) {
+		t.Fatalf("compressed envelope is %d bytes, original %d", proto.Size(compressed), proto.Size(env))
+	}
+	if EnvelopeVersion(compressed) != ProtocolVersion {
+		t.Fatalf("expected the compressed envelope to keep its version stamp")
+	}
+
+	got, err := DecompressEnvelope(compressed, LocalProtocol())
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if !proto.Equal(got, env) {
+		t.Fatalf("decompressed envelope differs from the original")
+	}
+
+	if _, err := DecompressEnvelope(compressed, Protocol{Version: LegacyProtocolVersion}); err == nil {
+		t.Fatalf("expected a compressed envelope to be refused on a session without compression")
+	}
+}
+
+func TestCompressEnvelopeSkips(t *testing.T) {
+	legacy := Protocol{Version: LegacyProtocolVersion}
+	if out, _ := CompressEnvelope(gossipWithFiles(256), legacy); out.GetCompressed() != nil {
+		t.Fatalf("expected no compression for a peer that did not negotiate it")
+	}
+
+	hello := &pb.Envelope{Payload: &pb.Envelope_Handshake{Handshake: &pb.HandshakeMsg{SessionId: bytes.Repeat([]byte("s"), 4096)}}}
+	if out, _ := CompressEnvelope(hello, LocalProtocol()); out.GetCompressed() != nil {
+		t.Fatalf("expected hellos never to be compressed")
+	}
+
+	if out, _ := CompressEnvelope(gossipWithFiles(1), LocalProtocol()); out.GetCompressed() != nil {
+		t.Fatalf("expected an envelope under the threshold to be sent as is")
+	}
+
+	media := make([]byte, 8192)
+	rand.Read(media)
+	copy(media, []byte{0xFF, 0xD8, 0xFF, 0xE0})
+	text := bytes.Repeat([]byte("plain text compresses well "), 300)
+	batch := func(data []byte) *pb.Envelope {
+		return &pb.Envelope{Payload: &pb.Envelope_ChunkBatch{ChunkBatch: &pb.ChunkBatch{
+			Chunks: []*pb.ChunkData{{ChunkIndex: 0, Data: data}},
+		}}}
+	}
+	if out, _ := CompressEnvelope(batch(media), LocalProtocol()); out.GetCompressed() != nil {
+		t.Fatalf("expected an already compressed chunk to be sent as is")
+	}
+	if out, _ := CompressEnvelope(batch(media[4096:]), LocalProtocol()); out.GetCompressed() != nil {
+		t.Fatalf("expected a high-entropy chunk without magic bytes to be sent as is")
+	}
+	if out, _ := CompressEnvelope(batch(text), LocalProtocol()); out.GetCompressed() == nil {
+		t.Fatalf("expected a text chunk to be compressed")
+	}
+}
+
+func TestDecompressEnvelopeLimits(t *testing.T) {
+	deflate := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	compressed := func(size uint32, data []byte) *pb.Envelope {
+		return &pb.Envelope{Payload: &pb.Envelope_Compressed{Compressed: &pb.CompressedEnvelope{
+			Algorithm:        pb.Compression_COMPRESSION_DEFLATE,
+			UncompressedSize: size,
+			Data:             data,
+		}}}
+	}
+
+	// a few kilobytes that inflate to far more than they claim
+	bomb := deflate(make([]byte, 4*MaxMessageSize))
+	if _, err := DecompressEnvelope(compressed(1024, bomb), LocalProtocol()); !errors.Is(err, ErrDecompressionLimit) {
+		t.Fatalf("expected ErrDecompressionLimit for output past the claimed size, got %v", err)
+	}
+	if _, err := DecompressEnvelope(compressed(MaxMessageSize+1, bomb), LocalProtocol()); !errors.Is(err, ErrDecompressionLimit) {
+		t.Fatalf("expected ErrDecompressionLimit for a claim over MaxMessageSize, got %v", err)
+	}
+
+	sealed, _ := proto.Marshal(&pb.Envelope{Payload: &pb.Envelope_Sealed{Sealed: &pb.SealedEnvelope{Counter: 1}}})
+	if _, err := DecompressEnvelope(compressed(uint32(len(sealed)), deflate(sealed)), LocalProtocol()); err == nil {
+		t.Fatalf("expected a sealed envelope inside a compressed one to be refused")
+	}
+}
@@ -0,0 +1,276 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Fragments carry length-prefixed envelopes over links whose writes are only a few hundred
+bytes, like BLE GATT writes and notifications.
+
+every fragment is one link write:
+
+	[2 bytes magic "BP"][2 bytes message id][2 bytes fragment count][2 bytes fragment index][payload]
+
+the payloads of a message's fragments, in index order, are exactly the bytes EncodeEnvelope
+produced. fragments may arrive out of order or twice; the Reassembler puts them back together
+per peer and hands out the frame once every index is in.
+*/
+
+const (
+	FragmentMagic      uint16 = 0x4250 // "BP"
+	FragmentHeaderSize        = 8
+	// MinFragmentMTU is the smallest write that still carries a byte of payload.
+	MinFragmentMTU = FragmentHeaderSize + 1
+	// DefaultFragmentMTU is a BLE write before the ATT MTU is negotiated (23 - 3 bytes of ATT header).
+	DefaultFragmentMTU = 20
+	// MaxFragments is the most fragments one message can be split into.
+	MaxFragments = 0xFFFF
+)
+
+// ErrReassemblyLimit is returned when a fragment would take the Reassembler over its limits.
+var ErrReassemblyLimit = errors.New("fragment reassembly limit exceeded")
+
+// Fragmenter splits frames into fragments. Message ids come from one counter, so use one
+// Fragmenter per sending side.
+type Fragmenter struct {
+	mu   sync.Mutex
+	next uint16
+}
+
+// Split cuts frame into fragments of at most mtu bytes each, header included.
+func (f *Fragmenter) Split(frame []byte, mtu int) ([][]byte, error) {
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("frame is empty")
+	}
+	if len(frame) > MaxMessageSize+4 {
+		return nil, fmt.Errorf("message length is greater than chunk size")
+	}
+	if mtu < MinFragmentMTU {
+		return nil, fmt.Errorf("mtu %d is below the minimum of %d", mtu, MinFragmentMTU)
+	}
+	size := mtu - FragmentHeaderSize
+	count := (len(frame) + size - 1) / size
+	if count > MaxFragments {
+		return nil, fmt.Errorf("message of %d bytes needs %d fragments at mtu %d, more than %d", len(frame), count, mtu, MaxFragments)
+	}
+
+	f.mu.Lock()
+	id := f.next
+	f.next++
+	f.mu.Unlock()
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*size, len(frame))
+		fragment := make([]byte, FragmentHeaderSize, FragmentHeaderSize+end-i*size)
+		binary.BigEndian.PutUint16(fragment[0:2], FragmentMagic)
+		binary.BigEndian.PutUint16(fragment[2:4], id)
+		binary.BigEndian.PutUint16(fragment[4:6], uint16(count))
+		binary.BigEndian.PutUint16(fragment[6:8], uint16(i))
+		fragments = append(fragments, append(fragment, frame[i*size:end]...))
+	}
+	return fragments, nil
+}
+
+type ReassemblyLimits struct {
+	// MaxPartialsPerPeer is how many messages one peer may have half delivered at once. Starting
+	// another drops that peer's oldest.
+	MaxPartialsPerPeer int
+	// MaxBufferedBytes bounds the payload held for partial messages across all peers. Going over
+	// drops the oldest partial messages.
+	MaxBufferedBytes int
+	// PartialTimeout drops a partial message that has had no fragment for this long.
+	PartialTimeout time.Duration
+}
+
+func DefaultReassemblyLimits() ReassemblyLimits {
+	return ReassemblyLimits{
+		MaxPartialsPerPeer: 4,
+		MaxBufferedBytes:   2 * MaxMessageSize,
+		PartialTimeout:     30 * time.Second,
+	}
+}
+
+// Reassembler rebuilds frames from the fragments of many peers. It is safe for concurrent use.
+type Reassembler struct {
+	limits   ReassemblyLimits
+	mu       sync.Mutex
+	partials map[partialKey]*partialMessage
+	buffered int
+}
+
+type partialKey struct {
+	peer string
+	id   uint16
+}
+
+type partialMessage struct {
+	parts    [][]byte
+	received int
+	bytes    int
+	started  time.Time
+	lastSeen time.Time
+}
+
+func NewReassembler(limits ReassemblyLimits) *Reassembler {
+	return &Reassembler{
+		limits:   limits,
+		partials: make(map[partialKey]*partialMessage),
+	}
+}
+
+// Push adds a fragment received from peer at now. It returns the whole frame once the
+// fragment completes a message, and nil while the message is still partial. A malformed or
+// inconsistent fragment is an error and drops the message it claims to belong to.
+func (r *Reassembler) Push(peer string, fragment []byte, now time.Time) ([]byte, error) {
+	if len(fragment) < MinFragmentMTU {
+		return nil, fmt.Errorf("fragment of %d bytes is too short", len(fragment))
+	}
+	if binary.BigEndian.Uint16(fragment[0:2]) != FragmentMagic {
+		return nil, fmt.Errorf("fragment has no magic marker")
+	}
+	id := binary.BigEndian.Uint16(fragment[2:4])
+	count := int(binary.BigEndian.Uint16(fragment[4:6]))
+	index := int(binary.BigEndian.Uint16(fragment[6:8]))
+	payload := fragment[FragmentHeaderSize:]
+	if count == 0 || index >= count {
+		return nil, fmt.Errorf("fragment index %d out of range for %d fragments", index, count)
+	}
+	if count == 1 {
+		return append([]byte(nil), payload...), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked(now)
+
+	key := partialKey{peer: peer, id: id}
+	msg, ok := r.partials[key]
+	if !ok {
+		r.evictPeerLocked(peer)
+		msg = &partialMessage{parts: make([][]byte, count), started: now}
+		r.partials[key] = msg
+	}
+	if len(msg.parts) != count {
+		r.dropLocked(key)
+		return nil, fmt.Errorf("fragment count changed from %d to %d within message %d", len(msg.parts), count, id)
+	}
+	msg.lastSeen = now
+	if msg.parts[index] != nil {
+		return nil, nil
+	}
+	if msg.bytes+len(payload) > MaxMessageSize+4 {
+		r.dropLocked(key)
+		return nil, fmt.Errorf("message length is greater than chunk size")
+	}
+	if !r.makeRoomLocked(key, len(payload)) {
+		r.dropLocked(key)
+		return nil, ErrReassemblyLimit
+	}
+	msg.parts[index] = append([]byte(nil), payload...)
+	msg.received++
+	msg.bytes += len(payload)
+	r.buffered += len(payload)
+	if msg.received < count {
+		return nil, nil
+	}
+
+	frame := make([]byte, 0, msg.bytes)
+	for _, part := range msg.parts {
+		frame = append(frame, part...)
+	}
+	r.dropLocked(key)
+	return frame, nil
+}
+
+// Forget drops every partial message of peer, e.g. when its link goes away.
+func (r *Reassembler) Forget(peer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.partials {
+		if key.peer == peer {
+			r.dropLocked(key)
+		}
+	}
+}
+
+// Buffered is the payload currently held for partial messages.
+func (r *Reassembler) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buffered
+}
+
+func (r *Reassembler) expireLocked(now time.Time) {
+	if r.limits.PartialTimeout <= 0 {
+		return
+	}
+	for key, msg := range r.partials {
+		if now.Sub(msg.lastSeen) > r.limits.PartialTimeout {
+			r.dropLocked(key)
+		}
+	}
+}
+
+// evictPeerLocked drops peer's oldest partial messages until it may start another one.
+func (r *Reassembler) evictPeerLocked(peer string) {
+	if r.limits.MaxPartialsPerPeer <= 0 {
+		return
+	}
+	for {
+		var oldest *partialKey
+		var oldestStart time.Time
+		n := 0
+		for key, msg := range r.partials {
+			if key.peer != peer {
+				continue
+			}
+			n++
+			if oldest == nil || msg.started.Before(oldestStart) {
+				k := key
+				oldest, oldestStart = &k, msg.started
+			}
+		}
+		if n < r.limits.MaxPartialsPerPeer {
+			return
+		}
+		r.dropLocked(*oldest)
+	}
+}
+
+// makeRoomLocked drops the oldest partial messages other than keep until size more bytes fit.
+func (r *Reassembler) makeRoomLocked(keep partialKey, size int) bool {
+	if r.limits.MaxBufferedBytes <= 0 {
+		return true
+	}
+	for r.buffered+size > r.limits.MaxBufferedBytes {
+		var oldest *partialKey
+		var oldestStart time.Time
+		for key, msg := range r.partials {
+			if key == keep {
+				continue
+			}
+			if oldest == nil || msg.started.Before(oldestStart) {
+				k := key
+				oldest, oldestStart = &k, msg.started
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		r.dropLocked(*oldest)
+	}
+	return true
+}
+
+func (r *Reassembler) dropLocked(key partialKey) {
+	if msg, ok := r.partials[key]; ok {
+		r.buffered -= msg.bytes
+		delete(r.partials, key)
+	}
+}
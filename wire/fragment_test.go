@@ -0,0 +1,100 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func TestFragmentRoundTripOutOfOrder(t *testing.T) {
+	frame, err := EncodeEnvelope(&pb.Envelope{Payload: &pb.Envelope_TransferRequest{
+		TransferRequest: &pb.TransferRequest{FileHash: bytes.Repeat([]byte{7}, 300)},
+	}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var f Fragmenter
+	fragments, err := f.Split(frame, DefaultFragmentMTU)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	for _, fragment := range fragments {
+		if len(fragment) > DefaultFragmentMTU {
+			t.Fatalf("fragment of %d bytes exceeds mtu", len(fragment))
+		}
+	}
+
+	r := NewReassembler(DefaultReassemblyLimits())
+	now := time.Unix(1000, 0)
+	var got []byte
+	// last first, then the rest with a duplicate
+	order := append([][]byte{fragments[len(fragments)-1], fragments[0]}, fragments[:len(fragments)-1]...)
+	for i, fragment := range order {
+		out, err := r.Push("peer", fragment, now)
+		if err != nil {
+			t.Fatalf("push %d: %v", i, err)
+		}
+		if out != nil {
+			if i != len(order)-1 {
+				t.Fatalf("message completed early at push %d", i)
+			}
+			got = out
+		}
+	}
+	if !bytes.Equal(got, frame) {
+		t.Fatalf("reassembled frame differs from the original")
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("expected nothing buffered after completion, got %d", r.Buffered())
+	}
+	if _, err := DecodeEnvelope(got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	var f Fragmenter
+	split := func(n int) [][]byte {
+		fragments, err := f.Split(bytes.Repeat([]byte{1}, n), 20)
+		if err != nil {
+			t.Fatalf("split: %v", err)
+		}
+		return fragments
+	}
+	now := time.Unix(1000, 0)
+
+	r := NewReassembler(ReassemblyLimits{MaxPartialsPerPeer: 2, MaxBufferedBytes: 30, PartialTimeout: time.Minute})
+	first, second, third := split(24), split(24), split(24)
+	r.Push("peer", first[0], now)
+	r.Push("peer", second[0], now.Add(time.Second))
+	r.Push("peer", third[0], now.Add(2*time.Second))
+	// the first message was evicted to admit the third
+	if out, _ := r.Push("peer", first[1], now.Add(3*time.Second)); out != nil {
+		t.Fatalf("expected the evicted message not to complete")
+	}
+	if r.Buffered() > 30 {
+		t.Fatalf("buffered %d bytes over the limit", r.Buffered())
+	}
+
+	r.Forget("peer")
+	if r.Buffered() != 0 {
+		t.Fatalf("expected Forget to drop the peer's partials, %d bytes left", r.Buffered())
+	}
+
+	tight := NewReassembler(ReassemblyLimits{MaxPartialsPerPeer: 4, MaxBufferedBytes: 10, PartialTimeout: time.Minute})
+	big := split(40)
+	tight.Push("peer", big[0], now)
+	if _, err := tight.Push("peer", big[1], now); !errors.Is(err, ErrReassemblyLimit) {
+		t.Fatalf("expected ErrReassemblyLimit, got %v", err)
+	}
+
+	stale := NewReassembler(ReassemblyLimits{MaxPartialsPerPeer: 4, MaxBufferedBytes: 1 << 20, PartialTimeout: time.Second})
+	msg := split(24)
+	stale.Push("peer", msg[0], now)
+	if out, _ := stale.Push("peer", msg[1], now.Add(time.Minute)); out != nil {
+		t.Fatalf("expected an expired partial not to complete")
+	}
+}
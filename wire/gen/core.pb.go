@@ -168,6 +168,52 @@ func (ServicePolicy) EnumDescriptor() ([]byte, []int) {
 	return file_core_proto_rawDescGZIP(), []int{2}
 }
 
+type Compression int32
+
+const (
+	Compression_COMPRESSION_NONE    Compression = 0
+	Compression_COMPRESSION_DEFLATE Compression = 1
+)
+
+// Enum value maps for Compression.
+var (
+	Compression_name = map[int32]string{
+		0: "COMPRESSION_NONE",
+		1: "COMPRESSION_DEFLATE",
+	}
+	Compression_value = map[string]int32{
+		"COMPRESSION_NONE":    0,
+		"COMPRESSION_DEFLATE": 1,
+	}
+)
+
+func (x Compression) Enum() *Compression {
+	p := new(Compression)
+	*p = x
+	return p
+}
+
+func (x Compression) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Compression) Descriptor() protoreflect.EnumDescriptor {
+	return file_core_proto_enumTypes[3].Descriptor()
+}
+
+func (Compression) Type() protoreflect.EnumType {
+	return &file_core_proto_enumTypes[3]
+}
+
+func (x Compression) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Compression.Descriptor instead.
+func (Compression) EnumDescriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{3}
+}
+
 type ShareRecord struct {
 	state               protoimpl.MessageState `protogen:"open.v1"`
 	Id                  []byte                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
@@ -187,8 +233,11 @@ type ShareRecord struct {
 	ReceiverSig         []byte                 `protobuf:"bytes,15,opt,name=receiver_sig,json=receiverSig,proto3" json:"receiver_sig,omitempty"`
 	FileHash            []byte                 `protobuf:"bytes,16,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
 	Visibility          Visibility             `protobuf:"varint,17,opt,name=visibility,proto3,enum=burntPeanut.Visibility" json:"visibility,omitempty"`
-	unknownFields       protoimpl.UnknownFields
-	sizeCache           protoimpl.SizeCache
+	// How the signed fields were encoded for sender_sig and receiver_sig:
+	// 0 for the legacy concatenation, 1 for the canonical encoding.
+	SigningVersion uint32 `protobuf:"varint,18,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *ShareRecord) Reset() {
@@ -340,6 +389,13 @@ func (x *ShareRecord) GetVisibility() Visibility {
 	return Visibility_VISIBILITY_PUBLIC
 }
 
+func (x *ShareRecord) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
 type CumulativeTotals struct {
 	state              protoimpl.MessageState `protogen:"open.v1"`
 	CumulativeSent     uint64                 `protobuf:"varint,1,opt,name=cumulative_sent,json=cumulativeSent,proto3" json:"cumulative_sent,omitempty"`
@@ -392,6 +448,69 @@ func (x *CumulativeTotals) GetCumulativeReceived() uint64 {
 	return 0
 }
 
+// ChainHead is a device's position on its own chain: the id of its latest
+// record, that record's index for the device, and the device's totals after it.
+// A device with no records yet has an empty record_id and index 0.
+type ChainHead struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RecordId      []byte                 `protobuf:"bytes,1,opt,name=record_id,json=recordId,proto3" json:"record_id,omitempty"`
+	Index         uint64                 `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	Totals        *CumulativeTotals      `protobuf:"bytes,3,opt,name=totals,proto3" json:"totals,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChainHead) Reset() {
+	*x = ChainHead{}
+	mi := &file_core_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChainHead) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChainHead) ProtoMessage() {}
+
+func (x *ChainHead) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChainHead.ProtoReflect.Descriptor instead.
+func (*ChainHead) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ChainHead) GetRecordId() []byte {
+	if x != nil {
+		return x.RecordId
+	}
+	return nil
+}
+
+func (x *ChainHead) GetIndex() uint64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *ChainHead) GetTotals() *CumulativeTotals {
+	if x != nil {
+		return x.Totals
+	}
+	return nil
+}
+
 type TransferRequest struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
 	RequesterPubkey []byte                 `protobuf:"bytes,1,opt,name=requester_pubkey,json=requesterPubkey,proto3" json:"requester_pubkey,omitempty"`
@@ -400,13 +519,18 @@ type TransferRequest struct {
 	Nonce           []byte                 `protobuf:"bytes,4,opt,name=nonce,proto3" json:"nonce,omitempty"`
 	Timestamp       int64                  `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	Signature       []byte                 `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
-	unknownFields   protoimpl.UnknownFields
-	sizeCache       protoimpl.SizeCache
+	// The requester's chain head, so the sender can link the share record it builds.
+	RequesterHead *ChainHead `protobuf:"bytes,7,opt,name=requester_head,json=requesterHead,proto3" json:"requester_head,omitempty"`
+	// Required for VISIBILITY_PRIVATE files: a capability granting the requester this file.
+	Capability     *FileCapability `protobuf:"bytes,8,opt,name=capability,proto3" json:"capability,omitempty"`
+	SigningVersion uint32          `protobuf:"varint,9,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *TransferRequest) Reset() {
 	*x = TransferRequest{}
-	mi := &file_core_proto_msgTypes[2]
+	mi := &file_core_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -418,7 +542,7 @@ func (x *TransferRequest) String() string {
 func (*TransferRequest) ProtoMessage() {}
 
 func (x *TransferRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[2]
+	mi := &file_core_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -431,7 +555,7 @@ func (x *TransferRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TransferRequest.ProtoReflect.Descriptor instead.
 func (*TransferRequest) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{2}
+	return file_core_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *TransferRequest) GetRequesterPubkey() []byte {
@@ -476,23 +600,45 @@ func (x *TransferRequest) GetSignature() []byte {
 	return nil
 }
 
+func (x *TransferRequest) GetRequesterHead() *ChainHead {
+	if x != nil {
+		return x.RequesterHead
+	}
+	return nil
+}
+
+func (x *TransferRequest) GetCapability() *FileCapability {
+	if x != nil {
+		return x.Capability
+	}
+	return nil
+}
+
+func (x *TransferRequest) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
 type FileMeta struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	FileHash      []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
-	FileName      string                 `protobuf:"bytes,2,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`
-	FileSize      uint64                 `protobuf:"varint,3,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`
-	ChunkSize     uint64                 `protobuf:"varint,4,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
-	ChunkHashes   [][]byte               `protobuf:"bytes,5,rep,name=chunk_hashes,json=chunkHashes,proto3" json:"chunk_hashes,omitempty"`
-	OriginPubkey  []byte                 `protobuf:"bytes,6,opt,name=origin_pubkey,json=originPubkey,proto3" json:"origin_pubkey,omitempty"`
-	OriginSig     []byte                 `protobuf:"bytes,7,opt,name=origin_sig,json=originSig,proto3" json:"origin_sig,omitempty"`
-	CreatedAt     int64                  `protobuf:"varint,8,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	FileHash       []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
+	FileName       string                 `protobuf:"bytes,2,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`
+	FileSize       uint64                 `protobuf:"varint,3,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`
+	ChunkSize      uint64                 `protobuf:"varint,4,opt,name=chunk_size,json=chunkSize,proto3" json:"chunk_size,omitempty"`
+	ChunkHashes    [][]byte               `protobuf:"bytes,5,rep,name=chunk_hashes,json=chunkHashes,proto3" json:"chunk_hashes,omitempty"`
+	OriginPubkey   []byte                 `protobuf:"bytes,6,opt,name=origin_pubkey,json=originPubkey,proto3" json:"origin_pubkey,omitempty"`
+	OriginSig      []byte                 `protobuf:"bytes,7,opt,name=origin_sig,json=originSig,proto3" json:"origin_sig,omitempty"`
+	CreatedAt      int64                  `protobuf:"varint,8,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	SigningVersion uint32                 `protobuf:"varint,9,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *FileMeta) Reset() {
 	*x = FileMeta{}
-	mi := &file_core_proto_msgTypes[3]
+	mi := &file_core_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -504,7 +650,7 @@ func (x *FileMeta) String() string {
 func (*FileMeta) ProtoMessage() {}
 
 func (x *FileMeta) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[3]
+	mi := &file_core_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -517,7 +663,7 @@ func (x *FileMeta) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileMeta.ProtoReflect.Descriptor instead.
 func (*FileMeta) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{3}
+	return file_core_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *FileMeta) GetFileHash() []byte {
@@ -576,24 +722,32 @@ func (x *FileMeta) GetCreatedAt() int64 {
 	return 0
 }
 
+func (x *FileMeta) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
 type Checkpoint struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	DevicePubkey  []byte                 `protobuf:"bytes,1,opt,name=device_pubkey,json=devicePubkey,proto3" json:"device_pubkey,omitempty"`
-	ChainHead     []byte                 `protobuf:"bytes,2,opt,name=chain_head,json=chainHead,proto3" json:"chain_head,omitempty"`
-	RecordIndex   uint64                 `protobuf:"varint,3,opt,name=record_index,json=recordIndex,proto3" json:"record_index,omitempty"`
-	Totals        *CumulativeTotals      `protobuf:"bytes,4,opt,name=totals,proto3" json:"totals,omitempty"`
-	RawBalance    int64                  `protobuf:"varint,5,opt,name=raw_balance,json=rawBalance,proto3" json:"raw_balance,omitempty"`
-	Timestamp     int64                  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
-	DeviceSig     []byte                 `protobuf:"bytes,7,opt,name=device_sig,json=deviceSig,proto3" json:"device_sig,omitempty"`
-	Witnesses     []*CheckpointWitness   `protobuf:"bytes,8,rep,name=witnesses,proto3" json:"witnesses,omitempty"`
-	Confidence    ConfidenceLevel        `protobuf:"varint,9,opt,name=confidence,proto3,enum=burntPeanut.ConfidenceLevel" json:"confidence,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	DevicePubkey   []byte                 `protobuf:"bytes,1,opt,name=device_pubkey,json=devicePubkey,proto3" json:"device_pubkey,omitempty"`
+	ChainHead      []byte                 `protobuf:"bytes,2,opt,name=chain_head,json=chainHead,proto3" json:"chain_head,omitempty"`
+	RecordIndex    uint64                 `protobuf:"varint,3,opt,name=record_index,json=recordIndex,proto3" json:"record_index,omitempty"`
+	Totals         *CumulativeTotals      `protobuf:"bytes,4,opt,name=totals,proto3" json:"totals,omitempty"`
+	RawBalance     int64                  `protobuf:"varint,5,opt,name=raw_balance,json=rawBalance,proto3" json:"raw_balance,omitempty"`
+	Timestamp      int64                  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	DeviceSig      []byte                 `protobuf:"bytes,7,opt,name=device_sig,json=deviceSig,proto3" json:"device_sig,omitempty"`
+	Witnesses      []*CheckpointWitness   `protobuf:"bytes,8,rep,name=witnesses,proto3" json:"witnesses,omitempty"`
+	Confidence     ConfidenceLevel        `protobuf:"varint,9,opt,name=confidence,proto3,enum=burntPeanut.ConfidenceLevel" json:"confidence,omitempty"`
+	SigningVersion uint32                 `protobuf:"varint,10,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *Checkpoint) Reset() {
 	*x = Checkpoint{}
-	mi := &file_core_proto_msgTypes[4]
+	mi := &file_core_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -605,7 +759,7 @@ func (x *Checkpoint) String() string {
 func (*Checkpoint) ProtoMessage() {}
 
 func (x *Checkpoint) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[4]
+	mi := &file_core_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -618,7 +772,7 @@ func (x *Checkpoint) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Checkpoint.ProtoReflect.Descriptor instead.
 func (*Checkpoint) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{4}
+	return file_core_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *Checkpoint) GetDevicePubkey() []byte {
@@ -684,18 +838,30 @@ func (x *Checkpoint) GetConfidence() ConfidenceLevel {
 	return ConfidenceLevel_CONFIDENCE_UNKNOWN
 }
 
+func (x *Checkpoint) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
+// device_sig covers every Checkpoint field except witnesses, confidence and
+// the signature itself. A witness signs the same fields plus device_sig, its
+// own pubkey and encounter_cluster. Confidence is derived from the witnesses
+// that verify, never trusted as sent.
 type CheckpointWitness struct {
 	state            protoimpl.MessageState `protogen:"open.v1"`
 	WitnessPubkey    []byte                 `protobuf:"bytes,1,opt,name=witness_pubkey,json=witnessPubkey,proto3" json:"witness_pubkey,omitempty"`
 	WitnessSig       []byte                 `protobuf:"bytes,2,opt,name=witness_sig,json=witnessSig,proto3" json:"witness_sig,omitempty"`
 	EncounterCluster string                 `protobuf:"bytes,3,opt,name=encounter_cluster,json=encounterCluster,proto3" json:"encounter_cluster,omitempty"`
+	SigningVersion   uint32                 `protobuf:"varint,4,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
 	unknownFields    protoimpl.UnknownFields
 	sizeCache        protoimpl.SizeCache
 }
 
 func (x *CheckpointWitness) Reset() {
 	*x = CheckpointWitness{}
-	mi := &file_core_proto_msgTypes[5]
+	mi := &file_core_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -707,7 +873,7 @@ func (x *CheckpointWitness) String() string {
 func (*CheckpointWitness) ProtoMessage() {}
 
 func (x *CheckpointWitness) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[5]
+	mi := &file_core_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -720,7 +886,7 @@ func (x *CheckpointWitness) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CheckpointWitness.ProtoReflect.Descriptor instead.
 func (*CheckpointWitness) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{5}
+	return file_core_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *CheckpointWitness) GetWitnessPubkey() []byte {
@@ -744,6 +910,13 @@ func (x *CheckpointWitness) GetEncounterCluster() string {
 	return ""
 }
 
+func (x *CheckpointWitness) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
 type ForkEvidence struct {
 	state          protoimpl.MessageState `protogen:"open.v1"`
 	DevicePubkey   []byte                 `protobuf:"bytes,1,opt,name=device_pubkey,json=devicePubkey,proto3" json:"device_pubkey,omitempty"`
@@ -752,13 +925,20 @@ type ForkEvidence struct {
 	ReporterPubkey []byte                 `protobuf:"bytes,4,opt,name=reporter_pubkey,json=reporterPubkey,proto3" json:"reporter_pubkey,omitempty"`
 	ReporterSig    []byte                 `protobuf:"bytes,5,opt,name=reporter_sig,json=reporterSig,proto3" json:"reporter_sig,omitempty"`
 	DetectedAt     int64                  `protobuf:"varint,6,opt,name=detected_at,json=detectedAt,proto3" json:"detected_at,omitempty"`
-	unknownFields  protoimpl.UnknownFields
-	sizeCache      protoimpl.SizeCache
+	// Set when the device's key was retired by this succession. The evidence is
+	// then record_a alone: a record the retired key signed past final_head.
+	Succession     *SuccessionRecord `protobuf:"bytes,7,opt,name=succession,proto3" json:"succession,omitempty"`
+	SigningVersion uint32            `protobuf:"varint,8,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	// Set with succession when the device's key signed two different successions,
+	// handing itself over twice. The evidence is then the two successions alone.
+	ConflictingSuccession *SuccessionRecord `protobuf:"bytes,9,opt,name=conflicting_succession,json=conflictingSuccession,proto3" json:"conflicting_succession,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
 }
 
 func (x *ForkEvidence) Reset() {
 	*x = ForkEvidence{}
-	mi := &file_core_proto_msgTypes[6]
+	mi := &file_core_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -770,7 +950,7 @@ func (x *ForkEvidence) String() string {
 func (*ForkEvidence) ProtoMessage() {}
 
 func (x *ForkEvidence) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[6]
+	mi := &file_core_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -783,7 +963,7 @@ func (x *ForkEvidence) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ForkEvidence.ProtoReflect.Descriptor instead.
 func (*ForkEvidence) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{6}
+	return file_core_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *ForkEvidence) GetDevicePubkey() []byte {
@@ -828,6 +1008,115 @@ func (x *ForkEvidence) GetDetectedAt() int64 {
 	return 0
 }
 
+func (x *ForkEvidence) GetSuccession() *SuccessionRecord {
+	if x != nil {
+		return x.Succession
+	}
+	return nil
+}
+
+func (x *ForkEvidence) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
+func (x *ForkEvidence) GetConflictingSuccession() *SuccessionRecord {
+	if x != nil {
+		return x.ConflictingSuccession
+	}
+	return nil
+}
+
+// SuccessionRecord hands a device's identity from old_pubkey to new_pubkey.
+// The old key signs every other field. final_head is the old key's chain head
+// at rotation: from then on the old key is retired, and any record it signs
+// past that head is a fork.
+type SuccessionRecord struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	OldPubkey      []byte                 `protobuf:"bytes,1,opt,name=old_pubkey,json=oldPubkey,proto3" json:"old_pubkey,omitempty"`
+	NewPubkey      []byte                 `protobuf:"bytes,2,opt,name=new_pubkey,json=newPubkey,proto3" json:"new_pubkey,omitempty"`
+	Timestamp      int64                  `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	FinalHead      *ChainHead             `protobuf:"bytes,4,opt,name=final_head,json=finalHead,proto3" json:"final_head,omitempty"`
+	Signature      []byte                 `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
+	SigningVersion uint32                 `protobuf:"varint,6,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *SuccessionRecord) Reset() {
+	*x = SuccessionRecord{}
+	mi := &file_core_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SuccessionRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SuccessionRecord) ProtoMessage() {}
+
+func (x *SuccessionRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SuccessionRecord.ProtoReflect.Descriptor instead.
+func (*SuccessionRecord) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *SuccessionRecord) GetOldPubkey() []byte {
+	if x != nil {
+		return x.OldPubkey
+	}
+	return nil
+}
+
+func (x *SuccessionRecord) GetNewPubkey() []byte {
+	if x != nil {
+		return x.NewPubkey
+	}
+	return nil
+}
+
+func (x *SuccessionRecord) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *SuccessionRecord) GetFinalHead() *ChainHead {
+	if x != nil {
+		return x.FinalHead
+	}
+	return nil
+}
+
+func (x *SuccessionRecord) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *SuccessionRecord) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
 type Balance struct {
 	state                   protoimpl.MessageState `protogen:"open.v1"`
 	DevicePubkey            []byte                 `protobuf:"bytes,1,opt,name=device_pubkey,json=devicePubkey,proto3" json:"device_pubkey,omitempty"`
@@ -837,13 +1126,15 @@ type Balance struct {
 	DecayPenalty            int64                  `protobuf:"varint,5,opt,name=decay_penalty,json=decayPenalty,proto3" json:"decay_penalty,omitempty"`
 	EffectiveBalance        int64                  `protobuf:"varint,6,opt,name=effective_balance,json=effectiveBalance,proto3" json:"effective_balance,omitempty"`
 	ComputedAt              int64                  `protobuf:"varint,7,opt,name=computed_at,json=computedAt,proto3" json:"computed_at,omitempty"`
-	unknownFields           protoimpl.UnknownFields
-	sizeCache               protoimpl.SizeCache
+	// Sent bytes above the per-peer cap within each epoch, which do not count.
+	CapReduction  int64 `protobuf:"varint,8,opt,name=cap_reduction,json=capReduction,proto3" json:"cap_reduction,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Balance) Reset() {
 	*x = Balance{}
-	mi := &file_core_proto_msgTypes[7]
+	mi := &file_core_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -855,7 +1146,7 @@ func (x *Balance) String() string {
 func (*Balance) ProtoMessage() {}
 
 func (x *Balance) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[7]
+	mi := &file_core_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -868,7 +1159,7 @@ func (x *Balance) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Balance.ProtoReflect.Descriptor instead.
 func (*Balance) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{7}
+	return file_core_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *Balance) GetDevicePubkey() []byte {
@@ -920,6 +1211,13 @@ func (x *Balance) GetComputedAt() int64 {
 	return 0
 }
 
+func (x *Balance) GetCapReduction() int64 {
+	if x != nil {
+		return x.CapReduction
+	}
+	return 0
+}
+
 type CreditParams struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
 	DripRate        int64                  `protobuf:"varint,1,opt,name=drip_rate,json=dripRate,proto3" json:"drip_rate,omitempty"`
@@ -934,7 +1232,7 @@ type CreditParams struct {
 
 func (x *CreditParams) Reset() {
 	*x = CreditParams{}
-	mi := &file_core_proto_msgTypes[8]
+	mi := &file_core_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -946,7 +1244,7 @@ func (x *CreditParams) String() string {
 func (*CreditParams) ProtoMessage() {}
 
 func (x *CreditParams) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[8]
+	mi := &file_core_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -959,7 +1257,7 @@ func (x *CreditParams) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CreditParams.ProtoReflect.Descriptor instead.
 func (*CreditParams) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{8}
+	return file_core_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *CreditParams) GetDripRate() int64 {
@@ -1004,9 +1302,105 @@ func (x *CreditParams) GetEpochSeconds() int64 {
 	return 0
 }
 
-type PeerInfo struct {
-	state           protoimpl.MessageState `protogen:"open.v1"`
-	Pubkey          []byte                 `protobuf:"bytes,1,opt,name=pubkey,proto3" json:"pubkey,omitempty"`
+// NetworkParams fixes the economics a network of nodes runs with. Peers must
+// agree on them or they disagree on every balance. Each network's issuer signs
+// every version, and versions only increase. Version 0 of the "default"
+// network is the built-in, unsigned set.
+type NetworkParams struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	NetworkId      string                 `protobuf:"bytes,1,opt,name=network_id,json=networkId,proto3" json:"network_id,omitempty"`
+	Version        uint32                 `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	Credit         *CreditParams          `protobuf:"bytes,3,opt,name=credit,proto3" json:"credit,omitempty"`
+	IssuerPubkey   []byte                 `protobuf:"bytes,4,opt,name=issuer_pubkey,json=issuerPubkey,proto3" json:"issuer_pubkey,omitempty"`
+	IssuedAt       int64                  `protobuf:"varint,5,opt,name=issued_at,json=issuedAt,proto3" json:"issued_at,omitempty"`
+	Signature      []byte                 `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	SigningVersion uint32                 `protobuf:"varint,7,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *NetworkParams) Reset() {
+	*x = NetworkParams{}
+	mi := &file_core_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NetworkParams) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NetworkParams) ProtoMessage() {}
+
+func (x *NetworkParams) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NetworkParams.ProtoReflect.Descriptor instead.
+func (*NetworkParams) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *NetworkParams) GetNetworkId() string {
+	if x != nil {
+		return x.NetworkId
+	}
+	return ""
+}
+
+func (x *NetworkParams) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *NetworkParams) GetCredit() *CreditParams {
+	if x != nil {
+		return x.Credit
+	}
+	return nil
+}
+
+func (x *NetworkParams) GetIssuerPubkey() []byte {
+	if x != nil {
+		return x.IssuerPubkey
+	}
+	return nil
+}
+
+func (x *NetworkParams) GetIssuedAt() int64 {
+	if x != nil {
+		return x.IssuedAt
+	}
+	return 0
+}
+
+func (x *NetworkParams) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *NetworkParams) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
+type PeerInfo struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Pubkey          []byte                 `protobuf:"bytes,1,opt,name=pubkey,proto3" json:"pubkey,omitempty"`
 	ChainHead       []byte                 `protobuf:"bytes,2,opt,name=chain_head,json=chainHead,proto3" json:"chain_head,omitempty"`
 	RecordIndex     uint64                 `protobuf:"varint,3,opt,name=record_index,json=recordIndex,proto3" json:"record_index,omitempty"`
 	Totals          *CumulativeTotals      `protobuf:"bytes,4,opt,name=totals,proto3" json:"totals,omitempty"`
@@ -1019,7 +1413,7 @@ type PeerInfo struct {
 
 func (x *PeerInfo) Reset() {
 	*x = PeerInfo{}
-	mi := &file_core_proto_msgTypes[9]
+	mi := &file_core_proto_msgTypes[12]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1031,7 +1425,7 @@ func (x *PeerInfo) String() string {
 func (*PeerInfo) ProtoMessage() {}
 
 func (x *PeerInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[9]
+	mi := &file_core_proto_msgTypes[12]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1044,7 +1438,7 @@ func (x *PeerInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PeerInfo.ProtoReflect.Descriptor instead.
 func (*PeerInfo) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{9}
+	return file_core_proto_rawDescGZIP(), []int{12}
 }
 
 func (x *PeerInfo) GetPubkey() []byte {
@@ -1097,19 +1491,21 @@ func (x *PeerInfo) GetTransportType() string {
 }
 
 type GossipPayload struct {
-	state            protoimpl.MessageState `protogen:"open.v1"`
-	SelfSummary      *PeerInfo              `protobuf:"bytes,1,opt,name=self_summary,json=selfSummary,proto3" json:"self_summary,omitempty"`
-	PeerSummaries    []*PeerInfo            `protobuf:"bytes,2,rep,name=peer_summaries,json=peerSummaries,proto3" json:"peer_summaries,omitempty"`
-	ForkEvidence     []*ForkEvidence        `protobuf:"bytes,3,rep,name=fork_evidence,json=forkEvidence,proto3" json:"fork_evidence,omitempty"`
-	SeedingFiles     []*FileMeta            `protobuf:"bytes,4,rep,name=seeding_files,json=seedingFiles,proto3" json:"seeding_files,omitempty"`
-	LatestCheckpoint *Checkpoint            `protobuf:"bytes,5,opt,name=latest_checkpoint,json=latestCheckpoint,proto3" json:"latest_checkpoint,omitempty"`
+	state            protoimpl.MessageState  `protogen:"open.v1"`
+	SelfSummary      *PeerInfo               `protobuf:"bytes,1,opt,name=self_summary,json=selfSummary,proto3" json:"self_summary,omitempty"`
+	PeerSummaries    []*PeerInfo             `protobuf:"bytes,2,rep,name=peer_summaries,json=peerSummaries,proto3" json:"peer_summaries,omitempty"`
+	ForkEvidence     []*ForkEvidence         `protobuf:"bytes,3,rep,name=fork_evidence,json=forkEvidence,proto3" json:"fork_evidence,omitempty"`
+	SeedingFiles     []*FileMeta             `protobuf:"bytes,4,rep,name=seeding_files,json=seedingFiles,proto3" json:"seeding_files,omitempty"`
+	LatestCheckpoint *Checkpoint             `protobuf:"bytes,5,opt,name=latest_checkpoint,json=latestCheckpoint,proto3" json:"latest_checkpoint,omitempty"`
+	Revocations      []*CapabilityRevocation `protobuf:"bytes,6,rep,name=revocations,proto3" json:"revocations,omitempty"`
+	Successions      []*SuccessionRecord     `protobuf:"bytes,7,rep,name=successions,proto3" json:"successions,omitempty"`
 	unknownFields    protoimpl.UnknownFields
 	sizeCache        protoimpl.SizeCache
 }
 
 func (x *GossipPayload) Reset() {
 	*x = GossipPayload{}
-	mi := &file_core_proto_msgTypes[10]
+	mi := &file_core_proto_msgTypes[13]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1121,7 +1517,7 @@ func (x *GossipPayload) String() string {
 func (*GossipPayload) ProtoMessage() {}
 
 func (x *GossipPayload) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[10]
+	mi := &file_core_proto_msgTypes[13]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1134,7 +1530,7 @@ func (x *GossipPayload) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use GossipPayload.ProtoReflect.Descriptor instead.
 func (*GossipPayload) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{10}
+	return file_core_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *GossipPayload) GetSelfSummary() *PeerInfo {
@@ -1172,6 +1568,20 @@ func (x *GossipPayload) GetLatestCheckpoint() *Checkpoint {
 	return nil
 }
 
+func (x *GossipPayload) GetRevocations() []*CapabilityRevocation {
+	if x != nil {
+		return x.Revocations
+	}
+	return nil
+}
+
+func (x *GossipPayload) GetSuccessions() []*SuccessionRecord {
+	if x != nil {
+		return x.Successions
+	}
+	return nil
+}
+
 type HandshakeMsg struct {
 	state                  protoimpl.MessageState `protogen:"open.v1"`
 	SessionId              []byte                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
@@ -1180,13 +1590,24 @@ type HandshakeMsg struct {
 	Policy                 ServicePolicy          `protobuf:"varint,4,opt,name=policy,proto3,enum=burntPeanut.ServicePolicy" json:"policy,omitempty"`
 	LatestCheckpoint       *Checkpoint            `protobuf:"bytes,5,opt,name=latest_checkpoint,json=latestCheckpoint,proto3" json:"latest_checkpoint,omitempty"`
 	RecordsSinceCheckpoint []*ShareRecord         `protobuf:"bytes,6,rep,name=records_since_checkpoint,json=recordsSinceCheckpoint,proto3" json:"records_since_checkpoint,omitempty"`
-	unknownFields          protoimpl.UnknownFields
-	sizeCache              protoimpl.SizeCache
+	// The sender's own successions, newest first, so history earned under its
+	// earlier keys is credited to it.
+	Successions []*SuccessionRecord `protobuf:"bytes,7,rep,name=successions,proto3" json:"successions,omitempty"`
+	// The network parameters the sender computes balances with.
+	NetworkParams *NetworkParams `protobuf:"bytes,8,opt,name=network_params,json=networkParams,proto3" json:"network_params,omitempty"`
+	// The range of protocol versions the sender speaks and the optional features
+	// it supports (wire.Features bits). Builds from before versions were
+	// exchanged leave them unset and speak version 1 only.
+	ProtocolVersion    uint32 `protobuf:"varint,9,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	MinProtocolVersion uint32 `protobuf:"varint,10,opt,name=min_protocol_version,json=minProtocolVersion,proto3" json:"min_protocol_version,omitempty"`
+	Features           uint64 `protobuf:"varint,11,opt,name=features,proto3" json:"features,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
 }
 
 func (x *HandshakeMsg) Reset() {
 	*x = HandshakeMsg{}
-	mi := &file_core_proto_msgTypes[11]
+	mi := &file_core_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1198,7 +1619,7 @@ func (x *HandshakeMsg) String() string {
 func (*HandshakeMsg) ProtoMessage() {}
 
 func (x *HandshakeMsg) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[11]
+	mi := &file_core_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1211,7 +1632,7 @@ func (x *HandshakeMsg) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use HandshakeMsg.ProtoReflect.Descriptor instead.
 func (*HandshakeMsg) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{11}
+	return file_core_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *HandshakeMsg) GetSessionId() []byte {
@@ -1256,6 +1677,158 @@ func (x *HandshakeMsg) GetRecordsSinceCheckpoint() []*ShareRecord {
 	return nil
 }
 
+func (x *HandshakeMsg) GetSuccessions() []*SuccessionRecord {
+	if x != nil {
+		return x.Successions
+	}
+	return nil
+}
+
+func (x *HandshakeMsg) GetNetworkParams() *NetworkParams {
+	if x != nil {
+		return x.NetworkParams
+	}
+	return nil
+}
+
+func (x *HandshakeMsg) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *HandshakeMsg) GetMinProtocolVersion() uint32 {
+	if x != nil {
+		return x.MinProtocolVersion
+	}
+	return 0
+}
+
+func (x *HandshakeMsg) GetFeatures() uint64 {
+	if x != nil {
+		return x.Features
+	}
+	return 0
+}
+
+// HandshakeAuth proves possession of identity_pubkey. It is sent after both
+// HandshakeMsgs have been exchanged; the signature covers the session id, the
+// signer's and the peer's ephemeral keys, and the negotiated policy.
+type HandshakeAuth struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	SessionId           []byte                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	IdentityPubkey      []byte                 `protobuf:"bytes,2,opt,name=identity_pubkey,json=identityPubkey,proto3" json:"identity_pubkey,omitempty"`
+	EphemeralPubkey     []byte                 `protobuf:"bytes,3,opt,name=ephemeral_pubkey,json=ephemeralPubkey,proto3" json:"ephemeral_pubkey,omitempty"`
+	PeerEphemeralPubkey []byte                 `protobuf:"bytes,4,opt,name=peer_ephemeral_pubkey,json=peerEphemeralPubkey,proto3" json:"peer_ephemeral_pubkey,omitempty"`
+	NegotiatedPolicy    ServicePolicy          `protobuf:"varint,5,opt,name=negotiated_policy,json=negotiatedPolicy,proto3,enum=burntPeanut.ServicePolicy" json:"negotiated_policy,omitempty"`
+	Signature           []byte                 `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	// The protocol version and features the signer negotiated. From version 2 on
+	// they are covered by the signature, so neither can be downgraded in transit.
+	NegotiatedVersion  uint32 `protobuf:"varint,7,opt,name=negotiated_version,json=negotiatedVersion,proto3" json:"negotiated_version,omitempty"`
+	NegotiatedFeatures uint64 `protobuf:"varint,8,opt,name=negotiated_features,json=negotiatedFeatures,proto3" json:"negotiated_features,omitempty"`
+	// Sent by version 2 builds whatever they negotiated, and ignored by version 1
+	// peers: a signature over the transcript together with the protocol range the
+	// signer advertised and the one it received, so a hello whose range was
+	// altered or stripped in transit fails verification.
+	TranscriptSignature []byte `protobuf:"bytes,9,opt,name=transcript_signature,json=transcriptSignature,proto3" json:"transcript_signature,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *HandshakeAuth) Reset() {
+	*x = HandshakeAuth{}
+	mi := &file_core_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HandshakeAuth) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HandshakeAuth) ProtoMessage() {}
+
+func (x *HandshakeAuth) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HandshakeAuth.ProtoReflect.Descriptor instead.
+func (*HandshakeAuth) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *HandshakeAuth) GetSessionId() []byte {
+	if x != nil {
+		return x.SessionId
+	}
+	return nil
+}
+
+func (x *HandshakeAuth) GetIdentityPubkey() []byte {
+	if x != nil {
+		return x.IdentityPubkey
+	}
+	return nil
+}
+
+func (x *HandshakeAuth) GetEphemeralPubkey() []byte {
+	if x != nil {
+		return x.EphemeralPubkey
+	}
+	return nil
+}
+
+func (x *HandshakeAuth) GetPeerEphemeralPubkey() []byte {
+	if x != nil {
+		return x.PeerEphemeralPubkey
+	}
+	return nil
+}
+
+func (x *HandshakeAuth) GetNegotiatedPolicy() ServicePolicy {
+	if x != nil {
+		return x.NegotiatedPolicy
+	}
+	return ServicePolicy_POLICY_NONE
+}
+
+func (x *HandshakeAuth) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *HandshakeAuth) GetNegotiatedVersion() uint32 {
+	if x != nil {
+		return x.NegotiatedVersion
+	}
+	return 0
+}
+
+func (x *HandshakeAuth) GetNegotiatedFeatures() uint64 {
+	if x != nil {
+		return x.NegotiatedFeatures
+	}
+	return 0
+}
+
+func (x *HandshakeAuth) GetTranscriptSignature() []byte {
+	if x != nil {
+		return x.TranscriptSignature
+	}
+	return nil
+}
+
 type ChunkBatch struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	FileHash      []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
@@ -1266,7 +1839,7 @@ type ChunkBatch struct {
 
 func (x *ChunkBatch) Reset() {
 	*x = ChunkBatch{}
-	mi := &file_core_proto_msgTypes[12]
+	mi := &file_core_proto_msgTypes[16]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1278,7 +1851,7 @@ func (x *ChunkBatch) String() string {
 func (*ChunkBatch) ProtoMessage() {}
 
 func (x *ChunkBatch) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[12]
+	mi := &file_core_proto_msgTypes[16]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1291,7 +1864,7 @@ func (x *ChunkBatch) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkBatch.ProtoReflect.Descriptor instead.
 func (*ChunkBatch) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{12}
+	return file_core_proto_rawDescGZIP(), []int{16}
 }
 
 func (x *ChunkBatch) GetFileHash() []byte {
@@ -1318,7 +1891,7 @@ type ChunkData struct {
 
 func (x *ChunkData) Reset() {
 	*x = ChunkData{}
-	mi := &file_core_proto_msgTypes[13]
+	mi := &file_core_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1330,7 +1903,7 @@ func (x *ChunkData) String() string {
 func (*ChunkData) ProtoMessage() {}
 
 func (x *ChunkData) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[13]
+	mi := &file_core_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1343,7 +1916,7 @@ func (x *ChunkData) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkData.ProtoReflect.Descriptor instead.
 func (*ChunkData) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{13}
+	return file_core_proto_rawDescGZIP(), []int{17}
 }
 
 func (x *ChunkData) GetChunkIndex() uint32 {
@@ -1360,36 +1933,45 @@ func (x *ChunkData) GetData() []byte {
 	return nil
 }
 
-type Envelope struct {
-	state protoimpl.MessageState `protogen:"open.v1"`
-	// Types that are valid to be assigned to Payload:
-	//
-	//	*Envelope_Handshake
-	//	*Envelope_TransferRequest
-	//	*Envelope_ChunkBatch
-	//	*Envelope_ShareRecord
-	//	*Envelope_Gossip
-	//	*Envelope_ForkEvidence
-	Payload       isEnvelope_Payload `protobuf_oneof:"payload"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+// ChunkAck is sent by the receiver for every ChunkBatch it stores. credits is
+// the number of chunks the receiver is willing to have outstanding (sent but
+// not yet acked); the sender stops sending once that window is full.
+// rejected_indices are chunks that failed verification against FileMeta and
+// must be sent again. requester_head, when set, is the receiver's chain head
+// as of this ack and replaces the one in the request for the share record the
+// sender builds; a receiver downloading from several peers sends it on the ack
+// that completes a request, once its head is reserved for that record.
+// head_pending, on the ack that completes a request, means that head is still
+// held by another record: the sender waits for a later ack naming
+// requester_head before it builds its own. Only sent to peers advertising
+// FeatureDeferredHead.
+type ChunkAck struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	FileHash        []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
+	ChunkIndices    []uint32               `protobuf:"varint,2,rep,packed,name=chunk_indices,json=chunkIndices,proto3" json:"chunk_indices,omitempty"`
+	Credits         uint32                 `protobuf:"varint,3,opt,name=credits,proto3" json:"credits,omitempty"`
+	RejectedIndices []uint32               `protobuf:"varint,4,rep,packed,name=rejected_indices,json=rejectedIndices,proto3" json:"rejected_indices,omitempty"`
+	RequesterHead   *ChainHead             `protobuf:"bytes,5,opt,name=requester_head,json=requesterHead,proto3" json:"requester_head,omitempty"`
+	HeadPending     bool                   `protobuf:"varint,6,opt,name=head_pending,json=headPending,proto3" json:"head_pending,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
 }
 
-func (x *Envelope) Reset() {
-	*x = Envelope{}
-	mi := &file_core_proto_msgTypes[14]
+func (x *ChunkAck) Reset() {
+	*x = ChunkAck{}
+	mi := &file_core_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Envelope) String() string {
+func (x *ChunkAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Envelope) ProtoMessage() {}
+func (*ChunkAck) ProtoMessage() {}
 
-func (x *Envelope) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[14]
+func (x *ChunkAck) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1400,58 +1982,153 @@ func (x *Envelope) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
-func (*Envelope) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{14}
+// Deprecated: Use ChunkAck.ProtoReflect.Descriptor instead.
+func (*ChunkAck) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{18}
 }
 
-func (x *Envelope) GetPayload() isEnvelope_Payload {
+func (x *ChunkAck) GetFileHash() []byte {
 	if x != nil {
-		return x.Payload
+		return x.FileHash
 	}
 	return nil
 }
 
-func (x *Envelope) GetHandshake() *HandshakeMsg {
+func (x *ChunkAck) GetChunkIndices() []uint32 {
 	if x != nil {
-		if x, ok := x.Payload.(*Envelope_Handshake); ok {
-			return x.Handshake
-		}
+		return x.ChunkIndices
 	}
 	return nil
 }
 
-func (x *Envelope) GetTransferRequest() *TransferRequest {
+func (x *ChunkAck) GetCredits() uint32 {
 	if x != nil {
-		if x, ok := x.Payload.(*Envelope_TransferRequest); ok {
-			return x.TransferRequest
-		}
+		return x.Credits
 	}
-	return nil
+	return 0
 }
 
-func (x *Envelope) GetChunkBatch() *ChunkBatch {
+func (x *ChunkAck) GetRejectedIndices() []uint32 {
 	if x != nil {
-		if x, ok := x.Payload.(*Envelope_ChunkBatch); ok {
-			return x.ChunkBatch
-		}
+		return x.RejectedIndices
 	}
 	return nil
 }
 
-func (x *Envelope) GetShareRecord() *ShareRecord {
+func (x *ChunkAck) GetRequesterHead() *ChainHead {
 	if x != nil {
-		if x, ok := x.Payload.(*Envelope_ShareRecord); ok {
-			return x.ShareRecord
-		}
+		return x.RequesterHead
 	}
 	return nil
 }
 
-func (x *Envelope) GetGossip() *GossipPayload {
+func (x *ChunkAck) GetHeadPending() bool {
 	if x != nil {
-		if x, ok := x.Payload.(*Envelope_Gossip); ok {
-			return x.Gossip
+		return x.HeadPending
+	}
+	return false
+}
+
+type Envelope struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*Envelope_Handshake
+	//	*Envelope_TransferRequest
+	//	*Envelope_ChunkBatch
+	//	*Envelope_ShareRecord
+	//	*Envelope_Gossip
+	//	*Envelope_ForkEvidence
+	//	*Envelope_Sealed
+	//	*Envelope_HandshakeAuth
+	//	*Envelope_ChunkAck
+	//	*Envelope_WitnessRequest
+	//	*Envelope_WitnessResponse
+	//	*Envelope_Compressed
+	Payload isEnvelope_Payload `protobuf_oneof:"payload"`
+	// The protocol version the payload was encoded for; unset means version 1.
+	ProtocolVersion uint32 `protobuf:"varint,12,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Envelope) Reset() {
+	*x = Envelope{}
+	mi := &file_core_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Envelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Envelope) ProtoMessage() {}
+
+func (x *Envelope) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Envelope.ProtoReflect.Descriptor instead.
+func (*Envelope) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *Envelope) GetPayload() isEnvelope_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *Envelope) GetHandshake() *HandshakeMsg {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Handshake); ok {
+			return x.Handshake
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetTransferRequest() *TransferRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_TransferRequest); ok {
+			return x.TransferRequest
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetChunkBatch() *ChunkBatch {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_ChunkBatch); ok {
+			return x.ChunkBatch
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetShareRecord() *ShareRecord {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_ShareRecord); ok {
+			return x.ShareRecord
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetGossip() *GossipPayload {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Gossip); ok {
+			return x.Gossip
 		}
 	}
 	return nil
@@ -1466,6 +2143,67 @@ func (x *Envelope) GetForkEvidence() *ForkEvidence {
 	return nil
 }
 
+func (x *Envelope) GetSealed() *SealedEnvelope {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Sealed); ok {
+			return x.Sealed
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetHandshakeAuth() *HandshakeAuth {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_HandshakeAuth); ok {
+			return x.HandshakeAuth
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetChunkAck() *ChunkAck {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_ChunkAck); ok {
+			return x.ChunkAck
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetWitnessRequest() *WitnessRequest {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_WitnessRequest); ok {
+			return x.WitnessRequest
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetWitnessResponse() *WitnessResponse {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_WitnessResponse); ok {
+			return x.WitnessResponse
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetCompressed() *CompressedEnvelope {
+	if x != nil {
+		if x, ok := x.Payload.(*Envelope_Compressed); ok {
+			return x.Compressed
+		}
+	}
+	return nil
+}
+
+func (x *Envelope) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
 type isEnvelope_Payload interface {
 	isEnvelope_Payload()
 }
@@ -1494,6 +2232,30 @@ type Envelope_ForkEvidence struct {
 	ForkEvidence *ForkEvidence `protobuf:"bytes,6,opt,name=fork_evidence,json=forkEvidence,proto3,oneof"`
 }
 
+type Envelope_Sealed struct {
+	Sealed *SealedEnvelope `protobuf:"bytes,7,opt,name=sealed,proto3,oneof"`
+}
+
+type Envelope_HandshakeAuth struct {
+	HandshakeAuth *HandshakeAuth `protobuf:"bytes,8,opt,name=handshake_auth,json=handshakeAuth,proto3,oneof"`
+}
+
+type Envelope_ChunkAck struct {
+	ChunkAck *ChunkAck `protobuf:"bytes,9,opt,name=chunk_ack,json=chunkAck,proto3,oneof"`
+}
+
+type Envelope_WitnessRequest struct {
+	WitnessRequest *WitnessRequest `protobuf:"bytes,10,opt,name=witness_request,json=witnessRequest,proto3,oneof"`
+}
+
+type Envelope_WitnessResponse struct {
+	WitnessResponse *WitnessResponse `protobuf:"bytes,11,opt,name=witness_response,json=witnessResponse,proto3,oneof"`
+}
+
+type Envelope_Compressed struct {
+	Compressed *CompressedEnvelope `protobuf:"bytes,13,opt,name=compressed,proto3,oneof"`
+}
+
 func (*Envelope_Handshake) isEnvelope_Payload() {}
 
 func (*Envelope_TransferRequest) isEnvelope_Payload() {}
@@ -1506,20 +2268,218 @@ func (*Envelope_Gossip) isEnvelope_Payload() {}
 
 func (*Envelope_ForkEvidence) isEnvelope_Payload() {}
 
-type FileCapability struct {
+func (*Envelope_Sealed) isEnvelope_Payload() {}
+
+func (*Envelope_HandshakeAuth) isEnvelope_Payload() {}
+
+func (*Envelope_ChunkAck) isEnvelope_Payload() {}
+
+func (*Envelope_WitnessRequest) isEnvelope_Payload() {}
+
+func (*Envelope_WitnessResponse) isEnvelope_Payload() {}
+
+func (*Envelope_Compressed) isEnvelope_Payload() {}
+
+// CompressedEnvelope carries a marshalled Envelope compressed with algorithm.
+// It is only sent to peers that negotiated compression in the handshake, and
+// uncompressed_size bounds what the receiver inflates before it starts.
+type CompressedEnvelope struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Algorithm        Compression            `protobuf:"varint,1,opt,name=algorithm,proto3,enum=burntPeanut.Compression" json:"algorithm,omitempty"`
+	UncompressedSize uint32                 `protobuf:"varint,2,opt,name=uncompressed_size,json=uncompressedSize,proto3" json:"uncompressed_size,omitempty"`
+	Data             []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *CompressedEnvelope) Reset() {
+	*x = CompressedEnvelope{}
+	mi := &file_core_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CompressedEnvelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompressedEnvelope) ProtoMessage() {}
+
+func (x *CompressedEnvelope) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompressedEnvelope.ProtoReflect.Descriptor instead.
+func (*CompressedEnvelope) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *CompressedEnvelope) GetAlgorithm() Compression {
+	if x != nil {
+		return x.Algorithm
+	}
+	return Compression_COMPRESSION_NONE
+}
+
+func (x *CompressedEnvelope) GetUncompressedSize() uint32 {
+	if x != nil {
+		return x.UncompressedSize
+	}
+	return 0
+}
+
+func (x *CompressedEnvelope) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// SealedEnvelope carries an AEAD-encrypted Envelope once both sides have
+// exchanged ephemeral keys. counter is the sender's per-direction message
+// counter; it doubles as the AEAD nonce and is authenticated as associated data.
+type SealedEnvelope struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	FileHash      []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
-	GrantedTo     []byte                 `protobuf:"bytes,2,opt,name=granted_to,json=grantedTo,proto3" json:"granted_to,omitempty"`
-	GrantedBy     []byte                 `protobuf:"bytes,3,opt,name=granted_by,json=grantedBy,proto3" json:"granted_by,omitempty"`
-	ExpiresAt     int64                  `protobuf:"varint,4,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
-	Signature     []byte                 `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
+	Counter       uint64                 `protobuf:"varint,1,opt,name=counter,proto3" json:"counter,omitempty"`
+	Ciphertext    []byte                 `protobuf:"bytes,2,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SealedEnvelope) Reset() {
+	*x = SealedEnvelope{}
+	mi := &file_core_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SealedEnvelope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SealedEnvelope) ProtoMessage() {}
+
+func (x *SealedEnvelope) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SealedEnvelope.ProtoReflect.Descriptor instead.
+func (*SealedEnvelope) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *SealedEnvelope) GetCounter() uint64 {
+	if x != nil {
+		return x.Counter
+	}
+	return 0
+}
+
+func (x *SealedEnvelope) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+// ChunkRange covers chunk indices start up to but not including end.
+type ChunkRange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Start         uint32                 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	End           uint32                 `protobuf:"varint,2,opt,name=end,proto3" json:"end,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChunkRange) Reset() {
+	*x = ChunkRange{}
+	mi := &file_core_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChunkRange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkRange) ProtoMessage() {}
+
+func (x *ChunkRange) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkRange.ProtoReflect.Descriptor instead.
+func (*ChunkRange) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *ChunkRange) GetStart() uint32 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *ChunkRange) GetEnd() uint32 {
+	if x != nil {
+		return x.End
+	}
+	return 0
+}
+
+// A capability with a parent was re-granted by the parent's grantee. It must be
+// for the same file and may not outlive its parent; the signature then also
+// covers the parent's signature.
+type FileCapability struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	FileHash  []byte                 `protobuf:"bytes,1,opt,name=file_hash,json=fileHash,proto3" json:"file_hash,omitempty"`
+	GrantedTo []byte                 `protobuf:"bytes,2,opt,name=granted_to,json=grantedTo,proto3" json:"granted_to,omitempty"`
+	GrantedBy []byte                 `protobuf:"bytes,3,opt,name=granted_by,json=grantedBy,proto3" json:"granted_by,omitempty"`
+	ExpiresAt int64                  `protobuf:"varint,4,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	Signature []byte                 `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
+	Parent    *FileCapability        `protobuf:"bytes,6,opt,name=parent,proto3" json:"parent,omitempty"`
+	// Optional limits; empty or zero means unlimited. Each link of a delegation
+	// chain is held to its own limits, and the serving device counts
+	// redemptions against every link.
+	ChunkRanges    []*ChunkRange `protobuf:"bytes,7,rep,name=chunk_ranges,json=chunkRanges,proto3" json:"chunk_ranges,omitempty"`
+	MaxDownloads   uint32        `protobuf:"varint,8,opt,name=max_downloads,json=maxDownloads,proto3" json:"max_downloads,omitempty"`
+	MaxBytes       uint64        `protobuf:"varint,9,opt,name=max_bytes,json=maxBytes,proto3" json:"max_bytes,omitempty"`
+	SigningVersion uint32        `protobuf:"varint,10,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	// The file's metadata, for a grantee that was never gossiped a private file.
+	// It is not covered by the signature: it must match file_hash and carry a
+	// valid origin signature. Holders drop it before presenting the capability.
+	FileMeta      *FileMeta `protobuf:"bytes,11,opt,name=file_meta,json=fileMeta,proto3" json:"file_meta,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *FileCapability) Reset() {
 	*x = FileCapability{}
-	mi := &file_core_proto_msgTypes[15]
+	mi := &file_core_proto_msgTypes[23]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -1531,7 +2491,7 @@ func (x *FileCapability) String() string {
 func (*FileCapability) ProtoMessage() {}
 
 func (x *FileCapability) ProtoReflect() protoreflect.Message {
-	mi := &file_core_proto_msgTypes[15]
+	mi := &file_core_proto_msgTypes[23]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1544,7 +2504,7 @@ func (x *FileCapability) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileCapability.ProtoReflect.Descriptor instead.
 func (*FileCapability) Descriptor() ([]byte, []int) {
-	return file_core_proto_rawDescGZIP(), []int{15}
+	return file_core_proto_rawDescGZIP(), []int{23}
 }
 
 func (x *FileCapability) GetFileHash() []byte {
@@ -1582,12 +2542,232 @@ func (x *FileCapability) GetSignature() []byte {
 	return nil
 }
 
+func (x *FileCapability) GetParent() *FileCapability {
+	if x != nil {
+		return x.Parent
+	}
+	return nil
+}
+
+func (x *FileCapability) GetChunkRanges() []*ChunkRange {
+	if x != nil {
+		return x.ChunkRanges
+	}
+	return nil
+}
+
+func (x *FileCapability) GetMaxDownloads() uint32 {
+	if x != nil {
+		return x.MaxDownloads
+	}
+	return 0
+}
+
+func (x *FileCapability) GetMaxBytes() uint64 {
+	if x != nil {
+		return x.MaxBytes
+	}
+	return 0
+}
+
+func (x *FileCapability) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
+func (x *FileCapability) GetFileMeta() *FileMeta {
+	if x != nil {
+		return x.FileMeta
+	}
+	return nil
+}
+
+// CapabilityRevocation withdraws a capability and everything delegated from it.
+// It is only honoured when revoked_by granted the capability or one of its
+// ancestors.
+type CapabilityRevocation struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	CapabilityId   []byte                 `protobuf:"bytes,1,opt,name=capability_id,json=capabilityId,proto3" json:"capability_id,omitempty"`
+	RevokedBy      []byte                 `protobuf:"bytes,2,opt,name=revoked_by,json=revokedBy,proto3" json:"revoked_by,omitempty"`
+	RevokedAt      int64                  `protobuf:"varint,3,opt,name=revoked_at,json=revokedAt,proto3" json:"revoked_at,omitempty"`
+	Signature      []byte                 `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	SigningVersion uint32                 `protobuf:"varint,5,opt,name=signing_version,json=signingVersion,proto3" json:"signing_version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *CapabilityRevocation) Reset() {
+	*x = CapabilityRevocation{}
+	mi := &file_core_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CapabilityRevocation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CapabilityRevocation) ProtoMessage() {}
+
+func (x *CapabilityRevocation) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CapabilityRevocation.ProtoReflect.Descriptor instead.
+func (*CapabilityRevocation) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *CapabilityRevocation) GetCapabilityId() []byte {
+	if x != nil {
+		return x.CapabilityId
+	}
+	return nil
+}
+
+func (x *CapabilityRevocation) GetRevokedBy() []byte {
+	if x != nil {
+		return x.RevokedBy
+	}
+	return nil
+}
+
+func (x *CapabilityRevocation) GetRevokedAt() int64 {
+	if x != nil {
+		return x.RevokedAt
+	}
+	return 0
+}
+
+func (x *CapabilityRevocation) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *CapabilityRevocation) GetSigningVersion() uint32 {
+	if x != nil {
+		return x.SigningVersion
+	}
+	return 0
+}
+
+// WitnessRequest asks a connected peer to co-sign the sender's checkpoint.
+type WitnessRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Checkpoint    *Checkpoint            `protobuf:"bytes,1,opt,name=checkpoint,proto3" json:"checkpoint,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WitnessRequest) Reset() {
+	*x = WitnessRequest{}
+	mi := &file_core_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WitnessRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WitnessRequest) ProtoMessage() {}
+
+func (x *WitnessRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WitnessRequest.ProtoReflect.Descriptor instead.
+func (*WitnessRequest) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *WitnessRequest) GetCheckpoint() *Checkpoint {
+	if x != nil {
+		return x.Checkpoint
+	}
+	return nil
+}
+
+// WitnessResponse returns the witness signature for the checkpoint whose
+// device_sig is checkpoint_sig.
+type WitnessResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CheckpointSig []byte                 `protobuf:"bytes,1,opt,name=checkpoint_sig,json=checkpointSig,proto3" json:"checkpoint_sig,omitempty"`
+	Witness       *CheckpointWitness     `protobuf:"bytes,2,opt,name=witness,proto3" json:"witness,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WitnessResponse) Reset() {
+	*x = WitnessResponse{}
+	mi := &file_core_proto_msgTypes[26]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WitnessResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WitnessResponse) ProtoMessage() {}
+
+func (x *WitnessResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_core_proto_msgTypes[26]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WitnessResponse.ProtoReflect.Descriptor instead.
+func (*WitnessResponse) Descriptor() ([]byte, []int) {
+	return file_core_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *WitnessResponse) GetCheckpointSig() []byte {
+	if x != nil {
+		return x.CheckpointSig
+	}
+	return nil
+}
+
+func (x *WitnessResponse) GetWitness() *CheckpointWitness {
+	if x != nil {
+		return x.Witness
+	}
+	return nil
+}
+
 var File_core_proto protoreflect.FileDescriptor
 
 const file_core_proto_rawDesc = "" +
 	"\n" +
 	"\n" +
-	"core.proto\x12\vburntPeanut\"\xbe\x05\n" +
+	"core.proto\x12\vburntPeanut\"\xe7\x05\n" +
 	"\vShareRecord\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\fR\x02id\x12#\n" +
 	"\rsender_pubkey\x18\x02 \x01(\fR\fsenderPubkey\x12'\n" +
@@ -1611,17 +2791,27 @@ const file_core_proto_rawDesc = "" +
 	"\tfile_hash\x18\x10 \x01(\fR\bfileHash\x127\n" +
 	"\n" +
 	"visibility\x18\x11 \x01(\x0e2\x17.burntPeanut.VisibilityR\n" +
-	"visibility\"l\n" +
+	"visibility\x12'\n" +
+	"\x0fsigning_version\x18\x12 \x01(\rR\x0esigningVersion\"l\n" +
 	"\x10CumulativeTotals\x12'\n" +
 	"\x0fcumulative_sent\x18\x01 \x01(\x04R\x0ecumulativeSent\x12/\n" +
-	"\x13cumulative_received\x18\x02 \x01(\x04R\x12cumulativeReceived\"\xd0\x01\n" +
+	"\x13cumulative_received\x18\x02 \x01(\x04R\x12cumulativeReceived\"u\n" +
+	"\tChainHead\x12\x1b\n" +
+	"\trecord_id\x18\x01 \x01(\fR\brecordId\x12\x14\n" +
+	"\x05index\x18\x02 \x01(\x04R\x05index\x125\n" +
+	"\x06totals\x18\x03 \x01(\v2\x1d.burntPeanut.CumulativeTotalsR\x06totals\"\xf5\x02\n" +
 	"\x0fTransferRequest\x12)\n" +
 	"\x10requester_pubkey\x18\x01 \x01(\fR\x0frequesterPubkey\x12\x1b\n" +
 	"\tfile_hash\x18\x02 \x01(\fR\bfileHash\x12#\n" +
 	"\rchunk_indices\x18\x03 \x03(\rR\fchunkIndices\x12\x14\n" +
 	"\x05nonce\x18\x04 \x01(\fR\x05nonce\x12\x1c\n" +
 	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\x12\x1c\n" +
-	"\tsignature\x18\x06 \x01(\fR\tsignature\"\x86\x02\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\x12=\n" +
+	"\x0erequester_head\x18\a \x01(\v2\x16.burntPeanut.ChainHeadR\rrequesterHead\x12;\n" +
+	"\n" +
+	"capability\x18\b \x01(\v2\x1b.burntPeanut.FileCapabilityR\n" +
+	"capability\x12'\n" +
+	"\x0fsigning_version\x18\t \x01(\rR\x0esigningVersion\"\xaf\x02\n" +
 	"\bFileMeta\x12\x1b\n" +
 	"\tfile_hash\x18\x01 \x01(\fR\bfileHash\x12\x1b\n" +
 	"\tfile_name\x18\x02 \x01(\tR\bfileName\x12\x1b\n" +
@@ -1633,7 +2823,8 @@ const file_core_proto_rawDesc = "" +
 	"\n" +
 	"origin_sig\x18\a \x01(\fR\toriginSig\x12\x1d\n" +
 	"\n" +
-	"created_at\x18\b \x01(\x03R\tcreatedAt\"\x84\x03\n" +
+	"created_at\x18\b \x01(\x03R\tcreatedAt\x12'\n" +
+	"\x0fsigning_version\x18\t \x01(\rR\x0esigningVersion\"\xad\x03\n" +
 	"\n" +
 	"Checkpoint\x12#\n" +
 	"\rdevice_pubkey\x18\x01 \x01(\fR\fdevicePubkey\x12\x1d\n" +
@@ -1649,12 +2840,15 @@ const file_core_proto_rawDesc = "" +
 	"\twitnesses\x18\b \x03(\v2\x1e.burntPeanut.CheckpointWitnessR\twitnesses\x12<\n" +
 	"\n" +
 	"confidence\x18\t \x01(\x0e2\x1c.burntPeanut.ConfidenceLevelR\n" +
-	"confidence\"\x88\x01\n" +
+	"confidence\x12'\n" +
+	"\x0fsigning_version\x18\n" +
+	" \x01(\rR\x0esigningVersion\"\xb1\x01\n" +
 	"\x11CheckpointWitness\x12%\n" +
 	"\x0ewitness_pubkey\x18\x01 \x01(\fR\rwitnessPubkey\x12\x1f\n" +
 	"\vwitness_sig\x18\x02 \x01(\fR\n" +
 	"witnessSig\x12+\n" +
-	"\x11encounter_cluster\x18\x03 \x01(\tR\x10encounterCluster\"\x8a\x02\n" +
+	"\x11encounter_cluster\x18\x03 \x01(\tR\x10encounterCluster\x12'\n" +
+	"\x0fsigning_version\x18\x04 \x01(\rR\x0esigningVersion\"\xc8\x03\n" +
 	"\fForkEvidence\x12#\n" +
 	"\rdevice_pubkey\x18\x01 \x01(\fR\fdevicePubkey\x123\n" +
 	"\brecord_a\x18\x02 \x01(\v2\x18.burntPeanut.ShareRecordR\arecordA\x123\n" +
@@ -1662,7 +2856,22 @@ const file_core_proto_rawDesc = "" +
 	"\x0freporter_pubkey\x18\x04 \x01(\fR\x0ereporterPubkey\x12!\n" +
 	"\freporter_sig\x18\x05 \x01(\fR\vreporterSig\x12\x1f\n" +
 	"\vdetected_at\x18\x06 \x01(\x03R\n" +
-	"detectedAt\"\xb5\x02\n" +
+	"detectedAt\x12=\n" +
+	"\n" +
+	"succession\x18\a \x01(\v2\x1d.burntPeanut.SuccessionRecordR\n" +
+	"succession\x12'\n" +
+	"\x0fsigning_version\x18\b \x01(\rR\x0esigningVersion\x12T\n" +
+	"\x16conflicting_succession\x18\t \x01(\v2\x1d.burntPeanut.SuccessionRecordR\x15conflictingSuccession\"\xec\x01\n" +
+	"\x10SuccessionRecord\x12\x1d\n" +
+	"\n" +
+	"old_pubkey\x18\x01 \x01(\fR\toldPubkey\x12\x1d\n" +
+	"\n" +
+	"new_pubkey\x18\x02 \x01(\fR\tnewPubkey\x12\x1c\n" +
+	"\ttimestamp\x18\x03 \x01(\x03R\ttimestamp\x125\n" +
+	"\n" +
+	"final_head\x18\x04 \x01(\v2\x16.burntPeanut.ChainHeadR\tfinalHead\x12\x1c\n" +
+	"\tsignature\x18\x05 \x01(\fR\tsignature\x12'\n" +
+	"\x0fsigning_version\x18\x06 \x01(\rR\x0esigningVersion\"\xda\x02\n" +
 	"\aBalance\x12#\n" +
 	"\rdevice_pubkey\x18\x01 \x01(\fR\fdevicePubkey\x12%\n" +
 	"\x0edrip_allowance\x18\x02 \x01(\x03R\rdripAllowance\x12:\n" +
@@ -1671,7 +2880,8 @@ const file_core_proto_rawDesc = "" +
 	"\rdecay_penalty\x18\x05 \x01(\x03R\fdecayPenalty\x12+\n" +
 	"\x11effective_balance\x18\x06 \x01(\x03R\x10effectiveBalance\x12\x1f\n" +
 	"\vcomputed_at\x18\a \x01(\x03R\n" +
-	"computedAt\"\xe0\x01\n" +
+	"computedAt\x12#\n" +
+	"\rcap_reduction\x18\b \x01(\x03R\fcapReduction\"\xe0\x01\n" +
 	"\fCreditParams\x12\x1b\n" +
 	"\tdrip_rate\x18\x01 \x01(\x03R\bdripRate\x12\x1f\n" +
 	"\vmax_balance\x18\x02 \x01(\x03R\n" +
@@ -1681,7 +2891,16 @@ const file_core_proto_rawDesc = "" +
 	"\x11half_life_seconds\x18\x04 \x01(\x03R\x0fhalfLifeSeconds\x12 \n" +
 	"\fper_peer_cap\x18\x05 \x01(\x03R\n" +
 	"perPeerCap\x12#\n" +
-	"\repoch_seconds\x18\x06 \x01(\x03R\fepochSeconds\"\x8b\x02\n" +
+	"\repoch_seconds\x18\x06 \x01(\x03R\fepochSeconds\"\x84\x02\n" +
+	"\rNetworkParams\x12\x1d\n" +
+	"\n" +
+	"network_id\x18\x01 \x01(\tR\tnetworkId\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\rR\aversion\x121\n" +
+	"\x06credit\x18\x03 \x01(\v2\x19.burntPeanut.CreditParamsR\x06credit\x12#\n" +
+	"\rissuer_pubkey\x18\x04 \x01(\fR\fissuerPubkey\x12\x1b\n" +
+	"\tissued_at\x18\x05 \x01(\x03R\bissuedAt\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\x12'\n" +
+	"\x0fsigning_version\x18\a \x01(\rR\x0esigningVersion\"\x8b\x02\n" +
 	"\bPeerInfo\x12\x16\n" +
 	"\x06pubkey\x18\x01 \x01(\fR\x06pubkey\x12\x1d\n" +
 	"\n" +
@@ -1690,13 +2909,15 @@ const file_core_proto_rawDesc = "" +
 	"\x06totals\x18\x04 \x01(\v2\x1d.burntPeanut.CumulativeTotalsR\x06totals\x12\x1b\n" +
 	"\tlast_seen\x18\x05 \x01(\x03R\blastSeen\x12*\n" +
 	"\x11has_fork_evidence\x18\x06 \x01(\bR\x0fhasForkEvidence\x12%\n" +
-	"\x0etransport_type\x18\a \x01(\tR\rtransportType\"\xc9\x02\n" +
+	"\x0etransport_type\x18\a \x01(\tR\rtransportType\"\xcf\x03\n" +
 	"\rGossipPayload\x128\n" +
 	"\fself_summary\x18\x01 \x01(\v2\x15.burntPeanut.PeerInfoR\vselfSummary\x12<\n" +
 	"\x0epeer_summaries\x18\x02 \x03(\v2\x15.burntPeanut.PeerInfoR\rpeerSummaries\x12>\n" +
 	"\rfork_evidence\x18\x03 \x03(\v2\x19.burntPeanut.ForkEvidenceR\fforkEvidence\x12:\n" +
 	"\rseeding_files\x18\x04 \x03(\v2\x15.burntPeanut.FileMetaR\fseedingFiles\x12D\n" +
-	"\x11latest_checkpoint\x18\x05 \x01(\v2\x17.burntPeanut.CheckpointR\x10latestCheckpoint\"\xcf\x02\n" +
+	"\x11latest_checkpoint\x18\x05 \x01(\v2\x17.burntPeanut.CheckpointR\x10latestCheckpoint\x12C\n" +
+	"\vrevocations\x18\x06 \x03(\v2!.burntPeanut.CapabilityRevocationR\vrevocations\x12?\n" +
+	"\vsuccessions\x18\a \x03(\v2\x1d.burntPeanut.SuccessionRecordR\vsuccessions\"\xcc\x04\n" +
 	"\fHandshakeMsg\x12\x1d\n" +
 	"\n" +
 	"session_id\x18\x01 \x01(\fR\tsessionId\x12)\n" +
@@ -1704,7 +2925,24 @@ const file_core_proto_rawDesc = "" +
 	"\x0fidentity_pubkey\x18\x03 \x01(\fR\x0eidentityPubkey\x122\n" +
 	"\x06policy\x18\x04 \x01(\x0e2\x1a.burntPeanut.ServicePolicyR\x06policy\x12D\n" +
 	"\x11latest_checkpoint\x18\x05 \x01(\v2\x17.burntPeanut.CheckpointR\x10latestCheckpoint\x12R\n" +
-	"\x18records_since_checkpoint\x18\x06 \x03(\v2\x18.burntPeanut.ShareRecordR\x16recordsSinceCheckpoint\"Y\n" +
+	"\x18records_since_checkpoint\x18\x06 \x03(\v2\x18.burntPeanut.ShareRecordR\x16recordsSinceCheckpoint\x12?\n" +
+	"\vsuccessions\x18\a \x03(\v2\x1d.burntPeanut.SuccessionRecordR\vsuccessions\x12A\n" +
+	"\x0enetwork_params\x18\b \x01(\v2\x1a.burntPeanut.NetworkParamsR\rnetworkParams\x12)\n" +
+	"\x10protocol_version\x18\t \x01(\rR\x0fprotocolVersion\x120\n" +
+	"\x14min_protocol_version\x18\n" +
+	" \x01(\rR\x12minProtocolVersion\x12\x1a\n" +
+	"\bfeatures\x18\v \x01(\x04R\bfeatures\"\xb0\x03\n" +
+	"\rHandshakeAuth\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\fR\tsessionId\x12'\n" +
+	"\x0fidentity_pubkey\x18\x02 \x01(\fR\x0eidentityPubkey\x12)\n" +
+	"\x10ephemeral_pubkey\x18\x03 \x01(\fR\x0fephemeralPubkey\x122\n" +
+	"\x15peer_ephemeral_pubkey\x18\x04 \x01(\fR\x13peerEphemeralPubkey\x12G\n" +
+	"\x11negotiated_policy\x18\x05 \x01(\x0e2\x1a.burntPeanut.ServicePolicyR\x10negotiatedPolicy\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\x12-\n" +
+	"\x12negotiated_version\x18\a \x01(\rR\x11negotiatedVersion\x12/\n" +
+	"\x13negotiated_features\x18\b \x01(\x04R\x12negotiatedFeatures\x121\n" +
+	"\x14transcript_signature\x18\t \x01(\fR\x13transcriptSignature\"Y\n" +
 	"\n" +
 	"ChunkBatch\x12\x1b\n" +
 	"\tfile_hash\x18\x01 \x01(\fR\bfileHash\x12.\n" +
@@ -1712,7 +2950,14 @@ const file_core_proto_rawDesc = "" +
 	"\tChunkData\x12\x1f\n" +
 	"\vchunk_index\x18\x01 \x01(\rR\n" +
 	"chunkIndex\x12\x12\n" +
-	"\x04data\x18\x02 \x01(\fR\x04data\"\x8e\x03\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\"\xf3\x01\n" +
+	"\bChunkAck\x12\x1b\n" +
+	"\tfile_hash\x18\x01 \x01(\fR\bfileHash\x12#\n" +
+	"\rchunk_indices\x18\x02 \x03(\rR\fchunkIndices\x12\x18\n" +
+	"\acredits\x18\x03 \x01(\rR\acredits\x12)\n" +
+	"\x10rejected_indices\x18\x04 \x03(\rR\x0frejectedIndices\x12=\n" +
+	"\x0erequester_head\x18\x05 \x01(\v2\x16.burntPeanut.ChainHeadR\rrequesterHead\x12!\n" +
+	"\fhead_pending\x18\x06 \x01(\bR\vheadPending\"\xc1\x06\n" +
 	"\bEnvelope\x129\n" +
 	"\thandshake\x18\x01 \x01(\v2\x19.burntPeanut.HandshakeMsgH\x00R\thandshake\x12I\n" +
 	"\x10transfer_request\x18\x02 \x01(\v2\x1c.burntPeanut.TransferRequestH\x00R\x0ftransferRequest\x12:\n" +
@@ -1720,8 +2965,31 @@ const file_core_proto_rawDesc = "" +
 	"chunkBatch\x12=\n" +
 	"\fshare_record\x18\x04 \x01(\v2\x18.burntPeanut.ShareRecordH\x00R\vshareRecord\x124\n" +
 	"\x06gossip\x18\x05 \x01(\v2\x1a.burntPeanut.GossipPayloadH\x00R\x06gossip\x12@\n" +
-	"\rfork_evidence\x18\x06 \x01(\v2\x19.burntPeanut.ForkEvidenceH\x00R\fforkEvidenceB\t\n" +
-	"\apayload\"\xa8\x01\n" +
+	"\rfork_evidence\x18\x06 \x01(\v2\x19.burntPeanut.ForkEvidenceH\x00R\fforkEvidence\x125\n" +
+	"\x06sealed\x18\a \x01(\v2\x1b.burntPeanut.SealedEnvelopeH\x00R\x06sealed\x12C\n" +
+	"\x0ehandshake_auth\x18\b \x01(\v2\x1a.burntPeanut.HandshakeAuthH\x00R\rhandshakeAuth\x124\n" +
+	"\tchunk_ack\x18\t \x01(\v2\x15.burntPeanut.ChunkAckH\x00R\bchunkAck\x12F\n" +
+	"\x0fwitness_request\x18\n" +
+	" \x01(\v2\x1b.burntPeanut.WitnessRequestH\x00R\x0ewitnessRequest\x12I\n" +
+	"\x10witness_response\x18\v \x01(\v2\x1c.burntPeanut.WitnessResponseH\x00R\x0fwitnessResponse\x12A\n" +
+	"\n" +
+	"compressed\x18\r \x01(\v2\x1f.burntPeanut.CompressedEnvelopeH\x00R\n" +
+	"compressed\x12)\n" +
+	"\x10protocol_version\x18\f \x01(\rR\x0fprotocolVersionB\t\n" +
+	"\apayload\"\x8d\x01\n" +
+	"\x12CompressedEnvelope\x126\n" +
+	"\talgorithm\x18\x01 \x01(\x0e2\x18.burntPeanut.CompressionR\talgorithm\x12+\n" +
+	"\x11uncompressed_size\x18\x02 \x01(\rR\x10uncompressedSize\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"J\n" +
+	"\x0eSealedEnvelope\x12\x18\n" +
+	"\acounter\x18\x01 \x01(\x04R\acounter\x12\x1e\n" +
+	"\n" +
+	"ciphertext\x18\x02 \x01(\fR\n" +
+	"ciphertext\"4\n" +
+	"\n" +
+	"ChunkRange\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\rR\x05start\x12\x10\n" +
+	"\x03end\x18\x02 \x01(\rR\x03end\"\xb8\x03\n" +
 	"\x0eFileCapability\x12\x1b\n" +
 	"\tfile_hash\x18\x01 \x01(\fR\bfileHash\x12\x1d\n" +
 	"\n" +
@@ -1730,7 +2998,29 @@ const file_core_proto_rawDesc = "" +
 	"granted_by\x18\x03 \x01(\fR\tgrantedBy\x12\x1d\n" +
 	"\n" +
 	"expires_at\x18\x04 \x01(\x03R\texpiresAt\x12\x1c\n" +
-	"\tsignature\x18\x05 \x01(\fR\tsignature*;\n" +
+	"\tsignature\x18\x05 \x01(\fR\tsignature\x123\n" +
+	"\x06parent\x18\x06 \x01(\v2\x1b.burntPeanut.FileCapabilityR\x06parent\x12:\n" +
+	"\fchunk_ranges\x18\a \x03(\v2\x17.burntPeanut.ChunkRangeR\vchunkRanges\x12#\n" +
+	"\rmax_downloads\x18\b \x01(\rR\fmaxDownloads\x12\x1b\n" +
+	"\tmax_bytes\x18\t \x01(\x04R\bmaxBytes\x12'\n" +
+	"\x0fsigning_version\x18\n" +
+	" \x01(\rR\x0esigningVersion\x122\n" +
+	"\tfile_meta\x18\v \x01(\v2\x15.burntPeanut.FileMetaR\bfileMeta\"\xc0\x01\n" +
+	"\x14CapabilityRevocation\x12#\n" +
+	"\rcapability_id\x18\x01 \x01(\fR\fcapabilityId\x12\x1d\n" +
+	"\n" +
+	"revoked_by\x18\x02 \x01(\fR\trevokedBy\x12\x1d\n" +
+	"\n" +
+	"revoked_at\x18\x03 \x01(\x03R\trevokedAt\x12\x1c\n" +
+	"\tsignature\x18\x04 \x01(\fR\tsignature\x12'\n" +
+	"\x0fsigning_version\x18\x05 \x01(\rR\x0esigningVersion\"I\n" +
+	"\x0eWitnessRequest\x127\n" +
+	"\n" +
+	"checkpoint\x18\x01 \x01(\v2\x17.burntPeanut.CheckpointR\n" +
+	"checkpoint\"r\n" +
+	"\x0fWitnessResponse\x12%\n" +
+	"\x0echeckpoint_sig\x18\x01 \x01(\fR\rcheckpointSig\x128\n" +
+	"\awitness\x18\x02 \x01(\v2\x1e.burntPeanut.CheckpointWitnessR\awitness*;\n" +
 	"\n" +
 	"Visibility\x12\x15\n" +
 	"\x11VISIBILITY_PUBLIC\x10\x00\x12\x16\n" +
@@ -1742,7 +3032,10 @@ const file_core_proto_rawDesc = "" +
 	"\rServicePolicy\x12\x0f\n" +
 	"\vPOLICY_NONE\x10\x00\x12\x10\n" +
 	"\fPOLICY_LIGHT\x10\x01\x12\x11\n" +
-	"\rPOLICY_STRICT\x10\x02B@Z>github.com/nyshthefantastic/burnt-peanut-network-core/wire/genb\x06proto3"
+	"\rPOLICY_STRICT\x10\x02*<\n" +
+	"\vCompression\x12\x14\n" +
+	"\x10COMPRESSION_NONE\x10\x00\x12\x17\n" +
+	"\x13COMPRESSION_DEFLATE\x10\x01B@Z>github.com/nyshthefantastic/burnt-peanut-network-core/wire/genb\x06proto3"
 
 var (
 	file_core_proto_rawDescOnce sync.Once
@@ -1756,59 +3049,96 @@ func file_core_proto_rawDescGZIP() []byte {
 	return file_core_proto_rawDescData
 }
 
-var file_core_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
-var file_core_proto_msgTypes = make([]protoimpl.MessageInfo, 16)
+var file_core_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_core_proto_msgTypes = make([]protoimpl.MessageInfo, 27)
 var file_core_proto_goTypes = []any{
-	(Visibility)(0),           // 0: burntPeanut.Visibility
-	(ConfidenceLevel)(0),      // 1: burntPeanut.ConfidenceLevel
-	(ServicePolicy)(0),        // 2: burntPeanut.ServicePolicy
-	(*ShareRecord)(nil),       // 3: burntPeanut.ShareRecord
-	(*CumulativeTotals)(nil),  // 4: burntPeanut.CumulativeTotals
-	(*TransferRequest)(nil),   // 5: burntPeanut.TransferRequest
-	(*FileMeta)(nil),          // 6: burntPeanut.FileMeta
-	(*Checkpoint)(nil),        // 7: burntPeanut.Checkpoint
-	(*CheckpointWitness)(nil), // 8: burntPeanut.CheckpointWitness
-	(*ForkEvidence)(nil),      // 9: burntPeanut.ForkEvidence
-	(*Balance)(nil),           // 10: burntPeanut.Balance
-	(*CreditParams)(nil),      // 11: burntPeanut.CreditParams
-	(*PeerInfo)(nil),          // 12: burntPeanut.PeerInfo
-	(*GossipPayload)(nil),     // 13: burntPeanut.GossipPayload
-	(*HandshakeMsg)(nil),      // 14: burntPeanut.HandshakeMsg
-	(*ChunkBatch)(nil),        // 15: burntPeanut.ChunkBatch
-	(*ChunkData)(nil),         // 16: burntPeanut.ChunkData
-	(*Envelope)(nil),          // 17: burntPeanut.Envelope
-	(*FileCapability)(nil),    // 18: burntPeanut.FileCapability
+	(Visibility)(0),              // 0: burntPeanut.Visibility
+	(ConfidenceLevel)(0),         // 1: burntPeanut.ConfidenceLevel
+	(ServicePolicy)(0),           // 2: burntPeanut.ServicePolicy
+	(Compression)(0),             // 3: burntPeanut.Compression
+	(*ShareRecord)(nil),          // 4: burntPeanut.ShareRecord
+	(*CumulativeTotals)(nil),     // 5: burntPeanut.CumulativeTotals
+	(*ChainHead)(nil),            // 6: burntPeanut.ChainHead
+	(*TransferRequest)(nil),      // 7: burntPeanut.TransferRequest
+	(*FileMeta)(nil),             // 8: burntPeanut.FileMeta
+	(*Checkpoint)(nil),           // 9: burntPeanut.Checkpoint
+	(*CheckpointWitness)(nil),    // 10: burntPeanut.CheckpointWitness
+	(*ForkEvidence)(nil),         // 11: burntPeanut.ForkEvidence
+	(*SuccessionRecord)(nil),     // 12: burntPeanut.SuccessionRecord
+	(*Balance)(nil),              // 13: burntPeanut.Balance
+	(*CreditParams)(nil),         // 14: burntPeanut.CreditParams
+	(*NetworkParams)(nil),        // 15: burntPeanut.NetworkParams
+	(*PeerInfo)(nil),             // 16: burntPeanut.PeerInfo
+	(*GossipPayload)(nil),        // 17: burntPeanut.GossipPayload
+	(*HandshakeMsg)(nil),         // 18: burntPeanut.HandshakeMsg
+	(*HandshakeAuth)(nil),        // 19: burntPeanut.HandshakeAuth
+	(*ChunkBatch)(nil),           // 20: burntPeanut.ChunkBatch
+	(*ChunkData)(nil),            // 21: burntPeanut.ChunkData
+	(*ChunkAck)(nil),             // 22: burntPeanut.ChunkAck
+	(*Envelope)(nil),             // 23: burntPeanut.Envelope
+	(*CompressedEnvelope)(nil),   // 24: burntPeanut.CompressedEnvelope
+	(*SealedEnvelope)(nil),       // 25: burntPeanut.SealedEnvelope
+	(*ChunkRange)(nil),           // 26: burntPeanut.ChunkRange
+	(*FileCapability)(nil),       // 27: burntPeanut.FileCapability
+	(*CapabilityRevocation)(nil), // 28: burntPeanut.CapabilityRevocation
+	(*WitnessRequest)(nil),       // 29: burntPeanut.WitnessRequest
+	(*WitnessResponse)(nil),      // 30: burntPeanut.WitnessResponse
 }
 var file_core_proto_depIdxs = []int32{
-	4,  // 0: burntPeanut.ShareRecord.sender_totals:type_name -> burntPeanut.CumulativeTotals
-	4,  // 1: burntPeanut.ShareRecord.receiver_totals:type_name -> burntPeanut.CumulativeTotals
+	5,  // 0: burntPeanut.ShareRecord.sender_totals:type_name -> burntPeanut.CumulativeTotals
+	5,  // 1: burntPeanut.ShareRecord.receiver_totals:type_name -> burntPeanut.CumulativeTotals
 	0,  // 2: burntPeanut.ShareRecord.visibility:type_name -> burntPeanut.Visibility
-	4,  // 3: burntPeanut.Checkpoint.totals:type_name -> burntPeanut.CumulativeTotals
-	8,  // 4: burntPeanut.Checkpoint.witnesses:type_name -> burntPeanut.CheckpointWitness
-	1,  // 5: burntPeanut.Checkpoint.confidence:type_name -> burntPeanut.ConfidenceLevel
-	3,  // 6: burntPeanut.ForkEvidence.record_a:type_name -> burntPeanut.ShareRecord
-	3,  // 7: burntPeanut.ForkEvidence.record_b:type_name -> burntPeanut.ShareRecord
-	4,  // 8: burntPeanut.PeerInfo.totals:type_name -> burntPeanut.CumulativeTotals
-	12, // 9: burntPeanut.GossipPayload.self_summary:type_name -> burntPeanut.PeerInfo
-	12, // 10: burntPeanut.GossipPayload.peer_summaries:type_name -> burntPeanut.PeerInfo
-	9,  // 11: burntPeanut.GossipPayload.fork_evidence:type_name -> burntPeanut.ForkEvidence
-	6,  // 12: burntPeanut.GossipPayload.seeding_files:type_name -> burntPeanut.FileMeta
-	7,  // 13: burntPeanut.GossipPayload.latest_checkpoint:type_name -> burntPeanut.Checkpoint
-	2,  // 14: burntPeanut.HandshakeMsg.policy:type_name -> burntPeanut.ServicePolicy
-	7,  // 15: burntPeanut.HandshakeMsg.latest_checkpoint:type_name -> burntPeanut.Checkpoint
-	3,  // 16: burntPeanut.HandshakeMsg.records_since_checkpoint:type_name -> burntPeanut.ShareRecord
-	16, // 17: burntPeanut.ChunkBatch.chunks:type_name -> burntPeanut.ChunkData
-	14, // 18: burntPeanut.Envelope.handshake:type_name -> burntPeanut.HandshakeMsg
-	5,  // 19: burntPeanut.Envelope.transfer_request:type_name -> burntPeanut.TransferRequest
-	15, // 20: burntPeanut.Envelope.chunk_batch:type_name -> burntPeanut.ChunkBatch
-	3,  // 21: burntPeanut.Envelope.share_record:type_name -> burntPeanut.ShareRecord
-	13, // 22: burntPeanut.Envelope.gossip:type_name -> burntPeanut.GossipPayload
-	9,  // 23: burntPeanut.Envelope.fork_evidence:type_name -> burntPeanut.ForkEvidence
-	24, // [24:24] is the sub-list for method output_type
-	24, // [24:24] is the sub-list for method input_type
-	24, // [24:24] is the sub-list for extension type_name
-	24, // [24:24] is the sub-list for extension extendee
-	0,  // [0:24] is the sub-list for field type_name
+	5,  // 3: burntPeanut.ChainHead.totals:type_name -> burntPeanut.CumulativeTotals
+	6,  // 4: burntPeanut.TransferRequest.requester_head:type_name -> burntPeanut.ChainHead
+	27, // 5: burntPeanut.TransferRequest.capability:type_name -> burntPeanut.FileCapability
+	5,  // 6: burntPeanut.Checkpoint.totals:type_name -> burntPeanut.CumulativeTotals
+	10, // 7: burntPeanut.Checkpoint.witnesses:type_name -> burntPeanut.CheckpointWitness
+	1,  // 8: burntPeanut.Checkpoint.confidence:type_name -> burntPeanut.ConfidenceLevel
+	4,  // 9: burntPeanut.ForkEvidence.record_a:type_name -> burntPeanut.ShareRecord
+	4,  // 10: burntPeanut.ForkEvidence.record_b:type_name -> burntPeanut.ShareRecord
+	12, // 11: burntPeanut.ForkEvidence.succession:type_name -> burntPeanut.SuccessionRecord
+	12, // 12: burntPeanut.ForkEvidence.conflicting_succession:type_name -> burntPeanut.SuccessionRecord
+	6,  // 13: burntPeanut.SuccessionRecord.final_head:type_name -> burntPeanut.ChainHead
+	14, // 14: burntPeanut.NetworkParams.credit:type_name -> burntPeanut.CreditParams
+	5,  // 15: burntPeanut.PeerInfo.totals:type_name -> burntPeanut.CumulativeTotals
+	16, // 16: burntPeanut.GossipPayload.self_summary:type_name -> burntPeanut.PeerInfo
+	16, // 17: burntPeanut.GossipPayload.peer_summaries:type_name -> burntPeanut.PeerInfo
+	11, // 18: burntPeanut.GossipPayload.fork_evidence:type_name -> burntPeanut.ForkEvidence
+	8,  // 19: burntPeanut.GossipPayload.seeding_files:type_name -> burntPeanut.FileMeta
+	9,  // 20: burntPeanut.GossipPayload.latest_checkpoint:type_name -> burntPeanut.Checkpoint
+	28, // 21: burntPeanut.GossipPayload.revocations:type_name -> burntPeanut.CapabilityRevocation
+	12, // 22: burntPeanut.GossipPayload.successions:type_name -> burntPeanut.SuccessionRecord
+	2,  // 23: burntPeanut.HandshakeMsg.policy:type_name -> burntPeanut.ServicePolicy
+	9,  // 24: burntPeanut.HandshakeMsg.latest_checkpoint:type_name -> burntPeanut.Checkpoint
+	4,  // 25: burntPeanut.HandshakeMsg.records_since_checkpoint:type_name -> burntPeanut.ShareRecord
+	12, // 26: burntPeanut.HandshakeMsg.successions:type_name -> burntPeanut.SuccessionRecord
+	15, // 27: burntPeanut.HandshakeMsg.network_params:type_name -> burntPeanut.NetworkParams
+	2,  // 28: burntPeanut.HandshakeAuth.negotiated_policy:type_name -> burntPeanut.ServicePolicy
+	21, // 29: burntPeanut.ChunkBatch.chunks:type_name -> burntPeanut.ChunkData
+	6,  // 30: burntPeanut.ChunkAck.requester_head:type_name -> burntPeanut.ChainHead
+	18, // 31: burntPeanut.Envelope.handshake:type_name -> burntPeanut.HandshakeMsg
+	7,  // 32: burntPeanut.Envelope.transfer_request:type_name -> burntPeanut.TransferRequest
+	20, // 33: burntPeanut.Envelope.chunk_batch:type_name -> burntPeanut.ChunkBatch
+	4,  // 34: burntPeanut.Envelope.share_record:type_name -> burntPeanut.ShareRecord
+	17, // 35: burntPeanut.Envelope.gossip:type_name -> burntPeanut.GossipPayload
+	11, // 36: burntPeanut.Envelope.fork_evidence:type_name -> burntPeanut.ForkEvidence
+	25, // 37: burntPeanut.Envelope.sealed:type_name -> burntPeanut.SealedEnvelope
+	19, // 38: burntPeanut.Envelope.handshake_auth:type_name -> burntPeanut.HandshakeAuth
+	22, // 39: burntPeanut.Envelope.chunk_ack:type_name -> burntPeanut.ChunkAck
+	29, // 40: burntPeanut.Envelope.witness_request:type_name -> burntPeanut.WitnessRequest
+	30, // 41: burntPeanut.Envelope.witness_response:type_name -> burntPeanut.WitnessResponse
+	24, // 42: burntPeanut.Envelope.compressed:type_name -> burntPeanut.CompressedEnvelope
+	3,  // 43: burntPeanut.CompressedEnvelope.algorithm:type_name -> burntPeanut.Compression
+	27, // 44: burntPeanut.FileCapability.parent:type_name -> burntPeanut.FileCapability
+	26, // 45: burntPeanut.FileCapability.chunk_ranges:type_name -> burntPeanut.ChunkRange
+	8,  // 46: burntPeanut.FileCapability.file_meta:type_name -> burntPeanut.FileMeta
+	9,  // 47: burntPeanut.WitnessRequest.checkpoint:type_name -> burntPeanut.Checkpoint
+	10, // 48: burntPeanut.WitnessResponse.witness:type_name -> burntPeanut.CheckpointWitness
+	49, // [49:49] is the sub-list for method output_type
+	49, // [49:49] is the sub-list for method input_type
+	49, // [49:49] is the sub-list for extension type_name
+	49, // [49:49] is the sub-list for extension extendee
+	0,  // [0:49] is the sub-list for field type_name
 }
 
 func init() { file_core_proto_init() }
@@ -1816,21 +3146,27 @@ func file_core_proto_init() {
 	if File_core_proto != nil {
 		return
 	}
-	file_core_proto_msgTypes[14].OneofWrappers = []any{
+	file_core_proto_msgTypes[19].OneofWrappers = []any{
 		(*Envelope_Handshake)(nil),
 		(*Envelope_TransferRequest)(nil),
 		(*Envelope_ChunkBatch)(nil),
 		(*Envelope_ShareRecord)(nil),
 		(*Envelope_Gossip)(nil),
 		(*Envelope_ForkEvidence)(nil),
+		(*Envelope_Sealed)(nil),
+		(*Envelope_HandshakeAuth)(nil),
+		(*Envelope_ChunkAck)(nil),
+		(*Envelope_WitnessRequest)(nil),
+		(*Envelope_WitnessResponse)(nil),
+		(*Envelope_Compressed)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_core_proto_rawDesc), len(file_core_proto_rawDesc)),
-			NumEnums:      3,
-			NumMessages:   16,
+			NumEnums:      4,
+			NumMessages:   27,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,164 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Stream frames carry envelopes over long-lived byte streams that can corrupt or lose bytes,
+like a WiFi Direct or TCP socket on a flaky link. with the plain length prefix one corrupted
+length desynchronizes everything after it; a stream frame can be found again.
+
+every frame is
+
+	[4 bytes magic "BPSF"][4 bytes payload length][4 bytes header crc][payload][4 bytes payload crc]
+
+both checksums are CRC-32C. the header crc covers the magic and the length, so a corrupted
+length is caught before the decoder waits for a payload that is not coming. the StreamDecoder
+checks both, and on a mismatch skips ahead to the next magic marker and tries again, counting
+every byte it skipped.
+
+a link only switches to stream frames when both hellos advertise FeatureStreamFraming; the
+hellos themselves go out in the link's usual framing, since neither side knows the other's
+features before them.
+*/
+
+const (
+	// StreamHeaderSize is the magic, length and header crc before each payload.
+	StreamHeaderSize = 12
+	// StreamTrailerSize is the payload crc after each payload.
+	StreamTrailerSize = 4
+	// streamReadSize is how much the decoder asks its reader for at a time.
+	streamReadSize = 4096
+)
+
+var (
+	streamMagic = []byte("BPSF")
+	castagnoli  = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// EncodeStreamFrame returns env framed for a stream read by a StreamDecoder.
+func EncodeStreamFrame(env *pb.Envelope) ([]byte, error) {
+	if env == nil {
+		return nil, fmt.Errorf("envelope is nil")
+	}
+	payload, err := proto.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > MaxMessageSize {
+		return nil, fmt.Errorf("message length is greater than chunk size")
+	}
+
+	frame := make([]byte, 0, StreamHeaderSize+len(payload)+StreamTrailerSize)
+	frame = append(frame, streamMagic...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(frame, castagnoli))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(payload, castagnoli))
+	return frame, nil
+}
+
+func WriteStreamEnvelope(w io.Writer, env *pb.Envelope) error {
+	frame, err := EncodeStreamFrame(env)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// StreamDecoder reads stream frames, skipping whatever does not check out. It is not safe for
+// concurrent use.
+type StreamDecoder struct {
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: r}
+}
+
+// ReadEnvelope returns the next valid envelope and how many bytes were dropped before it. A
+// frame with a bad checksum, an oversized length or a payload that is not an envelope is
+// dropped, and reading resumes at the next magic marker. When the reader ends, the bytes of a
+// frame that never finished are dropped too and the error is io.ErrUnexpectedEOF; an error
+// from the reader ends every later call as well.
+func (d *StreamDecoder) ReadEnvelope() (*pb.Envelope, int, error) {
+	dropped := 0
+	for {
+		if !d.fill(StreamHeaderSize) {
+			return d.end(dropped)
+		}
+		length := binary.BigEndian.Uint32(d.buf[4:8])
+		if !bytes.Equal(d.buf[:4], streamMagic) ||
+			crc32.Checksum(d.buf[:8], castagnoli) != binary.BigEndian.Uint32(d.buf[8:12]) ||
+			length > MaxMessageSize {
+			dropped += d.skip()
+			continue
+		}
+
+		total := StreamHeaderSize + int(length) + StreamTrailerSize
+		if !d.fill(total) {
+			return d.end(dropped)
+		}
+		payload := d.buf[StreamHeaderSize : StreamHeaderSize+int(length)]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(d.buf[total-StreamTrailerSize:total]) {
+			// the length was right but the payload was hit; a later frame may start inside it
+			dropped += d.skip()
+			continue
+		}
+		env := &pb.Envelope{}
+		err := proto.Unmarshal(payload, env)
+		d.consume(total)
+		if err != nil {
+			dropped += total
+			continue
+		}
+		return env, dropped, nil
+	}
+}
+
+// fill reads until n bytes are buffered. It is false if the reader ended first.
+func (d *StreamDecoder) fill(n int) bool {
+	for len(d.buf) < n && d.err == nil {
+		chunk := make([]byte, max(streamReadSize, n-len(d.buf)))
+		m, err := d.r.Read(chunk)
+		d.buf = append(d.buf, chunk[:m]...)
+		d.err = err
+	}
+	return len(d.buf) >= n
+}
+
+// skip drops the front byte and everything before the next magic marker. The last few bytes
+// are kept when no marker is found, in case one is cut off at the end of the buffer.
+func (d *StreamDecoder) skip() int {
+	n := bytes.Index(d.buf[1:], streamMagic) + 1
+	if n == 0 {
+		n = max(1, len(d.buf)-(len(streamMagic)-1))
+	}
+	d.consume(n)
+	return n
+}
+
+func (d *StreamDecoder) consume(n int) {
+	d.buf = d.buf[:copy(d.buf, d.buf[n:])]
+}
+
+// end reports a reader that ended. Bytes of an unfinished frame are dropped.
+func (d *StreamDecoder) end(dropped int) (*pb.Envelope, int, error) {
+	left := len(d.buf)
+	d.buf = nil
+	if left > 0 && d.err == io.EOF {
+		return nil, dropped + left, io.ErrUnexpectedEOF
+	}
+	return nil, dropped + left, d.err
+}
@@ -0,0 +1,74 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func streamFrame(t *testing.T, index uint32) []byte {
+	t.Helper()
+	frame, err := EncodeStreamFrame(&pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{ChunkIndices: []uint32{index}}}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return frame
+}
+
+func readIndex(t *testing.T, d *StreamDecoder) (uint32, int) {
+	t.Helper()
+	env, dropped, err := d.ReadEnvelope()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return env.GetChunkAck().GetChunkIndices()[0], dropped
+}
+
+func TestStreamDecoderResynchronizes(t *testing.T) {
+	first, second, third, fourth := streamFrame(t, 1), streamFrame(t, 2), streamFrame(t, 3), streamFrame(t, 4)
+
+	// a corrupted length on the second frame and a flipped payload byte on the third
+	badLength := append([]byte(nil), second...)
+	badLength[5] ^= 0xFF
+	badPayload := append([]byte(nil), third...)
+	badPayload[StreamHeaderSize] ^= 0x01
+	garbage := []byte("noise BPS")
+
+	var stream bytes.Buffer
+	for _, part := range [][]byte{first, badLength, garbage, badPayload, fourth} {
+		stream.Write(part)
+	}
+
+	d := NewStreamDecoder(&stream)
+	if index, dropped := readIndex(t, d); index != 1 || dropped != 0 {
+		t.Fatalf("expected frame 1 with nothing dropped, got %d after %d", index, dropped)
+	}
+	index, dropped := readIndex(t, d)
+	if index != 4 {
+		t.Fatalf("expected to resynchronize on frame 4, got %d", index)
+	}
+	if want := len(badLength) + len(garbage) + len(badPayload); dropped != want {
+		t.Fatalf("expected %d bytes dropped, got %d", want, dropped)
+	}
+	if _, _, err := d.ReadEnvelope(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestStreamDecoderTruncated(t *testing.T) {
+	first, second := streamFrame(t, 1), streamFrame(t, 2)
+	d := NewStreamDecoder(bytes.NewReader(append(first, second[:len(second)-3]...)))
+	if index, _ := readIndex(t, d); index != 1 {
+		t.Fatalf("expected frame 1, got %d", index)
+	}
+	_, dropped, err := d.ReadEnvelope()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+	if dropped != len(second)-3 {
+		t.Fatalf("expected the %d bytes of the unfinished frame dropped, got %d", len(second)-3, dropped)
+	}
+}
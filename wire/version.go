@@ -0,0 +1,123 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+/*
+Protocol versions let core.proto change without every installed phone upgrading at once.
+
+each hello carries the range of versions its sender speaks and the optional features it
+supports. a session runs at the highest version both ranges share, with the features both
+sides support. builds from before versions were exchanged send neither and speak version 1.
+
+every envelope is stamped with the version it was encoded for. hellos are always read,
+whatever their stamp, so a newer peer can still be downgraded; anything else stamped above the
+session's version is refused with ErrIncompatibleVersion instead of being misread.
+*/
+
+const (
+	// LegacyProtocolVersion is spoken by builds that exchange no version.
+	LegacyProtocolVersion uint32 = 1
+	// ProtocolVersion is the newest version this build speaks.
+	ProtocolVersion uint32 = 2
+	// MinProtocolVersion is the oldest version this build still speaks.
+	MinProtocolVersion uint32 = 1
+)
+
+// Features are optional protocol capabilities, advertised as bits in the hello.
+type Features uint64
+
+const (
+	// FeatureWitness means the peer co-signs checkpoints it is sent in a WitnessRequest.
+	FeatureWitness Features = 1 << iota
+	// FeatureCapabilities means the peer serves private files against a FileCapability.
+	FeatureCapabilities
+	// FeatureNetworkParams means the peer exchanges signed NetworkParams in its hello.
+	FeatureNetworkParams
+	// FeatureCanonicalSigning means the peer verifies signatures made over the Canonical encoding.
+	FeatureCanonicalSigning
+	// FeatureCompression means the peer reads envelopes deflated into a CompressedEnvelope.
+	FeatureCompression
+	// FeatureStreamFraming means the peer reads everything after its hello as stream frames.
+	FeatureStreamFraming
+	// FeatureDeferredHead means the peer, as sender, waits for the requester's head after a
+	// final ChunkAck marked head_pending.
+	FeatureDeferredHead
+)
+
+// SupportedFeatures is every feature this build supports.
+const SupportedFeatures = FeatureWitness | FeatureCapabilities | FeatureNetworkParams | FeatureCanonicalSigning |
+	FeatureCompression | FeatureStreamFraming | FeatureDeferredHead
+
+// ErrIncompatibleVersion is returned for a peer or envelope with no protocol version in common with ours.
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+func (f Features) Has(feature Features) bool {
+	return f&feature == feature
+}
+
+// Protocol is the version and features a session runs with.
+type Protocol struct {
+	Version  uint32
+	Features Features
+}
+
+// LocalProtocol is what this build runs before anything has been negotiated.
+func LocalProtocol() Protocol {
+	return Protocol{Version: ProtocolVersion, Features: SupportedFeatures}
+}
+
+// NegotiateProtocol picks the protocol for a session with a peer that speaks versions
+// peerMin to peerMax and supports peerFeatures. A peer sending no version is a legacy peer.
+func NegotiateProtocol(peerMin, peerMax uint32, peerFeatures Features) (Protocol, error) {
+	if peerMax == 0 {
+		peerMin, peerMax, peerFeatures = LegacyProtocolVersion, LegacyProtocolVersion, 0
+	}
+	if peerMin == 0 {
+		peerMin = LegacyProtocolVersion
+	}
+	if peerMin > peerMax {
+		return Protocol{}, fmt.Errorf("%w: peer claims versions %d to %d", ErrIncompatibleVersion, peerMin, peerMax)
+	}
+	version := min(peerMax, ProtocolVersion)
+	if version < max(peerMin, MinProtocolVersion) {
+		return Protocol{}, fmt.Errorf("%w: peer speaks versions %d to %d, we speak %d to %d",
+			ErrIncompatibleVersion, peerMin, peerMax, MinProtocolVersion, ProtocolVersion)
+	}
+	p := Protocol{Version: version}
+	if version > LegacyProtocolVersion {
+		p.Features = peerFeatures & SupportedFeatures
+	}
+	return p, nil
+}
+
+// Stamp marks env as encoded for p's version.
+func (p Protocol) Stamp(env *pb.Envelope) {
+	if env != nil {
+		env.ProtocolVersion = p.Version
+	}
+}
+
+// Accepts reports whether env can be read on a session running p.
+func (p Protocol) Accepts(env *pb.Envelope) error {
+	if env == nil || env.GetHandshake() != nil {
+		return nil
+	}
+	version := EnvelopeVersion(env)
+	if version > p.Version || version < MinProtocolVersion {
+		return fmt.Errorf("%w: envelope is for version %d, session runs version %d", ErrIncompatibleVersion, version, p.Version)
+	}
+	return nil
+}
+
+// EnvelopeVersion is the version env was encoded for.
+func EnvelopeVersion(env *pb.Envelope) uint32 {
+	if env.GetProtocolVersion() == 0 {
+		return LegacyProtocolVersion
+	}
+	return env.GetProtocolVersion()
+}
@@ -0,0 +1,63 @@
+package wire
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/nyshthefantastic/burnt-peanut-network-core/wire/gen"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	cases := []struct {
+		name             string
+		peerMin, peerMax uint32
+		peerFeatures     Features
+		want             Protocol
+		wantErr          bool
+	}{
+		{"legacy peer", 0, 0, 0, Protocol{Version: LegacyProtocolVersion}, false},
+		{"legacy peer features ignored", 0, 0, FeatureWitness, Protocol{Version: LegacyProtocolVersion}, false},
+		{"same build", MinProtocolVersion, ProtocolVersion, SupportedFeatures, LocalProtocol(), false},
+		{"newer peer", 1, ProtocolVersion + 3, SupportedFeatures | 1<<40, LocalProtocol(), false},
+		{"shared features only", 1, ProtocolVersion, FeatureWitness, Protocol{Version: ProtocolVersion, Features: FeatureWitness}, false},
+		{"peer too new", ProtocolVersion + 1, ProtocolVersion + 2, 0, Protocol{}, true},
+		{"inverted range", 3, 2, 0, Protocol{}, true},
+	}
+	for _, c := range cases {
+		got, err := NegotiateProtocol(c.peerMin, c.peerMax, c.peerFeatures)
+		if c.wantErr {
+			if !errors.Is(err, ErrIncompatibleVersion) {
+				t.Fatalf("%s: expected ErrIncompatibleVersion, got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Fatalf("%s: expected %+v, got %+v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestProtocolAccepts(t *testing.T) {
+	legacy := Protocol{Version: LegacyProtocolVersion}
+	unstamped := &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{}}}
+	if err := legacy.Accepts(unstamped); err != nil {
+		t.Fatalf("expected an unstamped envelope to be read as version 1: %v", err)
+	}
+
+	stamped := &pb.Envelope{Payload: &pb.Envelope_ChunkAck{ChunkAck: &pb.ChunkAck{}}}
+	LocalProtocol().Stamp(stamped)
+	if err := LocalProtocol().Accepts(stamped); err != nil {
+		t.Fatalf("expected our own envelope to be accepted: %v", err)
+	}
+	if err := legacy.Accepts(stamped); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("expected a version %d envelope on a legacy session to be refused, got %v", ProtocolVersion, err)
+	}
+
+	hello := &pb.Envelope{Payload: &pb.Envelope_Handshake{Handshake: &pb.HandshakeMsg{}}, ProtocolVersion: ProtocolVersion + 5}
+	if err := legacy.Accepts(hello); err != nil {
+		t.Fatalf("expected a hello to be read whatever its version: %v", err)
+	}
+}